@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/netlify/gotrue/metering"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+)
+
+const anonymousProviderType = "anonymous"
+
+// AnonymousSigninParams are the parameters the AnonymousSignin endpoint accepts
+type AnonymousSigninParams struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+// AnonymousSignin creates a guest user without an email or password and
+// signs it in. Guests keep their id when they add an email through
+// UserUpdate or link a provider account.
+func (a *API) AnonymousSignin(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+	cookie := r.Header.Get(useCookieHeader)
+
+	if config.DisableSignup {
+		return forbiddenError("Signups not allowed for this instance")
+	}
+
+	params := &AnonymousSigninParams{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	if err := jsonDecoder.Decode(params); err != nil {
+		return badRequestError("Could not read anonymous sign in params: %v", err)
+	}
+
+	user, err := models.NewAnonymousUser(instanceID, a.requestAud(ctx, r), params.Data)
+	if err != nil {
+		return internalServerError("Database error creating user").WithInternalError(err)
+	}
+	user.AppMetaData = map[string]interface{}{
+		"provider":  anonymousProviderType,
+		"providers": []string{anonymousProviderType},
+	}
+
+	var token *AccessTokenResponse
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if terr = tx.Create(user); terr != nil {
+			return internalServerError("Database error saving new user").WithInternalError(terr)
+		}
+		if terr = user.SetRole(tx, config.JWT.DefaultGroupName); terr != nil {
+			return internalServerError("Database error updating user").WithInternalError(terr)
+		}
+		if terr = models.NewAuditLogEntry(tx, instanceID, user, models.UserSignedUpAction, map[string]interface{}{
+			"provider": anonymousProviderType,
+		}); terr != nil {
+			return terr
+		}
+
+		token, terr = a.issueRefreshToken(ctx, tx, user, newGrantParams(r))
+		if terr != nil {
+			return terr
+		}
+
+		if cookie != "" && config.Cookie.Duration > 0 {
+			if terr = a.setCookieToken(config, token.Token, cookie == useSessionCookie, w); terr != nil {
+				return internalServerError("Failed to set JWT cookie. %s", terr)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	metering.RecordLogin(anonymousProviderType, user.ID, instanceID)
+	token.User = user
+	return sendJSON(w, http.StatusOK, token)
+}
+
+// upgradeAnonymousUser turns a guest into a regular user once they added a
+// way to sign in with the provider. This is their actual signup, so the
+// signup hooks run now.
+func (a *API) upgradeAnonymousUser(ctx context.Context, tx *storage.Connection, user *models.User, providerType string) error {
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	if err := user.ClearAnonymous(tx); err != nil {
+		return internalServerError("Database error updating user").WithInternalError(err)
+	}
+	if err := user.UpdateProviders(tx); err != nil {
+		return internalServerError("Database error updating user").WithInternalError(err)
+	}
+	if err := user.UpdateAppMetaData(tx, map[string]interface{}{
+		"provider": providerType,
+	}); err != nil {
+		return internalServerError("Database error updating user").WithInternalError(err)
+	}
+
+	if err := models.NewAuditLogEntry(tx, instanceID, user, models.UserSignedUpAction, map[string]interface{}{
+		"provider":  providerType,
+		"anonymous": true,
+	}); err != nil {
+		return err
+	}
+	return triggerEventHooks(ctx, tx, SignupEvent, user, instanceID, config)
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type AnonymousTestSuite struct {
+	suite.Suite
+	API    *API
+	Config *conf.Configuration
+
+	instanceID uuid.UUID
+}
+
+func TestAnonymous(t *testing.T) {
+	api, config, instanceID, err := setupAPIForTestForInstance()
+	require.NoError(t, err)
+
+	ts := &AnonymousTestSuite{
+		API:        api,
+		Config:     config,
+		instanceID: instanceID,
+	}
+	defer api.db.Close()
+
+	suite.Run(t, ts)
+}
+
+func (ts *AnonymousTestSuite) SetupTest() {
+	models.TruncateAll(ts.API.db)
+	ts.Config.External.Anonymous.Enabled = true
+	ts.Config.DisableSignup = false
+}
+
+func (ts *AnonymousTestSuite) request(method, path, token string, body map[string]interface{}) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+
+	req := httptest.NewRequest(method, path, &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+// signin signs in a new guest, returning its tokens
+func (ts *AnonymousTestSuite) signin() *AccessTokenResponse {
+	w := ts.request(http.MethodPost, "http://localhost/anonymous", "", map[string]interface{}{
+		"data": map[string]interface{}{
+			"cart": "abc",
+		},
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	token := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+	require.NotEmpty(ts.T(), token.Token)
+	require.NotEmpty(ts.T(), token.RefreshToken)
+	return token
+}
+
+func (ts *AnonymousTestSuite) claims(token string) *GoTrueClaims {
+	claims := &GoTrueClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(token, claims)
+	require.NoError(ts.T(), err)
+	return claims
+}
+
+func (ts *AnonymousTestSuite) TestSignin() {
+	token := ts.signin()
+
+	claims := ts.claims(token.Token)
+	assert.True(ts.T(), claims.IsAnonymous)
+	assert.Empty(ts.T(), claims.Email)
+
+	userID, err := uuid.FromString(claims.Subject)
+	require.NoError(ts.T(), err)
+	user, err := models.FindUserByInstanceIDAndID(ts.API.db, ts.instanceID, userID)
+	require.NoError(ts.T(), err)
+	assert.True(ts.T(), user.IsAnonymous)
+	assert.Empty(ts.T(), user.Email)
+	assert.False(ts.T(), user.HasPassword())
+	assert.Equal(ts.T(), "abc", user.UserMetaData["cart"])
+	assert.Equal(ts.T(), anonymousProviderType, user.AppMetaData["provider"])
+
+	// the session is refreshed like any other
+	w := ts.request(http.MethodPost, "http://localhost/token?grant_type=refresh_token", "", map[string]interface{}{
+		"refresh_token": token.RefreshToken,
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+}
+
+func (ts *AnonymousTestSuite) TestSigninDisabled() {
+	ts.Config.External.Anonymous.Enabled = false
+	w := ts.request(http.MethodPost, "http://localhost/anonymous", "", map[string]interface{}{})
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	ts.Config.External.Anonymous.Enabled = true
+	ts.Config.DisableSignup = true
+	w = ts.request(http.MethodPost, "http://localhost/anonymous", "", map[string]interface{}{})
+	assert.Equal(ts.T(), http.StatusForbidden, w.Code)
+}
+
+func (ts *AnonymousTestSuite) TestUpgradeWithEmail() {
+	token := ts.signin()
+	userID := ts.claims(token.Token).Subject
+
+	w := ts.request(http.MethodPut, "http://localhost/user", token.Token, map[string]interface{}{
+		"email":    "guest@example.com",
+		"password": "password",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	// the guest stays anonymous until the email is confirmed
+	user, err := models.FindUserByInstanceIDAndID(ts.API.db, ts.instanceID, uuid.FromStringOrNil(userID))
+	require.NoError(ts.T(), err)
+	assert.True(ts.T(), user.IsAnonymous)
+	assert.Equal(ts.T(), "guest@example.com", user.EmailChange)
+	require.NotEmpty(ts.T(), user.EmailChangeToken)
+
+	w = ts.request(http.MethodPut, "http://localhost/user", token.Token, map[string]interface{}{
+		"email_change_token": user.EmailChangeToken,
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	user, err = models.FindUserByInstanceIDAndID(ts.API.db, ts.instanceID, user.ID)
+	require.NoError(ts.T(), err)
+	assert.False(ts.T(), user.IsAnonymous)
+	assert.Equal(ts.T(), "guest@example.com", user.Email)
+	assert.True(ts.T(), user.IsConfirmed())
+	assert.Equal(ts.T(), "abc", user.UserMetaData["cart"])
+	assert.Equal(ts.T(), "email", user.AppMetaData["provider"])
+	assert.Equal(ts.T(), []interface{}{"email"}, user.AppMetaData["providers"])
+
+	// the same user signs in with the password now
+	w = ts.request(http.MethodPost, "http://localhost/token?grant_type=password", "", map[string]interface{}{
+		"email":    "guest@example.com",
+		"password": "password",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	signin := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&signin))
+	claims := ts.claims(signin.Token)
+	assert.Equal(ts.T(), userID, claims.Subject)
+	assert.False(ts.T(), claims.IsAnonymous)
+}
+
+func (ts *AnonymousTestSuite) TestUpgradeWithRegisteredEmail() {
+	u, err := models.NewUser(ts.instanceID, "taken@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(u))
+
+	token := ts.signin()
+	w := ts.request(http.MethodPut, "http://localhost/user", token.Token, map[string]interface{}{
+		"email": "taken@example.com",
+	})
+	assert.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+}
@@ -14,8 +14,10 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/gofrs/uuid"
 	"github.com/imdario/mergo"
+	"github.com/netlify/gotrue/api/provider"
 	"github.com/netlify/gotrue/conf"
 	"github.com/netlify/gotrue/mailer"
+	"github.com/netlify/gotrue/sms"
 	"github.com/netlify/gotrue/storage"
 	"github.com/rs/cors"
 	"github.com/sebest/xff"
@@ -47,6 +49,7 @@ func (a *API) ListenAndServe(hostAndPort string) {
 
 	done := make(chan struct{})
 	defer close(done)
+	go provider.RefreshMetadataPeriodically(done)
 	go func() {
 		waitForTermination(log, done)
 		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
@@ -111,21 +114,42 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 		}
 
 		r.Get("/settings", api.Settings)
+		r.Get("/.well-known/jwks.json", api.JWKS)
+		r.Get("/.well-known/openid-configuration", api.OpenIDConfiguration)
 
 		r.Get("/authorize", api.ExternalProviderRedirect)
 
+		r.Route("/oauth", func(r *router) {
+			r.Use(api.requireOAuthServer)
+			r.Get("/authorize", api.OAuthAuthorize)
+			r.With(api.requireAuthentication).Post("/authorize", api.OAuthAuthorizeConsent)
+		})
+
 		r.With(api.requireAdminCredentials).Post("/invite", api.Invite)
 
-		r.With(api.requireEmailProvider).Post("/signup", api.Signup)
+		r.Post("/signup", api.Signup)
 		r.With(api.requireEmailProvider).Post("/recover", api.Recover)
 		r.With(api.requireEmailProvider).Post("/magiclink", api.MagicLink)
-		r.With(api.requireEmailProvider).With(api.limitHandler(
+		r.With(api.requirePhoneProvider).Post("/otp", api.Otp)
+		r.With(api.requireAnonymousProvider).With(api.limitHandler(
+			// Allow requests at a rate of 30 per 5 minutes.
+			tollbooth.NewLimiter(30.0/(60*5), &limiter.ExpirableOptions{
+				DefaultExpirationTTL: time.Hour,
+			}).SetBurst(30),
+		)).Post("/anonymous", api.AnonymousSignin)
+		r.With(api.limitHandler(
 			// Allow requests at a rate of 30 per 5 minutes.
 			tollbooth.NewLimiter(30.0/(60*5), &limiter.ExpirableOptions{
 				DefaultExpirationTTL: time.Hour,
 			}).SetBurst(30),
 		)).Post("/token", api.Token)
 
+		r.Route("/webauthn/login", func(r *router) {
+			r.Use(api.requireWebAuthnEnabled)
+			r.Post("/begin", api.WebAuthnLoginBegin)
+			r.Post("/finish", api.WebAuthnLoginFinish)
+		})
+
 		r.Route("/verify", func(r *router) {
 			r.Get("/", api.Verify)
 			r.Post("/", api.Verify)
@@ -133,10 +157,44 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 		r.With(api.requireAuthentication).Post("/logout", api.Logout)
 
+		r.Route("/userinfo", func(r *router) {
+			r.Use(api.requireClientAuthentication)
+			r.Get("/", api.UserInfo)
+			r.Post("/", api.UserInfo)
+		})
+
 		r.Route("/user", func(r *router) {
 			r.Use(api.requireAuthentication)
 			r.Get("/", api.UserGet)
 			r.Put("/", api.UserUpdate)
+
+			r.Route("/sessions", func(r *router) {
+				r.Get("/", api.UserSessions)
+				r.Delete("/{session_id}", api.UserSessionDelete)
+			})
+
+			r.Route("/identities", func(r *router) {
+				r.Get("/", api.UserIdentities)
+				r.Get("/authorize", api.UserIdentityAuthorize)
+				r.Delete("/{identity_id}", api.UserIdentityDelete)
+				r.Get("/{identity_id}/token", api.UserIdentityToken)
+			})
+
+			r.Route("/factors", func(r *router) {
+				r.Use(api.requireMFAEnabled)
+				r.Get("/", api.UserFactors)
+				r.Post("/", api.EnrollFactor)
+				r.Delete("/", api.UnenrollFactor)
+				r.Post("/verify", api.VerifyFactor)
+			})
+
+			r.Route("/webauthn", func(r *router) {
+				r.Use(api.requireWebAuthnEnabled)
+				r.Post("/register/begin", api.WebAuthnRegisterBegin)
+				r.Post("/register/finish", api.WebAuthnRegisterFinish)
+				r.Get("/credentials", api.UserWebAuthnCredentials)
+				r.Delete("/credentials/{credential_id}", api.UserWebAuthnCredentialDelete)
+			})
 		})
 
 		r.Route("/admin", func(r *router) {
@@ -146,6 +204,40 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 				r.Get("/", api.adminAuditLog)
 			})
 
+			r.Route("/keys", func(r *router) {
+				r.Get("/", api.adminKeys)
+				r.Post("/", api.adminKeyRotate)
+				r.Delete("/{key_id}", api.adminKeyRetire)
+			})
+
+			r.Route("/oauth/clients", func(r *router) {
+				r.Get("/", api.adminOAuthClients)
+				r.Post("/", api.adminOAuthClientCreate)
+
+				r.Route("/{client_id}", func(r *router) {
+					r.Use(api.loadOAuthClient)
+
+					r.Get("/", api.adminOAuthClientGet)
+					r.Put("/", api.adminOAuthClientUpdate)
+					r.Delete("/", api.adminOAuthClientDelete)
+				})
+			})
+
+			r.Post("/saml/metadata/refresh", api.adminSAMLMetadataRefresh)
+
+			r.Route("/saml/connections", func(r *router) {
+				r.Get("/", api.adminSAMLConnections)
+				r.Post("/", api.adminSAMLConnectionCreate)
+
+				r.Route("/{connection_id}", func(r *router) {
+					r.Use(api.loadSAMLConnection)
+
+					r.Get("/", api.adminSAMLConnectionGet)
+					r.Put("/", api.adminSAMLConnectionUpdate)
+					r.Delete("/", api.adminSAMLConnectionDelete)
+				})
+			})
+
 			r.Route("/users", func(r *router) {
 				r.Get("/", api.adminUsers)
 				r.With(api.requireEmailProvider).Post("/", api.adminUserCreate)
@@ -156,6 +248,12 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 					r.Get("/", api.adminUserGet)
 					r.Put("/", api.adminUserUpdate)
 					r.Delete("/", api.adminUserDelete)
+
+					r.Route("/sessions", func(r *router) {
+						r.Get("/", api.adminUserSessions)
+						r.Delete("/", api.adminUserSessionsDelete)
+						r.Delete("/{session_id}", api.adminUserSessionDelete)
+					})
 				})
 			})
 		})
@@ -167,6 +265,8 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 			})
 
 			r.Get("/metadata", api.SAMLMetadata)
+			r.Get("/slo", api.SAMLSingleLogout)
+			r.Post("/slo", api.SAMLSingleLogout)
 		})
 	})
 
@@ -242,6 +342,11 @@ func (a *API) Mailer(ctx context.Context) mailer.Mailer {
 	return mailer.NewMailer(config)
 }
 
+func (a *API) SMSSender(ctx context.Context) (sms.SMSSender, error) {
+	config := a.getConfig(ctx)
+	return sms.NewSMSSender(config)
+}
+
 func (a *API) getConfig(ctx context.Context) *conf.Configuration {
 	obj := ctx.Value(configKey)
 	if obj == nil {
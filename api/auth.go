@@ -6,12 +6,25 @@ import (
 	"net/http"
 	"time"
 
-	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/netlify/gotrue/models"
 )
 
-// requireAuthentication checks incoming requests for tokens presented using the Authorization header
+// requireAuthentication checks incoming requests for tokens presented using the Authorization header.
+// Tokens issued to OAuth clients are rejected, they only give access to the userinfo endpoint.
 func (a *API) requireAuthentication(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	ctx, err := a.requireClientAuthentication(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims := getClaims(ctx); claims.ClientID != "" {
+		return nil, forbiddenError("Tokens issued to OAuth clients can't be used for this endpoint")
+	}
+	return ctx, nil
+}
+
+// requireClientAuthentication accepts tokens issued to OAuth clients as well
+func (a *API) requireClientAuthentication(w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	token, err := a.extractBearerToken(w, r)
 	if err != nil {
 		a.clearCookieToken(r.Context(), w)
@@ -31,7 +44,7 @@ func (a *API) requireAdmin(ctx context.Context, w http.ResponseWriter, r *http.R
 
 	adminRoles := a.getConfig(ctx).JWT.AdminRoles
 
-	if isStringInSlice(claims.Role, adminRoles) {
+	if claims.ClientID == "" && isStringInSlice(claims.Role, adminRoles) {
 		// successful authentication
 		return withAdminUser(ctx, &models.User{}), nil
 	}
@@ -56,12 +69,13 @@ func (a *API) extractBearerToken(w http.ResponseWriter, r *http.Request) (string
 
 func (a *API) parseJWTClaims(bearer string, r *http.Request, w http.ResponseWriter) (context.Context, error) {
 	ctx := r.Context()
-	config := a.getConfig(ctx)
 
-	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
-	token, err := p.ParseWithClaims(bearer, &GoTrueClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.JWT.Secret), nil
-	})
+	keys, err := a.loadKeySet(ctx, a.db)
+	if err != nil {
+		return nil, internalServerError("Error loading JWT signing key").WithInternalError(err)
+	}
+
+	token, err := keys.parse(bearer, &GoTrueClaims{})
 	if err != nil {
 		a.clearCookieToken(ctx, w)
 		return nil, unauthorizedError("Invalid token: %v", err)
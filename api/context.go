@@ -31,6 +31,14 @@ const (
 	adminUserKey            = contextKey("admin_user")
 	oauthTokenKey           = contextKey("oauth_token") // for OAuth1.0, also known as request token
 	oauthVerifierKey        = contextKey("oauth_verifier")
+	nonceKey                = contextKey("nonce")
+	oauthClientKey          = contextKey("oauth_client")
+	codeChallengeKey        = contextKey("code_challenge")
+	linkingUserIDKey        = contextKey("linking_user_id")
+	linkingNonceKey         = contextKey("linking_nonce")
+	samlConnectionKey       = contextKey("saml_connection")
+	samlConnectionIDKey     = contextKey("saml_connection_id")
+	samlIdPInitiatedKey     = contextKey("saml_idp_initiated")
 )
 
 // withToken adds the JWT token to the context.
@@ -197,6 +205,21 @@ func getExternalReferrer(ctx context.Context) string {
 	return obj.(string)
 }
 
+// withNonce adds the OpenID Connect nonce of the authorization request to the context.
+func withNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, nonceKey, nonce)
+}
+
+// getNonce reads the OpenID Connect nonce from the context.
+func getNonce(ctx context.Context) string {
+	obj := ctx.Value(nonceKey)
+	if obj == nil {
+		return ""
+	}
+
+	return obj.(string)
+}
+
 // withFunctionHooks adds the provided function hooks to the context.
 func withFunctionHooks(ctx context.Context, hooks map[string][]string) context.Context {
 	return context.WithValue(ctx, functionHooksKey, hooks)
@@ -250,3 +273,98 @@ func getOAuthVerifier(ctx context.Context) string {
 	}
 	return obj.(string)
 }
+
+// withOAuthClient adds the OAuth client to the context.
+func withOAuthClient(ctx context.Context, c *models.OAuthClient) context.Context {
+	return context.WithValue(ctx, oauthClientKey, c)
+}
+
+// getOAuthClient reads the OAuth client from the context.
+func getOAuthClient(ctx context.Context) *models.OAuthClient {
+	obj := ctx.Value(oauthClientKey)
+	if obj == nil {
+		return nil
+	}
+	return obj.(*models.OAuthClient)
+}
+
+// withCodeChallenge adds the PKCE code challenge of the authorization request to the context.
+func withCodeChallenge(ctx context.Context, challenge *codeChallenge) context.Context {
+	return context.WithValue(ctx, codeChallengeKey, challenge)
+}
+
+// getCodeChallenge reads the PKCE code challenge from the context.
+func getCodeChallenge(ctx context.Context) *codeChallenge {
+	obj := ctx.Value(codeChallengeKey)
+	if obj == nil {
+		return nil
+	}
+	return obj.(*codeChallenge)
+}
+
+// withLinkingUserID adds the id of the user the external provider account is linked to to the context.
+func withLinkingUserID(ctx context.Context, id uuid.UUID) context.Context {
+	return context.WithValue(ctx, linkingUserIDKey, id)
+}
+
+// getLinkingUserID reads the id of the user the external provider account is linked to from the context.
+func getLinkingUserID(ctx context.Context) uuid.UUID {
+	obj := ctx.Value(linkingUserIDKey)
+	if obj == nil {
+		return uuid.Nil
+	}
+	return obj.(uuid.UUID)
+}
+
+// withLinkingNonce adds the hash of the nonce the link is bound to to the context.
+func withLinkingNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, linkingNonceKey, nonce)
+}
+
+// getLinkingNonce reads the hash of the nonce the link is bound to from the context.
+func getLinkingNonce(ctx context.Context) string {
+	obj := ctx.Value(linkingNonceKey)
+	if obj == nil {
+		return ""
+	}
+	return obj.(string)
+}
+
+// withSAMLConnection adds the SAML connection to the context.
+func withSAMLConnection(ctx context.Context, c *models.SAMLConnection) context.Context {
+	return context.WithValue(ctx, samlConnectionKey, c)
+}
+
+// getSAMLConnection reads the SAML connection from the context.
+func getSAMLConnection(ctx context.Context) *models.SAMLConnection {
+	obj := ctx.Value(samlConnectionKey)
+	if obj == nil {
+		return nil
+	}
+	return obj.(*models.SAMLConnection)
+}
+
+// withSAMLConnectionID adds the id of the SAML connection the user signs in through to the context.
+func withSAMLConnectionID(ctx context.Context, id uuid.UUID) context.Context {
+	return context.WithValue(ctx, samlConnectionIDKey, id)
+}
+
+// getSAMLConnectionID reads the id of the SAML connection the user signs in through from the context.
+func getSAMLConnectionID(ctx context.Context) uuid.UUID {
+	obj := ctx.Value(samlConnectionIDKey)
+	if obj == nil {
+		return uuid.Nil
+	}
+	return obj.(uuid.UUID)
+}
+
+// withSAMLIdPInitiated marks the SAML response as sent without a request of GoTrue.
+func withSAMLIdPInitiated(ctx context.Context) context.Context {
+	return context.WithValue(ctx, samlIdPInitiatedKey, true)
+}
+
+// isSAMLIdPInitiated checks if the SAML response was sent without a request of GoTrue.
+func isSAMLIdPInitiated(ctx context.Context) bool {
+	initiated, _ := ctx.Value(samlIdPInitiatedKey).(bool)
+	return initiated
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/gofrs/uuid"
 	"github.com/markbates/goth/gothic"
 	"github.com/netlify/gotrue/api/provider"
+	"github.com/netlify/gotrue/crypto"
 	"github.com/netlify/gotrue/models"
 	"github.com/netlify/gotrue/storage"
 	"github.com/sirupsen/logrus"
@@ -24,6 +25,21 @@ type ExternalProviderClaims struct {
 	Provider    string `json:"provider"`
 	InviteToken string `json:"invite_token,omitempty"`
 	Referrer    string `json:"referrer,omitempty"`
+	Nonce       string `json:"nonce,omitempty"`
+
+	// ProviderNonce is sent to OpenID Connect providers, their ID token
+	// has to contain it
+	ProviderNonce string `json:"provider_nonce,omitempty"`
+
+	CodeChallenge       string `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string `json:"code_challenge_method,omitempty"`
+
+	LinkingUserID string `json:"linking_user_id,omitempty"`
+	// LinkingNonce is the hash of the nonce in the cookie of the browser
+	// that started the link.
+	LinkingNonce string `json:"linking_nonce,omitempty"`
+
+	SAMLConnectionID string `json:"saml_connection_id,omitempty"`
 }
 
 // ExternalSignupParams are the parameters the Signup endpoint accepts
@@ -33,15 +49,54 @@ type ExternalSignupParams struct {
 }
 
 func (a *API) ExternalProviderRedirect(w http.ResponseWriter, r *http.Request) error {
+	authURL, authForm, err := a.getExternalProviderAuthURL(w, r, "")
+	if err != nil {
+		return err
+	}
+
+	if authForm != nil {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write(authForm)
+		return err
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+	return nil
+}
+
+// getExternalProviderAuthURL builds the URL of the provider's authorization
+// page. Sign ins through it link the provider account to the user with the
+// linkingUserID, if set. SAML identity providers that only accept the POST
+// binding are sent the page of the form posting the AuthnRequest instead.
+func (a *API) getExternalProviderAuthURL(w http.ResponseWriter, r *http.Request, linkingUserID string) (string, []byte, error) {
 	ctx := r.Context()
 	config := a.getConfig(ctx)
 
 	providerType := r.URL.Query().Get("provider")
 	scopes := r.URL.Query().Get("scopes")
 
-	p, err := a.Provider(ctx, providerType, scopes)
-	if err != nil {
-		return badRequestError("Unsupported provider: %+v", err).WithInternalError(err)
+	var p provider.Provider
+	var samlConnectionID string
+	if domain := r.URL.Query().Get("domain"); domain != "" && providerProtocol(providerType) == provider.ProtocolSAML {
+		connection, err := models.FindSAMLConnectionByDomain(a.db, getInstanceID(ctx), domain)
+		if err != nil {
+			if models.IsNotFoundError(err) {
+				return "", nil, notFoundError("No SAML connection found for domain %s", domain)
+			}
+			return "", nil, internalServerError("Database error finding SAML connection").WithInternalError(err)
+		}
+		p, err = provider.NewSamlConnectionProvider(config.External.Saml, connection, a.db, getInstanceID(ctx))
+		if err != nil {
+			return "", nil, badRequestError("Could not initialize SAML provider: %+v", err).WithInternalError(err)
+		}
+		samlConnectionID = connection.ID.String()
+	} else {
+		var err error
+		p, err = a.Provider(ctx, providerType, scopes)
+		if err != nil {
+			return "", nil, badRequestError("Unsupported provider: %+v", err).WithInternalError(err)
+		}
 	}
 
 	inviteToken := r.URL.Query().Get("invite_token")
@@ -49,17 +104,26 @@ func (a *API) ExternalProviderRedirect(w http.ResponseWriter, r *http.Request) e
 		_, userErr := models.FindUserByConfirmationToken(a.db, inviteToken)
 		if userErr != nil {
 			if models.IsNotFoundError(userErr) {
-				return notFoundError(userErr.Error())
+				return "", nil, notFoundError(userErr.Error())
 			}
-			return internalServerError("Database error finding user").WithInternalError(userErr)
+			return "", nil, internalServerError("Database error finding user").WithInternalError(userErr)
 		}
 	}
 
+	challenge, err := newCodeChallenge(r.URL.Query().Get("code_challenge"), r.URL.Query().Get("code_challenge_method"))
+	if err != nil {
+		return "", nil, err
+	}
+
 	redirectURL := a.getRedirectURLOrReferrer(r, r.URL.Query().Get("redirect_to"))
 	log := getLogEntry(r)
 	log.WithField("provider", providerType).Info("Redirecting to external provider")
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, ExternalProviderClaims{
+	keys, err := a.loadSecretKeySet(ctx, a.db)
+	if err != nil {
+		return "", nil, internalServerError("Error loading JWT signing key").WithInternalError(err)
+	}
+	claims := ExternalProviderClaims{
 		NetlifyMicroserviceClaims: NetlifyMicroserviceClaims{
 			StandardClaims: jwt.StandardClaims{
 				ExpiresAt: time.Now().Add(5 * time.Minute).Unix(),
@@ -71,10 +135,25 @@ func (a *API) ExternalProviderRedirect(w http.ResponseWriter, r *http.Request) e
 		Provider:    providerType,
 		InviteToken: inviteToken,
 		Referrer:    redirectURL,
-	})
-	tokenString, err := token.SignedString([]byte(config.JWT.Secret))
+		Nonce:       r.URL.Query().Get("nonce"),
+
+		LinkingUserID: linkingUserID,
+
+		SAMLConnectionID: samlConnectionID,
+	}
+	if linkingUserID != "" {
+		claims.LinkingNonce = setLinkingNonceCookie(w)
+	}
+	if challenge != nil {
+		claims.CodeChallenge = challenge.Challenge
+		claims.CodeChallengeMethod = challenge.Method
+	}
+	if _, ok := p.(*provider.OIDCProvider); ok {
+		claims.ProviderNonce = crypto.SecureToken()
+	}
+	tokenString, err := keys.sign(claims)
 	if err != nil {
-		return internalServerError("Error creating state").WithInternalError(err)
+		return "", nil, internalServerError("Error creating state").WithInternalError(err)
 	}
 
 	var authURL string
@@ -83,7 +162,7 @@ func (a *API) ExternalProviderRedirect(w http.ResponseWriter, r *http.Request) e
 		authURL = externalProvider.AuthCodeURL(tokenString)
 		err := gothic.StoreInSession(providerType, externalProvider.Marshal(), r, w)
 		if err != nil {
-			return internalServerError("Error storing request token in session").WithInternalError(err)
+			return "", nil, internalServerError("Error storing request token in session").WithInternalError(err)
 		}
 	case *provider.AppleProvider:
 		opts := make([]oauth2.AuthCodeOption, 0, 1)
@@ -95,12 +174,22 @@ func (a *API) ExternalProviderRedirect(w http.ResponseWriter, r *http.Request) e
 				authURL = u.String()
 			}
 		}
+	case *provider.SamlProvider:
+		if externalProvider.IsSSOPostBinding() {
+			authForm, err := externalProvider.AuthRequestForm(tokenString)
+			if err != nil {
+				return "", nil, internalServerError("Error creating SAML AuthnRequest").WithInternalError(err)
+			}
+			return "", authForm, nil
+		}
+		authURL = externalProvider.AuthCodeURL(tokenString)
+	case *provider.OIDCProvider:
+		authURL = externalProvider.Config.AuthCodeURL(tokenString, oauth2.SetAuthURLParam("nonce", claims.ProviderNonce))
 	default:
 		authURL = p.AuthCodeURL(tokenString)
 	}
 
-	http.Redirect(w, r, authURL, http.StatusFound)
-	return nil
+	return authURL, nil, nil
 }
 
 func (a *API) ExternalProviderCallback(w http.ResponseWriter, r *http.Request) error {
@@ -114,55 +203,89 @@ func (a *API) internalExternalProviderCallback(w http.ResponseWriter, r *http.Re
 	instanceID := getInstanceID(ctx)
 
 	providerType := getExternalProviderType(ctx)
+	grantParams := newGrantParams(r)
 	var userData *provider.UserProvidedData
+	var samlAttrs *samlAttributes
 	var providerToken string
-	if providerType == "saml" {
-		samlUserData, err := a.samlCallback(r, ctx)
+	var oauthToken *oauth2.Token
+	switch providerProtocol(providerType) {
+	case provider.ProtocolSAML:
+		samlUserData, samlSession, err := a.samlCallback(r, ctx)
 		if err != nil {
 			return err
 		}
 		userData = samlUserData
-	} else if providerType == "twitter" {
-		// future OAuth1.0 providers will use this method
+		samlAttrs = samlSession.attributes
+		grantParams.SAMLConnectionID = samlSession.connectionID
+		grantParams.SAMLNameID = samlSession.nameID
+		grantParams.SAMLSessionIndex = samlSession.sessionIndex
+	case provider.ProtocolOAuth1:
 		oAuthResponseData, err := a.oAuth1Callback(ctx, r, providerType)
 		if err != nil {
 			return err
 		}
 		userData = oAuthResponseData.userData
 		providerToken = oAuthResponseData.token
-	} else {
+	default:
 		oAuthResponseData, err := a.oAuthCallback(ctx, r, providerType)
 		if err != nil {
 			return err
 		}
 		userData = oAuthResponseData.userData
 		providerToken = oAuthResponseData.token
+		oauthToken = oAuthResponseData.oauthToken
 	}
 
 	var user *models.User
 	var token *AccessTokenResponse
+	var authCode string
 	err := a.db.Transaction(func(tx *storage.Connection) error {
 		var terr error
 		inviteToken := getInviteToken(ctx)
-		if inviteToken != "" {
+		if linkingUserID := getLinkingUserID(ctx); linkingUserID != uuid.Nil {
+			// the signed in user is linking another account, so no new
+			// session is started
+			if !checkLinkingNonceCookie(w, r, getLinkingNonce(ctx)) {
+				return forbiddenError("The account can only be linked in the browser the link was started in")
+			}
+			if terr = a.processIdentityLink(ctx, tx, userData, instanceID, linkingUserID, providerType); terr != nil {
+				return terr
+			}
+			return a.saveProviderToken(ctx, tx, instanceID, providerType, userData, oauthToken)
+		} else if inviteToken != "" {
 			if user, terr = a.processInvite(ctx, tx, userData, instanceID, inviteToken, providerType); terr != nil {
 				return terr
 			}
+			if terr = a.saveProviderToken(ctx, tx, instanceID, providerType, userData, oauthToken); terr != nil {
+				return terr
+			}
 		} else {
 			aud := a.requestAud(ctx, r)
-
-			// search user using all available emails
 			var emailData provider.Email
-			for _, e := range userData.Emails {
-				if e.Verified || config.Mailer.Autoconfirm {
-					user, terr = models.FindUserByEmailAndAudience(tx, instanceID, e.Email, aud)
-					if terr != nil && !models.IsNotFoundError(terr) {
-						return internalServerError("Error checking for duplicate users").WithInternalError(terr)
-					}
 
-					if user != nil {
-						emailData = e
-						break
+			// the identity of the account identifies the user even if the
+			// email at the provider changed
+			if user, terr = findUserByIdentity(tx, instanceID, providerType, userData); terr != nil {
+				return terr
+			}
+			if user != nil {
+				emailData = userEmail(user, userData)
+			}
+
+			// search user using all available emails, only accounts with an
+			// email the provider verified are linked to existing users
+			if user == nil {
+				for _, e := range userData.Emails {
+					if e.Verified {
+						user, terr = models.FindUserByEmailAndAudience(tx, instanceID, e.Email, aud)
+						if terr != nil && !models.IsNotFoundError(terr) {
+							return internalServerError("Error checking for duplicate users").WithInternalError(terr)
+						}
+
+						if user != nil {
+							emailData = e
+							break
+						}
 					}
 				}
 			}
@@ -173,24 +296,13 @@ func (a *API) internalExternalProviderCallback(w http.ResponseWriter, r *http.Re
 				}
 
 				// prefer primary email for new signups
-				emailData = userData.Emails[0]
-				for _, e := range userData.Emails {
-					if e.Primary {
-						emailData = e
-						break
-					}
-				}
+				emailData = primaryEmail(userData)
 
 				params := &SignupParams{
 					Provider: providerType,
 					Email:    emailData.Email,
 					Aud:      aud,
-					Data:     make(map[string]interface{}),
-				}
-				for k, v := range userData.Metadata {
-					if v != "" {
-						params.Data[k] = v
-					}
+					Data:     userData.UserMetadata(),
 				}
 
 				user, terr = a.signupNewUser(ctx, tx, params)
@@ -199,6 +311,13 @@ func (a *API) internalExternalProviderCallback(w http.ResponseWriter, r *http.Re
 				}
 			}
 
+			if _, terr = a.linkIdentity(tx, user, providerType, userData); terr != nil {
+				return terr
+			}
+			if terr = a.saveProviderToken(ctx, tx, instanceID, providerType, userData, oauthToken); terr != nil {
+				return terr
+			}
+
 			if !user.IsConfirmed() {
 				if !emailData.Verified && !config.Mailer.Autoconfirm {
 					mailer := a.Mailer(ctx)
@@ -231,7 +350,19 @@ func (a *API) internalExternalProviderCallback(w http.ResponseWriter, r *http.Re
 			}
 		}
 
-		token, terr = a.issueRefreshToken(ctx, tx, user)
+		if samlAttrs != nil {
+			if terr = applySAMLAttributes(tx, user, samlAttrs); terr != nil {
+				return terr
+			}
+		}
+
+		// PKCE clients exchange an auth code for the tokens
+		if challenge := getCodeChallenge(ctx); challenge != nil {
+			authCode, terr = createFlowState(tx, config, user, challenge, providerType, providerToken, getNonce(ctx))
+			return terr
+		}
+
+		token, terr = a.issueRefreshToken(ctx, tx, user, grantParams)
 		if terr != nil {
 			return oauthError("server_error", terr.Error())
 		}
@@ -242,7 +373,12 @@ func (a *API) internalExternalProviderCallback(w http.ResponseWriter, r *http.Re
 	}
 
 	rurl := a.getExternalRedirectURL(r)
-	if token != nil {
+	if authCode != "" {
+		rurl, err = addQueryParams(rurl, map[string]string{"code": authCode})
+		if err != nil {
+			return internalServerError("Error building redirect URL").WithInternalError(err)
+		}
+	} else if token != nil {
 		q := url.Values{}
 		q.Set("provider_token", providerToken)
 		q.Set("access_token", token.Token)
@@ -284,14 +420,11 @@ func (a *API) processInvite(ctx context.Context, tx *storage.Connection, userDat
 	}); err != nil {
 		return nil, internalServerError("Database error updating user").WithInternalError(err)
 	}
-
-	updates := make(map[string]interface{})
-	for k, v := range userData.Metadata {
-		if v != "" {
-			updates[k] = v
-		}
+	if _, err := a.linkIdentity(tx, user, providerType, userData); err != nil {
+		return nil, err
 	}
-	if err := user.UpdateUserMetaData(tx, updates); err != nil {
+
+	if err := user.UpdateUserMetaData(tx, userData.UserMetadata()); err != nil {
 		return nil, internalServerError("Database error updating user").WithInternalError(err)
 	}
 
@@ -310,12 +443,13 @@ func (a *API) processInvite(ctx context.Context, tx *storage.Connection, userDat
 }
 
 func (a *API) loadExternalState(ctx context.Context, state string) (context.Context, error) {
-	config := a.getConfig(ctx)
+	keys, err := a.loadSecretKeySet(ctx, a.db)
+	if err != nil {
+		return nil, internalServerError("Error loading JWT signing key").WithInternalError(err)
+	}
+
 	claims := ExternalProviderClaims{}
-	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
-	_, err := p.ParseWithClaims(state, &claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.JWT.Secret), nil
-	})
+	_, err = keys.parse(state, &claims)
 	if err != nil || claims.Provider == "" {
 		return nil, badRequestError("OAuth state is invalid: %v", err)
 	}
@@ -325,6 +459,33 @@ func (a *API) loadExternalState(ctx context.Context, state string) (context.Cont
 	if claims.Referrer != "" {
 		ctx = withExternalReferrer(ctx, claims.Referrer)
 	}
+	if claims.Nonce != "" {
+		ctx = withNonce(ctx, claims.Nonce)
+	}
+	if claims.ProviderNonce != "" {
+		ctx = provider.WithOIDCNonce(ctx, claims.ProviderNonce)
+	}
+	if claims.LinkingUserID != "" {
+		linkingUserID, err := uuid.FromString(claims.LinkingUserID)
+		if err != nil {
+			return nil, badRequestError("OAuth state is invalid: %v", err)
+		}
+		ctx = withLinkingUserID(ctx, linkingUserID)
+		ctx = withLinkingNonce(ctx, claims.LinkingNonce)
+	}
+	if claims.SAMLConnectionID != "" {
+		samlConnectionID, err := uuid.FromString(claims.SAMLConnectionID)
+		if err != nil {
+			return nil, badRequestError("OAuth state is invalid: %v", err)
+		}
+		ctx = withSAMLConnectionID(ctx, samlConnectionID)
+	}
+	if claims.CodeChallenge != "" {
+		ctx = withCodeChallenge(ctx, &codeChallenge{
+			Challenge: claims.CodeChallenge,
+			Method:    claims.CodeChallengeMethod,
+		})
+	}
 
 	ctx = withExternalProviderType(ctx, claims.Provider)
 	return withSignature(ctx, state), nil
@@ -335,32 +496,26 @@ func (a *API) Provider(ctx context.Context, name string, scopes string) (provide
 	config := a.getConfig(ctx)
 	name = strings.ToLower(name)
 
-	switch name {
-	case "apple":
-		return provider.NewAppleProvider(config.External.Apple)
-	case "azure":
-		return provider.NewAzureProvider(config.External.Azure, scopes)
-	case "bitbucket":
-		return provider.NewBitbucketProvider(config.External.Bitbucket)
-	case "discord":
-		return provider.NewDiscordProvider(config.External.Discord, scopes)
-	case "github":
-		return provider.NewGithubProvider(config.External.Github, scopes)
-	case "gitlab":
-		return provider.NewGitlabProvider(config.External.Gitlab, scopes)
-	case "google":
-		return provider.NewGoogleProvider(config.External.Google, scopes)
-	case "facebook":
-		return provider.NewFacebookProvider(config.External.Facebook, scopes)
-	case "twitch":
-		return provider.NewTwitchProvider(config.External.Twitch, scopes)
-	case "twitter":
-		return provider.NewTwitterProvider(config.External.Twitter, scopes)
-	case "saml":
-		return provider.NewSamlProvider(config.External.Saml, a.db, getInstanceID(ctx))
-	default:
-		return nil, fmt.Errorf("Provider %s could not be found", name)
+	if reg, ok := provider.Lookup(name); ok {
+		return reg.NewProvider(&config.External, provider.Params{
+			Scopes:     scopes,
+			DB:         a.db,
+			InstanceID: getInstanceID(ctx),
+		})
+	}
+	if ext, ok := config.External.OIDC[name]; ok {
+		return provider.NewOIDCProvider(name, ext, scopes)
+	}
+	return nil, fmt.Errorf("Provider %s could not be found", name)
+}
+
+// providerProtocol returns how the callback of the provider signs users in.
+// Generic OpenID Connect providers aren't registered and use OAuth2.
+func providerProtocol(name string) provider.Protocol {
+	if reg, ok := provider.Lookup(name); ok {
+		return reg.Protocol
 	}
+	return provider.ProtocolOAuth2
 }
 
 func (a *API) redirectErrors(handler apiHandler, w http.ResponseWriter, r *http.Request) {
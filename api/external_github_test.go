@@ -1,12 +1,16 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/gotrue/models"
 )
 
 func (ts *ExternalTestSuite) TestSignupExternalGithub() {
@@ -47,7 +51,7 @@ func GitHubTestSignupSetup(ts *ExternalTestSuite, tokenCount *int, userCount *in
 		case "/api/v3/user":
 			*userCount++
 			w.Header().Add("Content-Type", "application/json")
-			fmt.Fprint(w, `{"name":"GitHub Test","avatar_url":"http://example.com/avatar"}`)
+			fmt.Fprint(w, `{"id":123,"name":"GitHub Test","avatar_url":"http://example.com/avatar"}`)
 		case "/api/v3/user/emails":
 			w.Header().Add("Content-Type", "application/json")
 			fmt.Fprint(w, emails)
@@ -184,3 +188,322 @@ func (ts *ExternalTestSuite) TestInviteTokenExternalGitHubErrorWhenEmailDoesntMa
 
 	assertAuthorizationFailure(ts, u, "Invited email does not match emails from external provider", "invalid_request", "")
 }
+
+func (ts *ExternalTestSuite) TestSignupExternalGitHub_PKCE() {
+	tokenCount, userCount := 0, 0
+	code := "authcode"
+	emails := `[{"email":"github@example.com", "primary": true, "verified": true}]`
+	server := GitHubTestSignupSetup(ts, &tokenCount, &userCount, code, emails)
+	defer server.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/authorize?provider=github&code_challenge_method=s256&code_challenge="+testCodeChallenge(testCodeVerifier), nil)
+	req.Header.Set("Referer", "https://example.netlify.com/admin")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code)
+	u, err := url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err, "redirect url parse failed")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/callback?code="+code+"&state="+u.Query().Get("state"), nil)
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code)
+	u, err = url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err, "redirect url parse failed")
+	ts.Equal("/admin", u.Path)
+	ts.Empty(u.Fragment)
+	authCode := u.Query().Get("code")
+	ts.Require().NotEmpty(authCode)
+
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=pkce", strings.NewReader(`{"auth_code":"`+authCode+`","code_verifier":"`+testCodeVerifier+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+
+	token := AccessTokenResponse{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(&token))
+	ts.NotEmpty(token.Token)
+	ts.Equal("github_token", token.ProviderToken)
+	ts.Equal("github@example.com", token.User.Email)
+}
+
+func (ts *ExternalTestSuite) TestSignupExternalGitHubCreatesIdentity() {
+	tokenCount, userCount := 0, 0
+	code := "authcode"
+	emails := `[{"email":"github@example.com", "primary": true, "verified": true}]`
+	server := GitHubTestSignupSetup(ts, &tokenCount, &userCount, code, emails)
+	defer server.Close()
+
+	performAuthorization(ts, "github", code, "")
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "github@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+	identity, err := models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "github", "123")
+	ts.Require().NoError(err)
+	ts.Equal(user.ID, identity.UserID)
+	ts.Equal("github@example.com", identity.IdentityData["email"])
+	ts.Equal([]interface{}{"github"}, user.AppMetaData["providers"])
+}
+
+func (ts *ExternalTestSuite) TestSignupExternalGitHubEmailChangedAtProvider() {
+	tokenCount, userCount := 0, 0
+	code := "authcode"
+	emails := `[{"email":"github@example.com", "primary": true, "verified": true}]`
+	server := GitHubTestSignupSetup(ts, &tokenCount, &userCount, code, emails)
+	performAuthorization(ts, "github", code, "")
+	server.Close()
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "github@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+
+	// the same GitHub account signs in with a new email
+	emails = `[{"email":"changed@example.com", "primary": true, "verified": true}]`
+	server = GitHubTestSignupSetup(ts, &tokenCount, &userCount, code, emails)
+	defer server.Close()
+	u := performAuthorization(ts, "github", code, "")
+	ts.Empty(u.Query().Get("error"))
+
+	_, err = models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "changed@example.com", ts.Config.JWT.Aud)
+	ts.True(models.IsNotFoundError(err), "expected no duplicate user")
+
+	identity, err := models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "github", "123")
+	ts.Require().NoError(err)
+	ts.Equal(user.ID, identity.UserID)
+	ts.Equal("changed@example.com", identity.IdentityData["email"])
+}
+
+func (ts *ExternalTestSuite) TestSignupExternalGitHubLinksExistingUser() {
+	existing, err := ts.createUser("github@example.com", "GitHub Test", "http://example.com/avatar", "")
+	ts.Require().NoError(err)
+	ts.Require().NoError(existing.UpdateAppMetaData(ts.API.db, map[string]interface{}{"provider": "email"}))
+
+	tokenCount, userCount := 0, 0
+	code := "authcode"
+	emails := `[{"email":"github@example.com", "primary": true, "verified": true}]`
+	server := GitHubTestSignupSetup(ts, &tokenCount, &userCount, code, emails)
+	defer server.Close()
+
+	performAuthorization(ts, "github", code, "")
+
+	identity, err := models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "github", "123")
+	ts.Require().NoError(err)
+	ts.Equal(existing.ID, identity.UserID)
+
+	user, err := models.FindUserByInstanceIDAndID(ts.API.db, ts.instanceID, existing.ID)
+	ts.Require().NoError(err)
+	ts.Equal([]interface{}{"email", "github"}, user.AppMetaData["providers"])
+}
+
+func (ts *ExternalTestSuite) userRequest(user *models.User, method, path string) *httptest.ResponseRecorder {
+	key, err := configSigningKey(&ts.Config.JWT)
+	ts.Require().NoError(err)
+	token, err := generateAccessToken(user, nil, time.Hour, key, "", "")
+	ts.Require().NoError(err)
+
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Referer", "https://example.netlify.com/admin")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *ExternalTestSuite) TestLinkExternalGitHubIdentity() {
+	user, err := ts.createUser("linked@example.com", "Linked Test", "", "")
+	ts.Require().NoError(err)
+
+	tokenCount, userCount := 0, 0
+	code := "authcode"
+	emails := `[{"email":"github@example.com", "primary": true, "verified": true}]`
+	server := GitHubTestSignupSetup(ts, &tokenCount, &userCount, code, emails)
+	defer server.Close()
+
+	w := ts.userRequest(user, http.MethodGet, "http://localhost/user/identities/authorize?provider=github")
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	data := map[string]string{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(&data))
+	u, err := url.Parse(data["url"])
+	ts.Require().NoError(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/callback?code="+code+"&state="+u.Query().Get("state"), nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code)
+	u, err = url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err)
+	ts.Equal("/admin", u.Path)
+	ts.Empty(u.Query().Get("error_description"))
+	// the user is already signed in
+	ts.Empty(u.Fragment)
+
+	identity, err := models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "github", "123")
+	ts.Require().NoError(err)
+	ts.Equal(user.ID, identity.UserID)
+	_, err = models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "github@example.com", ts.Config.JWT.Aud)
+	ts.True(models.IsNotFoundError(err), "expected no new user")
+
+	w = ts.userRequest(user, http.MethodGet, "http://localhost/user/identities")
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	identities := []*models.Identity{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(&identities))
+	ts.Require().Len(identities, 1)
+	ts.Equal(identity.ID, identities[0].ID)
+
+	w = ts.userRequest(user, http.MethodDelete, "http://localhost/user/identities/"+identity.ID.String())
+	ts.Require().Equal(http.StatusNoContent, w.Code, w.Body.String())
+
+	_, err = models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "github", "123")
+	ts.True(models.IsNotFoundError(err), "expected identity to be unlinked")
+	user, err = models.FindUserByInstanceIDAndID(ts.API.db, ts.instanceID, user.ID)
+	ts.Require().NoError(err)
+	ts.Equal([]interface{}{"email"}, user.AppMetaData["providers"])
+}
+
+func (ts *ExternalTestSuite) TestLinkExternalGitHubIdentityRequiresBrowser() {
+	user, err := ts.createUser("linked@example.com", "Linked Test", "", "")
+	ts.Require().NoError(err)
+
+	tokenCount, userCount := 0, 0
+	code := "authcode"
+	emails := `[{"email":"github@example.com", "primary": true, "verified": true}]`
+	server := GitHubTestSignupSetup(ts, &tokenCount, &userCount, code, emails)
+	defer server.Close()
+
+	w := ts.userRequest(user, http.MethodGet, "http://localhost/user/identities/authorize?provider=github")
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	data := map[string]string{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(&data))
+	u, err := url.Parse(data["url"])
+	ts.Require().NoError(err)
+
+	// the state is used in another browser, which has no nonce cookie
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/callback?code="+code+"&state="+u.Query().Get("state"), nil)
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code)
+	u, err = url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err)
+	ts.NotEmpty(u.Query().Get("error_description"))
+
+	_, err = models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "github", "123")
+	ts.True(models.IsNotFoundError(err), "expected no identity to be linked")
+}
+
+func (ts *ExternalTestSuite) TestLinkExternalGitHubIdentityUpgradesAnonymousUser() {
+	user, err := models.NewAnonymousUser(ts.instanceID, ts.Config.JWT.Aud, nil)
+	ts.Require().NoError(err)
+	ts.Require().NoError(ts.API.db.Create(user))
+
+	tokenCount, userCount := 0, 0
+	code := "authcode"
+	emails := `[{"email":"github@example.com", "primary": true, "verified": true}]`
+	server := GitHubTestSignupSetup(ts, &tokenCount, &userCount, code, emails)
+	defer server.Close()
+
+	w := ts.userRequest(user, http.MethodGet, "http://localhost/user/identities/authorize?provider=github")
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	data := map[string]string{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(&data))
+	u, err := url.Parse(data["url"])
+	ts.Require().NoError(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/callback?code="+code+"&state="+u.Query().Get("state"), nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code)
+	u, err = url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err)
+	ts.Empty(u.Query().Get("error_description"))
+
+	// the guest keeps its id and takes the email of the account
+	upgraded, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "github@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+	ts.Equal(user.ID, upgraded.ID)
+	ts.False(upgraded.IsAnonymous)
+	ts.True(upgraded.IsConfirmed())
+	ts.Equal("github", upgraded.AppMetaData["provider"])
+	ts.Equal([]interface{}{"github"}, upgraded.AppMetaData["providers"])
+}
+
+func (ts *ExternalTestSuite) TestUnlinkLastExternalIdentity() {
+	tokenCount, userCount := 0, 0
+	code := "authcode"
+	emails := `[{"email":"github@example.com", "primary": true, "verified": true}]`
+	server := GitHubTestSignupSetup(ts, &tokenCount, &userCount, code, emails)
+	defer server.Close()
+
+	performAuthorization(ts, "github", code, "")
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "github@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+	identity, err := models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "github", "123")
+	ts.Require().NoError(err)
+
+	w := ts.userRequest(user, http.MethodDelete, "http://localhost/user/identities/"+identity.ID.String())
+	ts.Equal(http.StatusUnprocessableEntity, w.Code, w.Body.String())
+
+	_, err = models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "github", "123")
+	ts.NoError(err)
+}
+
+func (ts *ExternalTestSuite) TestUnlinkLastExternalIdentityWithPhone() {
+	ts.Config.External.Phone.Enabled = true
+	defer func() {
+		ts.Config.External.Phone.Enabled = false
+	}()
+
+	tokenCount, userCount := 0, 0
+	code := "authcode"
+	emails := `[{"email":"github@example.com", "primary": true, "verified": true}]`
+	server := GitHubTestSignupSetup(ts, &tokenCount, &userCount, code, emails)
+	defer server.Close()
+
+	performAuthorization(ts, "github", code, "")
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "github@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+	identity, err := models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "github", "123")
+	ts.Require().NoError(err)
+
+	// the user still signs in with the phone number
+	user.Phone = "123456789"
+	ts.Require().NoError(ts.API.db.UpdateOnly(user, "phone"))
+	ts.Require().NoError(user.ConfirmPhone(ts.API.db))
+
+	w := ts.userRequest(user, http.MethodDelete, "http://localhost/user/identities/"+identity.ID.String())
+	ts.Equal(http.StatusNoContent, w.Code, w.Body.String())
+}
+
+func (ts *ExternalTestSuite) TestExternalGitHubProviderToken() {
+	tokenCount, userCount := 0, 0
+	code := "authcode"
+	emails := `[{"email":"github@example.com", "primary": true, "verified": true}]`
+	server := GitHubTestSignupSetup(ts, &tokenCount, &userCount, code, emails)
+	defer server.Close()
+
+	performAuthorization(ts, "github", code, "")
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "github@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+	identity, err := models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "github", "123")
+	ts.Require().NoError(err)
+
+	w := ts.userRequest(user, http.MethodGet, "http://localhost/user/identities/"+identity.ID.String()+"/token")
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	data := &ProviderTokenResponse{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(data))
+	ts.Equal("github_token", data.ProviderToken)
+
+	// expired tokens without a refresh token can't be renewed
+	expired := time.Now().Add(-time.Minute)
+	ts.Require().NoError(identity.UpdateProviderToken(ts.API.db, ts.Config.External.TokenEncryptionKey, "github_token", "", &expired))
+	w = ts.userRequest(user, http.MethodGet, "http://localhost/user/identities/"+identity.ID.String()+"/token")
+	ts.Equal(http.StatusUnprocessableEntity, w.Code, w.Body.String())
+}
@@ -125,8 +125,9 @@ func (ts *ExternalTestSuite) TestSignupExternalGitLabDisableSignupSuccessWithPri
 	assertAuthorizationSuccess(ts, u, tokenCount, userCount, "gitlab@example.com", "GitLab Test", "http://example.com/avatar")
 }
 
-func (ts *ExternalTestSuite) TestSignupExternalGitLabDisableSignupSuccessWithSecondaryEmail() {
-	// additional emails from GitLab don't return confirm status
+func (ts *ExternalTestSuite) TestSignupExternalGitLabDisableSignupErrorWithUnverifiedSecondaryEmail() {
+	// additional emails from GitLab don't return confirm status, so they
+	// aren't linked to existing users even with autoconfirm
 	ts.Config.Mailer.Autoconfirm = true
 	ts.Config.DisableSignup = true
 
@@ -141,7 +142,7 @@ func (ts *ExternalTestSuite) TestSignupExternalGitLabDisableSignupSuccessWithSec
 
 	u := performAuthorization(ts, "gitlab", code, "")
 
-	assertAuthorizationSuccess(ts, u, tokenCount, userCount, "secondary@example.com", "GitLab Test", "http://example.com/avatar")
+	assertAuthorizationFailure(ts, u, "Signups not allowed for this instance", "access_denied", "primary@example.com")
 }
 
 func (ts *ExternalTestSuite) TestInviteTokenExternalGitLabSuccessWhenMatchingToken() {
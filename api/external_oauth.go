@@ -9,11 +9,14 @@ import (
 	"github.com/mrjones/oauth"
 	"github.com/netlify/gotrue/api/provider"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
 )
 
 type OAuthProviderData struct {
 	userData *provider.UserProvidedData
 	token    string
+	// oauthToken is the complete token of OAuth2 providers
+	oauthToken *oauth2.Token
 }
 
 // loadOAuthState parses the `state` query parameter as a JWS payload,
@@ -91,8 +94,9 @@ func (a *API) oAuthCallback(ctx context.Context, r *http.Request, providerType s
 	}
 
 	return &OAuthProviderData{
-		userData: userData,
-		token:    token.AccessToken,
+		userData:   userData,
+		token:      token.AccessToken,
+		oauthToken: token,
 	}, nil
 }
 
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofrs/uuid"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+)
+
+// oidcTestServer is an OpenID Connect provider that puts the nonce of the
+// last authorization request into the ID tokens it issues
+type oidcTestServer struct {
+	*httptest.Server
+	issuer         string
+	nonce          string
+	discoveryCount int
+	// omitKeyID issues ID tokens without a kid
+	omitKeyID bool
+}
+
+func OIDCTestSignupSetup(ts *ExternalTestSuite, tokenCount *int, code string, claims jwt.MapClaims) *oidcTestServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	ts.Require().NoError(err)
+	publicKey, err := jwk.New(&key.PublicKey)
+	ts.Require().NoError(err)
+	ts.Require().NoError(publicKey.Set(jwk.KeyIDKey, "test-key"))
+	// the provider publishes another key before the one it signs with
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	ts.Require().NoError(err)
+	otherPublicKey, err := jwk.New(&otherKey.PublicKey)
+	ts.Require().NoError(err)
+	ts.Require().NoError(otherPublicKey.Set(jwk.KeyIDKey, "other-key"))
+
+	// every test uses another issuer, the provider caches them
+	server := &oidcTestServer{}
+	prefix := "/" + uuid.Must(uuid.NewV4()).String()
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		switch strings.TrimPrefix(r.URL.Path, prefix) {
+		case "/.well-known/openid-configuration":
+			server.discoveryCount++
+			fmt.Fprintf(w, `{"issuer":"%[1]s","authorization_endpoint":"%[1]s/authorize","token_endpoint":"%[1]s/token","jwks_uri":"%[1]s/keys"}`, server.issuer)
+		case "/keys":
+			ts.NoError(json.NewEncoder(w).Encode(&jwk.Set{Keys: []jwk.Key{otherPublicKey, publicKey}}))
+		case "/token":
+			if r.FormValue("grant_type") == "refresh_token" {
+				ts.Equal("oidc_refresh_token", r.FormValue("refresh_token"))
+				fmt.Fprint(w, `{"access_token":"oidc_token_refreshed","token_type":"bearer","expires_in":100000}`)
+				return
+			}
+
+			*tokenCount++
+			ts.Equal(code, r.FormValue("code"))
+			ts.Equal("authorization_code", r.FormValue("grant_type"))
+
+			idTokenClaims := jwt.MapClaims{
+				"iss":   server.issuer,
+				"aud":   "testclientid",
+				"exp":   time.Now().Add(time.Minute).Unix(),
+				"nonce": server.nonce,
+			}
+			for k, v := range claims {
+				idTokenClaims[k] = v
+			}
+			idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, idTokenClaims)
+			if !server.omitKeyID {
+				idToken.Header["kid"] = "test-key"
+			}
+			signed, err := idToken.SignedString(key)
+			ts.NoError(err)
+			fmt.Fprintf(w, `{"access_token":"oidc_token","refresh_token":"oidc_refresh_token","token_type":"bearer","expires_in":100000,"id_token":"%s"}`, signed)
+		default:
+			w.WriteHeader(500)
+			ts.Fail("unknown oidc call %s", r.URL.Path)
+		}
+	}))
+	server.issuer = server.URL + prefix
+
+	ts.Config.External.OIDC = conf.OIDCProviders{
+		"okta": conf.OIDCProviderConfiguration{
+			OAuthProviderConfiguration: conf.OAuthProviderConfiguration{
+				Enabled:     true,
+				ClientID:    "testclientid",
+				Secret:      "testsecret",
+				RedirectURI: "https://identity.services.netlify.com/callback",
+			},
+			Issuer: server.issuer,
+		},
+	}
+
+	return server
+}
+
+// performOIDCAuthorization signs in with the provider, which receives the
+// nonce of the authorization request
+func performOIDCAuthorization(ts *ExternalTestSuite, server *oidcTestServer, code string) *url.URL {
+	w := performAuthorizationRequest(ts, "okta", "")
+	ts.Require().Equal(http.StatusFound, w.Code)
+	u, err := url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err, "redirect url parse failed")
+
+	server.nonce = u.Query().Get("nonce")
+	return performAuthorizationCallback(ts, code, u.Query().Get("state"))
+}
+
+func (ts *ExternalTestSuite) TestSignupExternalOIDC() {
+	tokenCount := 0
+	server := OIDCTestSignupSetup(ts, &tokenCount, "authcode", nil)
+	defer server.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/authorize?provider=okta", nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code)
+	u, err := url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err, "redirect url parse failed")
+	ts.True(strings.HasPrefix(u.String(), server.issuer+"/authorize"))
+	q := u.Query()
+	ts.Equal("testclientid", q.Get("client_id"))
+	ts.Equal("code", q.Get("response_type"))
+	ts.Equal("openid email profile", q.Get("scope"))
+	ts.NotEmpty(q.Get("nonce"))
+
+	// requested scopes are added once
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/authorize?provider=okta&scopes=email%20groups", nil)
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code)
+	u, err = url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err, "redirect url parse failed")
+	ts.Equal("openid email profile groups", u.Query().Get("scope"))
+}
+
+func (ts *ExternalTestSuite) TestSignupExternalOIDC_AuthorizationCode() {
+	tokenCount := 0
+	code := "authcode"
+	server := OIDCTestSignupSetup(ts, &tokenCount, code, jwt.MapClaims{
+		"sub":            "oidc-user-1",
+		"email":          "oidc@example.com",
+		"email_verified": true,
+		"name":           "OIDC Test",
+	})
+	defer server.Close()
+
+	u := performOIDCAuthorization(ts, server, code)
+	v, err := url.ParseQuery(u.Fragment)
+	ts.Require().NoError(err)
+	ts.NotEmpty(v.Get("access_token"))
+	ts.Equal(1, tokenCount)
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "oidc@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+	ts.Equal("OIDC Test", user.UserMetaData["full_name"])
+	ts.Equal("okta", user.AppMetaData["provider"])
+
+	identity, err := models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "okta", "oidc-user-1")
+	ts.Require().NoError(err)
+	ts.Equal(user.ID, identity.UserID)
+}
+
+func (ts *ExternalTestSuite) TestSignupExternalOIDC_WithoutKeyID() {
+	tokenCount := 0
+	code := "authcode"
+	server := OIDCTestSignupSetup(ts, &tokenCount, code, jwt.MapClaims{
+		"sub":   "oidc-user-1",
+		"email": "oidc@example.com",
+		// some providers send booleans as strings
+		"email_verified": "true",
+	})
+	server.omitKeyID = true
+	defer server.Close()
+
+	u := performOIDCAuthorization(ts, server, code)
+	v, err := url.ParseQuery(u.Fragment)
+	ts.Require().NoError(err)
+	ts.NotEmpty(v.Get("access_token"))
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "oidc@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+	ts.True(user.IsConfirmed())
+}
+
+func (ts *ExternalTestSuite) TestSignupExternalOIDC_InvalidAudience() {
+	tokenCount := 0
+	code := "authcode"
+	server := OIDCTestSignupSetup(ts, &tokenCount, code, jwt.MapClaims{
+		"sub":            "oidc-user-1",
+		"aud":            "otherclientid",
+		"email":          "oidc@example.com",
+		"email_verified": true,
+	})
+	defer server.Close()
+
+	u := performOIDCAuthorization(ts, server, code)
+	assertAuthorizationFailure(ts, u, "Error getting user email from external provider", "server_error", "oidc@example.com")
+}
+
+func (ts *ExternalTestSuite) TestSignupExternalOIDC_InvalidNonce() {
+	tokenCount := 0
+	code := "authcode"
+	server := OIDCTestSignupSetup(ts, &tokenCount, code, jwt.MapClaims{
+		"sub":            "oidc-user-1",
+		"email":          "oidc@example.com",
+		"email_verified": true,
+		"nonce":          "replayed-nonce",
+	})
+	defer server.Close()
+
+	u := performOIDCAuthorization(ts, server, code)
+	assertAuthorizationFailure(ts, u, "Error getting user email from external provider", "server_error", "oidc@example.com")
+}
+
+func (ts *ExternalTestSuite) TestExternalOIDCDiscoveryIsCached() {
+	tokenCount := 0
+	code := "authcode"
+	server := OIDCTestSignupSetup(ts, &tokenCount, code, jwt.MapClaims{
+		"sub":            "oidc-user-1",
+		"email":          "oidc@example.com",
+		"email_verified": true,
+	})
+	defer server.Close()
+
+	performOIDCAuthorization(ts, server, code)
+	performOIDCAuthorization(ts, server, code)
+	ts.Equal(2, tokenCount)
+	ts.Equal(1, server.discoveryCount)
+}
+
+func (ts *ExternalTestSuite) TestExternalOIDCProviderTokenRefresh() {
+	tokenCount := 0
+	code := "authcode"
+	server := OIDCTestSignupSetup(ts, &tokenCount, code, jwt.MapClaims{
+		"sub":            "oidc-user-1",
+		"email":          "oidc@example.com",
+		"email_verified": true,
+	})
+	defer server.Close()
+
+	performOIDCAuthorization(ts, server, code)
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "oidc@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+	identity, err := models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "okta", "oidc-user-1")
+	ts.Require().NoError(err)
+	ts.NotEqual("oidc_token", string(identity.EncryptedProviderToken), "expected provider token to be encrypted")
+
+	expired := time.Now().Add(-time.Minute)
+	ts.Require().NoError(identity.UpdateProviderToken(ts.API.db, ts.Config.External.TokenEncryptionKey, "oidc_token", "", &expired))
+
+	w := ts.userRequest(user, http.MethodGet, "http://localhost/user/identities/"+identity.ID.String()+"/token")
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	data := &ProviderTokenResponse{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(data))
+	ts.Equal("oidc_token_refreshed", data.ProviderToken)
+	ts.True(data.ExpiresIn > 0)
+
+	identity, err = models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "okta", "oidc-user-1")
+	ts.Require().NoError(err)
+	token, refreshToken, err := identity.ProviderToken(ts.Config.External.TokenEncryptionKey)
+	ts.Require().NoError(err)
+	ts.Equal("oidc_token_refreshed", token)
+	ts.Equal("oidc_refresh_token", refreshToken)
+}
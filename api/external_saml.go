@@ -2,58 +2,431 @@ package api
 
 import (
 	"context"
+	"encoding/base64"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/beevik/etree"
+	"github.com/gofrs/uuid"
 	"github.com/netlify/gotrue/api/provider"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+	saml2 "github.com/russellhaering/gosaml2"
+	"github.com/russellhaering/gosaml2/types"
 )
 
 func (a *API) loadSAMLState(w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	state := r.FormValue("RelayState")
+	ctx := r.Context()
+
+	// responses to AuthnRequests of GoTrue carry its signed state, other
+	// responses are only accepted from connections that allow them
+	var stateErr error
 	if state == "" {
-		return nil, badRequestError("SAML RelayState is missing")
+		stateErr = badRequestError("SAML RelayState is missing")
+	} else {
+		stateCtx, err := a.loadExternalState(ctx, state)
+		if err == nil {
+			return stateCtx, nil
+		}
+		stateErr = err
 	}
 
-	ctx := r.Context()
+	connection, err := a.findIdPInitiatedSAMLConnection(ctx, r.FormValue("SAMLResponse"))
+	if err != nil {
+		return nil, err
+	}
+	if connection == nil {
+		return nil, stateErr
+	}
+
+	logEntrySetField(r, "saml_connection_id", connection.ID)
+	ctx = withExternalProviderType(ctx, "saml")
+	ctx = withSAMLConnectionID(ctx, connection.ID)
+	ctx = withSAMLIdPInitiated(ctx)
 
-	return a.loadExternalState(ctx, state)
+	// the RelayState of unsolicited responses can be the page to go to
+	config := a.getConfig(ctx)
+	if isRedirectURLValid(config, state) {
+		ctx = withExternalReferrer(ctx, state)
+	} else if connection.DefaultRedirectURL != "" {
+		ctx = withExternalReferrer(ctx, connection.DefaultRedirectURL)
+	}
+	return ctx, nil
 }
 
-func (a *API) samlCallback(r *http.Request, ctx context.Context) (*provider.UserProvidedData, error) {
+// findIdPInitiatedSAMLConnection finds the connection of the issuer of an
+// unsolicited response, if it allows IdP initiated sign ins. The response is
+// validated in the callback.
+func (a *API) findIdPInitiatedSAMLConnection(ctx context.Context, samlResponse string) (*models.SAMLConnection, error) {
+	if samlResponse == "" {
+		return nil, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		return nil, nil
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil || doc.Root() == nil {
+		return nil, nil
+	}
+	issuer := doc.Root().SelectElement("Issuer")
+	if issuer == nil {
+		return nil, nil
+	}
+
 	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+	connections, err := models.FindSAMLConnections(a.db, instanceID)
+	if err != nil {
+		return nil, internalServerError("Database error finding SAML connections").WithInternalError(err)
+	}
+	for _, connection := range connections {
+		if !connection.IdPInitiated {
+			continue
+		}
+		samlProvider, err := provider.NewSamlConnectionProvider(config.External.Saml, connection, a.db, instanceID)
+		if err == nil && samlProvider.ServiceProvider.IdentityProviderIssuer == strings.TrimSpace(issuer.Text()) {
+			return connection, nil
+		}
+	}
+	return nil, nil
+}
 
-	samlProvider, err := provider.NewSamlProvider(config.External.Saml, a.db, getInstanceID(ctx))
+// useSAMLAssertions records the unsolicited assertions of a connection, so
+// they can't be replayed. Assertions must say until when they are valid.
+func (a *API) useSAMLAssertions(ctx context.Context, connection *models.SAMLConnection, assertions []types.Assertion) error {
+	if len(assertions) == 0 {
+		return forbiddenError("SAML assertion is missing")
+	}
+
+	now := time.Now()
+	for _, assertion := range assertions {
+		if assertion.ID == "" {
+			return forbiddenError("SAML assertion has no ID")
+		}
+		notOnOrAfter, err := samlAssertionNotOnOrAfter(assertion)
+		if err != nil {
+			return forbiddenError("SAML assertion has an invalid NotOnOrAfter").WithInternalError(err)
+		}
+		if notOnOrAfter.IsZero() {
+			return forbiddenError("Unsolicited SAML assertions must have a NotOnOrAfter")
+		}
+		if !now.Before(notOnOrAfter) {
+			return forbiddenError("SAML assertion has expired")
+		}
+
+		if err := models.UseSAMLAssertion(a.db, getInstanceID(ctx), connection.ID, assertion.ID, notOnOrAfter); err != nil {
+			if _, ok := err.(models.SAMLAssertionReplayedError); ok {
+				return forbiddenError("SAML assertion was already used")
+			}
+			return internalServerError("Database error recording SAML assertion").WithInternalError(err)
+		}
+	}
+	return nil
+}
+
+// samlAssertionNotOnOrAfter returns the earliest NotOnOrAfter of the
+// conditions and the subject confirmation of the assertion
+func samlAssertionNotOnOrAfter(assertion types.Assertion) (time.Time, error) {
+	values := []string{}
+	if assertion.Conditions != nil {
+		values = append(values, assertion.Conditions.NotOnOrAfter)
+	}
+	if assertion.Subject != nil && assertion.Subject.SubjectConfirmation != nil && assertion.Subject.SubjectConfirmation.SubjectConfirmationData != nil {
+		values = append(values, assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter)
+	}
+
+	var notOnOrAfter time.Time
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if notOnOrAfter.IsZero() || t.Before(notOnOrAfter) {
+			notOnOrAfter = t
+		}
+	}
+	return notOnOrAfter, nil
+}
+
+// samlSession identifies the session at the identity provider a user signed
+// in with, which is recorded for single logout, and holds the attributes
+// mapped to the user
+type samlSession struct {
+	connectionID *uuid.UUID
+	nameID       string
+	sessionIndex string
+	attributes   *samlAttributes
+}
+
+// samlAttributes are the fields of the user mapped from the attributes of an
+// assertion. Attributes with several values are mapped to lists.
+type samlAttributes struct {
+	email        string
+	userMetadata map[string]interface{}
+	appMetadata  map[string]interface{}
+	role         string
+}
+
+// mapSAMLAttributes applies the rules of the mapping to the attributes of an
+// assertion
+func mapSAMLAttributes(mapping *conf.SamlAttributeMapping, values saml2.Values) *samlAttributes {
+	attributes := &samlAttributes{
+		userMetadata: map[string]interface{}{},
+		appMetadata:  map[string]interface{}{},
+	}
+
+	if email := samlAttributeValues(values, mapping.Email); len(email) > 0 {
+		attributes.email = email[0]
+	}
+	for key, name := range mapping.UserMetadata {
+		if v := samlAttributeValue(values, name); v != nil {
+			attributes.userMetadata[key] = v
+		}
+	}
+	for key, name := range mapping.AppMetadata {
+		if v := samlAttributeValue(values, name); v != nil {
+			attributes.appMetadata[key] = v
+		}
+	}
+
+	if role := samlAttributeValues(values, mapping.Role); len(role) > 0 {
+		attributes.role = role[0]
+		return attributes
+	}
+	groups := samlAttributeValues(values, mapping.Groups)
+	for _, rule := range mapping.GroupRoles {
+		for _, group := range groups {
+			if group == rule.Group {
+				attributes.role = rule.Role
+				return attributes
+			}
+		}
+	}
+	attributes.role = mapping.DefaultRole
+	return attributes
+}
+
+// samlAttributeValues returns the non-empty values of the attribute
+func samlAttributeValues(values saml2.Values, name string) []string {
+	if name == "" {
+		return nil
+	}
+	attribute, ok := values[name]
+	if !ok {
+		return nil
+	}
+	result := []string{}
+	for _, v := range attribute.Values {
+		if v.Value != "" {
+			result = append(result, v.Value)
+		}
+	}
+	return result
+}
+
+// samlAttributeValue returns the value of the attribute, or the list of its
+// values if it has several
+func samlAttributeValue(values saml2.Values, name string) interface{} {
+	v := samlAttributeValues(values, name)
+	switch len(v) {
+	case 0:
+		return nil
+	case 1:
+		return v[0]
+	default:
+		return v
+	}
+}
+
+// isAdminRole checks if users with the role are admins of the instance or
+// its API
+func isAdminRole(config *conf.Configuration, role string) bool {
+	if role == config.JWT.AdminGroupName {
+		return true
+	}
+	for _, adminRole := range config.JWT.AdminRoles {
+		if role == adminRole {
+			return true
+		}
+	}
+	return false
+}
+
+// applySAMLAttributes updates the user with the attributes of the assertion
+// the user signed in with, so the identity provider stays the source of
+// their metadata and role
+func applySAMLAttributes(tx *storage.Connection, user *models.User, attributes *samlAttributes) error {
+	if len(attributes.userMetadata) > 0 {
+		if err := user.UpdateUserMetaData(tx, attributes.userMetadata); err != nil {
+			return internalServerError("Error updating user").WithInternalError(err)
+		}
+	}
+	if len(attributes.appMetadata) > 0 {
+		if err := user.UpdateAppMetaData(tx, attributes.appMetadata); err != nil {
+			return internalServerError("Error updating user").WithInternalError(err)
+		}
+	}
+	if attributes.role != "" && attributes.role != user.Role {
+		if err := user.SetRole(tx, attributes.role); err != nil {
+			return internalServerError("Error updating user").WithInternalError(err)
+		}
+	}
+	return nil
+}
+
+// loadSAMLProvider creates the provider of the SAML connection, or of the
+// instance's identity provider if connectionID is nil
+func (a *API) loadSAMLProvider(ctx context.Context, connectionID uuid.UUID) (*provider.SamlProvider, *models.SAMLConnection, error) {
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	if connectionID == uuid.Nil {
+		samlProvider, err := provider.NewSamlProvider(config.External.Saml, a.db, instanceID)
+		if err != nil {
+			return nil, nil, badRequestError("Could not initialize SAML provider: %+v", err).WithInternalError(err)
+		}
+		return samlProvider, nil, nil
+	}
+
+	connection, err := models.FindSAMLConnectionByID(a.db, instanceID, connectionID)
 	if err != nil {
-		return nil, badRequestError("Could not initialize SAML provider: %+v", err).WithInternalError(err)
+		if models.IsNotFoundError(err) {
+			return nil, nil, notFoundError("SAML connection not found")
+		}
+		return nil, nil, internalServerError("Database error finding SAML connection").WithInternalError(err)
+	}
+	samlProvider, err := provider.NewSamlConnectionProvider(config.External.Saml, connection, a.db, instanceID)
+	if err != nil {
+		return nil, nil, badRequestError("Could not initialize SAML provider: %+v", err).WithInternalError(err)
+	}
+	return samlProvider, connection, nil
+}
+
+// findSAMLProviderByIssuer finds the identity provider of the instance or
+// of one of its connections with the entity id
+func (a *API) findSAMLProviderByIssuer(ctx context.Context, issuer string) (*provider.SamlProvider, *models.SAMLConnection, error) {
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	if config.External.Saml.Enabled && config.External.Saml.MetadataURL != "" {
+		samlProvider, err := provider.NewSamlProvider(config.External.Saml, a.db, instanceID)
+		if err == nil && samlProvider.ServiceProvider.IdentityProviderIssuer == issuer {
+			return samlProvider, nil, nil
+		}
+	}
+
+	connections, err := models.FindSAMLConnections(a.db, instanceID)
+	if err != nil {
+		return nil, nil, internalServerError("Database error finding SAML connections").WithInternalError(err)
+	}
+	for _, connection := range connections {
+		samlProvider, err := provider.NewSamlConnectionProvider(config.External.Saml, connection, a.db, instanceID)
+		if err == nil && samlProvider.ServiceProvider.IdentityProviderIssuer == issuer {
+			return samlProvider, connection, nil
+		}
+	}
+	return nil, nil, badRequestError("Unknown SAML identity provider %s", issuer)
+}
+
+func (a *API) samlCallback(r *http.Request, ctx context.Context) (*provider.UserProvidedData, *samlSession, error) {
+	// users that signed in through a SAML connection are sent back with
+	// its id in the RelayState
+	config := a.getConfig(ctx)
+	samlProvider, connection, err := a.loadSAMLProvider(ctx, getSAMLConnectionID(ctx))
+	if err != nil {
+		return nil, nil, err
 	}
 
 	samlResponse := r.FormValue("SAMLResponse")
 	if samlResponse == "" {
-		return nil, badRequestError("SAML Response is missing")
+		return nil, nil, badRequestError("SAML Response is missing")
 	}
 
 	assertionInfo, err := samlProvider.ServiceProvider.RetrieveAssertionInfo(samlResponse)
 	if err != nil {
-		return nil, internalServerError("Parsing SAML assertion failed: %+v", err).WithInternalError(err)
+		return nil, nil, internalServerError("Parsing SAML assertion failed: %+v", err).WithInternalError(err)
 	}
 
 	if assertionInfo.WarningInfo.InvalidTime {
-		return nil, forbiddenError("SAML response has invalid time")
+		return nil, nil, forbiddenError("SAML response has invalid time")
 	}
 
 	if assertionInfo.WarningInfo.NotInAudience {
-		return nil, forbiddenError("SAML response is not in audience")
+		return nil, nil, forbiddenError("SAML response is not in audience")
 	}
 
 	if assertionInfo == nil {
-		return nil, internalServerError("SAML Assertion is missing")
+		return nil, nil, internalServerError("SAML Assertion is missing")
+	}
+
+	if isSAMLIdPInitiated(ctx) {
+		if connection == nil || !connection.IdPInitiated {
+			return nil, nil, forbiddenError("SAML connection does not allow IdP initiated sign ins")
+		}
+		if err := a.useSAMLAssertions(ctx, connection, assertionInfo.Assertions); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	mapping := &config.External.Saml.AttributeMapping
+	if connection != nil {
+		connectionMapping, err := connection.Mapping()
+		if err != nil {
+			return nil, nil, internalServerError("Invalid SAML attribute mapping").WithInternalError(err)
+		}
+		if !connectionMapping.IsEmpty() {
+			mapping = connectionMapping
+		}
 	}
+	attributes := mapSAMLAttributes(mapping, assertionInfo.Values)
+	if attributes.role != "" && isAdminRole(config, attributes.role) {
+		getLogEntry(r).WithField("role", attributes.role).Warn("Ignoring admin role of SAML assertion")
+		attributes.role = mapping.DefaultRole
+	}
+
+	email := assertionInfo.NameID
+	if attributes.email != "" {
+		email = attributes.email
+	}
+	if connection != nil && !connection.AllowsEmail(email) {
+		return nil, nil, forbiddenError("Email domain is not allowed by the SAML connection")
+	}
+
+	metadata := make(map[string]string)
+	for key, value := range attributes.userMetadata {
+		switch v := value.(type) {
+		case string:
+			metadata[key] = v
+		case []string:
+			metadata[key] = v[0]
+		}
+	}
+
 	userData := &provider.UserProvidedData{
 		Emails: []provider.Email{{
-			Email:    assertionInfo.NameID,
+			Email:    email,
 			Verified: true,
 		}},
+		Metadata: metadata,
+	}
+	session := &samlSession{
+		nameID:       assertionInfo.NameID,
+		sessionIndex: assertionInfo.SessionIndex,
+		attributes:   attributes,
 	}
-	return userData, nil
+	if connection != nil {
+		// NameIDs are only unique at one identity provider
+		userData.SetProviderID(connection.ID.String() + ":" + assertionInfo.NameID)
+		session.connectionID = &connection.ID
+	}
+	return userData, session, nil
 }
 
 func (a *API) SAMLMetadata(w http.ResponseWriter, r *http.Request) error {
@@ -70,3 +443,115 @@ func (a *API) SAMLMetadata(w http.ResponseWriter, r *http.Request) error {
 	w.Write(metadata)
 	return nil
 }
+
+// SAMLSingleLogout receives the logout messages of identity providers. A
+// LogoutRequest revokes the sessions the user signed in to through the
+// identity provider, and a LogoutResponse ends a logout started by GoTrue.
+func (a *API) SAMLSingleLogout(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	msg, err := provider.ParseLogoutMessage(r)
+	if err != nil {
+		return badRequestError("Invalid SAML logout message: %v", err)
+	}
+
+	samlProvider, connection, err := a.findSAMLProviderByIssuer(ctx, msg.Issuer)
+	if err != nil {
+		return err
+	}
+	if err := samlProvider.ValidateLogoutMessage(msg); err != nil {
+		return forbiddenError("Invalid SAML logout message").WithInternalError(err)
+	}
+
+	if msg.IsResponse {
+		if msg.Status != provider.SAMLStatusSuccess {
+			getLogEntry(r).WithField("status", msg.Status).Warn("SAML identity provider failed to log out user")
+		}
+		redirectURL := config.SiteURL
+		if isRedirectURLValid(config, msg.RelayState) {
+			redirectURL = msg.RelayState
+		}
+		http.Redirect(w, r, redirectURL, http.StatusFound)
+		return nil
+	}
+
+	var connectionID *uuid.UUID
+	if connection != nil {
+		connectionID = &connection.ID
+	}
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		sessions, terr := models.FindSessionsBySAMLNameID(tx, instanceID, connectionID, msg.NameID, msg.SessionIndexes)
+		if terr != nil {
+			return terr
+		}
+		for _, session := range sessions {
+			user, terr := models.FindUserByInstanceIDAndID(tx, instanceID, session.UserID)
+			if terr != nil {
+				return terr
+			}
+			if terr := models.NewAuditLogEntry(tx, instanceID, user, models.LogoutAction, map[string]interface{}{
+				"session_id": session.ID,
+				"provider":   "saml",
+			}); terr != nil {
+				return terr
+			}
+			if terr := session.Logout(tx); terr != nil {
+				return terr
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return internalServerError("Error logging out SAML sessions").WithInternalError(err)
+	}
+
+	switch {
+	case samlProvider.SLOURL == "":
+		w.WriteHeader(http.StatusNoContent)
+	case samlProvider.IsSLORedirectBinding():
+		responseURL, err := samlProvider.LogoutResponseURL(msg.ID, msg.RelayState)
+		if err != nil {
+			return internalServerError("Error creating SAML logout response").WithInternalError(err)
+		}
+		http.Redirect(w, r, responseURL, http.StatusFound)
+	default:
+		form, err := samlProvider.LogoutResponseForm(msg.ID, msg.RelayState)
+		if err != nil {
+			return internalServerError("Error creating SAML logout response").WithInternalError(err)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(form)
+	}
+	return nil
+}
+
+// samlLogoutURL returns the URL that ends the session at the SAML identity
+// provider the session was signed in through, if the identity provider
+// supports single logout
+func (a *API) samlLogoutURL(r *http.Request, session *models.Session) (string, error) {
+	if session.SAMLNameID == "" {
+		return "", nil
+	}
+
+	connectionID := uuid.Nil
+	if session.SAMLConnectionID != nil {
+		connectionID = *session.SAMLConnectionID
+	}
+	samlProvider, _, err := a.loadSAMLProvider(r.Context(), connectionID)
+	if err != nil {
+		return "", err
+	}
+	if !samlProvider.IsSLORedirectBinding() {
+		return "", nil
+	}
+
+	redirectURL := a.getRedirectURLOrReferrer(r, r.URL.Query().Get("redirect_to"))
+	logoutURL, err := samlProvider.LogoutRequestURL(session.SAMLNameID, session.SAMLSessionIndex, redirectURL)
+	if err != nil {
+		return "", internalServerError("Error creating SAML logout request").WithInternalError(err)
+	}
+	return logoutURL, nil
+}
@@ -1,16 +1,29 @@
 package api
 
 import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"encoding/xml"
+	"html"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -68,6 +81,10 @@ func (ts *ExternalSamlTestSuite) docFromTemplate(path string, data interface{})
 }
 
 func (ts *ExternalSamlTestSuite) setupSamlExampleResponse(keyStore dsig.X509KeyStore) string {
+	return ts.signSamlResponse(ts.setupSamlExampleResponseDoc(), keyStore)
+}
+
+func (ts *ExternalSamlTestSuite) setupSamlExampleResponseDoc() *etree.Document {
 	path := filepath.Join("testdata", "saml-response.xml")
 	type ResponseParams struct {
 		Now       string
@@ -80,7 +97,10 @@ func (ts *ExternalSamlTestSuite) setupSamlExampleResponse(keyStore dsig.X509KeyS
 		NotBefore: now.Add(-5 * time.Minute).Format(time.RFC3339),
 		NotAfter:  now.Add(5 * time.Minute).Format(time.RFC3339),
 	})
+	return doc
+}
 
+func (ts *ExternalSamlTestSuite) signSamlResponse(doc *etree.Document, keyStore dsig.X509KeyStore) string {
 	// sign
 	resp := doc.SelectElement("Response")
 	ctx := dsig.NewDefaultSigningContext(keyStore)
@@ -217,3 +237,352 @@ func (ts *ExternalSamlTestSuite) TestMetadata() {
 		}
 	}
 }
+
+// samlSignIn signs in through the instance's identity provider and returns
+// the tokens of the session
+func (ts *ExternalSamlTestSuite) samlSignIn(idpKeyStore dsig.X509KeyStore) url.Values {
+	form := url.Values{}
+	form.Add("RelayState", ts.setupSamlExampleState())
+	form.Add("SAMLResponse", ts.setupSamlExampleResponse(idpKeyStore))
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/saml/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err)
+	v, err := url.ParseQuery(u.Fragment)
+	ts.Require().NoError(err)
+	ts.Require().NotEmpty(v.Get("access_token"))
+	return v
+}
+
+func (ts *ExternalSamlTestSuite) setupSamlSignIn() (*httptest.Server, dsig.X509KeyStore) {
+	server, idpKeyStore := ts.setupSamlMetadata()
+	ts.Config.External.Saml.MetadataURL = server.URL
+
+	key, cert := ts.setupSamlSPCert()
+	ts.Config.External.Saml.SigningKey = key
+	ts.Config.External.Saml.SigningCert = cert
+	return server, idpKeyStore
+}
+
+func (ts *ExternalSamlTestSuite) newSamlLogoutMessage(tag string) *etree.Element {
+	el := etree.NewElement("samlp:" + tag)
+	el.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	el.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	el.CreateAttr("ID", "_idp"+tag)
+	el.CreateAttr("Version", "2.0")
+	el.CreateAttr("IssueInstant", time.Now().UTC().Format(time.RFC3339))
+	el.CreateAttr("Destination", "http://localhost/saml/slo")
+	el.CreateElement("saml:Issuer").SetText("https://idp/saml2test")
+	return el
+}
+
+func (ts *ExternalSamlTestSuite) samlUserSessions() []*models.Session {
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "saml@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+	sessions, err := models.FindSessionsByUser(ts.API.db, user)
+	ts.Require().NoError(err)
+	return sessions
+}
+
+func (ts *ExternalSamlTestSuite) TestSamlSingleLogout_IdPInitiated() {
+	server, idpKeyStore := ts.setupSamlSignIn()
+	defer server.Close()
+	ts.samlSignIn(idpKeyStore)
+	ts.Require().Len(ts.samlUserSessions(), 1)
+
+	logoutRequest := ts.newSamlLogoutMessage("LogoutRequest")
+	logoutRequest.CreateElement("saml:NameID").SetText("saml@example.com")
+	signature, err := dsig.NewDefaultSigningContext(idpKeyStore).ConstructSignature(logoutRequest, true)
+	ts.Require().NoError(err)
+	logoutRequest.Child = append([]etree.Token{logoutRequest.Child[0], signature}, logoutRequest.Child[1:]...)
+	doc := etree.NewDocument()
+	doc.SetRoot(logoutRequest)
+	raw, err := doc.WriteToBytes()
+	ts.Require().NoError(err)
+
+	form := url.Values{}
+	form.Add("SAMLRequest", base64.StdEncoding.EncodeToString(raw))
+	form.Add("RelayState", "idp-state")
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/saml/slo", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code, w.Body.String())
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err)
+	ts.Equal("https://idp/saml2test/slo", u.Scheme+"://"+u.Host+u.Path)
+	ts.NotEmpty(u.Query().Get("SAMLResponse"))
+	ts.NotEmpty(u.Query().Get("Signature"))
+	ts.Equal("idp-state", u.Query().Get("RelayState"))
+
+	ts.Empty(ts.samlUserSessions())
+}
+
+func (ts *ExternalSamlTestSuite) TestSamlSingleLogout_RequiresSignature() {
+	server, idpKeyStore := ts.setupSamlSignIn()
+	defer server.Close()
+	ts.samlSignIn(idpKeyStore)
+
+	logoutRequest := ts.newSamlLogoutMessage("LogoutRequest")
+	logoutRequest.CreateElement("saml:NameID").SetText("saml@example.com")
+	doc := etree.NewDocument()
+	doc.SetRoot(logoutRequest)
+	raw, err := doc.WriteToBytes()
+	ts.Require().NoError(err)
+
+	form := url.Values{}
+	form.Add("SAMLRequest", base64.StdEncoding.EncodeToString(raw))
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/saml/slo", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Equal(http.StatusForbidden, w.Code)
+
+	ts.Len(ts.samlUserSessions(), 1)
+}
+
+func (ts *ExternalSamlTestSuite) TestSamlSingleLogout_SPInitiated() {
+	server, idpKeyStore := ts.setupSamlSignIn()
+	defer server.Close()
+	tokens := ts.samlSignIn(idpKeyStore)
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Get("access_token"))
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	data := map[string]string{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(&data))
+	ts.Empty(ts.samlUserSessions())
+
+	u, err := url.Parse(data["saml_logout_url"])
+	ts.Require().NoError(err)
+	ts.Equal("https://idp/saml2test/slo", u.Scheme+"://"+u.Host+u.Path)
+	deflated, err := base64.StdEncoding.DecodeString(u.Query().Get("SAMLRequest"))
+	ts.Require().NoError(err)
+	raw, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	ts.Require().NoError(err)
+	ts.Contains(string(raw), "saml@example.com")
+
+	// the identity provider responds with the redirect binding
+	logoutResponse := ts.newSamlLogoutMessage("LogoutResponse")
+	logoutResponse.CreateElement("samlp:Status").CreateElement("samlp:StatusCode").CreateAttr("Value", "urn:oasis:names:tc:SAML:2.0:status:Success")
+	doc := etree.NewDocument()
+	doc.SetRoot(logoutResponse)
+	raw, err = doc.WriteToBytes()
+	ts.Require().NoError(err)
+	var buffer bytes.Buffer
+	fw, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	ts.Require().NoError(err)
+	_, err = fw.Write(raw)
+	ts.Require().NoError(err)
+	ts.Require().NoError(fw.Close())
+
+	query := "SAMLResponse=" + url.QueryEscape(base64.StdEncoding.EncodeToString(buffer.Bytes())) +
+		"&RelayState=" + url.QueryEscape(ts.Config.SiteURL+"/logged-out") +
+		"&SigAlg=" + url.QueryEscape("http://www.w3.org/2001/04/xmldsig-more#rsa-sha256")
+	key, _, err := idpKeyStore.GetKeyPair()
+	ts.Require().NoError(err)
+	digest := sha256.Sum256([]byte(query))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	ts.Require().NoError(err)
+	query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/saml/slo?"+query, nil)
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code, w.Body.String())
+	ts.Equal(ts.Config.SiteURL+"/logged-out", w.Header().Get("Location"))
+}
+
+func (ts *ExternalSamlTestSuite) TestMetadata_EncryptionMethods() {
+	server, _ := ts.setupSamlMetadata()
+	defer server.Close()
+	ts.Config.External.Saml.MetadataURL = server.URL
+
+	key, cert := ts.setupSamlSPCert()
+	ts.Config.External.Saml.SigningKey = key
+	ts.Config.External.Saml.SigningCert = cert
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/saml/metadata", nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusOK, w.Code)
+
+	doc := etree.NewDocument()
+	ts.Require().NoError(doc.ReadFromBytes(w.Body.Bytes()))
+	kd := doc.FindElement("//KeyDescriptor[@use='encryption']")
+	ts.Require().NotNil(kd)
+	methods := []string{}
+	for _, method := range kd.SelectElements("EncryptionMethod") {
+		methods = append(methods, method.SelectAttrValue("Algorithm", ""))
+	}
+	ts.Contains(methods, "http://www.w3.org/2001/04/xmlenc#aes128-cbc")
+	ts.Contains(methods, "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p")
+}
+
+// encryptSamlAssertion replaces the assertion of the response with an
+// EncryptedAssertion for the service provider's certificate
+func (ts *ExternalSamlTestSuite) encryptSamlAssertion(doc *etree.Document, spCert string) {
+	block, _ := pem.Decode([]byte(spCert))
+	ts.Require().NotNil(block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	ts.Require().NoError(err)
+
+	resp := doc.SelectElement("Response")
+	assertion := resp.SelectElement("Assertion")
+	assertionDoc := etree.NewDocument()
+	assertionDoc.SetRoot(assertion.Copy())
+	plaintext, err := assertionDoc.WriteToBytes()
+	ts.Require().NoError(err)
+
+	key := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	_, err = rand.Read(key)
+	ts.Require().NoError(err)
+	_, err = rand.Read(iv)
+	ts.Require().NoError(err)
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	aesCipher, err := aes.NewCipher(key)
+	ts.Require().NoError(err)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(aesCipher, iv).CryptBlocks(ciphertext, plaintext)
+	encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, cert.PublicKey.(*rsa.PublicKey), key, nil)
+	ts.Require().NoError(err)
+
+	encrypted := etree.NewElement("saml2:EncryptedAssertion")
+	encrypted.CreateAttr("xmlns:saml2", "urn:oasis:names:tc:SAML:2.0:assertion")
+	data := encrypted.CreateElement("xenc:EncryptedData")
+	data.CreateAttr("xmlns:xenc", "http://www.w3.org/2001/04/xmlenc#")
+	data.CreateAttr("Type", "http://www.w3.org/2001/04/xmlenc#Element")
+	data.CreateElement("xenc:EncryptionMethod").CreateAttr("Algorithm", "http://www.w3.org/2001/04/xmlenc#aes128-cbc")
+	keyInfo := data.CreateElement("ds:KeyInfo")
+	keyInfo.CreateAttr("xmlns:ds", "http://www.w3.org/2000/09/xmldsig#")
+	ek := keyInfo.CreateElement("xenc:EncryptedKey")
+	ekMethod := ek.CreateElement("xenc:EncryptionMethod")
+	ekMethod.CreateAttr("Algorithm", "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p")
+	ekMethod.CreateElement("ds:DigestMethod").CreateAttr("Algorithm", "http://www.w3.org/2000/09/xmldsig#sha1")
+	ek.CreateElement("xenc:CipherData").CreateElement("xenc:CipherValue").SetText(base64.StdEncoding.EncodeToString(encryptedKey))
+	data.CreateElement("xenc:CipherData").CreateElement("xenc:CipherValue").SetText(base64.StdEncoding.EncodeToString(append(iv, ciphertext...)))
+
+	resp.InsertChild(assertion, encrypted)
+	resp.RemoveChild(assertion)
+}
+
+func (ts *ExternalSamlTestSuite) TestSignupExternalSaml_EncryptedAssertion() {
+	server, idpKeyStore := ts.setupSamlMetadata()
+	defer server.Close()
+	ts.Config.External.Saml.MetadataURL = server.URL
+
+	key, cert := ts.setupSamlSPCert()
+	ts.Config.External.Saml.SigningKey = key
+	ts.Config.External.Saml.SigningCert = cert
+
+	doc := ts.setupSamlExampleResponseDoc()
+	ts.encryptSamlAssertion(doc, cert)
+	ts.Require().Nil(doc.FindElement("//Assertion"))
+
+	form := url.Values{}
+	form.Add("RelayState", ts.setupSamlExampleState())
+	form.Add("SAMLResponse", ts.signSamlResponse(doc, idpKeyStore))
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/saml/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err)
+	v, err := url.ParseQuery(u.Fragment)
+	ts.Require().NoError(err)
+	ts.Empty(u.Query().Get("error_description"))
+	ts.NotEmpty(v.Get("access_token"))
+
+	_, err = models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "saml@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+}
+
+// setupSamlPOSTMetadata serves the metadata of an identity provider that
+// only offers the POST binding for AuthnRequests
+func (ts *ExternalSamlTestSuite) setupSamlPOSTMetadata() (*httptest.Server, dsig.X509KeyStore) {
+	server, idpKeyStore := ts.setupSamlMetadata()
+	res, err := http.Get(server.URL)
+	ts.Require().NoError(err)
+	metadata, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	server.Close()
+	ts.Require().NoError(err)
+
+	doc := etree.NewDocument()
+	ts.Require().NoError(doc.ReadFromBytes(metadata))
+	idp := doc.FindElement("//IDPSSODescriptor")
+	for _, service := range idp.SelectElements("SingleSignOnService") {
+		if service.SelectAttrValue("Binding", "") != "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" {
+			idp.RemoveChild(service)
+		}
+	}
+	postMetadata, err := doc.WriteToBytes()
+	ts.Require().NoError(err)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(postMetadata)
+	})), idpKeyStore
+}
+
+var samlFormValue = regexp.MustCompile(`name="(\w+)" value="([^"]*)"`)
+
+func (ts *ExternalSamlTestSuite) TestAuthorizeSaml_POSTBinding() {
+	server, idpKeyStore := ts.setupSamlPOSTMetadata()
+	defer server.Close()
+	ts.Config.External.Saml.MetadataURL = server.URL
+
+	key, cert := ts.setupSamlSPCert()
+	ts.Config.External.Saml.SigningKey = key
+	ts.Config.External.Saml.SigningCert = cert
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/authorize?provider=saml", nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	ts.Contains(w.Header().Get("Content-Type"), "text/html")
+
+	page := w.Body.String()
+	ts.Contains(page, `action="https://idp/saml2test/post"`)
+	values := map[string]string{}
+	for _, m := range samlFormValue.FindAllStringSubmatch(page, -1) {
+		values[m[1]] = html.UnescapeString(m[2])
+	}
+	ts.Require().NotEmpty(values["RelayState"])
+
+	raw, err := base64.StdEncoding.DecodeString(values["SAMLRequest"])
+	ts.Require().NoError(err)
+	doc := etree.NewDocument()
+	ts.Require().NoError(doc.ReadFromBytes(raw))
+	authnRequest := doc.SelectElement("AuthnRequest")
+	ts.Require().NotNil(authnRequest)
+	ts.Equal("https://idp/saml2test/post", authnRequest.SelectAttrValue("Destination", ""))
+	ts.NotNil(authnRequest.SelectElement("Signature"))
+
+	// the identity provider responds to the ACS with the RelayState
+	form := url.Values{}
+	form.Add("RelayState", values["RelayState"])
+	form.Add("SAMLResponse", ts.setupSamlExampleResponse(idpKeyStore))
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/saml/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err)
+	v, err := url.ParseQuery(u.Fragment)
+	ts.Require().NoError(err)
+	ts.NotEmpty(v.Get("access_token"))
+}
@@ -77,9 +77,11 @@ func performAuthorization(ts *ExternalTestSuite, provider string, code string, i
 	ts.Require().Equal(http.StatusFound, w.Code)
 	u, err := url.Parse(w.Header().Get("Location"))
 	ts.Require().NoError(err, "redirect url parse failed")
-	q := u.Query()
-	state := q.Get("state")
 
+	return performAuthorizationCallback(ts, code, u.Query().Get("state"))
+}
+
+func performAuthorizationCallback(ts *ExternalTestSuite, code string, state string) *url.URL {
 	// auth server callback
 	testURL, err := url.Parse("http://localhost/callback")
 	ts.Require().NoError(err)
@@ -88,10 +90,10 @@ func performAuthorization(ts *ExternalTestSuite, provider string, code string, i
 	v.Set("state", state)
 	testURL.RawQuery = v.Encode()
 	req := httptest.NewRequest(http.MethodGet, testURL.String(), nil)
-	w = httptest.NewRecorder()
+	w := httptest.NewRecorder()
 	ts.API.handler.ServeHTTP(w, req)
 	ts.Require().Equal(http.StatusFound, w.Code)
-	u, err = url.Parse(w.Header().Get("Location"))
+	u, err := url.Parse(w.Header().Get("Location"))
 	ts.Require().NoError(err, "redirect url parse failed")
 	ts.Require().Equal("/admin", u.Path)
 
@@ -118,6 +120,8 @@ func assertAuthorizationSuccess(ts *ExternalTestSuite, u *url.URL, tokenCount in
 	ts.Require().NoError(err)
 	ts.Equal(name, user.UserMetaData["full_name"])
 	ts.Equal(avatar, user.UserMetaData["avatar_url"])
+	// the provider id is only stored on the identity
+	ts.NotContains(user.UserMetaData, "provider_id")
 }
 
 func assertAuthorizationFailure(ts *ExternalTestSuite, u *url.URL, errorDescription string, errorType string, email string) {
@@ -0,0 +1,440 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/api/provider"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+	"golang.org/x/oauth2"
+)
+
+// linkingNonceCookie holds a nonce binding a link to the browser that started
+// it, so the state of a link handed to someone else can't link their account.
+const linkingNonceCookie = "gotrue-linking-nonce"
+
+// setLinkingNonceCookie stores a new nonce in the browser and returns its
+// hash for the state
+func setLinkingNonceCookie(w http.ResponseWriter) string {
+	nonce := crypto.SecureToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:  linkingNonceCookie,
+		Value: nonce,
+		// the state expires after 5 minutes
+		MaxAge:   300,
+		Secure:   true,
+		HttpOnly: true,
+		// identity providers may post their response to the callback
+		SameSite: http.SameSiteNoneMode,
+		Path:     "/",
+	})
+	return hashLinkingNonce(nonce)
+}
+
+// checkLinkingNonceCookie checks that the nonce of the browser matches the
+// hash of the state, clearing the cookie
+func checkLinkingNonceCookie(w http.ResponseWriter, r *http.Request, hash string) bool {
+	cookie, err := r.Cookie(linkingNonceCookie)
+	if err != nil || hash == "" {
+		return false
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     linkingNonceCookie,
+		Value:    "",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+		Path:     "/",
+	})
+	return subtle.ConstantTimeCompare([]byte(hashLinkingNonce(cookie.Value)), []byte(hash)) == 1
+}
+
+func hashLinkingNonce(nonce string) string {
+	hash := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(hash[:])
+}
+
+// primaryEmail returns the primary email of a provider account, or the first
+// one if none is marked as primary
+func primaryEmail(userData *provider.UserProvidedData) provider.Email {
+	for _, e := range userData.Emails {
+		if e.Primary {
+			return e
+		}
+	}
+	if len(userData.Emails) > 0 {
+		return userData.Emails[0]
+	}
+	return provider.Email{}
+}
+
+// userEmail returns the email of a provider account that matches the email
+// of the user, falling back to the primary email
+func userEmail(user *models.User, userData *provider.UserProvidedData) provider.Email {
+	for _, e := range userData.Emails {
+		if strings.EqualFold(e.Email, user.Email) {
+			return e
+		}
+	}
+	return primaryEmail(userData)
+}
+
+// externalProviderID returns the key of the identity of a provider account.
+// Accounts of providers that don't return a stable id are keyed by email.
+func externalProviderID(userData *provider.UserProvidedData) string {
+	if id := userData.ProviderID(); id != "" {
+		return id
+	}
+	return strings.ToLower(primaryEmail(userData).Email)
+}
+
+// findUserByIdentity finds the user linked to the account at the provider. The
+// identity of a deleted user is removed, so the account is linked again.
+func findUserByIdentity(tx *storage.Connection, instanceID uuid.UUID, providerType string, userData *provider.UserProvidedData) (*models.User, error) {
+	identity, err := models.FindIdentityByProviderID(tx, instanceID, providerType, externalProviderID(userData))
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, internalServerError("Database error finding identity").WithInternalError(err)
+	}
+
+	user, err := models.FindUserByInstanceIDAndID(tx, instanceID, identity.UserID)
+	if err != nil {
+		if !models.IsNotFoundError(err) {
+			return nil, internalServerError("Database error finding user").WithInternalError(err)
+		}
+		if err := tx.Destroy(identity); err != nil {
+			return nil, internalServerError("Database error deleting identity").WithInternalError(err)
+		}
+		return nil, nil
+	}
+	return user, nil
+}
+
+func newIdentityData(userData *provider.UserProvidedData) map[string]interface{} {
+	data := make(map[string]interface{})
+	for k, v := range userData.Metadata {
+		if v != "" {
+			data[k] = v
+		}
+	}
+	if email := primaryEmail(userData).Email; email != "" {
+		data["email"] = email
+	}
+	return data
+}
+
+// linkIdentity links a provider account to the user. Accounts can only be
+// linked to one user.
+func (a *API) linkIdentity(tx *storage.Connection, user *models.User, providerType string, userData *provider.UserProvidedData) (*models.Identity, error) {
+	providerID := externalProviderID(userData)
+	if providerID == "" {
+		return nil, badRequestError("Unable to identify the account at %s", providerType)
+	}
+
+	identity, err := models.FindIdentityByProviderID(tx, user.InstanceID, providerType, providerID)
+	if err != nil && !models.IsNotFoundError(err) {
+		return nil, internalServerError("Database error finding identity").WithInternalError(err)
+	}
+	if identity != nil {
+		if identity.UserID != user.ID {
+			return nil, badRequestError("This %s account is already linked to another user", providerType)
+		}
+		if err := identity.UpdateSignIn(tx, newIdentityData(userData)); err != nil {
+			return nil, internalServerError("Database error updating identity").WithInternalError(err)
+		}
+		return identity, nil
+	}
+
+	identity, err = models.NewIdentity(user, providerType, providerID, newIdentityData(userData))
+	if err != nil {
+		return nil, internalServerError("Error creating identity").WithInternalError(err)
+	}
+	if err := tx.Create(identity); err != nil {
+		return nil, internalServerError("Database error saving identity").WithInternalError(err)
+	}
+	if err := user.UpdateProviders(tx); err != nil {
+		return nil, internalServerError("Database error updating user").WithInternalError(err)
+	}
+	return identity, nil
+}
+
+// ProviderTokenResponse is the provider access token of an identity
+type ProviderTokenResponse struct {
+	ProviderToken string `json:"provider_token"`
+	ExpiresIn     int    `json:"expires_in,omitempty"`
+}
+
+// saveProviderToken stores the token the provider issued with the identity
+// of the account. Only OAuth2 providers issue tokens that are stored.
+func (a *API) saveProviderToken(ctx context.Context, tx *storage.Connection, instanceID uuid.UUID, providerType string, userData *provider.UserProvidedData, token *oauth2.Token) error {
+	if token == nil || token.AccessToken == "" {
+		return nil
+	}
+
+	identity, err := models.FindIdentityByProviderID(tx, instanceID, providerType, externalProviderID(userData))
+	if err != nil {
+		return internalServerError("Database error finding identity").WithInternalError(err)
+	}
+	return a.updateProviderToken(ctx, tx, identity, token)
+}
+
+func (a *API) updateProviderToken(ctx context.Context, tx *storage.Connection, identity *models.Identity, token *oauth2.Token) error {
+	config := a.getConfig(ctx)
+
+	var expiresAt *time.Time
+	if !token.Expiry.IsZero() {
+		expiresAt = &token.Expiry
+	}
+	if err := identity.UpdateProviderToken(tx, config.External.TokenEncryptionKey, token.AccessToken, token.RefreshToken, expiresAt); err != nil {
+		return internalServerError("Database error saving provider token").WithInternalError(err)
+	}
+	return nil
+}
+
+// processIdentityLink links a provider account to the user that requested it
+// through /user/identities/authorize
+func (a *API) processIdentityLink(ctx context.Context, tx *storage.Connection, userData *provider.UserProvidedData, instanceID, userID uuid.UUID, providerType string) error {
+	user, err := models.FindUserByInstanceIDAndID(tx, instanceID, userID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError(err.Error())
+		}
+		return internalServerError("Database error finding user").WithInternalError(err)
+	}
+
+	identity, err := a.linkIdentity(tx, user, providerType, userData)
+	if err != nil {
+		return err
+	}
+
+	if err := models.NewAuditLogEntry(tx, instanceID, user, models.IdentityLinkedAction, map[string]interface{}{
+		"identity_id": identity.ID,
+		"provider":    providerType,
+	}); err != nil {
+		return err
+	}
+
+	if !user.IsAnonymous {
+		return nil
+	}
+	// the guest takes the verified email of the account
+	if emailData := primaryEmail(userData); user.Email == "" && emailData.Email != "" && emailData.Verified {
+		exists, err := models.IsDuplicatedEmail(tx, instanceID, emailData.Email, user.Aud)
+		if err != nil {
+			return internalServerError("Database error checking email").WithInternalError(err)
+		}
+		if exists {
+			return unprocessableEntityError("Email address already registered by another user")
+		}
+		if err := user.SetEmail(tx, strings.ToLower(emailData.Email)); err != nil {
+			return internalServerError("Database error updating user").WithInternalError(err)
+		}
+		if err := user.Confirm(tx); err != nil {
+			return internalServerError("Database error updating user").WithInternalError(err)
+		}
+	}
+	return a.upgradeAnonymousUser(ctx, tx, user, providerType)
+}
+
+// UserIdentities lists the provider accounts linked to the authenticated user
+func (a *API) UserIdentities(w http.ResponseWriter, r *http.Request) error {
+	user, err := getUserFromClaims(r.Context(), a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+
+	identities, err := models.FindIdentitiesByUser(a.db, user)
+	if err != nil {
+		return internalServerError("Database error finding identities").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, identities)
+}
+
+// UserIdentityAuthorize returns the URL the authenticated user visits to link
+// an account of the provider to their user
+func (a *API) UserIdentityAuthorize(w http.ResponseWriter, r *http.Request) error {
+	user, err := getUserFromClaims(r.Context(), a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+
+	authURL, authForm, err := a.getExternalProviderAuthURL(w, r, user.ID.String())
+	if err != nil {
+		return err
+	}
+	if authForm != nil {
+		return badRequestError("The identity provider only accepts sign ins posted with the HTTP-POST binding")
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]string{
+		"url": authURL,
+	})
+}
+
+// UserIdentityDelete unlinks a provider account from the authenticated user.
+// The user must be left with another way to sign in.
+func (a *API) UserIdentityDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+
+	user, err := getUserFromClaims(ctx, a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+
+	identityID, err := uuid.FromString(chi.URLParam(r, "identity_id"))
+	if err != nil {
+		return badRequestError("identity_id must be an UUID")
+	}
+
+	logEntrySetField(r, "identity_id", identityID)
+
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		identity, terr := models.FindIdentityByUserAndID(tx, user, identityID)
+		if terr != nil {
+			if models.IsNotFoundError(terr) {
+				return notFoundError("Identity not found")
+			}
+			return internalServerError("Database error finding identity").WithInternalError(terr)
+		}
+
+		canSignIn, terr := a.canSignInWithoutIdentity(ctx, tx, user)
+		if terr != nil {
+			return terr
+		}
+		if !canSignIn {
+			return unprocessableEntityError("The last sign in method of a user can't be removed")
+		}
+
+		if terr := models.NewAuditLogEntry(tx, instanceID, user, models.IdentityUnlinkedAction, map[string]interface{}{
+			"identity_id": identity.ID,
+			"provider":    identity.Provider,
+		}); terr != nil {
+			return terr
+		}
+		if terr := tx.Destroy(identity); terr != nil {
+			return internalServerError("Database error deleting identity").WithInternalError(terr)
+		}
+		if terr := user.UpdateProviders(tx); terr != nil {
+			return internalServerError("Database error updating user").WithInternalError(terr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// canSignInWithoutIdentity checks if the user has another way to sign in
+// than the identity that is removed: another identity, a password, a
+// confirmed phone number or a passkey.
+func (a *API) canSignInWithoutIdentity(ctx context.Context, tx *storage.Connection, user *models.User) (bool, error) {
+	config := a.getConfig(ctx)
+
+	identities, err := models.FindIdentitiesByUser(tx, user)
+	if err != nil {
+		return false, internalServerError("Database error finding identities").WithInternalError(err)
+	}
+	if len(identities) > 1 || user.HasPassword() {
+		return true, nil
+	}
+	if config.External.Phone.Enabled && user.Phone != "" && user.IsPhoneConfirmed() {
+		return true, nil
+	}
+	if config.WebAuthn.Enabled {
+		credentials, err := models.FindWebAuthnCredentialsByUser(tx, user)
+		if err != nil {
+			return false, internalServerError("Database error finding webauthn credentials").WithInternalError(err)
+		}
+		return len(credentials) > 0, nil
+	}
+	return false, nil
+}
+
+// UserIdentityToken returns the provider access token of an identity of the
+// authenticated user, refreshing it with the provider if it expired
+func (a *API) UserIdentityToken(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+
+	user, err := getUserFromClaims(ctx, a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+
+	identityID, err := uuid.FromString(chi.URLParam(r, "identity_id"))
+	if err != nil {
+		return badRequestError("identity_id must be an UUID")
+	}
+
+	logEntrySetField(r, "identity_id", identityID)
+
+	identity, err := models.FindIdentityByUserAndID(a.db, user, identityID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError("Identity not found")
+		}
+		return internalServerError("Database error finding identity").WithInternalError(err)
+	}
+
+	accessToken, refreshToken, err := identity.ProviderToken(config.External.TokenEncryptionKey)
+	if err != nil {
+		return internalServerError("Error decrypting provider token").WithInternalError(err)
+	}
+	if accessToken == "" {
+		return notFoundError("No provider token stored for this identity")
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}
+	if identity.ProviderTokenExpiresAt != nil {
+		token.Expiry = *identity.ProviderTokenExpiresAt
+	}
+
+	if !token.Valid() {
+		if refreshToken == "" {
+			return unprocessableEntityError("The provider token expired and can't be refreshed")
+		}
+
+		p, err := a.Provider(ctx, identity.Provider, "")
+		if err != nil {
+			return badRequestError("Unsupported provider: %+v", err).WithInternalError(err)
+		}
+		refresher, ok := p.(provider.TokenRefresher)
+		if !ok {
+			return unprocessableEntityError("The provider token expired and can't be refreshed")
+		}
+
+		token, err = refresher.TokenSource(ctx, token).Token()
+		if err != nil {
+			return internalServerError("Error refreshing provider token").WithInternalError(err)
+		}
+		if err := a.updateProviderToken(ctx, a.db, identity, token); err != nil {
+			return err
+		}
+	}
+
+	response := &ProviderTokenResponse{ProviderToken: token.AccessToken}
+	if !token.Expiry.IsZero() {
+		response.ExpiresIn = int(time.Until(token.Expiry).Seconds())
+	}
+	return sendJSON(w, http.StatusOK, response)
+}
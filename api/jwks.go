@@ -0,0 +1,275 @@
+package api
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+)
+
+// jwtKey is a key tokens are signed or verified with
+type jwtKey struct {
+	ID     string
+	Method jwt.SigningMethod
+	Key    interface{}
+}
+
+// newJWTKey parses the secret or PEM encoded private key for alg. Unless
+// provided, asymmetric keys are identified by their RFC 7638 thumbprint.
+func newJWTKey(alg, material, kid string) (*jwtKey, error) {
+	k := &jwtKey{ID: kid}
+
+	switch alg {
+	case "", jwt.SigningMethodHS256.Alg():
+		k.Method = jwt.SigningMethodHS256
+		k.Key = []byte(material)
+		return k, nil
+	case jwt.SigningMethodRS256.Alg():
+		key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(material))
+		if err != nil {
+			return nil, err
+		}
+		k.Method = jwt.SigningMethodRS256
+		k.Key = key
+	case jwt.SigningMethodES256.Alg():
+		key, err := jwt.ParseECPrivateKeyFromPEM([]byte(material))
+		if err != nil {
+			return nil, err
+		}
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ES256 requires a P-256 key")
+		}
+		k.Method = jwt.SigningMethodES256
+		k.Key = key
+	default:
+		return nil, fmt.Errorf("Unsupported JWT algorithm: %s", alg)
+	}
+
+	if k.ID == "" {
+		thumbprint, err := keyThumbprint(k.Key)
+		if err != nil {
+			return nil, err
+		}
+		k.ID = thumbprint
+	}
+	return k, nil
+}
+
+// configSigningKey returns the key configured with JWT_ALGORITHM
+func configSigningKey(config *conf.JWTConfiguration) (*jwtKey, error) {
+	if config.Algorithm == "" || config.Algorithm == jwt.SigningMethodHS256.Alg() {
+		return newJWTKey(config.Algorithm, config.Secret, config.KeyID)
+	}
+	return newJWTKey(config.Algorithm, config.PrivateKey, config.KeyID)
+}
+
+func keyThumbprint(key interface{}) (string, error) {
+	k, err := jwk.New(key)
+	if err != nil {
+		return "", err
+	}
+	thumbprint, err := k.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// verificationKey returns the public half of asymmetric keys
+func (k *jwtKey) verificationKey() interface{} {
+	switch key := k.Key.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey
+	case *ecdsa.PrivateKey:
+		return &key.PublicKey
+	default:
+		return k.Key
+	}
+}
+
+func (k *jwtKey) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.Method, claims)
+	if k.ID != "" {
+		token.Header["kid"] = k.ID
+	}
+	return token.SignedString(k.Key)
+}
+
+// keySet holds the keys tokens are verified with, of which exactly one is
+// used for signing.
+type keySet struct {
+	signing *jwtKey
+	keys    []*jwtKey
+}
+
+// loadKeySet returns the keys of the instance. Until a key has been rotated
+// in, the configured key is the only one.
+func (a *API) loadKeySet(ctx context.Context, conn *storage.Connection) (*keySet, error) {
+	config := a.getConfig(ctx)
+
+	stored, err := models.FindActiveSigningKeys(conn, getInstanceID(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if len(stored) == 0 {
+		key, err := configSigningKey(&config.JWT)
+		if err != nil {
+			return nil, err
+		}
+		return &keySet{signing: key, keys: []*jwtKey{key}}, nil
+	}
+
+	set := &keySet{}
+	for _, s := range stored {
+		if err := s.EncryptLegacyMaterial(conn, config.JWT.KeyEncryptionKey); err != nil {
+			return nil, err
+		}
+		material, err := s.Material(config.JWT.KeyEncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		key, err := newJWTKey(s.Algorithm, material, s.KeyID)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading signing key %s: %v", s.KeyID, err)
+		}
+		if s.IsSigning() {
+			set.signing = key
+		}
+		set.keys = append(set.keys, key)
+	}
+	if set.signing == nil {
+		return nil, fmt.Errorf("No active signing key")
+	}
+	return set, nil
+}
+
+// loadSecretKeySet returns the HS256 keys used for tokens GoTrue verifies
+// itself, like the OAuth state and the operator signature. The configured
+// secret is used until an HS256 key has been rotated in.
+func (a *API) loadSecretKeySet(ctx context.Context, conn *storage.Connection) (*keySet, error) {
+	config := a.getConfig(ctx)
+
+	stored, err := models.FindActiveSigningKeys(conn, getInstanceID(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	set := &keySet{}
+	for _, s := range stored {
+		if s.Algorithm != jwt.SigningMethodHS256.Alg() {
+			continue
+		}
+		if err := s.EncryptLegacyMaterial(conn, config.JWT.KeyEncryptionKey); err != nil {
+			return nil, err
+		}
+		material, err := s.Material(config.JWT.KeyEncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		key := &jwtKey{ID: s.KeyID, Method: jwt.SigningMethodHS256, Key: []byte(material)}
+		if set.signing == nil || s.IsSigning() {
+			set.signing = key
+		}
+		set.keys = append(set.keys, key)
+	}
+	if set.signing == nil {
+		key := &jwtKey{Method: jwt.SigningMethodHS256, Key: []byte(config.JWT.Secret)}
+		return &keySet{signing: key, keys: []*jwtKey{key}}, nil
+	}
+	return set, nil
+}
+
+// sign signs claims with the signing key
+func (s *keySet) sign(claims jwt.Claims) (string, error) {
+	return s.signing.sign(claims)
+}
+
+// parse verifies a token with the key matching its kid. Tokens without a kid
+// are tried against every key of the same algorithm.
+func (s *keySet) parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	unverified, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	kid, _ := unverified.Header["kid"].(string)
+
+	err = fmt.Errorf("no key found for kid %q", kid)
+	for _, k := range s.keys {
+		if k.Method.Alg() != unverified.Method.Alg() || (kid != "" && k.ID != kid) {
+			continue
+		}
+
+		key := k.verificationKey()
+		p := jwt.Parser{ValidMethods: []string{k.Method.Alg()}}
+		token, perr := p.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+			return key, nil
+		})
+		if perr == nil {
+			return token, nil
+		}
+		err = perr
+		if verr, ok := perr.(*jwt.ValidationError); !ok || verr.Errors&jwt.ValidationErrorSignatureInvalid == 0 {
+			// the key matched, but the token is invalid for another reason
+			break
+		}
+	}
+	return nil, err
+}
+
+// publicKeys returns the keys access tokens can be verified with. Symmetric
+// keys are never published.
+func (s *keySet) publicKeys() (*jwk.Set, error) {
+	set := &jwk.Set{Keys: []jwk.Key{}}
+
+	for _, key := range s.keys {
+		if key.Method == jwt.SigningMethodHS256 {
+			continue
+		}
+
+		publicKey, err := jwk.GetPublicKey(key.Key)
+		if err != nil {
+			return nil, err
+		}
+		k, err := jwk.New(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := k.Set(jwk.KeyIDKey, key.ID); err != nil {
+			return nil, err
+		}
+		if err := k.Set(jwk.AlgorithmKey, key.Method.Alg()); err != nil {
+			return nil, err
+		}
+		if err := k.Set(jwk.KeyUsageKey, string(jwk.ForSignature)); err != nil {
+			return nil, err
+		}
+		set.Keys = append(set.Keys, k)
+	}
+	return set, nil
+}
+
+// JWKS returns the public keys access tokens can be verified with
+func (a *API) JWKS(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	keys, err := a.loadKeySet(ctx, a.db)
+	if err != nil {
+		return internalServerError("Error loading JWT signing key").WithInternalError(err)
+	}
+	set, err := keys.publicKeys()
+	if err != nil {
+		return internalServerError("Error loading JWT signing key").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, set)
+}
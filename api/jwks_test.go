@@ -0,0 +1,172 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofrs/uuid"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type JWKSTestSuite struct {
+	suite.Suite
+	API    *API
+	Config *conf.Configuration
+
+	instanceID uuid.UUID
+}
+
+func TestJWKS(t *testing.T) {
+	api, config, instanceID, err := setupAPIForTestForInstance()
+	require.NoError(t, err)
+
+	ts := &JWKSTestSuite{
+		API:        api,
+		Config:     config,
+		instanceID: instanceID,
+	}
+	defer api.db.Close()
+
+	suite.Run(t, ts)
+}
+
+func (ts *JWKSTestSuite) SetupTest() {
+	models.TruncateAll(ts.API.db)
+	ts.Config.JWT.Algorithm = "HS256"
+	ts.Config.JWT.PrivateKey = ""
+	ts.Config.JWT.KeyID = ""
+
+	u, err := models.NewUser(ts.instanceID, "test@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error creating test user model")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error saving new test user")
+	require.NoError(ts.T(), u.Confirm(ts.API.db))
+}
+
+func (ts *JWKSTestSuite) keySet() *jwk.Set {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/.well-known/jwks.json", nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	set, err := jwk.Parse(w.Body)
+	require.NoError(ts.T(), err)
+	return set
+}
+
+func (ts *JWKSTestSuite) login() string {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", strings.NewReader(`{"email":"test@example.com","password":"password"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+	return token.Token
+}
+
+func (ts *JWKSTestSuite) getUser(token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/user", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+// verifyWithKeySet checks the token can be verified with only the published keys
+func (ts *JWKSTestSuite) verifyWithKeySet(tokenString, alg string) {
+	set := ts.keySet()
+	require.Len(ts.T(), set.Keys, 1)
+
+	p := jwt.Parser{ValidMethods: []string{alg}}
+	token, err := p.ParseWithClaims(tokenString, &GoTrueClaims{}, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		keys := set.LookupKeyID(kid)
+		if len(keys) != 1 {
+			return nil, fmt.Errorf("unknown kid %q", kid)
+		}
+		return keys[0].Materialize()
+	})
+	require.NoError(ts.T(), err)
+	assert.True(ts.T(), token.Valid)
+	assert.Equal(ts.T(), "test@example.com", token.Claims.(*GoTrueClaims).Email)
+}
+
+func (ts *JWKSTestSuite) TestHS256KeysAreNotPublished() {
+	set := ts.keySet()
+	assert.Empty(ts.T(), set.Keys)
+
+	token := ts.login()
+	assert.Equal(ts.T(), http.StatusOK, ts.getUser(token).Code)
+}
+
+func (ts *JWKSTestSuite) TestRS256() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(ts.T(), err)
+	ts.Config.JWT.Algorithm = "RS256"
+	ts.Config.JWT.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+
+	token := ts.login()
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, &GoTrueClaims{})
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "RS256", parsed.Header["alg"])
+	assert.NotEmpty(ts.T(), parsed.Header["kid"])
+
+	ts.verifyWithKeySet(token, "RS256")
+	assert.Equal(ts.T(), http.StatusOK, ts.getUser(token).Code)
+
+	// tokens signed with the shared secret are no longer accepted
+	ts.Config.JWT.Algorithm = "HS256"
+	hs256Token := ts.login()
+	ts.Config.JWT.Algorithm = "RS256"
+	assert.Equal(ts.T(), http.StatusUnauthorized, ts.getUser(hs256Token).Code)
+}
+
+func (ts *JWKSTestSuite) TestES256() {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(ts.T(), err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(ts.T(), err)
+	ts.Config.JWT.Algorithm = "ES256"
+	ts.Config.JWT.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	ts.Config.JWT.KeyID = "my-key"
+
+	token := ts.login()
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, &GoTrueClaims{})
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "ES256", parsed.Header["alg"])
+	assert.Equal(ts.T(), "my-key", parsed.Header["kid"])
+
+	ts.verifyWithKeySet(token, "ES256")
+	assert.Equal(ts.T(), http.StatusOK, ts.getUser(token).Code)
+}
+
+func (ts *JWKSTestSuite) TestES256RequiresP256() {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(ts.T(), err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(ts.T(), err)
+	ts.Config.JWT.Algorithm = "ES256"
+	ts.Config.JWT.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/.well-known/jwks.json", nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	assert.Equal(ts.T(), http.StatusInternalServerError, w.Code)
+}
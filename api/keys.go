@@ -0,0 +1,200 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+	"github.com/pkg/errors"
+)
+
+// RotateKeyParams are the parameters the rotate endpoint accepts
+type RotateKeyParams struct {
+	Algorithm string `json:"algorithm"`
+	Key       string `json:"key"`
+	// Overlap is the number of seconds the previous signing key keeps
+	// verifying tokens. It defaults to the access token lifetime.
+	Overlap *int `json:"overlap"`
+}
+
+// RotateSigningKey makes a new key the signing key of the instance, keeping the
+// previous one valid for verification during the overlap. A key is generated
+// unless material is provided, and the algorithm defaults to the configured
+// one.
+func RotateSigningKey(tx *storage.Connection, instanceID uuid.UUID, config *conf.JWTConfiguration, alg, material string, overlap time.Duration) (*models.SigningKey, error) {
+	if alg == "" {
+		alg = config.Algorithm
+	}
+
+	if material == "" {
+		generated, err := crypto.GenerateSigningKey(alg)
+		if err != nil {
+			return nil, err
+		}
+		material = generated
+	}
+
+	key, err := newJWTKey(alg, material, "")
+	if err != nil {
+		return nil, err
+	}
+	if key.ID == "" {
+		if key.ID, err = newKeyID(); err != nil {
+			return nil, err
+		}
+	}
+
+	// the configured key is stored on the first rotation, so tokens signed
+	// with it stay valid during the overlap
+	var current *models.SigningKey
+	stored, err := models.FindSigningKeys(tx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if len(stored) == 0 {
+		configKey, err := configSigningKey(config)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading configured signing key")
+		}
+		currentMaterial := config.Secret
+		if configKey.Method != jwt.SigningMethodHS256 {
+			currentMaterial = config.PrivateKey
+		}
+		// tokens without a kid are checked against every key, so the
+		// configured secret can be given one
+		if configKey.ID == "" {
+			if configKey.ID, err = newKeyID(); err != nil {
+				return nil, err
+			}
+		}
+		if current, err = models.NewSigningKey(instanceID, configKey.ID, configKey.Method.Alg(), currentMaterial, config.KeyEncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+
+	next, err := models.NewSigningKey(instanceID, key.ID, alg, material, config.KeyEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := models.RotateSigningKey(tx, instanceID, current, next, overlap); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+func newKeyID() (string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", errors.Wrap(err, "error generating key id")
+	}
+	return id.String(), nil
+}
+
+// adminKeys responds with the signing keys of the instance
+func (a *API) adminKeys(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+
+	keys, err := models.FindSigningKeys(a.db, instanceID)
+	if err != nil {
+		return internalServerError("Database error finding signing keys").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": keys,
+	})
+}
+
+// adminKeyRotate adds a new signing key
+func (a *API) adminKeyRotate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+	adminUser := getAdminUser(ctx)
+
+	params := &RotateKeyParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read rotate key params: %v", err)
+	}
+
+	overlap := time.Second * time.Duration(config.JWT.Exp)
+	if params.Overlap != nil {
+		if *params.Overlap < 0 {
+			return unprocessableEntityError("Overlap must not be negative")
+		}
+		overlap = time.Second * time.Duration(*params.Overlap)
+	}
+
+	if params.Algorithm == "" {
+		params.Algorithm = config.JWT.Algorithm
+	}
+	switch params.Algorithm {
+	case jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg():
+	default:
+		return unprocessableEntityError("Unsupported JWT algorithm: %s", params.Algorithm)
+	}
+	if params.Key != "" {
+		if _, err := newJWTKey(params.Algorithm, params.Key, ""); err != nil {
+			return unprocessableEntityError("Invalid signing key: %v", err)
+		}
+	}
+
+	var key *models.SigningKey
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		key, terr = RotateSigningKey(tx, instanceID, &config.JWT, params.Algorithm, params.Key, overlap)
+		if terr != nil {
+			return terr
+		}
+
+		return models.NewAuditLogEntry(tx, instanceID, adminUser, models.SigningKeyRotatedAction, map[string]interface{}{
+			"kid": key.KeyID,
+		})
+	})
+	if err != nil {
+		return internalServerError("Error rotating signing key").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, key)
+}
+
+// adminKeyRetire stops tokens signed with a key from being accepted
+func (a *API) adminKeyRetire(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+	adminUser := getAdminUser(ctx)
+
+	key, err := models.FindSigningKeyByKeyID(a.db, instanceID, chi.URLParam(r, "key_id"))
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError("Signing key not found")
+		}
+		return internalServerError("Database error finding signing key").WithInternalError(err)
+	}
+
+	if key.IsSigning() {
+		return unprocessableEntityError("The signing key can't be retired. Rotate in a new key first.")
+	}
+
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		if terr := key.Retire(tx); terr != nil {
+			return terr
+		}
+
+		return models.NewAuditLogEntry(tx, instanceID, adminUser, models.SigningKeyRetiredAction, map[string]interface{}{
+			"kid": key.KeyID,
+		})
+	})
+	if err != nil {
+		return internalServerError("Error retiring signing key").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, key)
+}
@@ -0,0 +1,245 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofrs/uuid"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type KeysTestSuite struct {
+	suite.Suite
+	API    *API
+	Config *conf.Configuration
+
+	token      string
+	instanceID uuid.UUID
+}
+
+func TestKeys(t *testing.T) {
+	api, config, instanceID, err := setupAPIForTestForInstance()
+	require.NoError(t, err)
+
+	ts := &KeysTestSuite{
+		API:        api,
+		Config:     config,
+		instanceID: instanceID,
+	}
+	defer api.db.Close()
+
+	suite.Run(t, ts)
+}
+
+func (ts *KeysTestSuite) SetupTest() {
+	models.TruncateAll(ts.API.db)
+	ts.Config.JWT.Algorithm = "HS256"
+	ts.Config.JWT.PrivateKey = ""
+	ts.Config.JWT.KeyID = ""
+
+	u, err := models.NewUser(ts.instanceID, "admin@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error creating test user model")
+	u.Role = "supabase_admin"
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error saving new test user")
+	require.NoError(ts.T(), u.Confirm(ts.API.db))
+
+	key, err := configSigningKey(&ts.Config.JWT)
+	require.NoError(ts.T(), err)
+	ts.token, err = generateAccessToken(u, nil, time.Second*time.Duration(ts.Config.JWT.Exp), key, "", "")
+	require.NoError(ts.T(), err)
+}
+
+func (ts *KeysTestSuite) request(method, path, token string, body map[string]interface{}) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+
+	req := httptest.NewRequest(method, path, &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *KeysTestSuite) rotate(body map[string]interface{}) *models.SigningKey {
+	w := ts.request(http.MethodPost, "http://localhost/admin/keys", ts.token, body)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	key := &models.SigningKey{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(key))
+	assert.Equal(ts.T(), models.SigningKeyStatusSigning, key.Status)
+	return key
+}
+
+func (ts *KeysTestSuite) login() string {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", strings.NewReader(`{"email":"admin@example.com","password":"password"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+	return token.Token
+}
+
+func (ts *KeysTestSuite) getUser(token string) int {
+	return ts.request(http.MethodGet, "http://localhost/user", token, nil).Code
+}
+
+func (ts *KeysTestSuite) TestRotateKeepsPreviousKeyDuringOverlap() {
+	key := ts.rotate(map[string]interface{}{})
+	assert.Equal(ts.T(), "HS256", key.Algorithm)
+
+	// tokens signed with the configured secret are still accepted
+	assert.Equal(ts.T(), http.StatusOK, ts.getUser(ts.token))
+
+	token := ts.login()
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, &GoTrueClaims{})
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), key.KeyID, parsed.Header["kid"])
+	assert.Equal(ts.T(), http.StatusOK, ts.getUser(token))
+
+	keys, err := models.FindSigningKeys(ts.API.db, ts.instanceID)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), keys, 2)
+	assert.True(ts.T(), keys[0].IsSigning())
+	assert.Equal(ts.T(), models.SigningKeyStatusVerification, keys[1].Status)
+	assert.NotNil(ts.T(), keys[1].ExpiresAt)
+}
+
+func (ts *KeysTestSuite) TestRetire() {
+	ts.rotate(map[string]interface{}{})
+	adminToken := ts.login()
+
+	keys, err := models.FindSigningKeys(ts.API.db, ts.instanceID)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), keys, 2)
+	signing, previous := keys[0], keys[1]
+
+	w := ts.request(http.MethodDelete, "http://localhost/admin/keys/"+signing.KeyID, adminToken, nil)
+	assert.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	w = ts.request(http.MethodDelete, "http://localhost/admin/keys/"+previous.KeyID, adminToken, nil)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	assert.Equal(ts.T(), http.StatusUnauthorized, ts.getUser(ts.token))
+	assert.Equal(ts.T(), http.StatusOK, ts.getUser(adminToken))
+
+	w = ts.request(http.MethodDelete, "http://localhost/admin/keys/unknown", adminToken, nil)
+	assert.Equal(ts.T(), http.StatusNotFound, w.Code)
+}
+
+func (ts *KeysTestSuite) TestRotateWithoutOverlap() {
+	ts.rotate(map[string]interface{}{"overlap": 0})
+	assert.Equal(ts.T(), http.StatusUnauthorized, ts.getUser(ts.token))
+}
+
+func (ts *KeysTestSuite) TestRotateToRS256() {
+	key := ts.rotate(map[string]interface{}{"algorithm": "RS256"})
+	assert.Equal(ts.T(), "RS256", key.Algorithm)
+
+	token := ts.login()
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, &GoTrueClaims{})
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "RS256", parsed.Header["alg"])
+	assert.Equal(ts.T(), key.KeyID, parsed.Header["kid"])
+	assert.Equal(ts.T(), http.StatusOK, ts.getUser(token))
+	assert.Equal(ts.T(), http.StatusOK, ts.getUser(ts.token))
+
+	w := ts.request(http.MethodGet, "http://localhost/.well-known/jwks.json", "", nil)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	set, err := jwk.Parse(w.Body)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), set.Keys, 1)
+	assert.Equal(ts.T(), key.KeyID, set.Keys[0].KeyID())
+}
+
+func (ts *KeysTestSuite) TestRotateDefaultsToConfiguredAlgorithm() {
+	privateKey, err := crypto.GenerateSigningKey("ES256")
+	require.NoError(ts.T(), err)
+	ts.Config.JWT.Algorithm = "ES256"
+	ts.Config.JWT.PrivateKey = privateKey
+	defer func() {
+		ts.Config.JWT.Algorithm = "HS256"
+		ts.Config.JWT.PrivateKey = ""
+	}()
+
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "admin@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	configKey, err := configSigningKey(&ts.Config.JWT)
+	require.NoError(ts.T(), err)
+	ts.token, err = generateAccessToken(u, nil, time.Second*time.Duration(ts.Config.JWT.Exp), configKey, "", "")
+	require.NoError(ts.T(), err)
+
+	key := ts.rotate(map[string]interface{}{})
+	assert.Equal(ts.T(), "ES256", key.Algorithm)
+
+	// the stored keys are encrypted
+	keys, err := models.FindSigningKeys(ts.API.db, ts.instanceID)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), keys, 2)
+	for _, k := range keys {
+		assert.NotContains(ts.T(), string(k.EncryptedMaterial), "PRIVATE KEY")
+		material, err := k.Material(ts.Config.JWT.KeyEncryptionKey)
+		require.NoError(ts.T(), err)
+		assert.Contains(ts.T(), material, "PRIVATE KEY")
+	}
+}
+
+func (ts *KeysTestSuite) TestLegacyKeyIsEncrypted() {
+	key := &models.SigningKey{
+		InstanceID:     ts.instanceID,
+		KeyID:          "legacy",
+		Algorithm:      "HS256",
+		LegacyMaterial: "legacy secret",
+		Status:         models.SigningKeyStatusSigning,
+	}
+	require.NoError(ts.T(), ts.API.db.Create(key))
+
+	token := ts.login()
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, &GoTrueClaims{})
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "legacy", parsed.Header["kid"])
+
+	key, err = models.FindSigningKeyByKeyID(ts.API.db, ts.instanceID, "legacy")
+	require.NoError(ts.T(), err)
+	assert.Empty(ts.T(), key.LegacyMaterial)
+	material, err := key.Material(ts.Config.JWT.KeyEncryptionKey)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "legacy secret", material)
+}
+
+func (ts *KeysTestSuite) TestRotateInvalidKey() {
+	w := ts.request(http.MethodPost, "http://localhost/admin/keys", ts.token, map[string]interface{}{
+		"algorithm": "RS256",
+		"key":       "not a key",
+	})
+	assert.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	w = ts.request(http.MethodPost, "http://localhost/admin/keys", ts.token, map[string]interface{}{
+		"algorithm": "none",
+	})
+	assert.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+}
+
+func (ts *KeysTestSuite) TestKeysRequireAdmin() {
+	w := ts.request(http.MethodGet, "http://localhost/admin/keys", "", nil)
+	assert.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+}
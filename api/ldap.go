@@ -0,0 +1,97 @@
+package api
+
+import (
+	"context"
+
+	"github.com/netlify/gotrue/api/provider"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+)
+
+const ldapProviderType = "ldap"
+
+// ldapAuthenticate authenticates the user against the instance's directory,
+// creating the user on their first sign in. It returns no user if the
+// directory has no entry for the email, so users outside of the directory
+// sign in with their GoTrue password.
+func (a *API) ldapAuthenticate(ctx context.Context, email, password, aud string) (*models.User, error) {
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	ldapProvider, err := provider.NewLDAPProvider(config.External.LDAP)
+	if err != nil {
+		return nil, internalServerError("Could not initialize LDAP provider").WithInternalError(err)
+	}
+
+	userData, groups, err := ldapProvider.Authenticate(email, password)
+	switch {
+	case err == provider.ErrLDAPUserNotFound:
+		return nil, nil
+	case err == provider.ErrLDAPInvalidCredentials:
+		return nil, oauthError("invalid_grant", "Invalid email or password")
+	case err != nil:
+		return nil, internalServerError("Error authenticating with LDAP").WithInternalError(err)
+	}
+
+	var user *models.User
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if user, terr = findUserByIdentity(tx, instanceID, ldapProviderType, userData); terr != nil {
+			return terr
+		}
+
+		emailData := primaryEmail(userData)
+		if user == nil {
+			user, terr = models.FindUserByEmailAndAudience(tx, instanceID, emailData.Email, aud)
+			if terr != nil && !models.IsNotFoundError(terr) {
+				return internalServerError("Database error finding user").WithInternalError(terr)
+			}
+		}
+
+		if user == nil {
+			if config.DisableSignup {
+				return forbiddenError("Signups not allowed for this instance")
+			}
+
+			params := &SignupParams{
+				Provider: ldapProviderType,
+				Email:    emailData.Email,
+				Aud:      aud,
+				Data:     userData.UserMetadata(),
+			}
+
+			if user, terr = a.signupNewUser(ctx, tx, params); terr != nil {
+				return terr
+			}
+			if terr = models.NewAuditLogEntry(tx, instanceID, user, models.UserSignedUpAction, nil); terr != nil {
+				return terr
+			}
+			if terr = triggerEventHooks(ctx, tx, SignupEvent, user, instanceID, config); terr != nil {
+				return terr
+			}
+		}
+
+		if _, terr = a.linkIdentity(tx, user, ldapProviderType, userData); terr != nil {
+			return terr
+		}
+
+		// the directory verified the email of the user
+		if !user.IsConfirmed() {
+			if terr = user.Confirm(tx); terr != nil {
+				return internalServerError("Error updating user").WithInternalError(terr)
+			}
+		}
+
+		// the directory can't make the user an admin
+		if role := ldapProvider.GroupRole(groups); role != "" && role != user.Role && !isAdminRole(config, role) {
+			if terr = user.SetRole(tx, role); terr != nil {
+				return internalServerError("Error updating user").WithInternalError(terr)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
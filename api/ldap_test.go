@@ -0,0 +1,315 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+const (
+	ldapTestBindDN       = "cn=gotrue,dc=example,dc=com"
+	ldapTestBindPassword = "service-secret"
+)
+
+// ldapTestEntry is an entry of the test directory
+type ldapTestEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// ldapTestServer is a directory that answers the bind and search requests of
+// the LDAP provider
+type ldapTestServer struct {
+	listener net.Listener
+	entries  []*ldapTestEntry
+}
+
+func newLDAPTestServer(t *testing.T, entries ...*ldapTestEntry) *ldapTestServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &ldapTestServer{listener: listener, entries: entries}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ldapTestServer) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *ldapTestServer) Close() {
+	s.listener.Close()
+}
+
+func (s *ldapTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			name := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if name == ldapTestBindDN && password == ldapTestBindPassword {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, entry := range s.entries {
+				if entry.dn == name && entry.password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			s.write(conn, messageID, ldapTestResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				s.write(conn, messageID, ldapTestResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError))
+				continue
+			}
+			for _, entry := range s.entries {
+				if entry.matches(filter) {
+					s.write(conn, messageID, entry.packet())
+				}
+			}
+			s.write(conn, messageID, ldapTestResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			return
+		}
+	}
+}
+
+func (s *ldapTestServer) write(conn net.Conn, messageID int64, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
+
+func ldapTestResult(tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return op
+}
+
+// matches checks the equality filter of the default search filter
+func (e *ldapTestEntry) matches(filter string) bool {
+	for _, email := range e.attrs["mail"] {
+		if strings.EqualFold(filter, "(mail="+email+")") {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *ldapTestEntry) packet() *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "objectName"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range e.attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		attr.AppendChild(vals)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return op
+}
+
+type LDAPTestSuite struct {
+	suite.Suite
+	API    *API
+	Config *conf.Configuration
+
+	instanceID uuid.UUID
+	server     *ldapTestServer
+}
+
+func TestLDAP(t *testing.T) {
+	api, config, instanceID, err := setupAPIForTestForInstance()
+	require.NoError(t, err)
+
+	ts := &LDAPTestSuite{
+		API:        api,
+		Config:     config,
+		instanceID: instanceID,
+	}
+	defer api.db.Close()
+
+	ts.server = newLDAPTestServer(t, &ldapTestEntry{
+		dn:       "uid=alice,ou=people,dc=example,dc=com",
+		password: "alice-secret",
+		attrs: map[string][]string{
+			"entryUUID": {"5b3a4e1c-8f2d-4c6a-9e7b-1d2f3a4b5c6d"},
+			"mail":      {"alice@example.com"},
+			"cn":        {"Alice Example"},
+			"memberOf":  {"cn=everyone,ou=groups,dc=example,dc=com", "cn=engineering,ou=groups,dc=example,dc=com"},
+		},
+	})
+	defer ts.server.Close()
+
+	suite.Run(t, ts)
+}
+
+func (ts *LDAPTestSuite) SetupTest() {
+	models.TruncateAll(ts.API.db)
+
+	ts.Config.DisableSignup = false
+	ts.Config.External.LDAP = conf.LDAPProviderConfiguration{
+		Enabled:        true,
+		URL:            ts.server.URL(),
+		BindDN:         ldapTestBindDN,
+		BindPassword:   ldapTestBindPassword,
+		BaseDN:         "dc=example,dc=com",
+		SearchFilter:   "(mail={email})",
+		IDAttribute:    "entryUUID",
+		EmailAttribute: "mail",
+		NameAttribute:  "cn",
+		GroupAttribute: "memberOf",
+		GroupRoles: conf.GroupRoles{
+			{Group: "admins", Role: "admin"},
+			{Group: "engineering", Role: "engineer"},
+		},
+		Timeout: 10,
+	}
+}
+
+func (ts *LDAPTestSuite) TearDownTest() {
+	ts.Config.External.LDAP = conf.LDAPProviderConfiguration{}
+}
+
+func (ts *LDAPTestSuite) passwordGrant(email, password string) *httptest.ResponseRecorder {
+	body := `{"email":"` + email + `","password":"` + password + `"}`
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *LDAPTestSuite) TestPasswordGrant_ProvisionsUser() {
+	w := ts.passwordGrant("alice@example.com", "alice-secret")
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	token := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+	require.NotNil(ts.T(), token.User)
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "alice@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), token.User.ID, user.ID)
+	assert.True(ts.T(), user.IsConfirmed())
+	assert.Equal(ts.T(), "engineer", user.Role)
+	assert.Equal(ts.T(), "Alice Example", user.UserMetaData["full_name"])
+	assert.Equal(ts.T(), "ldap", user.AppMetaData["provider"])
+
+	identity, err := models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "ldap", "5b3a4e1c-8f2d-4c6a-9e7b-1d2f3a4b5c6d")
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), user.ID, identity.UserID)
+
+	// signing in again finds the user by the identity
+	w = ts.passwordGrant("alice@example.com", "alice-secret")
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	again := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(again))
+	assert.Equal(ts.T(), user.ID, again.User.ID)
+}
+
+func (ts *LDAPTestSuite) TestPasswordGrant_DefaultRole() {
+	ts.Config.External.LDAP.GroupRoles = conf.GroupRoles{{Group: "admins", Role: "admin"}}
+	ts.Config.External.LDAP.DefaultRole = "member"
+
+	w := ts.passwordGrant("alice@example.com", "alice-secret")
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "alice@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "member", user.Role)
+}
+
+func (ts *LDAPTestSuite) TestPasswordGrant_IgnoresAdminRole() {
+	ts.Config.External.LDAP.GroupRoles = conf.GroupRoles{{Group: "engineering", Role: "supabase_admin"}}
+
+	w := ts.passwordGrant("alice@example.com", "alice-secret")
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	// the directory can't make the user an admin
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "alice@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	assert.NotEqual(ts.T(), "supabase_admin", user.Role)
+}
+
+func (ts *LDAPTestSuite) TestPasswordGrant_InvalidPassword() {
+	w := ts.passwordGrant("alice@example.com", "wrong")
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code, w.Body.String())
+
+	_, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "alice@example.com", ts.Config.JWT.Aud)
+	assert.True(ts.T(), models.IsNotFoundError(err))
+}
+
+func (ts *LDAPTestSuite) TestPasswordGrant_LinksExistingUser() {
+	u, err := models.NewUser(ts.instanceID, "alice@example.com", "local-password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(u))
+
+	// the directory password signs in the unconfirmed local user
+	w := ts.passwordGrant("alice@example.com", "alice-secret")
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "alice@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), u.ID, user.ID)
+	assert.True(ts.T(), user.IsConfirmed())
+
+	// the local password of users in the directory is not accepted
+	w = ts.passwordGrant("alice@example.com", "local-password")
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code, w.Body.String())
+}
+
+func (ts *LDAPTestSuite) TestPasswordGrant_FallsBackToLocalUsers() {
+	u, err := models.NewUser(ts.instanceID, "bob@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(u))
+	require.NoError(ts.T(), u.Confirm(ts.API.db))
+
+	w := ts.passwordGrant("bob@example.com", "password")
+	assert.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+}
+
+func (ts *LDAPTestSuite) TestPasswordGrant_DisableSignup() {
+	ts.Config.DisableSignup = true
+
+	w := ts.passwordGrant("alice@example.com", "alice-secret")
+	assert.Equal(ts.T(), http.StatusForbidden, w.Code, w.Body.String())
+}
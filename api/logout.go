@@ -3,15 +3,32 @@ package api
 import (
 	"net/http"
 
+	"github.com/gofrs/uuid"
 	"github.com/netlify/gotrue/models"
 	"github.com/netlify/gotrue/storage"
 )
 
-// Logout is the endpoint for logging out a user and thereby revoking any refresh tokens
+const (
+	logoutScopeLocal  = "local"
+	logoutScopeGlobal = "global"
+)
+
+// Logout is the endpoint for logging out a user and thereby revoking their
+// refresh tokens. Only the session of the token is signed out, unless the
+// global scope is requested.
 func (a *API) Logout(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	instanceID := getInstanceID(ctx)
 
+	scope := r.URL.Query().Get("scope")
+	switch scope {
+	case "":
+		scope = logoutScopeLocal
+	case logoutScopeLocal, logoutScopeGlobal:
+	default:
+		return badRequestError("scope must be local or global")
+	}
+
 	a.clearCookieToken(ctx, w)
 
 	u, err := getUserFromClaims(ctx, a.db)
@@ -19,16 +36,45 @@ func (a *API) Logout(w http.ResponseWriter, r *http.Request) error {
 		return unauthorizedError("Invalid user").WithInternalError(err)
 	}
 
+	var session *models.Session
+	if sessionID, err := uuid.FromString(getClaims(ctx).SessionID); err == nil {
+		session, err = models.FindSessionByUserAndID(a.db, u, sessionID)
+		if err != nil && !models.IsNotFoundError(err) {
+			return internalServerError("Database error finding session").WithInternalError(err)
+		}
+	}
+
+	// users that signed in through a SAML identity provider are also
+	// logged out there, if it supports single logout
+	var samlLogoutURL string
+	if session != nil {
+		if samlLogoutURL, err = a.samlLogoutURL(r, session); err != nil {
+			getLogEntry(r).WithError(err).Warn("Error creating SAML logout request")
+		}
+	}
+
 	err = a.db.Transaction(func(tx *storage.Connection) error {
-		if terr := models.NewAuditLogEntry(tx, instanceID, u, models.LogoutAction, nil); terr != nil {
+		if terr := models.NewAuditLogEntry(tx, instanceID, u, models.LogoutAction, map[string]interface{}{
+			"scope": scope,
+		}); terr != nil {
 			return terr
 		}
+		// tokens without a session can only sign out all of them
+		if scope == logoutScopeLocal && session != nil {
+			return session.Logout(tx)
+		}
 		return models.Logout(tx, instanceID, u.ID)
 	})
 	if err != nil {
 		return internalServerError("Error logging out user").WithInternalError(err)
 	}
 
+	if samlLogoutURL != "" {
+		return sendJSON(w, http.StatusOK, map[string]string{
+			"saml_logout_url": samlLogoutURL,
+		})
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -14,7 +15,9 @@ import (
 
 // MagicLinkParams holds the parameters for a magic link request
 type MagicLinkParams struct {
-	Email string `json:"email"`
+	Email               string `json:"email"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
 }
 
 // MagicLink sends a recovery email
@@ -35,6 +38,10 @@ func (a *API) MagicLink(w http.ResponseWriter, r *http.Request) error {
 	if err := a.validateEmail(ctx, params.Email); err != nil {
 		return err
 	}
+	challenge, err := newCodeChallenge(params.CodeChallenge, params.CodeChallengeMethod)
+	if err != nil {
+		return err
+	}
 
 	aud := a.requestAud(ctx, r)
 	user, err := models.FindUserByEmailAndAudience(a.db, instanceID, params.Email, aud)
@@ -55,9 +62,12 @@ func (a *API) MagicLink(w http.ResponseWriter, r *http.Request) error {
 				if err := a.Signup(fakeResponse, r); err != nil {
 					return err
 				}
-				newBodyContent := `{"email":"` + params.Email + `"}`
-				r.Body = ioutil.NopCloser(strings.NewReader(newBodyContent))
-				r.ContentLength = int64(len(newBodyContent))
+				newBody, err := json.Marshal(params)
+				if err != nil {
+					return internalServerError("error creating magic link").WithInternalError(err)
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(newBody))
+				r.ContentLength = int64(len(newBody))
 				return a.MagicLink(w, r)
 			}
 			// otherwise confirmation email already contains 'magic link'
@@ -75,9 +85,23 @@ func (a *API) MagicLink(w http.ResponseWriter, r *http.Request) error {
 			return terr
 		}
 
+		// only the latest link can be used for a PKCE login
+		if terr := models.DeleteFlowStatesByUser(tx, user, magicLinkVerification); terr != nil {
+			return terr
+		}
+		if challenge != nil {
+			flowState, terr := models.NewFlowState(user, challenge.Challenge, challenge.Method, magicLinkVerification)
+			if terr != nil {
+				return terr
+			}
+			if terr := saveFlowState(tx, config, flowState); terr != nil {
+				return terr
+			}
+		}
+
 		mailer := a.Mailer(ctx)
 		referrer := a.getReferrer(r)
-		return a.sendMagicLink(tx, user, mailer, config.SMTP.MaxFrequency, referrer)
+		return a.sendMagicLink(tx, user, mailer, config, referrer)
 	})
 	if err != nil {
 		if errors.Is(err, MaxFrequencyLimitError) {
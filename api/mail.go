@@ -4,6 +4,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/netlify/gotrue/conf"
 	"github.com/netlify/gotrue/crypto"
 	"github.com/netlify/gotrue/mailer"
 	"github.com/netlify/gotrue/models"
@@ -60,22 +61,32 @@ func (a *API) sendPasswordRecovery(tx *storage.Connection, u *models.User, maile
 	return errors.Wrap(tx.UpdateOnly(u, "recovery_token", "recovery_sent_at"), "Database error updating user for recovery")
 }
 
-func (a *API) sendMagicLink(tx *storage.Connection, u *models.User, mailer mailer.Mailer, maxFrequency time.Duration, referrerURL string) error {
+func (a *API) sendMagicLink(tx *storage.Connection, u *models.User, mailer mailer.Mailer, config *conf.Configuration, referrerURL string) error {
 	// since Magic Link is just a recovery with a different template and behaviour
 	// around new users we will reuse the recovery db timer to prevent potential abuse
-	if u.RecoverySentAt != nil && !u.RecoverySentAt.Add(maxFrequency).Before(time.Now()) {
+	if u.RecoverySentAt != nil && !u.RecoverySentAt.Add(config.SMTP.MaxFrequency).Before(time.Now()) {
 		return MaxFrequencyLimitError
 	}
 
+	// the email includes a code for users that can't follow the link on
+	// the device they sign in on
+	otp, err := crypto.GenerateOTP(config.Mailer.OtpLength)
+	if err != nil {
+		return errors.Wrap(err, "Error generating otp")
+	}
+
 	oldToken := u.RecoveryToken
 	u.RecoveryToken = crypto.SecureToken()
 	now := time.Now()
-	if err := mailer.MagicLinkMail(u, referrerURL); err != nil {
+	if err := mailer.MagicLinkMail(u, otp, referrerURL); err != nil {
 		u.RecoveryToken = oldToken
 		return errors.Wrap(err, "Error sending magic link email")
 	}
 	u.RecoverySentAt = &now
-	return errors.Wrap(tx.UpdateOnly(u, "recovery_token", "recovery_sent_at"), "Database error updating user for recovery")
+	u.EmailOTPHash = crypto.HashOTP(u.Email, otp)
+	u.EmailOTPSentAt = &now
+	u.EmailOTPAttempts = 0
+	return errors.Wrap(tx.UpdateOnly(u, "recovery_token", "recovery_sent_at", "email_otp_hash", "email_otp_sent_at", "email_otp_attempts"), "Database error updating user for recovery")
 }
 
 func (a *API) sendEmailChange(tx *storage.Connection, u *models.User, mailer mailer.Mailer, email string, referrerURL string) error {
@@ -0,0 +1,433 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/metering"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+)
+
+const totpFactorType = "totp"
+
+// MFAChallengeClaims are the claims of the token handed out by the password
+// grant when the user still has to present a second factor. The user is
+// deliberately not stored in the subject so the token can't be used as an
+// access token.
+type MFAChallengeClaims struct {
+	jwt.StandardClaims
+	UserID string `json:"mfa_user_id"`
+}
+
+// MFAChallengeResponse is returned by the password grant instead of tokens
+// when the user has an enrolled factor
+type MFAChallengeResponse struct {
+	MFARequired bool     `json:"mfa_required"`
+	MFAToken    string   `json:"mfa_token"`
+	FactorType  string   `json:"factor_type"`
+	FactorTypes []string `json:"factor_types"`
+	ExpiresIn   int      `json:"expires_in"`
+
+	// WebAuthn starts a login with one of the credentials of the user
+	WebAuthn *WebAuthnLoginResponse `json:"webauthn,omitempty"`
+}
+
+// FactorResponse represents an enrolled factor. The secret and URI are only
+// returned when enrolling.
+type FactorResponse struct {
+	ID         int64      `json:"id"`
+	Type       string     `json:"type"`
+	Secret     string     `json:"secret,omitempty"`
+	URI        string     `json:"uri,omitempty"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// FactorCodeParams are the parameters the factor verify and unenroll endpoints accept
+type FactorCodeParams struct {
+	Code string `json:"code"`
+}
+
+// MFAGrantParams are the parameters the MFATOTPGrant method accepts
+type MFAGrantParams struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+// UserFactors lists the factors of the authenticated user
+func (a *API) UserFactors(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	user, err := getUserFromClaims(ctx, a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+
+	factors := []*FactorResponse{}
+	factor, err := models.FindTOTPFactorByUser(a.db, user)
+	if err != nil && !models.IsNotFoundError(err) {
+		return internalServerError("Database error finding factor").WithInternalError(err)
+	}
+	if factor != nil {
+		factors = append(factors, &FactorResponse{
+			ID:         factor.ID,
+			Type:       totpFactorType,
+			VerifiedAt: factor.VerifiedAt,
+			CreatedAt:  factor.CreatedAt,
+		})
+	}
+
+	return sendJSON(w, http.StatusOK, factors)
+}
+
+// EnrollFactor creates a new TOTP secret for the authenticated user. The
+// factor is only used for logins once it has been verified.
+func (a *API) EnrollFactor(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	user, err := getUserFromClaims(ctx, a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+	if user.ID == models.SystemUserUUID {
+		return badRequestError("Factors can not be enrolled for the system user")
+	}
+
+	secret := crypto.GenerateTOTPSecret()
+	otpURL := crypto.TOTPURL(config.MFA.Issuer, user.Email, secret)
+
+	var factor *models.TOTPFactor
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		factor, terr = models.FindTOTPFactorByUser(tx, user)
+		if terr != nil && !models.IsNotFoundError(terr) {
+			return internalServerError("Database error finding factor").WithInternalError(terr)
+		}
+
+		if factor != nil {
+			if factor.IsVerified() {
+				return unprocessableEntityError("A factor has already been enrolled for this user")
+			}
+			if terr = factor.Reset(tx, otpURL, config.MFA.EncryptionKey); terr != nil {
+				return internalServerError("Database error updating factor").WithInternalError(terr)
+			}
+		} else {
+			factor, terr = models.NewTOTPFactor(user, otpURL, config.MFA.EncryptionKey)
+			if terr != nil {
+				return internalServerError("Error creating factor").WithInternalError(terr)
+			}
+			if terr = tx.Create(factor); terr != nil {
+				return internalServerError("Database error saving factor").WithInternalError(terr)
+			}
+		}
+
+		if terr = models.NewAuditLogEntry(tx, instanceID, user, models.FactorEnrolledAction, nil); terr != nil {
+			return internalServerError("Error recording audit log entry").WithInternalError(terr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, &FactorResponse{
+		ID:        factor.ID,
+		Type:      totpFactorType,
+		Secret:    secret,
+		URI:       otpURL,
+		CreatedAt: factor.CreatedAt,
+	})
+}
+
+// VerifyFactor completes the enrollment of a factor with a code from the
+// authenticator app
+func (a *API) VerifyFactor(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	params := &FactorCodeParams{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	if err := jsonDecoder.Decode(params); err != nil {
+		return badRequestError("Could not read factor verification params: %v", err)
+	}
+	if params.Code == "" {
+		return unprocessableEntityError("Factor verification requires a code")
+	}
+
+	user, err := getUserFromClaims(ctx, a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+
+	factor, err := models.FindTOTPFactorByUser(a.db, user)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError(err.Error())
+		}
+		return internalServerError("Database error finding factor").WithInternalError(err)
+	}
+	if factor.IsVerified() {
+		return unprocessableEntityError("Factor has already been verified")
+	}
+	if err := a.countFactorAttempt(ctx, factor); err != nil {
+		return err
+	}
+
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		ok, terr := factor.Authenticate(tx, config.MFA.EncryptionKey, config.JWT.Secret, params.Code)
+		if terr != nil {
+			return internalServerError("Error verifying code").WithInternalError(terr)
+		}
+		if !ok {
+			return unprocessableEntityError("Invalid TOTP code")
+		}
+
+		if terr = factor.Verify(tx); terr != nil {
+			return internalServerError("Database error updating factor").WithInternalError(terr)
+		}
+		if terr = models.NewAuditLogEntry(tx, instanceID, user, models.FactorVerifiedAction, nil); terr != nil {
+			return internalServerError("Error recording audit log entry").WithInternalError(terr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, &FactorResponse{
+		ID:         factor.ID,
+		Type:       totpFactorType,
+		VerifiedAt: factor.VerifiedAt,
+		CreatedAt:  factor.CreatedAt,
+	})
+}
+
+// UnenrollFactor removes the factor of the authenticated user. Removing a
+// verified factor requires a current code.
+func (a *API) UnenrollFactor(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	params := &FactorCodeParams{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	if err := jsonDecoder.Decode(params); err != nil {
+		return badRequestError("Could not read factor params: %v", err)
+	}
+
+	user, err := getUserFromClaims(ctx, a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+
+	factor, err := models.FindTOTPFactorByUser(a.db, user)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError(err.Error())
+		}
+		return internalServerError("Database error finding factor").WithInternalError(err)
+	}
+	if factor.IsVerified() {
+		if err := a.countFactorAttempt(ctx, factor); err != nil {
+			return err
+		}
+	}
+
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		if factor.IsVerified() {
+			ok, terr := factor.Authenticate(tx, config.MFA.EncryptionKey, config.JWT.Secret, params.Code)
+			if terr != nil {
+				return internalServerError("Error verifying code").WithInternalError(terr)
+			}
+			if !ok {
+				return unprocessableEntityError("Invalid TOTP code")
+			}
+		}
+
+		if terr := tx.Destroy(factor); terr != nil {
+			return internalServerError("Database error deleting factor").WithInternalError(terr)
+		}
+		if terr := models.NewAuditLogEntry(tx, instanceID, user, models.FactorUnenrolledAction, nil); terr != nil {
+			return internalServerError("Error recording audit log entry").WithInternalError(terr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// MFATOTPGrant implements the second step of a password grant for users with an enrolled factor
+func (a *API) MFATOTPGrant(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	params := &MFAGrantParams{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	if err := jsonDecoder.Decode(params); err != nil {
+		return badRequestError("Could not read mfa grant params: %v", err)
+	}
+
+	cookie := r.Header.Get(useCookieHeader)
+
+	if params.MFAToken == "" || params.Code == "" {
+		return oauthError("invalid_request", "mfa_token and code required")
+	}
+
+	user, err := a.mfaChallengeUser(ctx, params.MFAToken)
+	if err != nil {
+		return err
+	}
+
+	factor, err := models.FindVerifiedTOTPFactorByUser(a.db, user)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return oauthError("invalid_grant", "No factor enrolled for user")
+		}
+		return internalServerError("Database error finding factor").WithInternalError(err)
+	}
+	if err := a.countFactorAttempt(ctx, factor); err != nil {
+		return err
+	}
+
+	var token *AccessTokenResponse
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		ok, terr := factor.Authenticate(tx, config.MFA.EncryptionKey, config.JWT.Secret, params.Code)
+		if terr != nil {
+			return internalServerError("Error verifying code").WithInternalError(terr)
+		}
+		if !ok {
+			return oauthError("invalid_grant", "Invalid TOTP code")
+		}
+
+		if terr = models.NewAuditLogEntry(tx, instanceID, user, models.LoginAction, map[string]interface{}{
+			"factor": totpFactorType,
+		}); terr != nil {
+			return terr
+		}
+		if terr = triggerEventHooks(ctx, tx, LoginEvent, user, instanceID, config); terr != nil {
+			return terr
+		}
+
+		token, terr = a.issueRefreshToken(ctx, tx, user, newGrantParams(r))
+		if terr != nil {
+			return terr
+		}
+
+		if cookie != "" && config.Cookie.Duration > 0 {
+			if terr = a.setCookieToken(config, token.Token, cookie == useSessionCookie, w); terr != nil {
+				return internalServerError("Failed to set JWT cookie. %s", terr)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	metering.RecordLogin("mfa", user.ID, instanceID)
+	token.User = user
+	return sendJSON(w, http.StatusOK, token)
+}
+
+// countFactorAttempt counts a code tried against the factor, failing once
+// too many wrong codes have been tried
+func (a *API) countFactorAttempt(ctx context.Context, factor *models.TOTPFactor) error {
+	config := a.getConfig(ctx)
+
+	err := factor.CountAttempt(a.db, config.MFA.MaxAttempts, time.Second*time.Duration(config.MFA.LockoutDuration))
+	if err != nil {
+		if _, ok := err.(models.TOTPFactorLockedError); ok {
+			return tooManyRequestsError("Too many failed attempts, try again later")
+		}
+		return internalServerError("Database error updating factor").WithInternalError(err)
+	}
+	return nil
+}
+
+// mfaChallengeUser finds the user the password grant handed out the MFA
+// token to
+func (a *API) mfaChallengeUser(ctx context.Context, mfaToken string) (*models.User, error) {
+	instanceID := getInstanceID(ctx)
+
+	keys, err := a.loadSecretKeySet(ctx, a.db)
+	if err != nil {
+		return nil, internalServerError("Error loading JWT signing key").WithInternalError(err)
+	}
+
+	claims := MFAChallengeClaims{}
+	if _, err := keys.parse(mfaToken, &claims); err != nil {
+		return nil, oauthError("invalid_grant", "Invalid MFA token").WithInternalError(err)
+	}
+
+	userID, err := uuid.FromString(claims.UserID)
+	if err != nil {
+		return nil, oauthError("invalid_grant", "Invalid MFA token").WithInternalError(err)
+	}
+
+	user, err := models.FindUserByInstanceIDAndID(a.db, instanceID, userID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil, oauthError("invalid_grant", "Invalid MFA token")
+		}
+		return nil, internalServerError("Database error finding user").WithInternalError(err)
+	}
+	return user, nil
+}
+
+// sendMFAChallenge asks the user for one of their second factors: a code of
+// their TOTP factor or, if they registered any, one of their WebAuthn
+// credentials
+func (a *API) sendMFAChallenge(ctx context.Context, w http.ResponseWriter, user *models.User, totp bool, credentials []*models.WebAuthnCredential) error {
+	config := a.getConfig(ctx)
+
+	keys, err := a.loadSecretKeySet(ctx, a.db)
+	if err != nil {
+		return internalServerError("Error loading JWT signing key").WithInternalError(err)
+	}
+	tokenString, err := generateMFAChallengeToken(user, time.Second*time.Duration(config.MFA.ChallengeExpiry), keys)
+	if err != nil {
+		return internalServerError("error generating mfa token").WithInternalError(err)
+	}
+
+	challenge := &MFAChallengeResponse{
+		MFARequired: true,
+		MFAToken:    tokenString,
+		FactorTypes: []string{},
+		ExpiresIn:   config.MFA.ChallengeExpiry,
+	}
+	if totp {
+		challenge.FactorTypes = append(challenge.FactorTypes, totpFactorType)
+	}
+	if len(credentials) > 0 {
+		challenge.FactorTypes = append(challenge.FactorTypes, webAuthnFactorType)
+		if challenge.WebAuthn, err = a.newWebAuthnLogin(ctx, a.db, user, credentials); err != nil {
+			return err
+		}
+	}
+	challenge.FactorType = challenge.FactorTypes[0]
+
+	return sendJSON(w, http.StatusOK, challenge)
+}
+
+func generateMFAChallengeToken(user *models.User, expiresIn time.Duration, keys *keySet) (string, error) {
+	claims := &MFAChallengeClaims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  user.Aud,
+			ExpiresAt: time.Now().Add(expiresIn).Unix(),
+		},
+		UserID: user.ID.String(),
+	}
+
+	return keys.sign(claims)
+}
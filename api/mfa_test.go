@@ -0,0 +1,280 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type MFATestSuite struct {
+	suite.Suite
+	API    *API
+	Config *conf.Configuration
+
+	instanceID uuid.UUID
+}
+
+func TestMFA(t *testing.T) {
+	api, config, instanceID, err := setupAPIForTestForInstance()
+	require.NoError(t, err)
+
+	ts := &MFATestSuite{
+		API:        api,
+		Config:     config,
+		instanceID: instanceID,
+	}
+	defer api.db.Close()
+
+	suite.Run(t, ts)
+}
+
+func (ts *MFATestSuite) SetupTest() {
+	models.TruncateAll(ts.API.db)
+	ts.Config.MFA.Enabled = true
+
+	u, err := models.NewUser(ts.instanceID, "test@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error creating test user model")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error saving new test user")
+	require.NoError(ts.T(), u.Confirm(ts.API.db))
+}
+
+func (ts *MFATestSuite) request(method, path string, body map[string]interface{}) *httptest.ResponseRecorder {
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+
+	req := httptest.NewRequest(method, path, &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	key, err := configSigningKey(&ts.Config.JWT)
+	require.NoError(ts.T(), err)
+	token, err := generateAccessToken(u, nil, time.Second*time.Duration(ts.Config.JWT.Exp), key, "", "")
+	require.NoError(ts.T(), err)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+// enroll enrolls and verifies a factor, returning its secret
+func (ts *MFATestSuite) enroll() string {
+	w := ts.request(http.MethodPost, "http://localhost/user/factors", map[string]interface{}{})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	factor := FactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&factor))
+	require.NotEmpty(ts.T(), factor.Secret)
+	require.Contains(ts.T(), factor.URI, "otpauth://totp/")
+
+	code, err := crypto.TOTPCode(factor.Secret, crypto.TOTPCounter(time.Now()))
+	require.NoError(ts.T(), err)
+
+	w = ts.request(http.MethodPost, "http://localhost/user/factors/verify", map[string]interface{}{
+		"code": code,
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	return factor.Secret
+}
+
+func (ts *MFATestSuite) passwordGrant() *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *MFATestSuite) mfaGrant(mfaToken, code string) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"mfa_token": mfaToken,
+		"code":      code,
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=mfa_totp", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *MFATestSuite) TestEnrollFactor() {
+	ts.enroll()
+
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	factor, err := models.FindVerifiedTOTPFactorByUser(ts.API.db, u)
+	require.NoError(ts.T(), err)
+	assert.True(ts.T(), factor.IsVerified())
+
+	// a second enrollment is rejected
+	w := ts.request(http.MethodPost, "http://localhost/user/factors", map[string]interface{}{})
+	assert.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+}
+
+func (ts *MFATestSuite) TestVerifyFactorInvalidCode() {
+	w := ts.request(http.MethodPost, "http://localhost/user/factors", map[string]interface{}{})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	w = ts.request(http.MethodPost, "http://localhost/user/factors/verify", map[string]interface{}{
+		"code": "000000",
+	})
+	assert.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+}
+
+func (ts *MFATestSuite) TestPasswordGrantWithoutFactor() {
+	w := ts.passwordGrant()
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+	assert.NotEmpty(ts.T(), token.Token)
+}
+
+func (ts *MFATestSuite) TestPasswordGrantWithFactor() {
+	secret := ts.enroll()
+
+	w := ts.passwordGrant()
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	challenge := MFAChallengeResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challenge))
+	require.True(ts.T(), challenge.MFARequired)
+	require.NotEmpty(ts.T(), challenge.MFAToken)
+
+	// the challenge token can't be used as an access token
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/user", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", challenge.MFAToken))
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	assert.NotEqual(ts.T(), http.StatusOK, w.Code)
+
+	// the code used during verification has been consumed
+	code, err := crypto.TOTPCode(secret, crypto.TOTPCounter(time.Now()))
+	require.NoError(ts.T(), err)
+	w = ts.mfaGrant(challenge.MFAToken, code)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	code, err = crypto.TOTPCode(secret, crypto.TOTPCounter(time.Now())+1)
+	require.NoError(ts.T(), err)
+	w = ts.mfaGrant(challenge.MFAToken, code)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+	assert.NotEmpty(ts.T(), token.Token)
+	assert.NotEmpty(ts.T(), token.RefreshToken)
+}
+
+func (ts *MFATestSuite) TestLegacyEncryptedFactor() {
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	// factors enrolled before the key was derived are encrypted with the secret
+	secret := crypto.GenerateTOTPSecret()
+	factor, err := models.NewTOTPFactor(u, crypto.TOTPURL(ts.Config.MFA.Issuer, u.Email, secret), ts.Config.JWT.Secret)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(factor))
+	require.NoError(ts.T(), factor.Verify(ts.API.db))
+
+	w := ts.passwordGrant()
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	challenge := MFAChallengeResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challenge))
+
+	code, err := crypto.TOTPCode(secret, crypto.TOTPCounter(time.Now()))
+	require.NoError(ts.T(), err)
+	w = ts.mfaGrant(challenge.MFAToken, code)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	// the secret has been encrypted with the configured key
+	factor, err = models.FindVerifiedTOTPFactorByUser(ts.API.db, u)
+	require.NoError(ts.T(), err)
+	_, err = factor.URL(ts.Config.MFA.EncryptionKey)
+	assert.NoError(ts.T(), err)
+}
+
+func (ts *MFATestSuite) TestMFAGrantLockout() {
+	secret := ts.enroll()
+
+	w := ts.passwordGrant()
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	challenge := MFAChallengeResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challenge))
+
+	for i := 0; i < ts.Config.MFA.MaxAttempts; i++ {
+		w = ts.mfaGrant(challenge.MFAToken, "000000")
+		require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	}
+
+	// the factor is locked, even for a valid code
+	code, err := crypto.TOTPCode(secret, crypto.TOTPCounter(time.Now())+1)
+	require.NoError(ts.T(), err)
+	w = ts.mfaGrant(challenge.MFAToken, code)
+	assert.Equal(ts.T(), http.StatusTooManyRequests, w.Code)
+
+	// the attempts are forgotten after the lockout
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	factor, err := models.FindVerifiedTOTPFactorByUser(ts.API.db, u)
+	require.NoError(ts.T(), err)
+	lastAttemptAt := time.Now().Add(-time.Second * time.Duration(ts.Config.MFA.LockoutDuration+1))
+	factor.LastAttemptAt = &lastAttemptAt
+	require.NoError(ts.T(), ts.API.db.UpdateOnly(factor, "last_attempt_at"))
+
+	w = ts.mfaGrant(challenge.MFAToken, code)
+	assert.Equal(ts.T(), http.StatusOK, w.Code)
+}
+
+func (ts *MFATestSuite) TestUnenrollFactor() {
+	secret := ts.enroll()
+
+	w := ts.request(http.MethodDelete, "http://localhost/user/factors", map[string]interface{}{
+		"code": "000000",
+	})
+	assert.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	code, err := crypto.TOTPCode(secret, crypto.TOTPCounter(time.Now())+1)
+	require.NoError(ts.T(), err)
+	w = ts.request(http.MethodDelete, "http://localhost/user/factors", map[string]interface{}{
+		"code": code,
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	w = ts.passwordGrant()
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+	assert.NotEmpty(ts.T(), token.Token)
+}
+
+func (ts *MFATestSuite) TestFactorsDisabled() {
+	ts.Config.MFA.Enabled = false
+	w := ts.request(http.MethodPost, "http://localhost/user/factors", map[string]interface{}{})
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
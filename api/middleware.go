@@ -82,18 +82,19 @@ func (a *API) loadJWSSignatureHeader(w http.ResponseWriter, r *http.Request) (co
 
 func (a *API) loadInstanceConfig(w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	ctx := r.Context()
-	config := a.getConfig(ctx)
 
 	signature := getSignature(ctx)
 	if signature == "" {
 		return nil, badRequestError("Operator signature missing")
 	}
 
+	keys, err := a.loadSecretKeySet(ctx, a.db)
+	if err != nil {
+		return nil, internalServerError("Error loading JWT signing key").WithInternalError(err)
+	}
+
 	claims := NetlifyMicroserviceClaims{}
-	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
-	_, err := p.ParseWithClaims(signature, &claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.JWT.Secret), nil
-	})
+	_, err = keys.parse(signature, &claims)
 	if err != nil {
 		return nil, badRequestError("Operator microservice signature is invalid: %v", err)
 	}
@@ -116,7 +117,7 @@ func (a *API) loadInstanceConfig(w http.ResponseWriter, r *http.Request) (contex
 		return nil, internalServerError("Database error loading instance").WithInternalError(err)
 	}
 
-	config, err = instance.Config()
+	config, err := instance.Config()
 	if err != nil {
 		return nil, internalServerError("Error loading environment config").WithInternalError(err)
 	}
@@ -176,3 +177,58 @@ func (a *API) requireEmailProvider(w http.ResponseWriter, req *http.Request) (co
 
 	return ctx, nil
 }
+
+func (a *API) requirePhoneProvider(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	ctx := req.Context()
+	config := a.getConfig(ctx)
+
+	if !config.External.Phone.Enabled {
+		return nil, badRequestError("Unsupported phone provider")
+	}
+
+	return ctx, nil
+}
+
+func (a *API) requireAnonymousProvider(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	ctx := req.Context()
+	config := a.getConfig(ctx)
+
+	if !config.External.Anonymous.Enabled {
+		return nil, badRequestError("Anonymous sign ins are disabled")
+	}
+
+	return ctx, nil
+}
+
+func (a *API) requireMFAEnabled(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	ctx := req.Context()
+	config := a.getConfig(ctx)
+
+	if !config.MFA.Enabled {
+		return nil, badRequestError("Multi-factor authentication is disabled")
+	}
+
+	return ctx, nil
+}
+
+func (a *API) requireWebAuthnEnabled(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	ctx := req.Context()
+	config := a.getConfig(ctx)
+
+	if !config.WebAuthn.Enabled {
+		return nil, badRequestError("WebAuthn is disabled")
+	}
+
+	return ctx, nil
+}
+
+func (a *API) requireOAuthServer(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	ctx := req.Context()
+	config := a.getConfig(ctx)
+
+	if !config.OAuthServer.Enabled {
+		return nil, badRequestError("OAuth server is disabled")
+	}
+
+	return ctx, nil
+}
@@ -0,0 +1,486 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/netlify/gotrue/metering"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+)
+
+// OAuthAuthorizeParams are the parameters the consent page sends back to
+// the authorize endpoint
+type OAuthAuthorizeParams struct {
+	ClientID    string `json:"client_id"`
+	RedirectURI string `json:"redirect_uri"`
+	Scope       string `json:"scope"`
+	State       string `json:"state"`
+	Nonce       string `json:"nonce"`
+	Consent     string `json:"consent"`
+}
+
+// AuthorizationCodeGrantParams are the parameters the AuthorizationCodeGrant method accepts
+type AuthorizationCodeGrantParams struct {
+	Code         string `json:"code"`
+	RedirectURI  string `json:"redirect_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// OAuthClientParams are the parameters the admin client endpoints accept
+type OAuthClientParams struct {
+	Name             string   `json:"name"`
+	RedirectURIs     []string `json:"redirect_uris"`
+	RegenerateSecret bool     `json:"regenerate_secret"`
+}
+
+// OAuthClientResponse includes the client secret, which is only returned
+// when it is generated
+type OAuthClientResponse struct {
+	*models.OAuthClient
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+const (
+	consentApprove = "approve"
+	consentDeny    = "deny"
+)
+
+// supportedScopes are the scopes clients can request
+var supportedScopes = []string{"openid", "email", "phone", "profile"}
+
+// isSupportedScope checks that every scope of a space separated list is
+// supported
+func isSupportedScope(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		supported := false
+		for _, t := range supportedScopes {
+			if s == t {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *API) loadOAuthClient(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	ctx := r.Context()
+	clientID := chi.URLParam(r, "client_id")
+
+	logEntrySetField(r, "client_id", clientID)
+
+	client, err := models.FindOAuthClientByClientID(a.db, getInstanceID(ctx), clientID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil, notFoundError("OAuth client not found")
+		}
+		return nil, internalServerError("Database error loading OAuth client").WithInternalError(err)
+	}
+
+	return withOAuthClient(ctx, client), nil
+}
+
+// findAuthorizeClient loads the client of an authorization request and
+// checks the redirect URI. Errors here are never redirected, since the
+// redirect URI can't be trusted yet.
+func (a *API) findAuthorizeClient(ctx context.Context, clientID, redirectURI string) (*models.OAuthClient, string, error) {
+	client, err := models.FindOAuthClientByClientID(a.db, getInstanceID(ctx), clientID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil, "", badRequestError("Invalid client_id")
+		}
+		return nil, "", internalServerError("Database error finding OAuth client").WithInternalError(err)
+	}
+
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !client.HasRedirectURI(redirectURI) {
+		return nil, "", badRequestError("Invalid redirect_uri")
+	}
+
+	return client, redirectURI, nil
+}
+
+func addQueryParams(rawURL string, params map[string]string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for k, v := range params {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// OAuthAuthorize starts an authorization request of a client by sending
+// the user to the consent page of the site
+func (a *API) OAuthAuthorize(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+	query := r.URL.Query()
+
+	client, redirectURI, err := a.findAuthorizeClient(ctx, query.Get("client_id"), query.Get("redirect_uri"))
+	if err != nil {
+		return err
+	}
+
+	var target string
+	if responseType := query.Get("response_type"); responseType != "code" {
+		target, err = addQueryParams(redirectURI, map[string]string{
+			"error": "unsupported_response_type",
+			"state": query.Get("state"),
+		})
+	} else if !isSupportedScope(query.Get("scope")) {
+		target, err = addQueryParams(redirectURI, map[string]string{
+			"error": "invalid_scope",
+			"state": query.Get("state"),
+		})
+	} else {
+		target, err = addQueryParams(config.OAuthServer.ConsentURL, map[string]string{
+			"client_id":    client.ClientID,
+			"client_name":  client.Name,
+			"redirect_uri": redirectURI,
+			"scope":        query.Get("scope"),
+			"state":        query.Get("state"),
+			"nonce":        query.Get("nonce"),
+		})
+	}
+	if err != nil {
+		return internalServerError("Error building redirect URL").WithInternalError(err)
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+	return nil
+}
+
+// OAuthAuthorizeConsent records the decision of the signed in user and
+// responds with the URL to send them back to the client with
+func (a *API) OAuthAuthorizeConsent(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	params := &OAuthAuthorizeParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read authorize params: %v", err)
+	}
+
+	client, redirectURI, err := a.findAuthorizeClient(ctx, params.ClientID, params.RedirectURI)
+	if err != nil {
+		return err
+	}
+
+	user, err := getUserFromClaims(ctx, a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+
+	var redirectTo string
+	switch {
+	case params.Consent == consentDeny:
+		redirectTo, err = addQueryParams(redirectURI, map[string]string{
+			"error": "access_denied",
+			"state": params.State,
+		})
+		if err != nil {
+			return internalServerError("Error building redirect URL").WithInternalError(err)
+		}
+	case params.Consent == consentApprove && !isSupportedScope(params.Scope):
+		redirectTo, err = addQueryParams(redirectURI, map[string]string{
+			"error": "invalid_scope",
+			"state": params.State,
+		})
+		if err != nil {
+			return internalServerError("Error building redirect URL").WithInternalError(err)
+		}
+	case params.Consent == consentApprove:
+		err = a.db.Transaction(func(tx *storage.Connection) error {
+			expiresIn := time.Second * time.Duration(config.OAuthServer.AuthorizationCodeExpiry)
+			code, terr := models.CreateOAuthAuthorizationCode(tx, client, user, redirectURI, params.Scope, params.Nonce, expiresIn)
+			if terr != nil {
+				return internalServerError("Database error creating authorization code").WithInternalError(terr)
+			}
+
+			if terr = models.NewAuditLogEntry(tx, instanceID, user, models.OAuthClientAuthorizedAction, map[string]interface{}{
+				"client_id": client.ClientID,
+			}); terr != nil {
+				return internalServerError("Error recording audit log entry").WithInternalError(terr)
+			}
+
+			redirectTo, terr = addQueryParams(redirectURI, map[string]string{
+				"code":  code,
+				"state": params.State,
+			})
+			if terr != nil {
+				return internalServerError("Error building redirect URL").WithInternalError(terr)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	default:
+		return unprocessableEntityError("consent must be either approve or deny")
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]string{
+		"redirect_to": redirectTo,
+	})
+}
+
+// AuthorizationCodeGrant implements the authorization_code grant type flow
+func (a *API) AuthorizationCodeGrant(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	if !config.OAuthServer.Enabled {
+		return oauthError("unsupported_grant_type", "")
+	}
+
+	params := &AuthorizationCodeGrantParams{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+			return badRequestError("Could not read authorization code grant params: %v", err)
+		}
+	} else {
+		params.Code = r.FormValue("code")
+		params.RedirectURI = r.FormValue("redirect_uri")
+		params.ClientID = r.FormValue("client_id")
+		params.ClientSecret = r.FormValue("client_secret")
+	}
+	if clientID, clientSecret, ok := r.BasicAuth(); ok {
+		params.ClientID = clientID
+		params.ClientSecret = clientSecret
+	}
+
+	if params.Code == "" {
+		return oauthError("invalid_request", "code required")
+	}
+
+	client, err := models.FindOAuthClientByClientID(a.db, instanceID, params.ClientID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return oauthError("invalid_client", "Invalid client credentials")
+		}
+		return internalServerError("Database error finding OAuth client").WithInternalError(err)
+	}
+	if !client.Authenticate(params.ClientSecret) {
+		return oauthError("invalid_client", "Invalid client credentials")
+	}
+
+	authCode, err := models.FindOAuthAuthorizationCode(a.db, instanceID, params.Code)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return oauthError("invalid_grant", "Invalid authorization code")
+		}
+		return internalServerError("Database error finding authorization code").WithInternalError(err)
+	}
+	if authCode.ClientID != client.ID || authCode.RedirectURI != params.RedirectURI {
+		return oauthError("invalid_grant", "Invalid authorization code")
+	}
+	if authCode.IsExpired() {
+		if err := authCode.Consume(a.db); err != nil && !models.IsNotFoundError(err) {
+			return internalServerError("Database error deleting authorization code").WithInternalError(err)
+		}
+		return oauthError("invalid_grant", "Authorization code has expired")
+	}
+
+	user, err := models.FindUserByInstanceIDAndID(a.db, instanceID, authCode.UserID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return oauthError("invalid_grant", "Invalid authorization code")
+		}
+		return internalServerError("Database error finding user").WithInternalError(err)
+	}
+
+	// the tokens are issued to the client, limited to the granted scope
+	grantParams := newGrantParams(r)
+	grantParams.OAuthClientID = client.ClientID
+	grantParams.Scope = authCode.Scope
+
+	var token *AccessTokenResponse
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if terr = authCode.Consume(tx); terr != nil {
+			if models.IsNotFoundError(terr) {
+				return oauthError("invalid_grant", "Invalid authorization code")
+			}
+			return internalServerError("Database error deleting authorization code").WithInternalError(terr)
+		}
+		if terr = models.NewAuditLogEntry(tx, instanceID, user, models.LoginAction, map[string]interface{}{
+			"client_id": client.ClientID,
+		}); terr != nil {
+			return terr
+		}
+
+		token, terr = a.issueRefreshToken(withNonce(ctx, authCode.Nonce), tx, user, grantParams)
+		return terr
+	})
+	if err != nil {
+		return err
+	}
+	metering.RecordLogin("authorization_code", user.ID, instanceID)
+	return sendJSON(w, http.StatusOK, token)
+}
+
+func validateRedirectURIs(uris []string) error {
+	if len(uris) == 0 {
+		return unprocessableEntityError("At least one redirect URI is required")
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return unprocessableEntityError("Redirect URI must be an absolute URL: %s", uri)
+		}
+		if u.Fragment != "" {
+			return unprocessableEntityError("Redirect URI must not contain a fragment: %s", uri)
+		}
+	}
+	return nil
+}
+
+// adminOAuthClients responds with the OAuth clients of the instance
+func (a *API) adminOAuthClients(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	clients, err := models.FindOAuthClients(a.db, getInstanceID(ctx))
+	if err != nil {
+		return internalServerError("Database error finding OAuth clients").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{
+		"clients": clients,
+	})
+}
+
+// adminOAuthClientCreate registers a new OAuth client
+func (a *API) adminOAuthClientCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+	adminUser := getAdminUser(ctx)
+
+	params := &OAuthClientParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read OAuth client params: %v", err)
+	}
+	if params.Name == "" {
+		return unprocessableEntityError("OAuth client name is required")
+	}
+	if err := validateRedirectURIs(params.RedirectURIs); err != nil {
+		return err
+	}
+
+	client, secret, err := models.NewOAuthClient(instanceID, params.Name, params.RedirectURIs)
+	if err != nil {
+		return internalServerError("Error creating OAuth client").WithInternalError(err)
+	}
+
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		if terr := tx.Create(client); terr != nil {
+			return terr
+		}
+
+		return models.NewAuditLogEntry(tx, instanceID, adminUser, models.OAuthClientCreatedAction, map[string]interface{}{
+			"client_id": client.ClientID,
+			"name":      client.Name,
+		})
+	})
+	if err != nil {
+		return internalServerError("Database error creating OAuth client").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, &OAuthClientResponse{OAuthClient: client, ClientSecret: secret})
+}
+
+// adminOAuthClientGet returns information about a single OAuth client
+func (a *API) adminOAuthClientGet(w http.ResponseWriter, r *http.Request) error {
+	return sendJSON(w, http.StatusOK, getOAuthClient(r.Context()))
+}
+
+// adminOAuthClientUpdate updates a single OAuth client
+func (a *API) adminOAuthClientUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+	adminUser := getAdminUser(ctx)
+	client := getOAuthClient(ctx)
+
+	params := &OAuthClientParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read OAuth client params: %v", err)
+	}
+
+	name := client.Name
+	if params.Name != "" {
+		name = params.Name
+	}
+	redirectURIs := []string(client.RedirectURIs)
+	if params.RedirectURIs != nil {
+		if err := validateRedirectURIs(params.RedirectURIs); err != nil {
+			return err
+		}
+		redirectURIs = params.RedirectURIs
+	}
+
+	var secret string
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if terr = client.UpdateInfo(tx, name, redirectURIs); terr != nil {
+			return terr
+		}
+
+		if params.RegenerateSecret {
+			if secret, terr = client.RegenerateSecret(tx); terr != nil {
+				return terr
+			}
+		}
+
+		return models.NewAuditLogEntry(tx, instanceID, adminUser, models.OAuthClientUpdatedAction, map[string]interface{}{
+			"client_id":          client.ClientID,
+			"regenerated_secret": params.RegenerateSecret,
+		})
+	})
+	if err != nil {
+		return internalServerError("Error updating OAuth client").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, &OAuthClientResponse{OAuthClient: client, ClientSecret: secret})
+}
+
+// adminOAuthClientDelete removes an OAuth client
+func (a *API) adminOAuthClientDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+	adminUser := getAdminUser(ctx)
+	client := getOAuthClient(ctx)
+
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		if terr := client.Delete(tx); terr != nil {
+			return terr
+		}
+
+		return models.NewAuditLogEntry(tx, instanceID, adminUser, models.OAuthClientDeletedAction, map[string]interface{}{
+			"client_id": client.ClientID,
+			"name":      client.Name,
+		})
+	})
+	if err != nil {
+		return internalServerError("Error deleting OAuth client").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{})
+}
@@ -0,0 +1,370 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type OAuthServerTestSuite struct {
+	suite.Suite
+	API    *API
+	Config *conf.Configuration
+
+	adminToken string
+	userToken  string
+	instanceID uuid.UUID
+}
+
+func TestOAuthServer(t *testing.T) {
+	api, config, instanceID, err := setupAPIForTestForInstance()
+	require.NoError(t, err)
+
+	ts := &OAuthServerTestSuite{
+		API:        api,
+		Config:     config,
+		instanceID: instanceID,
+	}
+	defer api.db.Close()
+
+	suite.Run(t, ts)
+}
+
+func (ts *OAuthServerTestSuite) SetupTest() {
+	models.TruncateAll(ts.API.db)
+	ts.Config.OAuthServer.Enabled = true
+	ts.Config.OAuthServer.ConsentURL = "https://example.com/consent"
+	ts.Config.OAuthServer.AuthorizationCodeExpiry = 300
+
+	key, err := configSigningKey(&ts.Config.JWT)
+	require.NoError(ts.T(), err)
+
+	admin, err := models.NewUser(ts.instanceID, "admin@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error creating test user model")
+	admin.Role = "supabase_admin"
+	require.NoError(ts.T(), ts.API.db.Create(admin), "Error saving new test user")
+	ts.adminToken, err = generateAccessToken(admin, nil, time.Second*time.Duration(ts.Config.JWT.Exp), key, "", "")
+	require.NoError(ts.T(), err)
+
+	u, err := models.NewUser(ts.instanceID, "test@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error creating test user model")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error saving new test user")
+	require.NoError(ts.T(), u.Confirm(ts.API.db))
+	ts.userToken, err = generateAccessToken(u, nil, time.Second*time.Duration(ts.Config.JWT.Exp), key, "", "")
+	require.NoError(ts.T(), err)
+}
+
+func (ts *OAuthServerTestSuite) request(method, path, token string, body map[string]interface{}) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+
+	req := httptest.NewRequest(method, path, &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *OAuthServerTestSuite) createClient() *OAuthClientResponse {
+	w := ts.request(http.MethodPost, "http://localhost/admin/oauth/clients", ts.adminToken, map[string]interface{}{
+		"name":          "Example App",
+		"redirect_uris": []string{"https://app.example.com/callback"},
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	client := &OAuthClientResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(client))
+	require.NotEmpty(ts.T(), client.ClientID)
+	require.NotEmpty(ts.T(), client.ClientSecret)
+	return client
+}
+
+func (ts *OAuthServerTestSuite) authorize(client *OAuthClientResponse, consent string) *url.URL {
+	w := ts.request(http.MethodPost, "http://localhost/oauth/authorize", ts.userToken, map[string]interface{}{
+		"client_id":    client.ClientID,
+		"redirect_uri": "https://app.example.com/callback",
+		"scope":        "openid email",
+		"state":        "xyz",
+		"nonce":        "n-0S6_WzA2Mj",
+		"consent":      consent,
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	data := map[string]string{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	u, err := url.Parse(data["redirect_to"])
+	require.NoError(ts.T(), err)
+	return u
+}
+
+func (ts *OAuthServerTestSuite) exchange(form url.Values, clientID, clientSecret string) *httptest.ResponseRecorder {
+	form.Set("grant_type", "authorization_code")
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientID != "" {
+		req.SetBasicAuth(clientID, clientSecret)
+	}
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *OAuthServerTestSuite) TestAuthorizationCodeFlow() {
+	client := ts.createClient()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/oauth/authorize?response_type=code&client_id="+client.ClientID+"&redirect_uri=https://app.example.com/callback&state=xyz", nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusFound, w.Code, w.Body.String())
+	consent, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "example.com", consent.Host)
+	assert.Equal(ts.T(), "/consent", consent.Path)
+	assert.Equal(ts.T(), client.ClientID, consent.Query().Get("client_id"))
+	assert.Equal(ts.T(), "Example App", consent.Query().Get("client_name"))
+	assert.Equal(ts.T(), "xyz", consent.Query().Get("state"))
+
+	redirect := ts.authorize(client, "approve")
+	assert.Equal(ts.T(), "app.example.com", redirect.Host)
+	assert.Equal(ts.T(), "xyz", redirect.Query().Get("state"))
+	code := redirect.Query().Get("code")
+	require.NotEmpty(ts.T(), code)
+
+	form := url.Values{}
+	form.Set("code", code)
+	form.Set("redirect_uri", "https://app.example.com/callback")
+	w = ts.exchange(form, client.ClientID, client.ClientSecret)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+	assert.NotEmpty(ts.T(), token.RefreshToken)
+	claims := &GoTrueClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(token.Token, claims)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "test@example.com", claims.Email)
+	assert.Equal(ts.T(), "n-0S6_WzA2Mj", claims.Nonce)
+	assert.Equal(ts.T(), client.ClientID, claims.ClientID)
+	assert.Equal(ts.T(), client.ClientID, claims.Audience)
+	assert.Equal(ts.T(), "openid email", claims.Scope)
+	assert.Empty(ts.T(), claims.Role)
+	assert.Nil(ts.T(), token.User)
+
+	// codes are single use
+	w = ts.exchange(form, client.ClientID, client.ClientSecret)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(ts.T(), w.Body.String(), "invalid_grant")
+}
+
+func (ts *OAuthServerTestSuite) TestClientTokens() {
+	client := ts.createClient()
+	code := ts.authorize(client, "approve").Query().Get("code")
+
+	form := url.Values{}
+	form.Set("code", code)
+	form.Set("redirect_uri", "https://app.example.com/callback")
+	w := ts.exchange(form, client.ClientID, client.ClientSecret)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+
+	// the token can't act as the user on first-party endpoints
+	w = ts.request(http.MethodGet, "http://localhost/user", token.Token, nil)
+	assert.Equal(ts.T(), http.StatusForbidden, w.Code)
+	w = ts.request(http.MethodGet, "http://localhost/admin/users", token.Token, nil)
+	assert.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+
+	// the userinfo endpoint returns the claims of the granted scope
+	w = ts.request(http.MethodGet, "http://localhost/userinfo", token.Token, nil)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	info := map[string]interface{}{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&info))
+	assert.Equal(ts.T(), "test@example.com", info["email"])
+	assert.NotContains(ts.T(), info, "app_metadata")
+	assert.NotContains(ts.T(), info, "role")
+
+	// refreshed tokens are still limited to the client
+	w = ts.request(http.MethodPost, "http://localhost/token?grant_type=refresh_token", "", map[string]interface{}{
+		"refresh_token": token.RefreshToken,
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	refreshed := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&refreshed))
+	claims := &GoTrueClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(refreshed.Token, claims)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), client.ClientID, claims.ClientID)
+	assert.Equal(ts.T(), "openid email", claims.Scope)
+	w = ts.request(http.MethodGet, "http://localhost/user", refreshed.Token, nil)
+	assert.Equal(ts.T(), http.StatusForbidden, w.Code)
+}
+
+func (ts *OAuthServerTestSuite) TestClientSecretPost() {
+	client := ts.createClient()
+	code := ts.authorize(client, "approve").Query().Get("code")
+
+	form := url.Values{}
+	form.Set("code", code)
+	form.Set("redirect_uri", "https://app.example.com/callback")
+	form.Set("client_id", client.ClientID)
+	form.Set("client_secret", "wrong")
+	w := ts.exchange(form, "", "")
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(ts.T(), w.Body.String(), "invalid_client")
+
+	form.Set("client_secret", client.ClientSecret)
+	w = ts.exchange(form, "", "")
+	assert.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+}
+
+func (ts *OAuthServerTestSuite) TestExchangeRequiresMatchingRedirectURI() {
+	client := ts.createClient()
+	code := ts.authorize(client, "approve").Query().Get("code")
+
+	form := url.Values{}
+	form.Set("code", code)
+	form.Set("redirect_uri", "https://app.example.com/other")
+	w := ts.exchange(form, client.ClientID, client.ClientSecret)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(ts.T(), w.Body.String(), "invalid_grant")
+}
+
+func (ts *OAuthServerTestSuite) TestDeny() {
+	client := ts.createClient()
+	redirect := ts.authorize(client, "deny")
+	assert.Equal(ts.T(), "access_denied", redirect.Query().Get("error"))
+	assert.Equal(ts.T(), "xyz", redirect.Query().Get("state"))
+	assert.Empty(ts.T(), redirect.Query().Get("code"))
+}
+
+func (ts *OAuthServerTestSuite) TestInvalidScope() {
+	client := ts.createClient()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/oauth/authorize?response_type=code&scope=openid+admin&state=xyz&client_id="+client.ClientID, nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusFound, w.Code)
+	redirect, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "app.example.com", redirect.Host)
+	assert.Equal(ts.T(), "invalid_scope", redirect.Query().Get("error"))
+
+	w = ts.request(http.MethodPost, "http://localhost/oauth/authorize", ts.userToken, map[string]interface{}{
+		"client_id":    client.ClientID,
+		"redirect_uri": "https://app.example.com/callback",
+		"scope":        "openid admin",
+		"state":        "xyz",
+		"consent":      "approve",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	data := map[string]string{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	redirect, err = url.Parse(data["redirect_to"])
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "invalid_scope", redirect.Query().Get("error"))
+	assert.Equal(ts.T(), "xyz", redirect.Query().Get("state"))
+	assert.Empty(ts.T(), redirect.Query().Get("code"))
+}
+
+func (ts *OAuthServerTestSuite) TestAuthorizeValidatesClient() {
+	client := ts.createClient()
+
+	for _, query := range []string{
+		"response_type=code&client_id=unknown&redirect_uri=https://app.example.com/callback",
+		"response_type=code&client_id=" + client.ClientID + "&redirect_uri=https://evil.example.com/callback",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/oauth/authorize?"+query, nil)
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+		assert.Empty(ts.T(), w.Header().Get("Location"))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/oauth/authorize?response_type=token&client_id="+client.ClientID, nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusFound, w.Code)
+	redirect, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "app.example.com", redirect.Host)
+	assert.Equal(ts.T(), "unsupported_response_type", redirect.Query().Get("error"))
+}
+
+func (ts *OAuthServerTestSuite) TestAdminClients() {
+	client := ts.createClient()
+
+	w := ts.request(http.MethodGet, "http://localhost/admin/oauth/clients", ts.adminToken, nil)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	data := struct {
+		Clients []*models.OAuthClient `json:"clients"`
+	}{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Len(ts.T(), data.Clients, 1)
+	assert.Equal(ts.T(), client.ClientID, data.Clients[0].ClientID)
+	assert.NotContains(ts.T(), w.Body.String(), "secret")
+
+	w = ts.request(http.MethodPut, "http://localhost/admin/oauth/clients/"+client.ClientID, ts.adminToken, map[string]interface{}{
+		"redirect_uris":     []string{"https://app.example.com/new"},
+		"regenerate_secret": true,
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	updated := &OAuthClientResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(updated))
+	assert.Equal(ts.T(), "Example App", updated.Name)
+	assert.Equal(ts.T(), models.StringList{"https://app.example.com/new"}, updated.RedirectURIs)
+	assert.NotEmpty(ts.T(), updated.ClientSecret)
+	assert.NotEqual(ts.T(), client.ClientSecret, updated.ClientSecret)
+
+	w = ts.request(http.MethodDelete, "http://localhost/admin/oauth/clients/"+client.ClientID, ts.adminToken, nil)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	w = ts.request(http.MethodGet, "http://localhost/admin/oauth/clients/"+client.ClientID, ts.adminToken, nil)
+	assert.Equal(ts.T(), http.StatusNotFound, w.Code)
+}
+
+func (ts *OAuthServerTestSuite) TestAdminClientValidatesRedirectURIs() {
+	for _, uris := range [][]string{
+		{},
+		{"/relative"},
+		{"https://app.example.com/callback#fragment"},
+	} {
+		w := ts.request(http.MethodPost, "http://localhost/admin/oauth/clients", ts.adminToken, map[string]interface{}{
+			"name":          "Example App",
+			"redirect_uris": uris,
+		})
+		assert.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+	}
+}
+
+func (ts *OAuthServerTestSuite) TestDisabled() {
+	ts.Config.OAuthServer.Enabled = false
+	client := ts.createClient()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/oauth/authorize?response_type=code&client_id="+client.ClientID, nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	w = ts.exchange(url.Values{"code": {"code"}}, client.ClientID, client.ClientSecret)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(ts.T(), w.Body.String(), "unsupported_grant_type")
+}
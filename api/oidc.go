@@ -0,0 +1,177 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+)
+
+// OpenIDConfiguration is the OpenID Connect discovery document. No ID tokens
+// are issued, so it only describes the endpoints GoTrue implements. The
+// authorization endpoint is only listed if the OAuth server is enabled.
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported,omitempty"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// UserInfo holds the OpenID Connect standard claims of a user
+type UserInfo struct {
+	Subject             string                 `json:"sub"`
+	Email               string                 `json:"email,omitempty"`
+	EmailVerified       bool                   `json:"email_verified"`
+	PhoneNumber         string                 `json:"phone_number,omitempty"`
+	PhoneNumberVerified bool                   `json:"phone_number_verified"`
+	Name                string                 `json:"name,omitempty"`
+	Picture             string                 `json:"picture,omitempty"`
+	UpdatedAt           int64                  `json:"updated_at"`
+	Role                string                 `json:"role,omitempty"`
+	AppMetaData         map[string]interface{} `json:"app_metadata"`
+	UserMetaData        map[string]interface{} `json:"user_metadata"`
+}
+
+// jwtIssuer returns the iss claim of issued tokens. It defaults to the
+// external URL of the API.
+func (a *API) jwtIssuer(config *conf.Configuration) string {
+	if config.JWT.Issuer != "" {
+		return config.JWT.Issuer
+	}
+	return a.config.API.ExternalURL
+}
+
+// OpenIDConfiguration returns the OpenID Connect discovery document
+func (a *API) OpenIDConfiguration(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+
+	issuer := a.jwtIssuer(config)
+	if issuer == "" {
+		return notFoundError("OpenID Connect discovery requires JWT_ISSUER or API_EXTERNAL_URL to be set")
+	}
+	baseURL := strings.TrimSuffix(issuer, "/")
+
+	discovery := &OpenIDConfiguration{
+		Issuer:                            issuer,
+		TokenEndpoint:                     baseURL + "/token",
+		UserInfoEndpoint:                  baseURL + "/userinfo",
+		JWKSURI:                           baseURL + "/.well-known/jwks.json",
+		GrantTypesSupported:               []string{"password", "refresh_token"},
+		SubjectTypesSupported:             []string{"public"},
+		ScopesSupported:                   supportedScopes,
+		TokenEndpointAuthMethodsSupported: []string{"none"},
+		ClaimsSupported: []string{
+			"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce",
+			"email", "email_verified", "phone_number", "phone_number_verified",
+			"name", "picture", "updated_at", "role", "app_metadata", "user_metadata",
+		},
+	}
+
+	// registered clients sign in with the authorization code flow
+	if config.OAuthServer.Enabled {
+		discovery.AuthorizationEndpoint = baseURL + "/oauth/authorize"
+		discovery.ResponseTypesSupported = []string{"code"}
+		discovery.GrantTypesSupported = []string{"authorization_code", "password", "refresh_token"}
+		discovery.TokenEndpointAuthMethodsSupported = []string{"client_secret_basic", "client_secret_post"}
+	}
+
+	return sendJSON(w, http.StatusOK, discovery)
+}
+
+// UserInfo returns the OpenID Connect claims of the authenticated user
+func (a *API) UserInfo(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	claims := getClaims(ctx)
+	if claims == nil {
+		return badRequestError("Could not read claims")
+	}
+
+	userID, err := uuid.FromString(claims.Subject)
+	if err != nil {
+		return badRequestError("Could not read User ID claim")
+	}
+
+	user, err := models.FindUserByInstanceIDAndID(a.db, getInstanceID(ctx), userID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError(err.Error())
+		}
+		return internalServerError("Database error finding user").WithInternalError(err)
+	}
+
+	info := newUserInfo(user)
+	if claims.ClientID == "" {
+		return sendJSON(w, http.StatusOK, info)
+	}
+
+	// OAuth clients only get the claims of the scope the user granted
+	scopes := strings.Fields(claims.Scope)
+	if !isStringInSlice("openid", scopes) {
+		return forbiddenError("The token was not granted the openid scope")
+	}
+	return sendJSON(w, http.StatusOK, info.limitToScopes(scopes))
+}
+
+// limitToScopes returns the claims the OpenID Connect scopes give access to.
+// The role and app metadata are never shared with OAuth clients.
+func (info *UserInfo) limitToScopes(scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub": info.Subject,
+	}
+	if isStringInSlice("email", scopes) && info.Email != "" {
+		claims["email"] = info.Email
+		claims["email_verified"] = info.EmailVerified
+	}
+	if isStringInSlice("phone", scopes) && info.PhoneNumber != "" {
+		claims["phone_number"] = info.PhoneNumber
+		claims["phone_number_verified"] = info.PhoneNumberVerified
+	}
+	if isStringInSlice("profile", scopes) {
+		if info.Name != "" {
+			claims["name"] = info.Name
+		}
+		if info.Picture != "" {
+			claims["picture"] = info.Picture
+		}
+		claims["updated_at"] = info.UpdatedAt
+		claims["user_metadata"] = info.UserMetaData
+	}
+	return claims
+}
+
+func newUserInfo(user *models.User) *UserInfo {
+	info := &UserInfo{
+		Subject:             user.ID.String(),
+		Email:               user.Email,
+		EmailVerified:       user.IsConfirmed(),
+		PhoneNumberVerified: user.IsPhoneConfirmed(),
+		UpdatedAt:           user.UpdatedAt.Unix(),
+		Role:                user.Role,
+		AppMetaData:         user.AppMetaData,
+		UserMetaData:        user.UserMetaData,
+	}
+	if user.Phone != "" {
+		info.PhoneNumber = "+" + user.Phone
+	}
+
+	// external providers store the profile in the user metadata
+	if name, ok := user.UserMetaData["full_name"].(string); ok {
+		info.Name = name
+	} else if name, ok := user.UserMetaData["name"].(string); ok {
+		info.Name = name
+	}
+	if picture, ok := user.UserMetaData["avatar_url"].(string); ok {
+		info.Picture = picture
+	}
+	return info
+}
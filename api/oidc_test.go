@@ -0,0 +1,204 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type OIDCTestSuite struct {
+	suite.Suite
+	API    *API
+	Config *conf.Configuration
+
+	instanceID uuid.UUID
+}
+
+func TestOIDC(t *testing.T) {
+	api, config, instanceID, err := setupAPIForTestForInstance()
+	require.NoError(t, err)
+
+	ts := &OIDCTestSuite{
+		API:        api,
+		Config:     config,
+		instanceID: instanceID,
+	}
+	defer api.db.Close()
+
+	suite.Run(t, ts)
+}
+
+func (ts *OIDCTestSuite) SetupTest() {
+	models.TruncateAll(ts.API.db)
+	ts.Config.JWT.Issuer = "https://auth.example.com"
+
+	u, err := models.NewUser(ts.instanceID, "test@example.com", "password", ts.Config.JWT.Aud, map[string]interface{}{"full_name": "Test User"})
+	require.NoError(ts.T(), err, "Error creating test user model")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error saving new test user")
+	require.NoError(ts.T(), u.Confirm(ts.API.db))
+}
+
+func (ts *OIDCTestSuite) login() string {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", strings.NewReader(`{"email":"test@example.com","password":"password"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+	return token.Token
+}
+
+func (ts *OIDCTestSuite) TestOpenIDConfiguration() {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/.well-known/openid-configuration", nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	config := OpenIDConfiguration{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&config))
+	assert.Equal(ts.T(), "https://auth.example.com", config.Issuer)
+	assert.Empty(ts.T(), config.AuthorizationEndpoint)
+	assert.Empty(ts.T(), config.ResponseTypesSupported)
+	assert.Equal(ts.T(), "https://auth.example.com/token", config.TokenEndpoint)
+	assert.Equal(ts.T(), "https://auth.example.com/userinfo", config.UserInfoEndpoint)
+	assert.Equal(ts.T(), "https://auth.example.com/.well-known/jwks.json", config.JWKSURI)
+}
+
+func (ts *OIDCTestSuite) TestOpenIDConfigurationWithOAuthServer() {
+	ts.Config.OAuthServer.Enabled = true
+	defer func() { ts.Config.OAuthServer.Enabled = false }()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/.well-known/openid-configuration", nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	config := OpenIDConfiguration{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&config))
+	assert.Equal(ts.T(), "https://auth.example.com/oauth/authorize", config.AuthorizationEndpoint)
+	assert.Equal(ts.T(), []string{"code"}, config.ResponseTypesSupported)
+	assert.Contains(ts.T(), config.GrantTypesSupported, "authorization_code")
+}
+
+func (ts *OIDCTestSuite) TestOpenIDConfigurationRequiresIssuer() {
+	ts.Config.JWT.Issuer = ""
+	externalURL := ts.API.config.API.ExternalURL
+	ts.API.config.API.ExternalURL = ""
+	defer func() { ts.API.config.API.ExternalURL = externalURL }()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/.well-known/openid-configuration", nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	assert.Equal(ts.T(), http.StatusNotFound, w.Code)
+}
+
+func (ts *OIDCTestSuite) TestTokenClaims() {
+	before := time.Now().Unix()
+	token := ts.login()
+
+	claims := &GoTrueClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(token, claims)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "https://auth.example.com", claims.Issuer)
+	assert.GreaterOrEqual(ts.T(), claims.IssuedAt, before)
+	assert.GreaterOrEqual(ts.T(), claims.AuthTime, before)
+	assert.Empty(ts.T(), claims.Nonce)
+}
+
+func (ts *OIDCTestSuite) TestAuthTimeIsSessionStart() {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", strings.NewReader(`{"email":"test@example.com","password":"password"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+
+	claims := &GoTrueClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(token.Token, claims)
+	require.NoError(ts.T(), err)
+
+	// signing in on another device doesn't change the auth_time of the session
+	time.Sleep(time.Second)
+	ts.login()
+
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=refresh_token", strings.NewReader(`{"refresh_token":"`+token.RefreshToken+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	refreshed := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&refreshed))
+
+	refreshedClaims := &GoTrueClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(refreshed.Token, refreshedClaims)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), claims.SessionID, refreshedClaims.SessionID)
+	assert.Equal(ts.T(), claims.AuthTime, refreshedClaims.AuthTime)
+}
+
+func (ts *OIDCTestSuite) TestUserInfo() {
+	token := ts.login()
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		req := httptest.NewRequest(method, "http://localhost/userinfo", nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+		info := UserInfo{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&info))
+		assert.NotEmpty(ts.T(), info.Subject)
+		assert.Equal(ts.T(), "test@example.com", info.Email)
+		assert.True(ts.T(), info.EmailVerified)
+		assert.False(ts.T(), info.PhoneNumberVerified)
+		assert.Equal(ts.T(), "Test User", info.Name)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/userinfo", nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	assert.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+}
+
+func (ts *OIDCTestSuite) TestNonce() {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/authorize?provider=github&nonce=n-0S6_WzA2Mj", nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusFound, w.Code)
+	u, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(ts.T(), err)
+
+	ctx, err := WithInstanceConfig(context.Background(), ts.Config, ts.instanceID)
+	require.NoError(ts.T(), err)
+	ctx, err = ts.API.loadExternalState(ctx, u.Query().Get("state"))
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "n-0S6_WzA2Mj", getNonce(ctx))
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	token, err := ts.API.issueRefreshToken(ctx, ts.API.db, user, models.GrantParams{})
+	require.NoError(ts.T(), err)
+
+	claims := &GoTrueClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(token.Token, claims)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "n-0S6_WzA2Mj", claims.Nonce)
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/sms"
+	"github.com/netlify/gotrue/storage"
+	"github.com/pkg/errors"
+)
+
+const smsVerification = "sms"
+
+// phoneRegexp matches E.164 phone numbers without the leading +
+var phoneRegexp = regexp.MustCompile(`^[1-9][0-9]{7,14}$`)
+
+// OtpParams holds the parameters for a one-time password request
+type OtpParams struct {
+	Phone string `json:"phone"`
+}
+
+// Otp sends a one-time password by SMS, signing the user up if needed
+func (a *API) Otp(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+	params := &OtpParams{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	err := jsonDecoder.Decode(params)
+	if err != nil {
+		return badRequestError("Could not read OTP params: %v", err)
+	}
+
+	if params.Phone == "" {
+		return unprocessableEntityError("OTP requires a phone number")
+	}
+	if params.Phone, err = validatePhone(params.Phone); err != nil {
+		return err
+	}
+
+	smsSender, err := a.SMSSender(ctx)
+	if err != nil {
+		return internalServerError("Error configuring SMS provider").WithInternalError(err)
+	}
+
+	aud := a.requestAud(ctx, r)
+	user, err := models.FindUserByPhoneAndAudience(a.db, instanceID, params.Phone, aud)
+	if err != nil && !models.IsNotFoundError(err) {
+		return internalServerError("Database error finding user").WithInternalError(err)
+	}
+	if user == nil && config.DisableSignup {
+		return forbiddenError("Signups not allowed for this instance")
+	}
+
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if user == nil {
+			user, terr = a.signupNewUser(ctx, tx, &SignupParams{
+				Phone:    params.Phone,
+				Provider: "phone",
+				Aud:      aud,
+			})
+			if terr != nil {
+				return terr
+			}
+		}
+
+		if terr = models.NewAuditLogEntry(tx, instanceID, user, models.UserRecoveryRequestedAction, nil); terr != nil {
+			return terr
+		}
+		return sendPhoneOtp(tx, user, smsSender, config)
+	})
+	if err != nil {
+		if errors.Is(err, MaxFrequencyLimitError) {
+			return tooManyRequestsError(fmt.Sprintf("For security purposes, you can only request this once every %d seconds", int(config.SMS.MaxFrequency.Seconds())))
+		}
+		var e *HTTPError
+		if errors.As(err, &e) {
+			return err
+		}
+		return internalServerError("Error sending otp").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, make(map[string]string))
+}
+
+func (a *API) smsVerify(ctx context.Context, conn *storage.Connection, params *VerifyParams, aud string) (*models.User, error) {
+	instanceID := getInstanceID(ctx)
+	config := a.getConfig(ctx)
+
+	phone, err := validatePhone(params.Phone)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := models.FindUserByPhoneAndAudience(conn, instanceID, phone, aud)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil, expiredTokenError("Token has expired or is invalid")
+		}
+		return nil, internalServerError("Database error finding user").WithInternalError(err)
+	}
+
+	// codes are short, so each one can only be guessed a few times. The
+	// attempt is counted outside of the transaction of the request, which is
+	// rolled back.
+	ok, err := user.CountPhoneOTPAttempt(a.db, config.SMS.OtpMaxAttempts)
+	if err != nil {
+		return nil, internalServerError("Database error updating user").WithInternalError(err)
+	}
+	if !ok {
+		return nil, expiredTokenError("Token has expired or is invalid")
+	}
+
+	tokenHash := crypto.HashOTP(user.Phone, params.Token)
+	otpExp := time.Duration(config.SMS.OtpExp) * time.Second
+	switch {
+	case isValidOtp(user.ConfirmationToken, tokenHash, user.ConfirmationSentAt, otpExp):
+	case isValidOtp(user.RecoveryToken, tokenHash, user.RecoverySentAt, otpExp):
+	default:
+		return nil, expiredTokenError("Token has expired or is invalid")
+	}
+
+	err = conn.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if terr = user.Recover(tx); terr != nil {
+			return terr
+		}
+		if !user.IsPhoneConfirmed() {
+			if terr = models.NewAuditLogEntry(tx, instanceID, user, models.UserSignedUpAction, nil); terr != nil {
+				return terr
+			}
+
+			if terr = triggerEventHooks(ctx, tx, SignupEvent, user, instanceID, config); terr != nil {
+				return terr
+			}
+		}
+		return user.ConfirmPhone(tx)
+	})
+	if err != nil {
+		return nil, internalServerError("Database error updating user").WithInternalError(err)
+	}
+	return user, nil
+}
+
+func isValidOtp(storedHash, tokenHash string, sentAt *time.Time, otpExp time.Duration) bool {
+	if storedHash == "" || sentAt == nil || time.Now().After(sentAt.Add(otpExp)) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(storedHash), []byte(tokenHash)) == 1
+}
+
+// validatePhone normalizes a phone number to E.164 without the leading +
+func validatePhone(phone string) (string, error) {
+	phone = strings.NewReplacer("+", "", " ", "", "-", "", "(", "", ")", "").Replace(strings.TrimSpace(phone))
+	if !phoneRegexp.MatchString(phone) {
+		return "", unprocessableEntityError("Invalid phone number format")
+	}
+	return phone, nil
+}
+
+func sendPhoneConfirmation(tx *storage.Connection, u *models.User, smsSender sms.SMSSender, config *conf.Configuration) error {
+	if u.ConfirmationSentAt != nil && !u.ConfirmationSentAt.Add(config.SMS.MaxFrequency).Before(time.Now()) {
+		return MaxFrequencyLimitError
+	}
+
+	otp, err := sendOtpMessage(u, smsSender, config)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	u.ConfirmationToken = crypto.HashOTP(u.Phone, otp)
+	u.ConfirmationSentAt = &now
+	u.PhoneOTPAttempts = 0
+	return errors.Wrap(tx.UpdateOnly(u, "confirmation_token", "confirmation_sent_at", "phone_otp_attempts"), "Database error updating user for confirmation")
+}
+
+func sendPhoneOtp(tx *storage.Connection, u *models.User, smsSender sms.SMSSender, config *conf.Configuration) error {
+	// like magic links, sms logins reuse the recovery db timer to prevent potential abuse
+	if u.RecoverySentAt != nil && !u.RecoverySentAt.Add(config.SMS.MaxFrequency).Before(time.Now()) {
+		return MaxFrequencyLimitError
+	}
+
+	otp, err := sendOtpMessage(u, smsSender, config)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	u.RecoveryToken = crypto.HashOTP(u.Phone, otp)
+	u.RecoverySentAt = &now
+	u.PhoneOTPAttempts = 0
+	return errors.Wrap(tx.UpdateOnly(u, "recovery_token", "recovery_sent_at", "phone_otp_attempts"), "Database error updating user for recovery")
+}
+
+func sendOtpMessage(u *models.User, smsSender sms.SMSSender, config *conf.Configuration) (string, error) {
+	otp, err := crypto.GenerateOTP(config.SMS.OtpLength)
+	if err != nil {
+		return "", errors.Wrap(err, "Error generating otp")
+	}
+	message, err := sms.OtpMessage(config.SMS.Template, otp)
+	if err != nil {
+		return "", errors.Wrap(err, "Error rendering sms template")
+	}
+	if err := smsSender.Send(u.Phone, message); err != nil {
+		return "", errors.Wrap(err, "Error sending sms")
+	}
+	return otp, nil
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/sms"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type PhoneTestSuite struct {
+	suite.Suite
+	API    *API
+	Config *conf.Configuration
+
+	instanceID uuid.UUID
+	smsServer  *httptest.Server
+	messages   []sms.WebhookPayload
+}
+
+func TestPhone(t *testing.T) {
+	api, config, instanceID, err := setupAPIForTestForInstance()
+	require.NoError(t, err)
+
+	ts := &PhoneTestSuite{
+		API:        api,
+		Config:     config,
+		instanceID: instanceID,
+	}
+	defer api.db.Close()
+
+	ts.smsServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := sms.WebhookPayload{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		ts.messages = append(ts.messages, payload)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.smsServer.Close()
+
+	suite.Run(t, ts)
+}
+
+func (ts *PhoneTestSuite) SetupTest() {
+	models.TruncateAll(ts.API.db)
+	ts.messages = nil
+	ts.Config.External.Phone.Enabled = true
+	ts.Config.DisableSignup = false
+	ts.Config.SMS.Autoconfirm = false
+	ts.Config.SMS.Provider = "webhook"
+	ts.Config.SMS.Webhook.URL = ts.smsServer.URL
+}
+
+func (ts *PhoneTestSuite) request(method, path string, body map[string]interface{}) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+
+	req := httptest.NewRequest(method, path, &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *PhoneTestSuite) createUser(phone, password string) *models.User {
+	u, err := models.NewUser(ts.instanceID, "", password, ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error creating test user model")
+	u.Phone = phone
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error saving new test user")
+	require.NoError(ts.T(), u.ConfirmPhone(ts.API.db))
+	return u
+}
+
+// lastOtp returns the code from the last SMS sent to phone
+func (ts *PhoneTestSuite) lastOtp(phone string) string {
+	require.NotEmpty(ts.T(), ts.messages)
+	message := ts.messages[len(ts.messages)-1]
+	require.Equal(ts.T(), phone, message.Phone)
+
+	matches := regexp.MustCompile(`[0-9]{6}`).FindStringSubmatch(message.Message)
+	require.Len(ts.T(), matches, 1)
+	return matches[0]
+}
+
+func (ts *PhoneTestSuite) TestSignupWithPhone() {
+	w := ts.request(http.MethodPost, "http://localhost/signup", map[string]interface{}{
+		"phone":    "+1 (555) 123-4567",
+		"password": "test123",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	data := models.User{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	assert.Equal(ts.T(), "15551234567", data.Phone)
+	assert.Equal(ts.T(), "phone", data.AppMetaData["provider"])
+	assert.Nil(ts.T(), data.PhoneConfirmedAt)
+
+	otp := ts.lastOtp("15551234567")
+	w = ts.request(http.MethodPost, "http://localhost/verify", map[string]interface{}{
+		"type":  smsVerification,
+		"phone": "+15551234567",
+		"token": otp,
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+	assert.NotEmpty(ts.T(), token.Token)
+	assert.NotEmpty(ts.T(), token.RefreshToken)
+
+	u, err := models.FindUserByPhoneAndAudience(ts.API.db, ts.instanceID, "15551234567", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	assert.True(ts.T(), u.IsPhoneConfirmed())
+	assert.Empty(ts.T(), u.ConfirmationToken)
+
+	w = ts.request(http.MethodPost, "http://localhost/token?grant_type=password", map[string]interface{}{
+		"phone":    "15551234567",
+		"password": "test123",
+	})
+	assert.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+}
+
+func (ts *PhoneTestSuite) TestSignupWithPhoneAutoconfirm() {
+	ts.Config.SMS.Autoconfirm = true
+
+	w := ts.request(http.MethodPost, "http://localhost/signup", map[string]interface{}{
+		"phone":    "15551234567",
+		"password": "test123",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+	assert.NotEmpty(ts.T(), token.Token)
+	assert.Empty(ts.T(), ts.messages)
+}
+
+func (ts *PhoneTestSuite) TestSignupWithEmailAndPhone() {
+	w := ts.request(http.MethodPost, "http://localhost/signup", map[string]interface{}{
+		"email":    "test@example.com",
+		"phone":    "15551234567",
+		"password": "test123",
+	})
+	assert.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+}
+
+func (ts *PhoneTestSuite) TestSignupWithInvalidPhone() {
+	w := ts.request(http.MethodPost, "http://localhost/signup", map[string]interface{}{
+		"phone":    "555-CALL-NOW",
+		"password": "test123",
+	})
+	assert.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+}
+
+func (ts *PhoneTestSuite) TestSignupDuplicatePhone() {
+	ts.createUser("15551234567", "test123")
+
+	w := ts.request(http.MethodPost, "http://localhost/signup", map[string]interface{}{
+		"phone":    "15551234567",
+		"password": "test123",
+	})
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *PhoneTestSuite) TestOtpLogin() {
+	ts.createUser("15551234567", "test123")
+
+	w := ts.request(http.MethodPost, "http://localhost/otp", map[string]interface{}{
+		"phone": "+15551234567",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	otp := ts.lastOtp("15551234567")
+	body := map[string]interface{}{
+		"type":  smsVerification,
+		"phone": "15551234567",
+		"token": otp,
+	}
+	w = ts.request(http.MethodPost, "http://localhost/verify", body)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	// codes can only be used once
+	w = ts.request(http.MethodPost, "http://localhost/verify", body)
+	assert.Equal(ts.T(), http.StatusGone, w.Code)
+}
+
+func (ts *PhoneTestSuite) TestOtpSignsUpNewUser() {
+	w := ts.request(http.MethodPost, "http://localhost/otp", map[string]interface{}{
+		"phone": "15551234567",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	u, err := models.FindUserByPhoneAndAudience(ts.API.db, ts.instanceID, "15551234567", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	assert.False(ts.T(), u.IsPhoneConfirmed())
+	assert.Empty(ts.T(), u.EncryptedPassword)
+
+	w = ts.request(http.MethodPost, "http://localhost/verify", map[string]interface{}{
+		"type":  smsVerification,
+		"phone": "15551234567",
+		"token": ts.lastOtp("15551234567"),
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	u, err = models.FindUserByPhoneAndAudience(ts.API.db, ts.instanceID, "15551234567", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	assert.True(ts.T(), u.IsPhoneConfirmed())
+}
+
+func (ts *PhoneTestSuite) TestOtpSignupDisabled() {
+	ts.Config.DisableSignup = true
+
+	w := ts.request(http.MethodPost, "http://localhost/otp", map[string]interface{}{
+		"phone": "15551234567",
+	})
+	assert.Equal(ts.T(), http.StatusForbidden, w.Code)
+	assert.Empty(ts.T(), ts.messages)
+}
+
+func (ts *PhoneTestSuite) TestOtpMaxFrequency() {
+	ts.createUser("15551234567", "test123")
+
+	w := ts.request(http.MethodPost, "http://localhost/otp", map[string]interface{}{
+		"phone": "15551234567",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	w = ts.request(http.MethodPost, "http://localhost/otp", map[string]interface{}{
+		"phone": "15551234567",
+	})
+	assert.Equal(ts.T(), http.StatusTooManyRequests, w.Code)
+	assert.Len(ts.T(), ts.messages, 1)
+}
+
+func (ts *PhoneTestSuite) TestVerifyInvalidOtp() {
+	ts.createUser("15551234567", "test123")
+
+	w := ts.request(http.MethodPost, "http://localhost/otp", map[string]interface{}{
+		"phone": "15551234567",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	otp := ts.lastOtp("15551234567")
+	wrong := otp[:5] + string('0'+(otp[5]-'0'+1)%10)
+	w = ts.request(http.MethodPost, "http://localhost/verify", map[string]interface{}{
+		"type":  smsVerification,
+		"phone": "15551234567",
+		"token": wrong,
+	})
+	assert.Equal(ts.T(), http.StatusGone, w.Code)
+
+	w = ts.request(http.MethodPost, "http://localhost/verify", map[string]interface{}{
+		"type":  smsVerification,
+		"phone": "15550000000",
+		"token": otp,
+	})
+	assert.Equal(ts.T(), http.StatusGone, w.Code)
+}
+
+func (ts *PhoneTestSuite) TestVerifyOtpMaxAttempts() {
+	ts.createUser("15551234567", "test123")
+
+	w := ts.request(http.MethodPost, "http://localhost/otp", map[string]interface{}{
+		"phone": "15551234567",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	otp := ts.lastOtp("15551234567")
+	wrong := otp[:5] + string('0'+(otp[5]-'0'+1)%10)
+	for i := 0; i < ts.Config.SMS.OtpMaxAttempts; i++ {
+		w = ts.request(http.MethodPost, "http://localhost/verify", map[string]interface{}{
+			"type":  smsVerification,
+			"phone": "15551234567",
+			"token": wrong,
+		})
+		require.Equal(ts.T(), http.StatusGone, w.Code)
+	}
+
+	// the code is no longer accepted after too many attempts
+	w = ts.request(http.MethodPost, "http://localhost/verify", map[string]interface{}{
+		"type":  smsVerification,
+		"phone": "15551234567",
+		"token": otp,
+	})
+	assert.Equal(ts.T(), http.StatusGone, w.Code)
+}
+
+func (ts *PhoneTestSuite) TestPasswordGrantEmailProviderDisabled() {
+	ts.Config.External.Email.Disabled = true
+	defer func() { ts.Config.External.Email.Disabled = false }()
+	ts.createUser("15551234567", "test123")
+
+	w := ts.request(http.MethodPost, "http://localhost/token?grant_type=password", map[string]interface{}{
+		"phone":    "15551234567",
+		"password": "test123",
+	})
+	assert.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	w = ts.request(http.MethodPost, "http://localhost/token?grant_type=password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "test123",
+	})
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *PhoneTestSuite) TestPasswordGrantPhoneNotConfirmed() {
+	u, err := models.NewUser(ts.instanceID, "", "test123", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	u.Phone = "15551234567"
+	require.NoError(ts.T(), ts.API.db.Create(u))
+
+	w := ts.request(http.MethodPost, "http://localhost/token?grant_type=password", map[string]interface{}{
+		"phone":    "15551234567",
+		"password": "test123",
+	})
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *PhoneTestSuite) TestPhoneProviderDisabled() {
+	ts.Config.External.Phone.Enabled = false
+
+	w := ts.request(http.MethodPost, "http://localhost/otp", map[string]interface{}{
+		"phone": "15551234567",
+	})
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	w = ts.request(http.MethodPost, "http://localhost/signup", map[string]interface{}{
+		"phone":    "15551234567",
+		"password": "test123",
+	})
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/metering"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+)
+
+// pkceAuthCodeExpiry is how long an auth code can be exchanged for tokens
+const pkceAuthCodeExpiry = 5 * time.Minute
+
+// PKCEGrantParams are the parameters the PKCEGrant method accepts
+type PKCEGrantParams struct {
+	AuthCode     string `json:"auth_code"`
+	CodeVerifier string `json:"code_verifier"`
+}
+
+type codeChallenge struct {
+	Challenge string
+	Method    string
+}
+
+// newCodeChallenge validates the PKCE parameters of a request. It returns
+// nil when the client doesn't use PKCE.
+func newCodeChallenge(challenge, method string) (*codeChallenge, error) {
+	if challenge == "" {
+		if method != "" {
+			return nil, badRequestError("code_challenge_method requires a code_challenge")
+		}
+		return nil, nil
+	}
+
+	if err := models.ValidateCodeChallenge(challenge); err != nil {
+		return nil, badRequestError("Invalid code_challenge: %v", err)
+	}
+	method, err := models.ParseCodeChallengeMethod(method)
+	if err != nil {
+		return nil, badRequestError("Invalid code_challenge_method: %v", err)
+	}
+
+	return &codeChallenge{Challenge: challenge, Method: method}, nil
+}
+
+// createFlowState stores an authenticated PKCE login, returning the auth
+// code the client exchanges for tokens
+func createFlowState(tx *storage.Connection, config *conf.Configuration, user *models.User, challenge *codeChallenge, authenticationMethod, providerToken, nonce string) (string, error) {
+	flowState, err := models.NewFlowState(user, challenge.Challenge, challenge.Method, authenticationMethod)
+	if err != nil {
+		return "", internalServerError("Error creating flow state").WithInternalError(err)
+	}
+	if err := flowState.SetProviderToken(config.External.TokenEncryptionKey, providerToken); err != nil {
+		return "", internalServerError("Error creating flow state").WithInternalError(err)
+	}
+	flowState.Nonce = nonce
+
+	authCode := flowState.GenerateAuthCode()
+	if err := saveFlowState(tx, config, flowState); err != nil {
+		return "", internalServerError("Database error creating flow state").WithInternalError(err)
+	}
+	return authCode, nil
+}
+
+// saveFlowState stores a new flow state. The flow states of abandoned
+// logins are deleted at the same time.
+func saveFlowState(tx *storage.Connection, config *conf.Configuration, flowState *models.FlowState) error {
+	// magic link flow states wait for the link to be used
+	maxAge := time.Second * time.Duration(config.Mailer.OtpExp)
+	if maxAge < pkceAuthCodeExpiry {
+		maxAge = pkceAuthCodeExpiry
+	}
+	if err := models.DeleteExpiredFlowStates(tx, pkceAuthCodeExpiry, maxAge); err != nil {
+		return err
+	}
+	return tx.Create(flowState)
+}
+
+// PKCEGrant implements the pkce grant type flow, exchanging an auth code and
+// the code verifier for tokens
+func (a *API) PKCEGrant(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	params := &PKCEGrantParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read pkce grant params: %v", err)
+	}
+
+	if params.AuthCode == "" || params.CodeVerifier == "" {
+		return oauthError("invalid_request", "auth_code and code_verifier required")
+	}
+
+	flowState, err := models.FindFlowStateByAuthCode(a.db, instanceID, params.AuthCode)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return oauthError("invalid_grant", "Invalid auth code")
+		}
+		return internalServerError("Database error finding flow state").WithInternalError(err)
+	}
+	if flowState.IsAuthCodeExpired(pkceAuthCodeExpiry) {
+		if err := flowState.Consume(a.db); err != nil && !models.IsNotFoundError(err) {
+			return internalServerError("Database error deleting flow state").WithInternalError(err)
+		}
+		return oauthError("invalid_grant", "Auth code has expired")
+	}
+	if !flowState.VerifyCodeVerifier(params.CodeVerifier) {
+		return oauthError("invalid_grant", "Invalid code verifier")
+	}
+
+	user, err := models.FindUserByInstanceIDAndID(a.db, instanceID, flowState.UserID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return oauthError("invalid_grant", "Invalid auth code")
+		}
+		return internalServerError("Database error finding user").WithInternalError(err)
+	}
+	providerToken, err := flowState.ProviderToken(config.External.TokenEncryptionKey)
+	if err != nil {
+		return internalServerError("Error decrypting provider token").WithInternalError(err)
+	}
+
+	var token *AccessTokenResponse
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if terr = flowState.Consume(tx); terr != nil {
+			if models.IsNotFoundError(terr) {
+				return oauthError("invalid_grant", "Invalid auth code")
+			}
+			return internalServerError("Database error deleting flow state").WithInternalError(terr)
+		}
+
+		token, terr = a.issueRefreshToken(withNonce(ctx, flowState.Nonce), tx, user, newGrantParams(r))
+		return terr
+	})
+	if err != nil {
+		return err
+	}
+	metering.RecordLogin("pkce", user.ID, instanceID)
+	token.User = user
+	token.ProviderToken = providerToken
+	return sendJSON(w, http.StatusOK, token)
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+const testCodeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+func testCodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type PKCETestSuite struct {
+	suite.Suite
+	API    *API
+	Config *conf.Configuration
+
+	instanceID uuid.UUID
+}
+
+func TestPKCE(t *testing.T) {
+	api, config, instanceID, err := setupAPIForTestForInstance()
+	require.NoError(t, err)
+
+	ts := &PKCETestSuite{
+		API:        api,
+		Config:     config,
+		instanceID: instanceID,
+	}
+	defer api.db.Close()
+
+	suite.Run(t, ts)
+}
+
+func (ts *PKCETestSuite) SetupTest() {
+	models.TruncateAll(ts.API.db)
+
+	u, err := models.NewUser(ts.instanceID, "test@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error creating test user model")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error saving new test user")
+	require.NoError(ts.T(), u.Confirm(ts.API.db))
+}
+
+func (ts *PKCETestSuite) request(method, path string, body map[string]interface{}) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+
+	req := httptest.NewRequest(method, path, &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *PKCETestSuite) magicLink(body map[string]interface{}) *url.URL {
+	w := ts.request(http.MethodPost, "http://localhost/magiclink", body)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	require.NotEmpty(ts.T(), u.RecoveryToken)
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost/verify?type=magiclink&token=%s", u.RecoveryToken), nil)
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusSeeOther, w.Code, w.Body.String())
+
+	redirect, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(ts.T(), err)
+	return redirect
+}
+
+func (ts *PKCETestSuite) exchange(authCode, verifier string) *httptest.ResponseRecorder {
+	return ts.request(http.MethodPost, "http://localhost/token?grant_type=pkce", map[string]interface{}{
+		"auth_code":     authCode,
+		"code_verifier": verifier,
+	})
+}
+
+func (ts *PKCETestSuite) TestMagicLink() {
+	redirect := ts.magicLink(map[string]interface{}{
+		"email":                 "test@example.com",
+		"code_challenge":        testCodeChallenge(testCodeVerifier),
+		"code_challenge_method": "S256",
+	})
+	assert.Empty(ts.T(), redirect.Fragment)
+	authCode := redirect.Query().Get("code")
+	require.NotEmpty(ts.T(), authCode)
+
+	w := ts.exchange(authCode, testCodeVerifier)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+	assert.NotEmpty(ts.T(), token.Token)
+	assert.NotEmpty(ts.T(), token.RefreshToken)
+	assert.Equal(ts.T(), "test@example.com", token.User.Email)
+
+	// auth codes are single use
+	w = ts.exchange(authCode, testCodeVerifier)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(ts.T(), w.Body.String(), "invalid_grant")
+}
+
+func (ts *PKCETestSuite) TestPlainChallenge() {
+	redirect := ts.magicLink(map[string]interface{}{
+		"email":          "test@example.com",
+		"code_challenge": testCodeVerifier,
+	})
+
+	w := ts.exchange(redirect.Query().Get("code"), testCodeVerifier)
+	assert.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+}
+
+func (ts *PKCETestSuite) TestInvalidVerifier() {
+	redirect := ts.magicLink(map[string]interface{}{
+		"email":                 "test@example.com",
+		"code_challenge":        testCodeChallenge(testCodeVerifier),
+		"code_challenge_method": "s256",
+	})
+	authCode := redirect.Query().Get("code")
+
+	w := ts.exchange(authCode, "wrong-verifier-wrong-verifier-wrong-verifier")
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(ts.T(), w.Body.String(), "invalid_grant")
+
+	// the client that holds the verifier can still use the code
+	w = ts.exchange(authCode, testCodeVerifier)
+	assert.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+}
+
+func (ts *PKCETestSuite) TestExpiredAuthCode() {
+	redirect := ts.magicLink(map[string]interface{}{
+		"email":                 "test@example.com",
+		"code_challenge":        testCodeChallenge(testCodeVerifier),
+		"code_challenge_method": "s256",
+	})
+	authCode := redirect.Query().Get("code")
+
+	flowState, err := models.FindFlowStateByAuthCode(ts.API.db, ts.instanceID, authCode)
+	require.NoError(ts.T(), err)
+	issuedAt := time.Now().Add(-pkceAuthCodeExpiry - time.Minute)
+	flowState.AuthCodeIssuedAt = &issuedAt
+	require.NoError(ts.T(), ts.API.db.UpdateOnly(flowState, "auth_code_issued_at"))
+
+	w := ts.exchange(authCode, testCodeVerifier)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(ts.T(), w.Body.String(), "Auth code has expired")
+}
+
+func (ts *PKCETestSuite) TestExpiredFlowStatesAreDeleted() {
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	abandoned, err := models.NewFlowState(u, testCodeChallenge(testCodeVerifier), models.CodeChallengeMethodS256, "github")
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), abandoned.SetProviderToken(ts.Config.External.TokenEncryptionKey, "provider-token"))
+	authCode := abandoned.GenerateAuthCode()
+	issuedAt := time.Now().Add(-pkceAuthCodeExpiry - time.Minute)
+	abandoned.AuthCodeIssuedAt = &issuedAt
+	require.NoError(ts.T(), ts.API.db.Create(abandoned))
+
+	// the provider token is only stored encrypted
+	assert.NotContains(ts.T(), string(abandoned.EncryptedProviderToken), "provider-token")
+	providerToken, err := abandoned.ProviderToken(ts.Config.External.TokenEncryptionKey)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "provider-token", providerToken)
+
+	ts.magicLink(map[string]interface{}{
+		"email":          "test@example.com",
+		"code_challenge": testCodeVerifier,
+	})
+
+	_, err = models.FindFlowStateByAuthCode(ts.API.db, ts.instanceID, authCode)
+	assert.True(ts.T(), models.IsNotFoundError(err))
+}
+
+func (ts *PKCETestSuite) TestMagicLinkWithoutChallenge() {
+	redirect := ts.magicLink(map[string]interface{}{
+		"email": "test@example.com",
+	})
+	assert.Empty(ts.T(), redirect.Query().Get("code"))
+
+	v, err := url.ParseQuery(redirect.Fragment)
+	require.NoError(ts.T(), err)
+	assert.NotEmpty(ts.T(), v.Get("access_token"))
+}
+
+func (ts *PKCETestSuite) TestInvalidChallenge() {
+	w := ts.request(http.MethodPost, "http://localhost/magiclink", map[string]interface{}{
+		"email":          "test@example.com",
+		"code_challenge": "too-short",
+	})
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	w = ts.request(http.MethodPost, "http://localhost/magiclink", map[string]interface{}{
+		"email":                 "test@example.com",
+		"code_challenge":        testCodeChallenge(testCodeVerifier),
+		"code_challenge_method": "s512",
+	})
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/authorize?provider=github&code_challenge=too-short", nil)
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
@@ -50,6 +50,14 @@ type idTokenClaims struct {
 	IsPrivateEmail  bool   `json:"is_private_email,string"`
 }
 
+func init() {
+	registerOAuth("apple", ProtocolOAuth2, func(ext *conf.ProviderConfiguration) conf.OAuthProviderConfiguration {
+		return ext.Apple
+	}, func(ext conf.OAuthProviderConfiguration, scopes string) (OAuthProvider, error) {
+		return NewAppleProvider(ext)
+	})
+}
+
 func NewAppleProvider(ext conf.OAuthProviderConfiguration) (OAuthProvider, error) {
 	if err := ext.Validate(); err != nil {
 		return nil, err
@@ -136,6 +144,9 @@ func (p AppleProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (*Use
 			return &UserProvidedData{}, err
 		}
 		user = &UserProvidedData{
+			Metadata: map[string]string{
+				providerIdKey: idToken.Claims.(*idTokenClaims).Subject,
+			},
 			Emails: []Email{{
 				Email:    idToken.Claims.(*idTokenClaims).Email,
 				Verified: true,
@@ -19,6 +19,7 @@ type azureProvider struct {
 }
 
 type azureUser struct {
+	Sub   string `json:"sub"`
 	Name  string `json:"name"`
 	Email string `json:"email"`
 }
@@ -29,6 +30,12 @@ type azureEmail struct {
 	Verified bool   `json:"is_confirmed"`
 }
 
+func init() {
+	registerOAuth("azure", ProtocolOAuth2, func(ext *conf.ProviderConfiguration) conf.OAuthProviderConfiguration {
+		return ext.Azure
+	}, NewAzureProvider)
+}
+
 // NewAzureProvider creates a Azure account provider.
 func NewAzureProvider(ext conf.OAuthProviderConfiguration, scopes string) (OAuthProvider, error) {
 	if err := ext.Validate(); err != nil {
@@ -72,7 +79,8 @@ func (g azureProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (*Use
 
 	return &UserProvidedData{
 		Metadata: map[string]string{
-			nameKey: u.Name,
+			nameKey:       u.Name,
+			providerIdKey: u.Sub,
 		},
 		Emails: []Email{{
 			Email:    u.Email,
@@ -19,6 +19,7 @@ type bitbucketProvider struct {
 }
 
 type bitbucketUser struct {
+	UUID   string `json:"uuid"`
 	Name   string `json:"display_name"`
 	Avatar struct {
 		Href string `json:"href"`
@@ -35,6 +36,14 @@ type bitbucketEmails struct {
 	Values []bitbucketEmail `json:"values"`
 }
 
+func init() {
+	registerOAuth("bitbucket", ProtocolOAuth2, func(ext *conf.ProviderConfiguration) conf.OAuthProviderConfiguration {
+		return ext.Bitbucket
+	}, func(ext conf.OAuthProviderConfiguration, scopes string) (OAuthProvider, error) {
+		return NewBitbucketProvider(ext)
+	})
+}
+
 // NewBitbucketProvider creates a Bitbucket account provider.
 func NewBitbucketProvider(ext conf.OAuthProviderConfiguration) (OAuthProvider, error) {
 	if err := ext.Validate(); err != nil {
@@ -71,8 +80,9 @@ func (g bitbucketProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (
 
 	data := &UserProvidedData{
 		Metadata: map[string]string{
-			nameKey:      u.Name,
-			avatarURLKey: u.Avatar.Href,
+			nameKey:       u.Name,
+			avatarURLKey:  u.Avatar.Href,
+			providerIdKey: u.UUID,
 		},
 	}
 
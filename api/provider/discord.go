@@ -28,6 +28,12 @@ type discordUser struct {
 	Verified      bool   `json:"verified"`
 }
 
+func init() {
+	registerOAuth("discord", ProtocolOAuth2, func(ext *conf.ProviderConfiguration) conf.OAuthProviderConfiguration {
+		return ext.Discord
+	}, NewDiscordProvider)
+}
+
 // NewDiscordProvider creates a Discord account provider.
 func NewDiscordProvider(ext conf.OAuthProviderConfiguration, scopes string) (OAuthProvider, error) {
 	if err := ext.Validate(); err != nil {
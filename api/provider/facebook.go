@@ -24,6 +24,7 @@ type facebookProvider struct {
 }
 
 type facebookUser struct {
+	ID        string `json:"id"`
 	Email     string `json:"email"`
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
@@ -35,11 +36,17 @@ type facebookUser struct {
 	} `json:"picture"`
 }
 
+func init() {
+	registerOAuth("facebook", ProtocolOAuth2, func(ext *conf.ProviderConfiguration) conf.OAuthProviderConfiguration {
+		return ext.Facebook
+	}, NewFacebookProvider)
+}
+
 // NewFacebookProvider creates a Facebook account provider.
 func NewFacebookProvider(ext conf.OAuthProviderConfiguration, scopes string) (OAuthProvider, error) {
 	authHost := chooseHost(ext.URL, defaultFacebookAuthBase)
 	tokenHost := chooseHost(ext.URL, defaultFacebookTokenBase)
-	profileURL := chooseHost(ext.URL, defaultFacebookAPIBase) + "/me?fields=email,first_name,last_name,name,picture"
+	profileURL := chooseHost(ext.URL, defaultFacebookAPIBase) + "/me?fields=id,email,first_name,last_name,name,picture"
 
 	return &facebookProvider{
 		Config: &oauth2.Config{
@@ -80,9 +87,10 @@ func (p facebookProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (*
 
 	return &UserProvidedData{
 		Metadata: map[string]string{
-			aliasKey:     u.Alias,
-			nameKey:      strings.TrimSpace(u.FirstName + " " + u.LastName),
-			avatarURLKey: u.Avatar.Data.URL,
+			aliasKey:      u.Alias,
+			nameKey:       strings.TrimSpace(u.FirstName + " " + u.LastName),
+			avatarURLKey:  u.Avatar.Data.URL,
+			providerIdKey: u.ID,
 		},
 		Emails: []Email{{
 			Email:    u.Email,
@@ -2,6 +2,7 @@ package provider
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"strings"
 
@@ -22,10 +23,11 @@ type githubProvider struct {
 }
 
 type githubUser struct {
-	UserName  string `json:"login"`
-	Email     string `json:"email"`
-	Name      string `json:"name"`
-	AvatarURL string `json:"avatar_url"`
+	ID        json.Number `json:"id"`
+	UserName  string      `json:"login"`
+	Email     string      `json:"email"`
+	Name      string      `json:"name"`
+	AvatarURL string      `json:"avatar_url"`
 }
 
 type githubUserEmail struct {
@@ -34,6 +36,12 @@ type githubUserEmail struct {
 	Verified bool   `json:"verified"`
 }
 
+func init() {
+	registerOAuth("github", ProtocolOAuth2, func(ext *conf.ProviderConfiguration) conf.OAuthProviderConfiguration {
+		return ext.Github
+	}, NewGithubProvider)
+}
+
 // NewGithubProvider creates a Github account provider.
 func NewGithubProvider(ext conf.OAuthProviderConfiguration, scopes string) (OAuthProvider, error) {
 	if err := ext.Validate(); err != nil {
@@ -76,9 +84,10 @@ func (g githubProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (*Us
 
 	data := &UserProvidedData{
 		Metadata: map[string]string{
-			userNameKey:  u.UserName,
-			nameKey:      u.Name,
-			avatarURLKey: u.AvatarURL,
+			userNameKey:   u.UserName,
+			nameKey:       u.Name,
+			avatarURLKey:  u.AvatarURL,
+			providerIdKey: u.ID.String(),
 		},
 	}
 
@@ -2,6 +2,7 @@ package provider
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 
 	"github.com/netlify/gotrue/conf"
@@ -18,10 +19,11 @@ type gitlabProvider struct {
 }
 
 type gitlabUser struct {
-	Email       string `json:"email"`
-	Name        string `json:"name"`
-	AvatarURL   string `json:"avatar_url"`
-	ConfirmedAt string `json:"confirmed_at"`
+	ID          json.Number `json:"id"`
+	Email       string      `json:"email"`
+	Name        string      `json:"name"`
+	AvatarURL   string      `json:"avatar_url"`
+	ConfirmedAt string      `json:"confirmed_at"`
 }
 
 type gitlabUserEmail struct {
@@ -29,6 +31,12 @@ type gitlabUserEmail struct {
 	Email string `json:"email"`
 }
 
+func init() {
+	registerOAuth("gitlab", ProtocolOAuth2, func(ext *conf.ProviderConfiguration) conf.OAuthProviderConfiguration {
+		return ext.Gitlab
+	}, NewGitlabProvider)
+}
+
 // NewGitlabProvider creates a Gitlab account provider.
 func NewGitlabProvider(ext conf.OAuthProviderConfiguration, scopes string) (OAuthProvider, error) {
 	if err := ext.Validate(); err != nil {
@@ -67,8 +75,9 @@ func (g gitlabProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (*Us
 
 	data := &UserProvidedData{
 		Metadata: map[string]string{
-			nameKey:      u.Name,
-			avatarURLKey: u.AvatarURL,
+			nameKey:       u.Name,
+			avatarURLKey:  u.AvatarURL,
+			providerIdKey: u.ID.String(),
 		},
 	}
 
@@ -19,12 +19,19 @@ type googleProvider struct {
 }
 
 type googleUser struct {
+	ID            string `json:"id"`
 	Name          string `json:"name"`
 	AvatarURL     string `json:"picture"`
 	Email         string `json:"email"`
 	EmailVerified bool   `json:"verified_email"`
 }
 
+func init() {
+	registerOAuth("google", ProtocolOAuth2, func(ext *conf.ProviderConfiguration) conf.OAuthProviderConfiguration {
+		return ext.Google
+	}, NewGoogleProvider)
+}
+
 // NewGoogleProvider creates a Google account provider.
 func NewGoogleProvider(ext conf.OAuthProviderConfiguration, scopes string) (OAuthProvider, error) {
 	if err := ext.Validate(); err != nil {
@@ -65,8 +72,9 @@ func (g googleProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (*Us
 
 	data := &UserProvidedData{
 		Metadata: map[string]string{
-			nameKey:      u.Name,
-			avatarURLKey: u.AvatarURL,
+			nameKey:       u.Name,
+			avatarURLKey:  u.AvatarURL,
+			providerIdKey: u.ID,
 		},
 	}
 
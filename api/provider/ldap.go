@@ -0,0 +1,194 @@
+package provider
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/netlify/gotrue/conf"
+)
+
+var (
+	// ErrLDAPUserNotFound is returned when no entry of the directory
+	// matches the email
+	ErrLDAPUserNotFound = errors.New("User not found in directory")
+	// ErrLDAPInvalidCredentials is returned when the directory rejects the
+	// password of the user
+	ErrLDAPInvalidCredentials = errors.New("Invalid credentials")
+)
+
+// LDAPProvider authenticates users with their password against a directory
+type LDAPProvider struct {
+	Config *conf.LDAPProviderConfiguration
+}
+
+// NewLDAPProvider creates an LDAP provider
+func NewLDAPProvider(ext conf.LDAPProviderConfiguration) (*LDAPProvider, error) {
+	if ext.URL == "" {
+		return nil, errors.New("Missing LDAP URL")
+	}
+	if ext.BaseDN == "" {
+		return nil, errors.New("Missing LDAP base DN")
+	}
+	if !strings.Contains(ext.SearchFilter, "{email}") {
+		return nil, errors.New("LDAP search filter must contain {email}")
+	}
+
+	return &LDAPProvider{Config: &ext}, nil
+}
+
+func (p *LDAPProvider) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: p.Config.InsecureSkipVerify}
+	if p.Config.RootCA != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(p.Config.RootCA)) {
+			return nil, errors.New("Invalid LDAP root CA")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func (p *LDAPProvider) dial() (*ldap.Conn, error) {
+	tlsConfig, err := p.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := ldap.DialURL(p.Config.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(time.Duration(p.Config.Timeout) * time.Second)
+
+	if p.Config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Authenticate finds the entry of the email in the directory and binds as it
+// with the password. It returns the account of the user and the groups the
+// user is a member of.
+func (p *LDAPProvider) Authenticate(email, password string) (*UserProvidedData, []string, error) {
+	// an empty password is an unauthenticated bind, which directories
+	// accept for any DN
+	if password == "" {
+		return nil, nil, ErrLDAPInvalidCredentials
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	if p.Config.BindDN != "" {
+		if err := conn.Bind(p.Config.BindDN, p.Config.BindPassword); err != nil {
+			return nil, nil, fmt.Errorf("Binding as %s failed: %v", p.Config.BindDN, err)
+		}
+	}
+
+	filter := strings.Replace(p.Config.SearchFilter, "{email}", ldap.EscapeFilter(email), -1)
+	req := ldap.NewSearchRequest(
+		p.Config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, p.Config.Timeout, false,
+		filter,
+		[]string{p.Config.IDAttribute, p.Config.EmailAttribute, p.Config.NameAttribute, p.Config.GroupAttribute},
+		nil,
+	)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch len(res.Entries) {
+	case 0:
+		return nil, nil, ErrLDAPUserNotFound
+	case 1:
+	default:
+		return nil, nil, fmt.Errorf("Found %d directory entries for %s", len(res.Entries), email)
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, nil, ErrLDAPInvalidCredentials
+		}
+		return nil, nil, err
+	}
+
+	id := ldapEntryID(entry, p.Config.IDAttribute)
+	if id == "" {
+		return nil, nil, fmt.Errorf("Directory entry %s has no %s", entry.DN, p.Config.IDAttribute)
+	}
+
+	// the directory is trusted with the email of the entry, which may
+	// differ in case from the one the user entered
+	entryEmail := entry.GetAttributeValue(p.Config.EmailAttribute)
+	if entryEmail == "" {
+		entryEmail = email
+	}
+
+	data := &UserProvidedData{
+		Emails: []Email{{
+			Email:    entryEmail,
+			Verified: true,
+			Primary:  true,
+		}},
+		Metadata: map[string]string{
+			providerIdKey: id,
+			nameKey:       entry.GetAttributeValue(p.Config.NameAttribute),
+		},
+	}
+	return data, entry.GetAttributeValues(p.Config.GroupAttribute), nil
+}
+
+// ldapEntryID returns the value of the ID attribute of the entry. The binary
+// objectGUID of Active Directory is formatted like a UUID, with the first
+// three groups stored little endian.
+func ldapEntryID(entry *ldap.Entry, attribute string) string {
+	if !strings.EqualFold(attribute, "objectGUID") {
+		return entry.GetAttributeValue(attribute)
+	}
+	b := entry.GetRawAttributeValue(attribute)
+	if len(b) != 16 {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x",
+		[]byte{b[3], b[2], b[1], b[0]}, []byte{b[5], b[4]}, []byte{b[7], b[6]}, b[8:10], b[10:])
+}
+
+// GroupRole returns the role of the first of the configured group roles the
+// user is a member of, or the default role. Groups match the DN or the CN of
+// a group the user is a member of.
+func (p *LDAPProvider) GroupRole(groups []string) string {
+	for _, rule := range p.Config.GroupRoles {
+		for _, group := range groups {
+			if strings.EqualFold(group, rule.Group) || strings.EqualFold(ldapCommonName(group), rule.Group) {
+				return rule.Role
+			}
+		}
+	}
+	return p.Config.DefaultRole
+}
+
+// ldapCommonName returns the CN of the DN, or an empty string
+func ldapCommonName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return ""
+	}
+	for _, attr := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "cn") {
+			return attr.Value
+		}
+	}
+	return ""
+}
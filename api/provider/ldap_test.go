@@ -0,0 +1,25 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLDAPEntryID(t *testing.T) {
+	entry := &ldap.Entry{
+		DN: "cn=Alice,ou=people,dc=example,dc=com",
+		Attributes: []*ldap.EntryAttribute{
+			{Name: "entryUUID", Values: []string{"5b3a4e1c-8f2d-4c6a-9e7b-1d2f3a4b5c6d"}},
+			{Name: "objectGUID", ByteValues: [][]byte{{
+				0x1c, 0x4e, 0x3a, 0x5b, 0x2d, 0x8f, 0x6a, 0x4c,
+				0x9e, 0x7b, 0x1d, 0x2f, 0x3a, 0x4b, 0x5c, 0x6d,
+			}}},
+		},
+	}
+
+	assert.Equal(t, "5b3a4e1c-8f2d-4c6a-9e7b-1d2f3a4b5c6d", ldapEntryID(entry, "entryUUID"))
+	assert.Equal(t, "5b3a4e1c-8f2d-4c6a-9e7b-1d2f3a4b5c6d", ldapEntryID(entry, "objectGUID"))
+	assert.Equal(t, "", ldapEntryID(entry, "nsUniqueId"))
+}
@@ -0,0 +1,430 @@
+package provider
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/netlify/gotrue/conf"
+	"golang.org/x/oauth2"
+)
+
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+const (
+	// oidcDiscoveryTTL is how long the discovery document of an issuer is
+	// cached
+	oidcDiscoveryTTL = 24 * time.Hour
+	// oidcKeySetTTL is how long the keys of an issuer are cached
+	oidcKeySetTTL = time.Hour
+	// minOIDCKeySetRefresh limits how often ID tokens signed with an
+	// unknown key fetch the keys again
+	minOIDCKeySetRefresh = time.Minute
+)
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+var oidcIssuerCache = newOIDCCache()
+
+// OIDCProvider is a generic OpenID Connect provider. Users are identified by
+// the claims of the ID token the provider issues.
+type OIDCProvider struct {
+	*oauth2.Config
+	Issuer       string
+	JWKSURL      string
+	UserInfoURL  string
+	providerName string
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcAudience is the aud claim, which is either a string or a list of them.
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var aud string
+	if err := json.Unmarshal(data, &aud); err == nil {
+		*a = oidcAudience{aud}
+		return nil
+	}
+	var auds []string
+	if err := json.Unmarshal(data, &auds); err != nil {
+		return err
+	}
+	*a = auds
+	return nil
+}
+
+func (a oidcAudience) contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcBool is a boolean claim, which some providers send as a string.
+type oidcBool bool
+
+func (b *oidcBool) UnmarshalJSON(data []byte) error {
+	var v bool
+	if err := json.Unmarshal(data, &v); err == nil {
+		*b = oidcBool(v)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*b = s == "true"
+	return nil
+}
+
+type oidcUser struct {
+	Subject           string   `json:"sub"`
+	Email             string   `json:"email"`
+	EmailVerified     oidcBool `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+	Picture           string   `json:"picture"`
+}
+
+type oidcIDTokenClaims struct {
+	oidcUser
+	Issuer    string       `json:"iss"`
+	Audience  oidcAudience `json:"aud"`
+	ExpiresAt int64        `json:"exp"`
+	Nonce     string       `json:"nonce"`
+}
+
+func (c *oidcIDTokenClaims) Valid() error {
+	if time.Now().Unix() > c.ExpiresAt {
+		return errors.New("ID token is expired")
+	}
+	return nil
+}
+
+type oidcCacheEntry struct {
+	discovery          *oidcDiscovery
+	discoveryExpiresAt time.Time
+	keySet             *jwk.Set
+	keySetFetchedAt    time.Time
+}
+
+// oidcCache caches the discovery documents and keys of issuers
+type oidcCache struct {
+	sync.Mutex
+	entries map[string]*oidcCacheEntry
+	now     func() time.Time
+}
+
+func newOIDCCache() *oidcCache {
+	return &oidcCache{
+		entries: map[string]*oidcCacheEntry{},
+		now:     time.Now,
+	}
+}
+
+func (c *oidcCache) entry(issuer string) *oidcCacheEntry {
+	entry, ok := c.entries[issuer]
+	if !ok {
+		entry = &oidcCacheEntry{}
+		c.entries[issuer] = entry
+	}
+	return entry
+}
+
+// discovery returns the discovery document of the issuer, fetching it if
+// the cached copy expired
+func (c *oidcCache) discovery(issuer string) (*oidcDiscovery, error) {
+	c.Lock()
+	entry := c.entry(issuer)
+	if entry.discovery != nil && c.now().Before(entry.discoveryExpiresAt) {
+		defer c.Unlock()
+		return entry.discovery, nil
+	}
+	c.Unlock()
+
+	discovery, err := fetchOIDCDiscovery(issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	entry.discovery = discovery
+	entry.discoveryExpiresAt = c.now().Add(oidcDiscoveryTTL)
+	c.Unlock()
+	return discovery, nil
+}
+
+// keySet returns the keys of the issuer, fetching them if the cached copy
+// expired. With refresh they are fetched again unless that just happened,
+// for issuers that rotated their keys.
+func (c *oidcCache) keySet(issuer, jwksURL string, refresh bool) (*jwk.Set, error) {
+	c.Lock()
+	entry := c.entry(issuer)
+	age := c.now().Sub(entry.keySetFetchedAt)
+	if entry.keySet != nil && age < oidcKeySetTTL && (!refresh || age < minOIDCKeySetRefresh) {
+		defer c.Unlock()
+		return entry.keySet, nil
+	}
+	c.Unlock()
+
+	set, err := jwk.FetchHTTP(jwksURL, jwk.WithHTTPClient(oidcHTTPClient))
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	entry.keySet = set
+	entry.keySetFetchedAt = c.now()
+	c.Unlock()
+	return set, nil
+}
+
+func fetchOIDCDiscovery(issuer string) (*oidcDiscovery, error) {
+	res, err := oidcHTTPClient.Get(issuer + oidcDiscoveryPath)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OpenID Connect discovery of %s failed with status %d", issuer, res.StatusCode)
+	}
+
+	discovery := &oidcDiscovery{}
+	if err := json.NewDecoder(res.Body).Decode(discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("OpenID Connect discovery returned issuer %s instead of %s", discovery.Issuer, issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("OpenID Connect discovery of %s is missing endpoints", issuer)
+	}
+	return discovery, nil
+}
+
+type oidcNonceKey struct{}
+
+// WithOIDCNonce adds the nonce sent to an OpenID Connect provider with the
+// authorization request to the context. The ID token has to contain it.
+func WithOIDCNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, oidcNonceKey{}, nonce)
+}
+
+func getOIDCNonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(oidcNonceKey{}).(string)
+	return nonce
+}
+
+// NewOIDCProvider creates a generic OpenID Connect provider by discovering
+// the endpoints of its issuer.
+func NewOIDCProvider(name string, ext conf.OIDCProviderConfiguration, scopes string) (OAuthProvider, error) {
+	if err := ValidateOIDCName(name); err != nil {
+		return nil, err
+	}
+	if err := ext.Validate(); err != nil {
+		return nil, err
+	}
+
+	discovery, err := oidcIssuerCache.discovery(strings.TrimSuffix(ext.Issuer, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCProvider{
+		Config: &oauth2.Config{
+			ClientID:     ext.ClientID,
+			ClientSecret: ext.Secret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  discovery.AuthorizationEndpoint,
+				TokenURL: discovery.TokenEndpoint,
+			},
+			Scopes:      oidcScopes(ext.Scopes, scopes),
+			RedirectURL: ext.RedirectURI,
+		},
+		Issuer:       discovery.Issuer,
+		JWKSURL:      discovery.JWKSURI,
+		UserInfoURL:  discovery.UserInfoEndpoint,
+		providerName: name,
+	}, nil
+}
+
+// oidcScopes returns the space separated scopes requested from the provider
+// without duplicates, always starting with openid, email and profile
+func oidcScopes(extra ...string) []string {
+	scopes := []string{}
+	seen := map[string]bool{}
+	for _, s := range strings.Fields("openid email profile " + strings.Join(extra, " ")) {
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+func (p OIDCProvider) GetOAuthToken(code string) (*oauth2.Token, error) {
+	return p.Exchange(oauth2.NoContext, code)
+}
+
+func (p OIDCProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (*UserProvidedData, error) {
+	idToken, ok := tok.Extra("id_token").(string)
+	if !ok || idToken == "" {
+		return nil, fmt.Errorf("%s did not return an ID token", p.providerName)
+	}
+
+	claims, err := p.verifyIDToken(idToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != getOIDCNonce(ctx) {
+		return nil, errors.New("ID token has an incorrect nonce")
+	}
+
+	// some providers only return the profile from the userinfo endpoint
+	u := claims.oidcUser
+	if u.Email == "" && p.UserInfoURL != "" {
+		var info oidcUser
+		if err := makeRequest(ctx, tok, p.Config, p.UserInfoURL, &info); err != nil {
+			return nil, err
+		}
+		if info.Subject != u.Subject {
+			return nil, fmt.Errorf("%s returned userinfo of another subject", p.providerName)
+		}
+		u = info
+	}
+
+	if u.Email == "" {
+		return nil, fmt.Errorf("Unable to find email with %s provider", p.providerName)
+	}
+
+	return &UserProvidedData{
+		Metadata: map[string]string{
+			nameKey:       u.Name,
+			userNameKey:   u.PreferredUsername,
+			avatarURLKey:  u.Picture,
+			providerIdKey: u.Subject,
+		},
+		Emails: []Email{{
+			Email:    u.Email,
+			Verified: bool(u.EmailVerified),
+			Primary:  true,
+		}},
+	}, nil
+}
+
+// verifyIDToken checks that the ID token was signed by the issuer for this
+// client
+func (p OIDCProvider) verifyIDToken(idToken string) (*oidcIDTokenClaims, error) {
+	unverified, _, err := new(jwt.Parser).ParseUnverified(idToken, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	kid, _ := unverified.Header["kid"].(string)
+
+	keys, err := p.verificationKeys(kid, false)
+	if err != nil {
+		return nil, err
+	}
+	// the issuer may have rotated its keys
+	if len(keys) == 0 && kid != "" {
+		if keys, err = p.verificationKeys(kid, true); err != nil {
+			return nil, err
+		}
+	}
+
+	claims, err := parseIDToken(idToken, unverified.Method.Alg(), keys)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != p.Issuer {
+		return nil, errors.New("ID token has an incorrect issuer")
+	}
+	if !claims.Audience.contains(p.ClientID) {
+		return nil, errors.New("ID token has an incorrect audience")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token is missing the subject")
+	}
+	return claims, nil
+}
+
+// parseIDToken verifies the ID token with the keys matching its algorithm,
+// trying each of them if the ID token doesn't name one
+func parseIDToken(idToken, alg string, keys []jwk.Key) (*oidcIDTokenClaims, error) {
+	parser := jwt.Parser{ValidMethods: []string{
+		jwt.SigningMethodRS256.Name,
+		jwt.SigningMethodRS384.Name,
+		jwt.SigningMethodRS512.Name,
+		jwt.SigningMethodES256.Name,
+		jwt.SigningMethodES384.Name,
+		jwt.SigningMethodES512.Name,
+	}}
+
+	err := errors.New("no key to verify the ID token")
+	for _, k := range keys {
+		key, kerr := k.Materialize()
+		if kerr != nil {
+			err = kerr
+			continue
+		}
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if !strings.HasPrefix(alg, "RS") {
+				continue
+			}
+		case *ecdsa.PublicKey:
+			if !strings.HasPrefix(alg, "ES") {
+				continue
+			}
+		default:
+			continue
+		}
+
+		claims := &oidcIDTokenClaims{}
+		_, perr := parser.ParseWithClaims(idToken, claims, func(*jwt.Token) (interface{}, error) {
+			return key, nil
+		})
+		if perr == nil {
+			return claims, nil
+		}
+		err = perr
+		if verr, ok := perr.(*jwt.ValidationError); !ok || verr.Errors&jwt.ValidationErrorSignatureInvalid == 0 {
+			// the key matched, but the ID token is invalid for another reason
+			break
+		}
+	}
+	return nil, err
+}
+
+// verificationKeys returns the keys of the issuer with the kid, or all of
+// them if the ID token doesn't name one
+func (p OIDCProvider) verificationKeys(kid string, refresh bool) ([]jwk.Key, error) {
+	set, err := oidcIssuerCache.keySet(p.Issuer, p.JWKSURL, refresh)
+	if err != nil {
+		return nil, err
+	}
+	if kid == "" {
+		return set.Keys, nil
+	}
+	return set.LookupKeyID(kid), nil
+}
@@ -26,6 +26,35 @@ type UserProvidedData struct {
 	Metadata map[string]string
 }
 
+// profileKeys are the metadata keys copied to the user metadata. Other keys,
+// like the provider id, are only stored on the identity.
+var profileKeys = []string{nameKey, avatarURLKey, userNameKey}
+
+// UserMetadata returns the profile of the account to store as user metadata
+func (u *UserProvidedData) UserMetadata() map[string]interface{} {
+	data := make(map[string]interface{})
+	for _, k := range profileKeys {
+		if v := u.Metadata[k]; v != "" {
+			data[k] = v
+		}
+	}
+	return data
+}
+
+// ProviderID returns the stable id of the account at the provider, if the
+// provider returned one
+func (u *UserProvidedData) ProviderID() string {
+	return u.Metadata[providerIdKey]
+}
+
+// SetProviderID sets the stable id of the account at the provider.
+func (u *UserProvidedData) SetProviderID(id string) {
+	if u.Metadata == nil {
+		u.Metadata = make(map[string]string)
+	}
+	u.Metadata[providerIdKey] = id
+}
+
 // Provider is an interface for interacting with external account providers
 type Provider interface {
 	AuthCodeURL(string, ...oauth2.AuthCodeOption) string
@@ -38,6 +67,12 @@ type OAuthProvider interface {
 	GetOAuthToken(string) (*oauth2.Token, error)
 }
 
+// TokenRefresher is implemented by providers that embed their oauth2.Config,
+// whose token source refreshes expired tokens.
+type TokenRefresher interface {
+	TokenSource(context.Context, *oauth2.Token) oauth2.TokenSource
+}
+
 func chooseHost(base, defaultHost string) string {
 	if base == "" {
 		return "https://" + defaultHost
@@ -0,0 +1,161 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/storage"
+)
+
+// Protocol is how the callback of a provider signs users in.
+type Protocol int
+
+const (
+	ProtocolOAuth2 Protocol = iota
+	ProtocolOAuth1
+	ProtocolSAML
+)
+
+// Params are what a provider is created with besides its config.
+type Params struct {
+	Scopes     string
+	DB         *storage.Connection
+	InstanceID uuid.UUID
+}
+
+// Registration describes an external provider to the API. Providers register
+// themselves in an init function, including ones compiled in from outside of
+// this package.
+type Registration struct {
+	// Name selects the provider in /authorize and is its key in /settings.
+	Name     string
+	Protocol Protocol
+	// Config returns the config of the provider from the instance's
+	// provider configuration.
+	Config func(ext *conf.ProviderConfiguration) (interface{}, error)
+	// New creates the provider from the config returned by Config.
+	New func(config interface{}, params Params) (Provider, error)
+	// Enabled returns the settings flag of the provider from its config.
+	Enabled func(config interface{}) bool
+}
+
+// NewProvider creates the provider with its config from ext.
+func (r *Registration) NewProvider(ext *conf.ProviderConfiguration, params Params) (Provider, error) {
+	config, err := r.Config(ext)
+	if err != nil {
+		return nil, err
+	}
+	return r.New(config, params)
+}
+
+// IsEnabled returns true if the provider is enabled in ext.
+func (r *Registration) IsEnabled(ext *conf.ProviderConfiguration) bool {
+	config, err := r.Config(ext)
+	if err != nil {
+		return false
+	}
+	return r.Enabled(config)
+}
+
+// reservedNames are the keys of the sign in methods in /settings that aren't
+// registered providers, and the key generic OpenID Connect providers are
+// listed under.
+var reservedNames = map[string]bool{
+	"email":     true,
+	"phone":     true,
+	"ldap":      true,
+	"anonymous": true,
+	"oidc":      true,
+}
+
+var registry = struct {
+	sync.RWMutex
+	providers map[string]*Registration
+}{providers: map[string]*Registration{}}
+
+// Register adds a provider to the registry. It panics if the name is
+// already taken.
+func Register(r Registration) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if reservedNames[r.Name] {
+		panic(fmt.Sprintf("provider name %s is reserved", r.Name))
+	}
+	if _, ok := registry.providers[r.Name]; ok {
+		panic(fmt.Sprintf("provider %s is already registered", r.Name))
+	}
+	registry.providers[r.Name] = &r
+}
+
+// Lookup finds a registered provider by name.
+func Lookup(name string) (*Registration, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	r, ok := registry.providers[name]
+	return r, ok
+}
+
+// ValidateOIDCName returns an error if a generic OpenID Connect provider can't
+// be named name because a sign in method or registered provider has the name.
+func ValidateOIDCName(name string) error {
+	if reservedNames[name] {
+		return fmt.Errorf("OpenID Connect provider name %s is reserved", name)
+	}
+	if _, ok := Lookup(name); ok {
+		return fmt.Errorf("OpenID Connect provider name %s is taken by a built-in provider", name)
+	}
+	return nil
+}
+
+// Registrations returns all registered providers, sorted by name.
+func Registrations() []*Registration {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	registrations := make([]*Registration, 0, len(registry.providers))
+	for _, r := range registry.providers {
+		registrations = append(registrations, r)
+	}
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].Name < registrations[j].Name
+	})
+	return registrations
+}
+
+// DecodeCustomConfig decodes the config of a provider that has no field in
+// conf.ProviderConfiguration from ext.Custom into config. The config is left
+// as is if the provider isn't configured.
+func DecodeCustomConfig(ext *conf.ProviderConfiguration, name string, config interface{}) error {
+	raw, ok := ext.Custom[name]
+	if !ok {
+		return nil
+	}
+	if err := json.Unmarshal(raw, config); err != nil {
+		return fmt.Errorf("Invalid config for provider %s: %v", name, err)
+	}
+	return nil
+}
+
+// registerOAuth registers a built-in provider configured by an
+// OAuthProviderConfiguration.
+func registerOAuth(name string, protocol Protocol, config func(ext *conf.ProviderConfiguration) conf.OAuthProviderConfiguration, newProvider func(ext conf.OAuthProviderConfiguration, scopes string) (OAuthProvider, error)) {
+	Register(Registration{
+		Name:     name,
+		Protocol: protocol,
+		Config: func(ext *conf.ProviderConfiguration) (interface{}, error) {
+			return config(ext), nil
+		},
+		New: func(config interface{}, params Params) (Provider, error) {
+			return newProvider(config.(conf.OAuthProviderConfiguration), params.Scopes)
+		},
+		Enabled: func(config interface{}) bool {
+			return config.(conf.OAuthProviderConfiguration).Enabled
+		},
+	})
+}
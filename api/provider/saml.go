@@ -10,9 +10,7 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"math/big"
-	"net/http"
 	"net/url"
 	"strings"
 	"time"
@@ -20,6 +18,7 @@ import (
 	"github.com/netlify/gotrue/models"
 	"github.com/netlify/gotrue/storage"
 
+	"github.com/beevik/etree"
 	"github.com/netlify/gotrue/conf"
 	saml2 "github.com/russellhaering/gosaml2"
 	"github.com/russellhaering/gosaml2/types"
@@ -28,8 +27,27 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// encryptionMethods are the algorithms of encrypted assertions the service
+// provider decrypts
+var encryptionMethods = []string{
+	"http://www.w3.org/2009/xmlenc11#aes128-gcm",
+	"http://www.w3.org/2001/04/xmlenc#aes128-cbc",
+	"http://www.w3.org/2001/04/xmlenc#aes256-cbc",
+	"http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p",
+}
+
 type SamlProvider struct {
 	ServiceProvider *saml2.SAMLServiceProvider
+
+	// SSOBinding is the binding AuthnRequests are sent with
+	SSOBinding string
+
+	// SLOURL is the single logout service of the identity provider, if it
+	// has one with a supported binding
+	SLOURL     string
+	SLOBinding string
+	// LogoutURL is the single logout endpoint of GoTrue
+	LogoutURL string
 }
 
 type ConfigX509KeyStore struct {
@@ -39,31 +57,37 @@ type ConfigX509KeyStore struct {
 }
 
 func getMetadata(url string) (*types.EntityDescriptor, error) {
-	res, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-
-	if res.StatusCode >= 300 {
-		return nil, fmt.Errorf("Request failed with status %s", res.Status)
-	}
-
-	rawMetadata, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
+	return samlMetadataCache.get(url)
+}
 
+// ParseMetadata parses the metadata XML of an identity provider.
+func ParseMetadata(rawMetadata []byte) (*types.EntityDescriptor, error) {
 	metadata := &types.EntityDescriptor{}
-	err = xml.Unmarshal(rawMetadata, metadata)
-	if err != nil {
+	if err := xml.Unmarshal(rawMetadata, metadata); err != nil {
 		return nil, err
 	}
-
-	// TODO: cache in memory
-
+	if metadata.IDPSSODescriptor == nil {
+		return nil, errors.New("Metadata has no IDPSSODescriptor")
+	}
 	return metadata, nil
 }
 
+func init() {
+	Register(Registration{
+		Name:     "saml",
+		Protocol: ProtocolSAML,
+		Config: func(ext *conf.ProviderConfiguration) (interface{}, error) {
+			return ext.Saml, nil
+		},
+		New: func(config interface{}, params Params) (Provider, error) {
+			return NewSamlProvider(config.(conf.SamlProviderConfiguration), params.DB, params.InstanceID)
+		},
+		Enabled: func(config interface{}) bool {
+			return config.(conf.SamlProviderConfiguration).Enabled
+		},
+	})
+}
+
 // NewSamlProvider creates a Saml account provider.
 func NewSamlProvider(ext conf.SamlProviderConfiguration, db *storage.Connection, instanceId uuid.UUID) (*SamlProvider, error) {
 	if !ext.Enabled {
@@ -79,18 +103,46 @@ func NewSamlProvider(ext conf.SamlProviderConfiguration, db *storage.Connection,
 		return nil, fmt.Errorf("Fetching metadata failed: %+v", err)
 	}
 
+	return newSamlProvider(ext, meta, db, instanceId)
+}
+
+// NewSamlConnectionProvider creates a Saml account provider for the identity
+// provider of a SAML connection. The service provider settings are shared
+// with the instance's SAML provider.
+func NewSamlConnectionProvider(ext conf.SamlProviderConfiguration, connection *models.SAMLConnection, db *storage.Connection, instanceId uuid.UUID) (*SamlProvider, error) {
+	var meta *types.EntityDescriptor
+	var err error
+	if connection.MetadataXML != "" {
+		meta, err = ParseMetadata([]byte(connection.MetadataXML))
+		if err != nil {
+			return nil, fmt.Errorf("Parsing metadata failed: %+v", err)
+		}
+	} else {
+		meta, err = getMetadata(connection.MetadataURL)
+		if err != nil {
+			return nil, fmt.Errorf("Fetching metadata failed: %+v", err)
+		}
+	}
+
+	return newSamlProvider(ext, meta, db, instanceId)
+}
+
+func newSamlProvider(ext conf.SamlProviderConfiguration, meta *types.EntityDescriptor, db *storage.Connection, instanceId uuid.UUID) (*SamlProvider, error) {
 	baseURI, err := url.Parse(strings.Trim(ext.APIBase, "/"))
 	if err != nil || ext.APIBase == "" {
 		return nil, fmt.Errorf("Invalid API base URI: %s", ext.APIBase)
 	}
 
+	// the redirect binding is preferred, the POST binding is used with
+	// identity providers that only support it
 	var ssoService types.SingleSignOnService
 	foundService := false
-	for _, service := range meta.IDPSSODescriptor.SingleSignOnServices {
-		if service.Binding == "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" {
-			ssoService = service
-			foundService = true
-			break
+	for _, binding := range []string{samlRedirectBinding, samlPOSTBinding} {
+		for _, service := range meta.IDPSSODescriptor.SingleSignOnServices {
+			if service.Binding == binding && !foundService {
+				ssoService = service
+				foundService = true
+			}
 		}
 	}
 	if !foundService {
@@ -140,6 +192,19 @@ func NewSamlProvider(ext conf.SamlProviderConfiguration, db *storage.Connection,
 
 	p := &SamlProvider{
 		ServiceProvider: sp,
+		SSOBinding:      ssoService.Binding,
+		LogoutURL:       baseURI.String() + "/saml/slo",
+	}
+
+	// the redirect binding is preferred, since SP initiated logout only
+	// returns a URL
+	for _, binding := range []string{samlRedirectBinding, samlPOSTBinding} {
+		for _, service := range meta.IDPSSODescriptor.SingleLogoutServices {
+			if service.Binding == binding && p.SLOURL == "" {
+				p.SLOURL = service.Location
+				p.SLOBinding = service.Binding
+			}
+		}
 	}
 	return p, nil
 }
@@ -152,6 +217,22 @@ func (p SamlProvider) AuthCodeURL(tokenString string, args ...oauth2.AuthCodeOpt
 	return url
 }
 
+// IsSSOPostBinding returns true if AuthnRequests are posted to the identity
+// provider with AuthRequestForm instead of redirecting to AuthCodeURL.
+func (p SamlProvider) IsSSOPostBinding() bool {
+	return p.SSOBinding == samlPOSTBinding
+}
+
+// AuthRequestForm returns the page that posts a signed AuthnRequest to the
+// identity provider for the POST binding.
+func (p SamlProvider) AuthRequestForm(relayState string) ([]byte, error) {
+	doc, err := p.ServiceProvider.BuildAuthRequestDocument()
+	if err != nil {
+		return nil, err
+	}
+	return postForm(p.ServiceProvider.IdentityProviderSSOURL, "SAMLRequest", doc, relayState)
+}
+
 func (p SamlProvider) SPMetadata() ([]byte, error) {
 	metadata, err := p.ServiceProvider.Metadata()
 	if err != nil {
@@ -162,12 +243,29 @@ func (p SamlProvider) SPMetadata() ([]byte, error) {
 	// therefore they are removed since they are optional anyways and mostly unused
 	metadata.SPSSODescriptor.KeyDescriptors[1].EncryptionMethods = []types.EncryptionMethod{}
 
+	metadata.SPSSODescriptor.SingleLogoutServices = []types.Endpoint{
+		{Binding: samlRedirectBinding, Location: p.LogoutURL},
+		{Binding: samlPOSTBinding, Location: p.LogoutURL},
+	}
+
 	rawMetadata, err := xml.Marshal(metadata)
 	if err != nil {
 		return nil, err
 	}
 
-	return rawMetadata, nil
+	// the encryption methods are added to the encryption key without the
+	// typing, so identity providers can encrypt assertions
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(rawMetadata); err != nil {
+		return nil, err
+	}
+	for _, kd := range doc.FindElements("//KeyDescriptor[@use='encryption']") {
+		for _, method := range encryptionMethods {
+			kd.CreateElement("EncryptionMethod").CreateAttr("Algorithm", method)
+		}
+	}
+
+	return doc.WriteToBytes()
 }
 
 func (ks ConfigX509KeyStore) GetKeyPair() (*rsa.PrivateKey, []byte, error) {
@@ -0,0 +1,410 @@
+package provider
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/gofrs/uuid"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	samlRedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlPOSTBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	samlProtocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+
+	// SAMLStatusSuccess is the status of successful SAML responses
+	SAMLStatusSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+
+	sigAlgRSASHA1   = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	sigAlgRSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	sigAlgRSASHA512 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+
+	// maxSAMLMessageSize limits the size of inflated messages of the
+	// redirect binding
+	maxSAMLMessageSize = 1 << 20
+)
+
+var samlPostFormTemplate = template.Must(template.New("saml_post_form").Parse(`<!DOCTYPE html>
+<html>
+<body onload="document.forms[0].submit()">
+<form method="post" action="{{ .URL }}">
+<input type="hidden" name="{{ .Param }}" value="{{ .Message }}">
+{{ if .RelayState }}<input type="hidden" name="RelayState" value="{{ .RelayState }}">{{ end }}
+<noscript><input type="submit" value="Continue"></noscript>
+</form>
+</body>
+</html>
+`))
+
+// LogoutMessage is a LogoutRequest or LogoutResponse sent by an identity
+// provider to the single logout endpoint.
+type LogoutMessage struct {
+	IsResponse     bool
+	ID             string
+	InResponseTo   string
+	Issuer         string
+	NameID         string
+	SessionIndexes []string
+	Status         string
+	RelayState     string
+
+	binding     string
+	element     *etree.Element
+	signedQuery string
+	sigAlg      string
+	signature   []byte
+}
+
+// ParseLogoutMessage reads a logout message of the redirect or POST binding
+// from the request. The message must be validated with the provider of its
+// issuer before it is trusted.
+func ParseLogoutMessage(r *http.Request) (*LogoutMessage, error) {
+	msg := &LogoutMessage{}
+
+	var values url.Values
+	if r.Method == http.MethodGet {
+		msg.binding = samlRedirectBinding
+		values = r.URL.Query()
+	} else {
+		msg.binding = samlPOSTBinding
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		values = r.PostForm
+	}
+
+	param := "SAMLRequest"
+	if values.Get(param) == "" {
+		param = "SAMLResponse"
+		msg.IsResponse = true
+	}
+	encoded := values.Get(param)
+	if encoded == "" {
+		return nil, errors.New("SAMLRequest or SAMLResponse is missing")
+	}
+	msg.RelayState = values.Get("RelayState")
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Decoding %s failed: %+v", param, err)
+	}
+
+	if msg.binding == samlRedirectBinding {
+		raw, err = ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(raw)), maxSAMLMessageSize))
+		if err != nil {
+			return nil, fmt.Errorf("Inflating %s failed: %+v", param, err)
+		}
+
+		// the signature covers the parameters as they were encoded by the
+		// identity provider
+		parts := []string{}
+		for _, key := range []string{param, "RelayState", "SigAlg"} {
+			if v, ok := rawQueryValue(r.URL.RawQuery, key); ok {
+				parts = append(parts, key+"="+v)
+			}
+		}
+		msg.signedQuery = strings.Join(parts, "&")
+		msg.sigAlg = values.Get("SigAlg")
+		if signature := values.Get("Signature"); signature != "" {
+			msg.signature, err = base64.StdEncoding.DecodeString(signature)
+			if err != nil {
+				return nil, fmt.Errorf("Decoding Signature failed: %+v", err)
+			}
+		}
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return nil, fmt.Errorf("Parsing %s failed: %+v", param, err)
+	}
+	el := doc.Root()
+	if el == nil {
+		return nil, fmt.Errorf("%s is empty", param)
+	}
+	if (msg.IsResponse && el.Tag != "LogoutResponse") || (!msg.IsResponse && el.Tag != "LogoutRequest") {
+		return nil, fmt.Errorf("%s is not a logout message", param)
+	}
+
+	msg.element = el
+	msg.readElement(el)
+	return msg, nil
+}
+
+func (msg *LogoutMessage) readElement(el *etree.Element) {
+	msg.ID = el.SelectAttrValue("ID", "")
+	msg.InResponseTo = el.SelectAttrValue("InResponseTo", "")
+	msg.Issuer = ""
+	msg.NameID = ""
+	msg.SessionIndexes = nil
+	msg.Status = ""
+
+	for _, child := range el.ChildElements() {
+		switch child.Tag {
+		case "Issuer":
+			msg.Issuer = strings.TrimSpace(child.Text())
+		case "NameID":
+			msg.NameID = strings.TrimSpace(child.Text())
+		case "SessionIndex":
+			msg.SessionIndexes = append(msg.SessionIndexes, strings.TrimSpace(child.Text()))
+		case "Status":
+			for _, code := range child.ChildElements() {
+				if code.Tag == "StatusCode" {
+					msg.Status = code.SelectAttrValue("Value", "")
+				}
+			}
+		}
+	}
+}
+
+// rawQueryValue returns the value of the query parameter without decoding it
+func rawQueryValue(rawQuery, key string) (string, bool) {
+	for _, part := range strings.Split(rawQuery, "&") {
+		if strings.HasPrefix(part, key+"=") {
+			return strings.TrimPrefix(part, key+"="), true
+		}
+	}
+	return "", false
+}
+
+// ValidateLogoutMessage checks that the message was signed by the identity
+// provider and is meant for this service provider.
+func (p SamlProvider) ValidateLogoutMessage(msg *LogoutMessage) error {
+	if msg.Issuer != p.ServiceProvider.IdentityProviderIssuer {
+		return fmt.Errorf("Logout message has an unknown issuer %s", msg.Issuer)
+	}
+	if destination := msg.element.SelectAttrValue("Destination", ""); destination != "" && destination != p.LogoutURL {
+		return fmt.Errorf("Logout message is meant for %s", destination)
+	}
+
+	if msg.binding == samlRedirectBinding {
+		return p.validateQuerySignature(msg)
+	}
+
+	ctx := dsig.NewDefaultValidationContext(p.ServiceProvider.IDPCertificateStore)
+	validated, err := ctx.Validate(msg.element)
+	if err != nil {
+		return fmt.Errorf("Logout message signature is invalid: %+v", err)
+	}
+	// only the signed content is trusted
+	msg.readElement(validated)
+	return nil
+}
+
+func (p SamlProvider) validateQuerySignature(msg *LogoutMessage) error {
+	if len(msg.signature) == 0 {
+		return errors.New("Logout message is not signed")
+	}
+
+	var hash crypto.Hash
+	var digest []byte
+	switch msg.sigAlg {
+	case sigAlgRSASHA1:
+		sum := sha1.Sum([]byte(msg.signedQuery))
+		hash, digest = crypto.SHA1, sum[:]
+	case sigAlgRSASHA256:
+		sum := sha256.Sum256([]byte(msg.signedQuery))
+		hash, digest = crypto.SHA256, sum[:]
+	case sigAlgRSASHA512:
+		sum := sha512.Sum512([]byte(msg.signedQuery))
+		hash, digest = crypto.SHA512, sum[:]
+	default:
+		return fmt.Errorf("Unsupported signature algorithm %s", msg.sigAlg)
+	}
+
+	certs, err := p.ServiceProvider.IDPCertificateStore.Certificates()
+	if err != nil {
+		return err
+	}
+	for _, cert := range certs {
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			continue
+		}
+		if rsa.VerifyPKCS1v15(key, hash, digest, msg.signature) == nil {
+			return nil
+		}
+	}
+	return errors.New("Logout message signature is invalid")
+}
+
+func (p SamlProvider) newLogoutElement(tag string) (*etree.Element, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	el := etree.NewElement("samlp:" + tag)
+	el.CreateAttr("xmlns:samlp", samlProtocolNamespace)
+	el.CreateAttr("xmlns:saml", samlAssertionNamespace)
+	el.CreateAttr("ID", "_"+id.String())
+	el.CreateAttr("Version", "2.0")
+	el.CreateAttr("IssueInstant", time.Now().UTC().Format(time.RFC3339))
+	el.CreateAttr("Destination", p.SLOURL)
+	el.CreateElement("saml:Issuer").SetText(p.ServiceProvider.ServiceProviderIssuer)
+	return el, nil
+}
+
+func (p SamlProvider) newLogoutRequest(nameID, sessionIndex string) (*etree.Element, error) {
+	el, err := p.newLogoutElement("LogoutRequest")
+	if err != nil {
+		return nil, err
+	}
+	el.CreateElement("saml:NameID").SetText(nameID)
+	if sessionIndex != "" {
+		el.CreateElement("samlp:SessionIndex").SetText(sessionIndex)
+	}
+	return el, nil
+}
+
+func (p SamlProvider) newLogoutResponse(inResponseTo string) (*etree.Element, error) {
+	el, err := p.newLogoutElement("LogoutResponse")
+	if err != nil {
+		return nil, err
+	}
+	if inResponseTo != "" {
+		el.CreateAttr("InResponseTo", inResponseTo)
+	}
+	el.CreateElement("samlp:Status").CreateElement("samlp:StatusCode").CreateAttr("Value", SAMLStatusSuccess)
+	return el, nil
+}
+
+// LogoutRequestURL returns the URL that ends the session of the NameID at
+// the identity provider. Only the redirect binding is supported, since the
+// URL is returned from the logout endpoint.
+func (p SamlProvider) LogoutRequestURL(nameID, sessionIndex, relayState string) (string, error) {
+	if p.SLOBinding != samlRedirectBinding {
+		return "", errors.New("Identity provider has no single logout service with the redirect binding")
+	}
+	el, err := p.newLogoutRequest(nameID, sessionIndex)
+	if err != nil {
+		return "", err
+	}
+	return p.redirectBindingURL(p.SLOURL, "SAMLRequest", el, relayState)
+}
+
+// LogoutResponseURL returns the URL of the response to a LogoutRequest of
+// the identity provider for the redirect binding.
+func (p SamlProvider) LogoutResponseURL(inResponseTo, relayState string) (string, error) {
+	el, err := p.newLogoutResponse(inResponseTo)
+	if err != nil {
+		return "", err
+	}
+	return p.redirectBindingURL(p.SLOURL, "SAMLResponse", el, relayState)
+}
+
+// LogoutResponseForm returns the page that posts the response to a
+// LogoutRequest of the identity provider for the POST binding.
+func (p SamlProvider) LogoutResponseForm(inResponseTo, relayState string) ([]byte, error) {
+	el, err := p.newLogoutResponse(inResponseTo)
+	if err != nil {
+		return nil, err
+	}
+	return p.postBindingForm(p.SLOURL, "SAMLResponse", el, relayState)
+}
+
+// IsSLORedirectBinding returns true if the identity provider receives logout
+// messages with the redirect binding.
+func (p SamlProvider) IsSLORedirectBinding() bool {
+	return p.SLOBinding == samlRedirectBinding
+}
+
+// redirectBindingURL deflates the message into the query of the location,
+// signed with the key of the service provider
+func (p SamlProvider) redirectBindingURL(location, param string, el *etree.Element, relayState string) (string, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	raw, err := doc.WriteToBytes()
+	if err != nil {
+		return "", err
+	}
+
+	var deflated bytes.Buffer
+	fw, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fw.Write(raw); err != nil {
+		return "", err
+	}
+	if err := fw.Close(); err != nil {
+		return "", err
+	}
+
+	query := param + "=" + url.QueryEscape(base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	if relayState != "" {
+		query += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	query += "&SigAlg=" + url.QueryEscape(sigAlgRSASHA256)
+
+	key, _, err := p.ServiceProvider.SPKeyStore.GetKeyPair()
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(query))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+
+	if strings.Contains(location, "?") {
+		return location + "&" + query, nil
+	}
+	return location + "?" + query, nil
+}
+
+// postBindingForm signs the message with the key of the service provider
+// and returns a page that posts it to the location
+func (p SamlProvider) postBindingForm(location, param string, el *etree.Element, relayState string) ([]byte, error) {
+	ctx := dsig.NewDefaultSigningContext(p.ServiceProvider.SPKeyStore)
+	signature, err := ctx.ConstructSignature(el, true)
+	if err != nil {
+		return nil, err
+	}
+	// the signature follows the issuer
+	children := []etree.Token{el.Child[0], signature}
+	el.Child = append(children, el.Child[1:]...)
+
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	return postForm(location, param, doc, relayState)
+}
+
+// postForm returns a page that posts the signed message to the location
+func postForm(location, param string, doc *etree.Document, relayState string) ([]byte, error) {
+	raw, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var page bytes.Buffer
+	if err := samlPostFormTemplate.Execute(&page, map[string]string{
+		"URL":        location,
+		"Param":      param,
+		"Message":    base64.StdEncoding.EncodeToString(raw),
+		"RelayState": relayState,
+	}); err != nil {
+		return nil, err
+	}
+	return page.Bytes(), nil
+}
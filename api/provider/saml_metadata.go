@@ -0,0 +1,264 @@
+package provider
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/russellhaering/gosaml2/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultMetadataTTL is how long metadata without validUntil or
+	// cacheDuration is cached
+	defaultMetadataTTL = 24 * time.Hour
+	// minMetadataTTL keeps identity providers with very short cache
+	// durations from being fetched on every request
+	minMetadataTTL = time.Minute
+	// metadataRetryBackoff is how long the last good copy is used after
+	// fetching the metadata failed, before it is fetched again
+	metadataRetryBackoff = time.Minute
+	// metadataRefreshInterval is how often the cached metadata is checked
+	// for entries that are about to expire
+	metadataRefreshInterval = time.Minute
+)
+
+var samlHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+var samlMetadataCache = newMetadataCache()
+
+// metadataCacheAttrs are the attributes of the metadata that limit how long
+// it is cached
+type metadataCacheAttrs struct {
+	ValidUntil    string `xml:"validUntil,attr"`
+	CacheDuration string `xml:"cacheDuration,attr"`
+}
+
+type metadataCacheEntry struct {
+	metadata  *types.EntityDescriptor
+	expiresAt time.Time
+	// refreshAt is when the entry is refreshed in the background, so
+	// requests don't wait for the identity provider when it expires
+	refreshAt  time.Time
+	validUntil time.Time
+	refreshing bool
+}
+
+// backoff keeps using the entry for a while after fetching the metadata
+// failed, so requests don't all wait for an identity provider that is down
+func (e *metadataCacheEntry) backoff(now time.Time) {
+	e.refreshing = false
+	e.refreshAt = now.Add(metadataRetryBackoff)
+	if e.expiresAt.Before(e.refreshAt) {
+		e.expiresAt = e.refreshAt
+	}
+	if !e.validUntil.IsZero() && e.validUntil.Before(e.expiresAt) {
+		e.expiresAt = e.validUntil
+	}
+}
+
+// metadataCache caches the metadata of identity providers by URL
+type metadataCache struct {
+	sync.Mutex
+	entries map[string]*metadataCacheEntry
+	now     func() time.Time
+}
+
+func newMetadataCache() *metadataCache {
+	return &metadataCache{
+		entries: map[string]*metadataCacheEntry{},
+		now:     time.Now,
+	}
+}
+
+// get returns the cached metadata. Metadata that is about to expire is
+// refreshed in the background. Expired metadata is fetched again, and the
+// last good copy is used if the identity provider can't be reached.
+func (c *metadataCache) get(url string) (*types.EntityDescriptor, error) {
+	c.Lock()
+	entry, ok := c.entries[url]
+	now := c.now()
+	if ok && now.Before(entry.expiresAt) {
+		if !now.Before(entry.refreshAt) && !entry.refreshing {
+			entry.refreshing = true
+			go c.refreshInBackground(url)
+		}
+		c.Unlock()
+		return entry.metadata, nil
+	}
+	c.Unlock()
+
+	metadata, _, err := c.refresh(url)
+	if err != nil {
+		if ok && (entry.validUntil.IsZero() || now.Before(entry.validUntil)) {
+			logrus.WithError(err).WithField("metadata_url", url).Warn("Fetching SAML metadata failed, using last good copy")
+			c.Lock()
+			entry.backoff(c.now())
+			c.Unlock()
+			return entry.metadata, nil
+		}
+		return nil, err
+	}
+	return metadata, nil
+}
+
+func (c *metadataCache) refreshInBackground(url string) {
+	if _, _, err := c.refresh(url); err != nil {
+		logrus.WithError(err).WithField("metadata_url", url).Warn("Refreshing SAML metadata failed")
+
+		c.Lock()
+		if entry, ok := c.entries[url]; ok {
+			entry.backoff(c.now())
+		}
+		c.Unlock()
+	}
+}
+
+// refreshDue refreshes the entries that are about to expire
+func (c *metadataCache) refreshDue() {
+	c.Lock()
+	now := c.now()
+	urls := []string{}
+	for url, entry := range c.entries {
+		if !now.Before(entry.refreshAt) && !entry.refreshing {
+			entry.refreshing = true
+			urls = append(urls, url)
+		}
+	}
+	c.Unlock()
+
+	for _, url := range urls {
+		c.refreshInBackground(url)
+	}
+}
+
+// refresh fetches the metadata and replaces the cached copy
+func (c *metadataCache) refresh(url string) (*types.EntityDescriptor, time.Time, error) {
+	rawMetadata, err := fetchMetadata(url)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	metadata, err := ParseMetadata(rawMetadata)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	attrs := metadataCacheAttrs{}
+	if err := xml.Unmarshal(rawMetadata, &attrs); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	now := c.now()
+	entry := &metadataCacheEntry{
+		metadata:  metadata,
+		expiresAt: now.Add(defaultMetadataTTL),
+	}
+	if attrs.CacheDuration != "" {
+		d, err := parseISO8601Duration(attrs.CacheDuration)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("Invalid cacheDuration: %+v", err)
+		}
+		entry.expiresAt = now.Add(d)
+	}
+	if attrs.ValidUntil != "" {
+		validUntil, err := time.Parse(time.RFC3339, attrs.ValidUntil)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("Invalid validUntil: %+v", err)
+		}
+		if !now.Before(validUntil) {
+			return nil, time.Time{}, errors.New("Metadata is no longer valid")
+		}
+		entry.validUntil = validUntil
+		if validUntil.Before(entry.expiresAt) {
+			entry.expiresAt = validUntil
+		}
+	}
+	if entry.expiresAt.Sub(now) < minMetadataTTL {
+		entry.expiresAt = now.Add(minMetadataTTL)
+	}
+	entry.refreshAt = entry.expiresAt.Add(-entry.expiresAt.Sub(now) / 5)
+
+	c.Lock()
+	c.entries[url] = entry
+	c.Unlock()
+
+	return metadata, entry.expiresAt, nil
+}
+
+func fetchMetadata(url string) ([]byte, error) {
+	res, err := samlHTTPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("Request failed with status %s", res.Status)
+	}
+
+	return ioutil.ReadAll(res.Body)
+}
+
+// RefreshMetadata fetches the metadata of the identity provider at url,
+// replacing the cached copy. It returns when the new copy expires.
+func RefreshMetadata(url string) (time.Time, error) {
+	_, expiresAt, err := samlMetadataCache.refresh(url)
+	return expiresAt, err
+}
+
+// RefreshMetadataPeriodically refreshes the cached metadata of identity
+// providers before it expires until done is closed, so sign ins don't wait for
+// identity providers that weren't used for a while.
+func RefreshMetadataPeriodically(done <-chan struct{}) {
+	ticker := time.NewTicker(metadataRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			samlMetadataCache.refreshDue()
+		}
+	}
+}
+
+var iso8601Duration = regexp.MustCompile(`^P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISO8601Duration parses the xs:duration of cacheDuration. Years and
+// months are counted as 365 and 30 days.
+func parseISO8601Duration(s string) (time.Duration, error) {
+	m := iso8601Duration.FindStringSubmatch(s)
+	if m == nil || s == "P" || s[len(s)-1] == 'T' {
+		return 0, fmt.Errorf("%q is not an ISO 8601 duration", s)
+	}
+
+	units := []time.Duration{
+		365 * 24 * time.Hour,
+		30 * 24 * time.Hour,
+		7 * 24 * time.Hour,
+		24 * time.Hour,
+		time.Hour,
+		time.Minute,
+		time.Second,
+	}
+	var d time.Duration
+	for i, unit := range units {
+		if m[i+1] == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(m[i+1], 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(v * float64(unit))
+	}
+	return d, nil
+}
@@ -0,0 +1,62 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMetadata = `<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com" cacheDuration="PT1H">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`
+
+func TestMetadataCacheBacksOffWhenDown(t *testing.T) {
+	count := 0
+	down := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(testMetadata))
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	cache := newMetadataCache()
+	cache.now = func() time.Time { return now }
+
+	_, err := cache.get(server.URL)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	// the last good copy is used while the identity provider is down, and it
+	// is only fetched again after the backoff
+	down = true
+	now = now.Add(2 * time.Hour)
+	metadata, err := cache.get(server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "https://idp.example.com", metadata.EntityID)
+	assert.Equal(t, 2, count)
+	_, err = cache.get(server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	now = now.Add(metadataRetryBackoff)
+	cache.refreshDue()
+	assert.Equal(t, 3, count)
+
+	down = false
+	now = now.Add(metadataRetryBackoff)
+	cache.refreshDue()
+	assert.Equal(t, 4, count)
+	cache.refreshDue()
+	assert.Equal(t, 4, count)
+}
@@ -41,6 +41,12 @@ type twitchUsers struct {
 	} `json:"data"`
 }
 
+func init() {
+	registerOAuth("twitch", ProtocolOAuth2, func(ext *conf.ProviderConfiguration) conf.OAuthProviderConfiguration {
+		return ext.Twitch
+	}, NewTwitchProvider)
+}
+
 // NewTwitchProvider creates a Twitch account provider.
 func NewTwitchProvider(ext conf.OAuthProviderConfiguration, scopes string) (OAuthProvider, error) {
 	if err := ext.Validate(); err != nil {
@@ -114,9 +120,10 @@ func (t twitchProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (*Us
 
 	data := &UserProvidedData{
 		Metadata: map[string]string{
-			nameKey:      user.Login,
-			aliasKey:     user.DisplayName,
-			avatarURLKey: user.ProfileImageURL,
+			nameKey:       user.Login,
+			aliasKey:      user.DisplayName,
+			avatarURLKey:  user.ProfileImageURL,
+			providerIdKey: user.ID,
 		},
 		Emails: []Email{{
 			Email:    user.Email,
@@ -32,12 +32,19 @@ type TwitterProvider struct {
 }
 
 type twitterUser struct {
+	ID        string `json:"id_str"`
 	UserName  string `json:"screen_name"`
 	Name      string `json:"name"`
 	AvatarURL string `json:"profile_image_url"`
 	Email     string `json:"email"`
 }
 
+func init() {
+	registerOAuth("twitter", ProtocolOAuth1, func(ext *conf.ProviderConfiguration) conf.OAuthProviderConfiguration {
+		return ext.Twitter
+	}, NewTwitterProvider)
+}
+
 func NewTwitterProvider(ext conf.OAuthProviderConfiguration, scopes string) (OAuthProvider, error) {
 	p := &TwitterProvider{
 		ClientKey:   ext.ClientID,
@@ -79,9 +86,10 @@ func (t TwitterProvider) FetchUserData(ctx context.Context, tok *oauth.AccessTok
 
 	data := &UserProvidedData{
 		Metadata: map[string]string{
-			userNameKey:  u.UserName,
-			nameKey:      u.Name,
-			avatarURLKey: u.AvatarURL,
+			userNameKey:   u.UserName,
+			nameKey:       u.Name,
+			avatarURLKey:  u.AvatarURL,
+			providerIdKey: u.ID,
 		},
 		Emails: []Email{{
 			Email:    u.Email,
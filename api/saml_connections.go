@@ -0,0 +1,304 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/api/provider"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+)
+
+// SAMLConnectionParams are the parameters the admin SAML connection endpoints accept
+type SAMLConnectionParams struct {
+	Name             string                 `json:"name"`
+	MetadataURL      string                 `json:"metadata_url"`
+	MetadataXML      string                 `json:"metadata_xml"`
+	AttributeMapping map[string]interface{} `json:"attribute_mapping"`
+	Domains          []string               `json:"domains"`
+
+	IdPInitiated       *bool   `json:"idp_initiated"`
+	DefaultRedirectURL *string `json:"default_redirect_url"`
+}
+
+// SAMLMetadataRefreshResult is the outcome of refreshing the metadata of an
+// identity provider
+type SAMLMetadataRefreshResult struct {
+	ConnectionID *uuid.UUID `json:"connection_id,omitempty"`
+	MetadataURL  string     `json:"metadata_url"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+func (a *API) loadSAMLConnection(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	ctx := r.Context()
+
+	connectionID, err := uuid.FromString(chi.URLParam(r, "connection_id"))
+	if err != nil {
+		return nil, badRequestError("connection_id must be an UUID")
+	}
+
+	logEntrySetField(r, "saml_connection_id", connectionID)
+
+	connection, err := models.FindSAMLConnectionByID(a.db, getInstanceID(ctx), connectionID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil, notFoundError("SAML connection not found")
+		}
+		return nil, internalServerError("Database error loading SAML connection").WithInternalError(err)
+	}
+
+	return withSAMLConnection(ctx, connection), nil
+}
+
+// applySAMLConnectionParams sets the fields of the connection that are
+// present in the params
+func applySAMLConnectionParams(connection *models.SAMLConnection, params *SAMLConnectionParams) {
+	if params.Name != "" {
+		connection.Name = params.Name
+	}
+	if params.MetadataURL != "" || params.MetadataXML != "" {
+		connection.MetadataURL = params.MetadataURL
+		connection.MetadataXML = params.MetadataXML
+	}
+	if params.AttributeMapping != nil {
+		connection.AttributeMapping = models.JSONMap{}
+		for k, v := range params.AttributeMapping {
+			connection.AttributeMapping[k] = v
+		}
+	}
+	if params.Domains != nil {
+		domains := make(models.StringList, 0, len(params.Domains))
+		for _, d := range params.Domains {
+			domains = append(domains, strings.ToLower(strings.TrimSpace(d)))
+		}
+		connection.Domains = domains
+	}
+	if params.IdPInitiated != nil {
+		connection.IdPInitiated = *params.IdPInitiated
+	}
+	if params.DefaultRedirectURL != nil {
+		connection.DefaultRedirectURL = *params.DefaultRedirectURL
+	}
+}
+
+// validateSAMLConnection checks the identity provider of the connection and
+// that no other connection of the instance has one of its domains
+func validateSAMLConnection(tx *storage.Connection, config *conf.Configuration, connection *models.SAMLConnection) error {
+	if connection.Name == "" {
+		return unprocessableEntityError("SAML connection name is required")
+	}
+
+	switch {
+	case connection.MetadataURL != "" && connection.MetadataXML != "":
+		return unprocessableEntityError("Only one of metadata_url and metadata_xml can be set")
+	case connection.MetadataXML != "":
+		if _, err := provider.ParseMetadata([]byte(connection.MetadataXML)); err != nil {
+			return unprocessableEntityError("SAML metadata is invalid: %v", err)
+		}
+	case connection.MetadataURL != "":
+		u, err := url.Parse(connection.MetadataURL)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return unprocessableEntityError("Metadata URL must be an absolute URL: %s", connection.MetadataURL)
+		}
+	default:
+		return unprocessableEntityError("One of metadata_url and metadata_xml is required")
+	}
+
+	if _, err := connection.Mapping(); err != nil {
+		return unprocessableEntityError("Invalid attribute mapping: %v", err)
+	}
+
+	if connection.DefaultRedirectURL != "" && !isRedirectURLValid(config, connection.DefaultRedirectURL) {
+		return unprocessableEntityError("Default redirect URL is not allowed: %s", connection.DefaultRedirectURL)
+	}
+
+	// the domains limit the emails the identity provider is trusted with
+	if len(connection.Domains) == 0 {
+		return unprocessableEntityError("At least one domain is required")
+	}
+	for _, domain := range connection.Domains {
+		if domain == "" || strings.Contains(domain, "@") {
+			return unprocessableEntityError("Invalid domain: %q", domain)
+		}
+	}
+
+	connections, err := models.FindSAMLConnections(tx, connection.InstanceID)
+	if err != nil {
+		return internalServerError("Database error finding SAML connections").WithInternalError(err)
+	}
+	for _, other := range connections {
+		if other.ID == connection.ID {
+			continue
+		}
+		for _, domain := range connection.Domains {
+			if other.HasDomain(domain) {
+				return unprocessableEntityError("Domain %s is already used by SAML connection %s", domain, other.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// adminSAMLConnections responds with the SAML connections of the instance
+func (a *API) adminSAMLConnections(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	connections, err := models.FindSAMLConnections(a.db, getInstanceID(ctx))
+	if err != nil {
+		return internalServerError("Database error finding SAML connections").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{
+		"connections": connections,
+	})
+}
+
+// adminSAMLConnectionCreate adds the identity provider of an organization
+func (a *API) adminSAMLConnectionCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+	adminUser := getAdminUser(ctx)
+
+	params := &SAMLConnectionParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read SAML connection params: %v", err)
+	}
+
+	connection, err := models.NewSAMLConnection(instanceID, params.Name)
+	if err != nil {
+		return internalServerError("Error creating SAML connection").WithInternalError(err)
+	}
+	applySAMLConnectionParams(connection, params)
+
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		if terr := validateSAMLConnection(tx, a.getConfig(ctx), connection); terr != nil {
+			return terr
+		}
+		if terr := tx.Create(connection); terr != nil {
+			return internalServerError("Database error creating SAML connection").WithInternalError(terr)
+		}
+
+		return models.NewAuditLogEntry(tx, instanceID, adminUser, models.SAMLConnectionCreatedAction, map[string]interface{}{
+			"connection_id": connection.ID,
+			"name":          connection.Name,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, connection)
+}
+
+// adminSAMLConnectionGet returns information about a single SAML connection
+func (a *API) adminSAMLConnectionGet(w http.ResponseWriter, r *http.Request) error {
+	return sendJSON(w, http.StatusOK, getSAMLConnection(r.Context()))
+}
+
+// adminSAMLConnectionUpdate updates a single SAML connection
+func (a *API) adminSAMLConnectionUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+	adminUser := getAdminUser(ctx)
+	connection := getSAMLConnection(ctx)
+
+	params := &SAMLConnectionParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read SAML connection params: %v", err)
+	}
+	applySAMLConnectionParams(connection, params)
+
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		if terr := validateSAMLConnection(tx, a.getConfig(ctx), connection); terr != nil {
+			return terr
+		}
+		if terr := connection.UpdateInfo(tx); terr != nil {
+			return internalServerError("Error updating SAML connection").WithInternalError(terr)
+		}
+
+		return models.NewAuditLogEntry(tx, instanceID, adminUser, models.SAMLConnectionUpdatedAction, map[string]interface{}{
+			"connection_id": connection.ID,
+			"name":          connection.Name,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, connection)
+}
+
+// adminSAMLConnectionDelete removes a SAML connection
+func (a *API) adminSAMLConnectionDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+	adminUser := getAdminUser(ctx)
+	connection := getSAMLConnection(ctx)
+
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		if terr := tx.Destroy(connection); terr != nil {
+			return terr
+		}
+
+		return models.NewAuditLogEntry(tx, instanceID, adminUser, models.SAMLConnectionDeletedAction, map[string]interface{}{
+			"connection_id": connection.ID,
+			"name":          connection.Name,
+		})
+	})
+	if err != nil {
+		return internalServerError("Error deleting SAML connection").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// adminSAMLMetadataRefresh fetches the metadata of the instance's identity
+// providers again, replacing the cached copies. Identity providers that fail
+// keep their last good copy.
+func (a *API) adminSAMLMetadataRefresh(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+
+	connections, err := models.FindSAMLConnections(a.db, getInstanceID(ctx))
+	if err != nil {
+		return internalServerError("Database error finding SAML connections").WithInternalError(err)
+	}
+
+	results := []*SAMLMetadataRefreshResult{}
+	if config.External.Saml.Enabled && config.External.Saml.MetadataURL != "" {
+		results = append(results, &SAMLMetadataRefreshResult{MetadataURL: config.External.Saml.MetadataURL})
+	}
+	for _, connection := range connections {
+		if connection.MetadataURL == "" {
+			continue
+		}
+		connectionID := connection.ID
+		results = append(results, &SAMLMetadataRefreshResult{
+			ConnectionID: &connectionID,
+			MetadataURL:  connection.MetadataURL,
+		})
+	}
+
+	log := getLogEntry(r)
+	for _, result := range results {
+		expiresAt, err := provider.RefreshMetadata(result.MetadataURL)
+		if err != nil {
+			log.WithError(err).WithField("metadata_url", result.MetadataURL).Warn("Refreshing SAML metadata failed")
+			result.Error = err.Error()
+			continue
+		}
+		result.ExpiresAt = &expiresAt
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{
+		"metadata": results,
+	})
+}
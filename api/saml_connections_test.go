@@ -0,0 +1,486 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+)
+
+func (ts *ExternalSamlTestSuite) adminRequest(method, path string, body map[string]interface{}) *httptest.ResponseRecorder {
+	u, err := models.NewUser(ts.instanceID, "admin@example.com", "test", ts.Config.JWT.Aud, nil)
+	ts.Require().NoError(err)
+	u.IsSuperAdmin = true
+	ts.Require().NoError(ts.API.db.Create(u))
+
+	key, err := configSigningKey(&ts.Config.JWT)
+	ts.Require().NoError(err)
+	token, err := generateAccessToken(u, nil, time.Hour, key, "", "")
+	ts.Require().NoError(err)
+
+	var buffer bytes.Buffer
+	ts.Require().NoError(json.NewEncoder(&buffer).Encode(body))
+	req := httptest.NewRequest(method, path, &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+
+	ts.Require().NoError(ts.API.db.Destroy(u))
+	return w
+}
+
+func (ts *ExternalSamlTestSuite) createSAMLConnection(metadataURL string, domains []string, mapping map[string]interface{}) *models.SAMLConnection {
+	connection, err := models.NewSAMLConnection(ts.instanceID, "Acme")
+	ts.Require().NoError(err)
+	connection.MetadataURL = metadataURL
+	connection.Domains = domains
+	connection.AttributeMapping = mapping
+	ts.Require().NoError(ts.API.db.Create(connection))
+	return connection
+}
+
+// samlConnectionCallback signs in through the SAML connection of the domain
+func (ts *ExternalSamlTestSuite) samlConnectionCallback(domain, samlResponse string) *url.URL {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/authorize?provider=saml&domain="+domain, nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code, w.Body.String())
+	u, err := url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err)
+	state := u.Query().Get("RelayState")
+	ts.Require().NotEmpty(state)
+
+	form := url.Values{}
+	form.Add("RelayState", state)
+	form.Add("SAMLResponse", samlResponse)
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/saml/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code)
+
+	u, err = url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err)
+	return u
+}
+
+func (ts *ExternalSamlTestSuite) TestAdminSAMLConnections() {
+	server, _ := ts.setupSamlMetadata()
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	ts.Require().NoError(err)
+	metadata, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	ts.Require().NoError(err)
+
+	w := ts.adminRequest(http.MethodPost, "http://localhost/admin/saml/connections", map[string]interface{}{
+		"name":              "Acme",
+		"metadata_xml":      string(metadata),
+		"attribute_mapping": map[string]string{"full_name": "displayName"},
+		"domains":           []string{"Acme.com"},
+	})
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	connection := &models.SAMLConnection{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(connection))
+	ts.Equal(models.StringList{"acme.com"}, connection.Domains)
+	ts.Equal("displayName", connection.AttributeMapping["full_name"])
+
+	w = ts.adminRequest(http.MethodGet, "http://localhost/admin/saml/connections", nil)
+	ts.Require().Equal(http.StatusOK, w.Code)
+	data := struct {
+		Connections []*models.SAMLConnection `json:"connections"`
+	}{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(&data))
+	ts.Require().Len(data.Connections, 1)
+	ts.Equal(connection.ID, data.Connections[0].ID)
+
+	// domains can only belong to one connection
+	w = ts.adminRequest(http.MethodPost, "http://localhost/admin/saml/connections", map[string]interface{}{
+		"name":         "Other",
+		"metadata_url": server.URL,
+		"domains":      []string{"acme.com"},
+	})
+	ts.Equal(http.StatusUnprocessableEntity, w.Code)
+
+	w = ts.adminRequest(http.MethodPut, "http://localhost/admin/saml/connections/"+connection.ID.String(), map[string]interface{}{
+		"metadata_url": server.URL,
+		"domains":      []string{"acme.com", "acme.org"},
+	})
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	updated := &models.SAMLConnection{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(updated))
+	ts.Equal("Acme", updated.Name)
+	ts.Equal(server.URL, updated.MetadataURL)
+	ts.Empty(updated.MetadataXML)
+	ts.Equal(models.StringList{"acme.com", "acme.org"}, updated.Domains)
+
+	w = ts.adminRequest(http.MethodDelete, "http://localhost/admin/saml/connections/"+connection.ID.String(), nil)
+	ts.Require().Equal(http.StatusOK, w.Code)
+
+	w = ts.adminRequest(http.MethodGet, "http://localhost/admin/saml/connections/"+connection.ID.String(), nil)
+	ts.Equal(http.StatusNotFound, w.Code)
+}
+
+func (ts *ExternalSamlTestSuite) TestAdminSAMLConnectionValidatesMetadata() {
+	for _, params := range []map[string]interface{}{
+		{"name": "Acme"},
+		{"name": "Acme", "metadata_url": "https://idp.acme.com/metadata"},
+		{"name": "Acme", "metadata_url": "/relative"},
+		{"name": "Acme", "metadata_xml": "<invalid"},
+		{"name": "Acme", "metadata_url": "https://idp.acme.com/metadata", "metadata_xml": "<md:EntityDescriptor/>"},
+	} {
+		w := ts.adminRequest(http.MethodPost, "http://localhost/admin/saml/connections", params)
+		ts.Equal(http.StatusUnprocessableEntity, w.Code, params)
+	}
+}
+
+func (ts *ExternalSamlTestSuite) TestSignupExternalSaml_Connection() {
+	server, idpKeyStore := ts.setupSamlMetadata()
+	defer server.Close()
+	ts.Config.External.Saml.MetadataURL = ""
+
+	key, cert := ts.setupSamlSPCert()
+	ts.Config.External.Saml.SigningKey = key
+	ts.Config.External.Saml.SigningCert = cert
+
+	connection := ts.createSAMLConnection(server.URL, []string{"acme.com"}, map[string]interface{}{
+		"email":     "mail",
+		"full_name": "displayName",
+	})
+
+	u := ts.samlConnectionCallback("ACME.com", ts.setupSamlExampleResponse(idpKeyStore))
+	v, err := url.ParseQuery(u.Fragment)
+	ts.Require().NoError(err)
+	ts.Empty(u.Query().Get("error_description"))
+	ts.NotEmpty(v.Get("access_token"))
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "saml.user@acme.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+	ts.Equal("SAML Test", user.UserMetaData["full_name"])
+
+	// the identity is keyed by the connection and the NameID
+	identity, err := models.FindIdentityByProviderID(ts.API.db, ts.instanceID, "saml", connection.ID.String()+":saml@example.com")
+	ts.Require().NoError(err)
+	ts.Equal(user.ID, identity.UserID)
+}
+
+func (ts *ExternalSamlTestSuite) TestSignupExternalSaml_ConnectionDomainNotAllowed() {
+	server, idpKeyStore := ts.setupSamlMetadata()
+	defer server.Close()
+
+	key, cert := ts.setupSamlSPCert()
+	ts.Config.External.Saml.SigningKey = key
+	ts.Config.External.Saml.SigningCert = cert
+
+	ts.createSAMLConnection(server.URL, []string{"acme.com"}, map[string]interface{}{})
+
+	u := ts.samlConnectionCallback("acme.com", ts.setupSamlExampleResponse(idpKeyStore))
+	ts.Equal("access_denied", u.Query().Get("error"))
+
+	_, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "saml@example.com", ts.Config.JWT.Aud)
+	ts.True(models.IsNotFoundError(err))
+}
+
+func (ts *ExternalSamlTestSuite) TestAuthorizeSaml_UnknownDomain() {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/authorize?provider=saml&domain=unknown.com", nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Equal(http.StatusNotFound, w.Code)
+}
+
+// setupSamlCountingMetadata serves the metadata of the identity provider,
+// counting the requests. Requests fail while down is set.
+func (ts *ExternalSamlTestSuite) setupSamlCountingMetadata(count *int, down *bool) *httptest.Server {
+	server, _ := ts.setupSamlMetadata()
+	res, err := http.Get(server.URL)
+	ts.Require().NoError(err)
+	metadata, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	server.Close()
+	ts.Require().NoError(err)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*count++
+		if *down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(metadata)
+	}))
+}
+
+func (ts *ExternalSamlTestSuite) TestSamlMetadataCached() {
+	count := 0
+	down := false
+	server := ts.setupSamlCountingMetadata(&count, &down)
+	defer server.Close()
+	ts.Config.External.Saml.MetadataURL = server.URL
+
+	key, cert := ts.setupSamlSPCert()
+	ts.Config.External.Saml.SigningKey = key
+	ts.Config.External.Saml.SigningCert = cert
+
+	ts.setupSamlExampleState()
+	ts.setupSamlExampleState()
+	ts.Equal(1, count)
+}
+
+func (ts *ExternalSamlTestSuite) TestAdminSAMLMetadataRefresh() {
+	count := 0
+	down := false
+	server := ts.setupSamlCountingMetadata(&count, &down)
+	defer server.Close()
+	ts.Config.External.Saml.MetadataURL = server.URL
+
+	key, cert := ts.setupSamlSPCert()
+	ts.Config.External.Saml.SigningKey = key
+	ts.Config.External.Saml.SigningCert = cert
+
+	connection := ts.createSAMLConnection(server.URL+"/acme", []string{"acme.com"}, map[string]interface{}{})
+
+	ts.setupSamlExampleState()
+	ts.Require().Equal(1, count)
+
+	w := ts.adminRequest(http.MethodPost, "http://localhost/admin/saml/metadata/refresh", nil)
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	data := struct {
+		Metadata []*SAMLMetadataRefreshResult `json:"metadata"`
+	}{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(&data))
+	ts.Require().Len(data.Metadata, 2)
+	ts.Equal(server.URL, data.Metadata[0].MetadataURL)
+	ts.Nil(data.Metadata[0].ConnectionID)
+	ts.NotNil(data.Metadata[0].ExpiresAt)
+	ts.Empty(data.Metadata[0].Error)
+	ts.Require().NotNil(data.Metadata[1].ConnectionID)
+	ts.Equal(connection.ID, *data.Metadata[1].ConnectionID)
+	ts.Equal(3, count)
+
+	// the last good copy is kept when the identity provider is down
+	down = true
+	w = ts.adminRequest(http.MethodPost, "http://localhost/admin/saml/metadata/refresh", nil)
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(&data))
+	ts.Require().Len(data.Metadata, 2)
+	ts.NotEmpty(data.Metadata[0].Error)
+	ts.Nil(data.Metadata[0].ExpiresAt)
+
+	ts.setupSamlExampleState()
+	ts.Equal(5, count)
+}
+
+func (ts *ExternalSamlTestSuite) TestSignupExternalSaml_AttributeMapping() {
+	server, idpKeyStore := ts.setupSamlSignIn()
+	defer server.Close()
+
+	ts.Config.External.Saml.AttributeMapping = conf.SamlAttributeMapping{
+		UserMetadata: map[string]string{"full_name": "displayName"},
+		AppMetadata:  map[string]string{"groups": "memberOf", "department": "department"},
+		Groups:       "memberOf",
+		GroupRoles: conf.GroupRoles{
+			{Group: "admins", Role: "owner"},
+			{Group: "engineering", Role: "developer"},
+			{Group: "everyone", Role: "member"},
+		},
+	}
+	defer func() {
+		ts.Config.External.Saml.AttributeMapping = conf.SamlAttributeMapping{}
+	}()
+
+	ts.samlSignIn(idpKeyStore)
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "saml@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+	ts.Equal("developer", user.Role)
+	ts.Equal("SAML Test", user.UserMetaData["full_name"])
+	ts.Equal("Research", user.AppMetaData["department"])
+	ts.Equal([]interface{}{"everyone", "engineering"}, user.AppMetaData["groups"])
+	ts.Equal("saml", user.AppMetaData["provider"])
+
+	// the role follows the groups at the identity provider
+	ts.Config.External.Saml.AttributeMapping.GroupRoles = conf.GroupRoles{
+		{Group: "everyone", Role: "member"},
+	}
+	ts.samlSignIn(idpKeyStore)
+
+	user, err = models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "saml@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+	ts.Equal("member", user.Role)
+}
+
+func (ts *ExternalSamlTestSuite) TestSignupExternalSaml_ConnectionRoleAttribute() {
+	server, idpKeyStore := ts.setupSamlSignIn()
+	defer server.Close()
+
+	ts.createSAMLConnection(server.URL, []string{"acme.com"}, map[string]interface{}{
+		"email":        "mail",
+		"role":         "role",
+		"default_role": "member",
+		"app_metadata": map[string]interface{}{"department": "department"},
+	})
+
+	u := ts.samlConnectionCallback("acme.com", ts.setupSamlExampleResponse(idpKeyStore))
+	v, err := url.ParseQuery(u.Fragment)
+	ts.Require().NoError(err)
+	ts.NotEmpty(v.Get("access_token"))
+
+	// the identity provider can't make the user an admin
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "saml.user@acme.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+	ts.Equal("member", user.Role)
+	ts.Equal("Research", user.AppMetaData["department"])
+}
+
+func (ts *ExternalSamlTestSuite) TestAdminSAMLConnectionValidatesAttributeMapping() {
+	for _, mapping := range []map[string]interface{}{
+		{"app_metadata": map[string]interface{}{"provider": "mail"}},
+		{"group_roles": []map[string]interface{}{{"group": "admins", "role": "owner"}}},
+		{"groups": "memberOf", "group_roles": []map[string]interface{}{{"group": "admins"}}},
+		{"user_metadata": "displayName"},
+	} {
+		w := ts.adminRequest(http.MethodPost, "http://localhost/admin/saml/connections", map[string]interface{}{
+			"name":              "Acme",
+			"metadata_url":      "https://idp.acme.com/metadata",
+			"attribute_mapping": mapping,
+			"domains":           []string{"acme.com"},
+		})
+		ts.Equal(http.StatusUnprocessableEntity, w.Code, mapping)
+	}
+}
+
+func (ts *ExternalSamlTestSuite) createIdPInitiatedSAMLConnection(metadataURL string) *models.SAMLConnection {
+	connection := ts.createSAMLConnection(metadataURL, []string{"example.com"}, map[string]interface{}{})
+	connection.IdPInitiated = true
+	connection.DefaultRedirectURL = ts.Config.SiteURL + "/dashboard"
+	ts.Require().NoError(connection.UpdateInfo(ts.API.db))
+	return connection
+}
+
+// samlUnsolicitedResponse posts a response of the identity provider to the
+// ACS without a request of GoTrue
+func (ts *ExternalSamlTestSuite) samlUnsolicitedResponse(relayState, samlResponse string) *httptest.ResponseRecorder {
+	form := url.Values{}
+	if relayState != "" {
+		form.Add("RelayState", relayState)
+	}
+	form.Add("SAMLResponse", samlResponse)
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/saml/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *ExternalSamlTestSuite) TestSignupExternalSaml_IdPInitiated() {
+	server, idpKeyStore := ts.setupSamlSignIn()
+	defer server.Close()
+	ts.Config.External.Saml.MetadataURL = ""
+	ts.createIdPInitiatedSAMLConnection(server.URL)
+
+	samlResponse := ts.setupSamlExampleResponse(idpKeyStore)
+	w := ts.samlUnsolicitedResponse("", samlResponse)
+	ts.Require().Equal(http.StatusFound, w.Code, w.Body.String())
+	u, err := url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err)
+	ts.Equal(ts.Config.SiteURL+"/dashboard", u.Scheme+"://"+u.Host+u.Path)
+	v, err := url.ParseQuery(u.Fragment)
+	ts.Require().NoError(err)
+	ts.NotEmpty(v.Get("access_token"))
+
+	_, err = models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "saml@example.com", ts.Config.JWT.Aud)
+	ts.Require().NoError(err)
+
+	// the assertion can't be replayed
+	w = ts.samlUnsolicitedResponse("", samlResponse)
+	ts.Require().Equal(http.StatusFound, w.Code)
+	u, err = url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err)
+	ts.Equal("access_denied", u.Query().Get("error"))
+	ts.Empty(u.Fragment)
+}
+
+func (ts *ExternalSamlTestSuite) TestSignupExternalSaml_IdPInitiatedRelayState() {
+	server, idpKeyStore := ts.setupSamlSignIn()
+	defer server.Close()
+	ts.Config.External.Saml.MetadataURL = ""
+	ts.createIdPInitiatedSAMLConnection(server.URL)
+
+	w := ts.samlUnsolicitedResponse(ts.Config.SiteURL+"/app", ts.setupSamlExampleResponse(idpKeyStore))
+	ts.Require().Equal(http.StatusFound, w.Code, w.Body.String())
+	u, err := url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err)
+	ts.Equal(ts.Config.SiteURL+"/app", u.Scheme+"://"+u.Host+u.Path)
+	v, err := url.ParseQuery(u.Fragment)
+	ts.Require().NoError(err)
+	ts.NotEmpty(v.Get("access_token"))
+}
+
+func (ts *ExternalSamlTestSuite) TestSignupExternalSaml_IdPInitiatedRequiresNotOnOrAfter() {
+	server, idpKeyStore := ts.setupSamlSignIn()
+	defer server.Close()
+	ts.Config.External.Saml.MetadataURL = ""
+	ts.createIdPInitiatedSAMLConnection(server.URL)
+
+	doc := ts.setupSamlExampleResponseDoc()
+	for _, el := range doc.FindElements("//Conditions") {
+		el.RemoveAttr("NotOnOrAfter")
+	}
+	for _, el := range doc.FindElements("//SubjectConfirmationData") {
+		el.RemoveAttr("NotOnOrAfter")
+	}
+
+	w := ts.samlUnsolicitedResponse("", ts.signSamlResponse(doc, idpKeyStore))
+	ts.Require().Equal(http.StatusFound, w.Code)
+	u, err := url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err)
+	ts.NotEmpty(u.Query().Get("error"))
+	ts.Empty(u.Fragment)
+}
+
+func (ts *ExternalSamlTestSuite) TestSignupExternalSaml_IdPInitiatedNotAllowed() {
+	server, idpKeyStore := ts.setupSamlSignIn()
+	defer server.Close()
+	ts.Config.External.Saml.MetadataURL = ""
+	ts.createSAMLConnection(server.URL, []string{"example.com"}, map[string]interface{}{})
+
+	w := ts.samlUnsolicitedResponse("", ts.setupSamlExampleResponse(idpKeyStore))
+	ts.Equal(http.StatusBadRequest, w.Code)
+
+	_, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "saml@example.com", ts.Config.JWT.Aud)
+	ts.True(models.IsNotFoundError(err))
+}
+
+func (ts *ExternalSamlTestSuite) TestAdminSAMLConnectionIdPInitiated() {
+	w := ts.adminRequest(http.MethodPost, "http://localhost/admin/saml/connections", map[string]interface{}{
+		"name":                 "Acme",
+		"metadata_url":         "https://idp.acme.com/metadata",
+		"idp_initiated":        true,
+		"default_redirect_url": "https://attacker.example.org",
+		"domains":              []string{"acme.com"},
+	})
+	ts.Equal(http.StatusUnprocessableEntity, w.Code)
+
+	w = ts.adminRequest(http.MethodPost, "http://localhost/admin/saml/connections", map[string]interface{}{
+		"name":                 "Acme",
+		"metadata_url":         "https://idp.acme.com/metadata",
+		"idp_initiated":        true,
+		"default_redirect_url": ts.Config.SiteURL + "/dashboard",
+		"domains":              []string{"acme.com"},
+	})
+	ts.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	connection := &models.SAMLConnection{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(connection))
+	ts.True(connection.IdPInitiated)
+	ts.Equal(ts.Config.SiteURL+"/dashboard", connection.DefaultRedirectURL)
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+)
+
+// SessionResponse represents a signed in device of a user
+type SessionResponse struct {
+	*models.Session
+	Current bool `json:"current"`
+}
+
+func newSessionResponses(sessions []*models.Session, currentID string) []*SessionResponse {
+	responses := make([]*SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		responses = append(responses, &SessionResponse{
+			Session: session,
+			Current: session.ID.String() == currentID,
+		})
+	}
+	return responses
+}
+
+func (a *API) findUserSession(r *http.Request, user *models.User) (*models.Session, error) {
+	sessionID, err := uuid.FromString(chi.URLParam(r, "session_id"))
+	if err != nil {
+		return nil, badRequestError("session_id must be an UUID")
+	}
+
+	logEntrySetField(r, "session_id", sessionID)
+
+	session, err := models.FindSessionByUserAndID(a.db, user, sessionID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil, notFoundError("Session not found")
+		}
+		return nil, internalServerError("Database error loading session").WithInternalError(err)
+	}
+	return session, nil
+}
+
+// revokeSession signs out a session, recording the actor in the audit log
+func (a *API) revokeSession(r *http.Request, actor *models.User, session *models.Session) error {
+	instanceID := getInstanceID(r.Context())
+
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		if terr := models.NewAuditLogEntry(tx, instanceID, actor, models.SessionRevokedAction, map[string]interface{}{
+			"user_id":    session.UserID,
+			"session_id": session.ID,
+		}); terr != nil {
+			return terr
+		}
+		return session.Logout(tx)
+	})
+	if err != nil {
+		return internalServerError("Error revoking session").WithInternalError(err)
+	}
+	return nil
+}
+
+// UserSessions lists the sessions of the authenticated user
+func (a *API) UserSessions(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	user, err := getUserFromClaims(ctx, a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+
+	sessions, err := models.FindSessionsByUser(a.db, user)
+	if err != nil {
+		return internalServerError("Database error finding sessions").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, newSessionResponses(sessions, getClaims(ctx).SessionID))
+}
+
+// UserSessionDelete signs out one of the sessions of the authenticated user
+func (a *API) UserSessionDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	user, err := getUserFromClaims(ctx, a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+
+	session, err := a.findUserSession(r, user)
+	if err != nil {
+		return err
+	}
+	if err := a.revokeSession(r, user, session); err != nil {
+		return err
+	}
+
+	if session.ID.String() == getClaims(ctx).SessionID {
+		a.clearCookieToken(ctx, w)
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// adminUserSessions lists the sessions of a user
+func (a *API) adminUserSessions(w http.ResponseWriter, r *http.Request) error {
+	user := getUser(r.Context())
+
+	sessions, err := models.FindSessionsByUser(a.db, user)
+	if err != nil {
+		return internalServerError("Database error finding sessions").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": newSessionResponses(sessions, ""),
+	})
+}
+
+// adminUserSessionDelete signs out one of the sessions of a user
+func (a *API) adminUserSessionDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+
+	session, err := a.findUserSession(r, user)
+	if err != nil {
+		return err
+	}
+	if err := a.revokeSession(r, getAdminUser(ctx), session); err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// adminUserSessionsDelete signs out all sessions of a user
+func (a *API) adminUserSessionsDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+	user := getUser(ctx)
+
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		if terr := models.NewAuditLogEntry(tx, instanceID, getAdminUser(ctx), models.SessionRevokedAction, map[string]interface{}{
+			"user_id": user.ID,
+		}); terr != nil {
+			return terr
+		}
+		return models.Logout(tx, instanceID, user.ID)
+	})
+	if err != nil {
+		return internalServerError("Error revoking sessions").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{})
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type SessionsTestSuite struct {
+	suite.Suite
+	API    *API
+	Config *conf.Configuration
+
+	adminToken string
+	user       *models.User
+	instanceID uuid.UUID
+}
+
+func TestSessions(t *testing.T) {
+	api, config, instanceID, err := setupAPIForTestForInstance()
+	require.NoError(t, err)
+
+	ts := &SessionsTestSuite{
+		API:        api,
+		Config:     config,
+		instanceID: instanceID,
+	}
+	defer api.db.Close()
+
+	suite.Run(t, ts)
+}
+
+func (ts *SessionsTestSuite) SetupTest() {
+	models.TruncateAll(ts.API.db)
+
+	key, err := configSigningKey(&ts.Config.JWT)
+	require.NoError(ts.T(), err)
+
+	admin, err := models.NewUser(ts.instanceID, "admin@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error creating test user model")
+	admin.Role = "supabase_admin"
+	require.NoError(ts.T(), ts.API.db.Create(admin), "Error saving new test user")
+	ts.adminToken, err = generateAccessToken(admin, nil, time.Second*time.Duration(ts.Config.JWT.Exp), key, "", "")
+	require.NoError(ts.T(), err)
+
+	ts.user, err = models.NewUser(ts.instanceID, "test@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error creating test user model")
+	require.NoError(ts.T(), ts.API.db.Create(ts.user), "Error saving new test user")
+	require.NoError(ts.T(), ts.user.Confirm(ts.API.db))
+}
+
+func (ts *SessionsTestSuite) request(method, path, token string, body map[string]interface{}) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+
+	req := httptest.NewRequest(method, path, &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "test-agent")
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *SessionsTestSuite) login() *AccessTokenResponse {
+	w := ts.request(http.MethodPost, "http://localhost/token?grant_type=password", "", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	token := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+	return token
+}
+
+func (ts *SessionsTestSuite) refresh(refreshToken string) *httptest.ResponseRecorder {
+	return ts.request(http.MethodPost, "http://localhost/token?grant_type=refresh_token", "", map[string]interface{}{
+		"refresh_token": refreshToken,
+	})
+}
+
+func (ts *SessionsTestSuite) sessionClaim(accessToken string) string {
+	claims := &GoTrueClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(accessToken, claims)
+	require.NoError(ts.T(), err)
+	return claims.SessionID
+}
+
+func (ts *SessionsTestSuite) TestSessionClaim() {
+	token := ts.login()
+	sessionID := ts.sessionClaim(token.Token)
+	require.NotEmpty(ts.T(), sessionID)
+
+	w := ts.refresh(token.RefreshToken)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	refreshed := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(refreshed))
+	assert.Equal(ts.T(), sessionID, ts.sessionClaim(refreshed.Token))
+
+	id, err := uuid.FromString(sessionID)
+	require.NoError(ts.T(), err)
+	session, err := models.FindSessionByID(ts.API.db, ts.instanceID, id)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "test-agent", session.UserAgent)
+	assert.NotEmpty(ts.T(), session.IP)
+	assert.NotNil(ts.T(), session.RefreshedAt)
+}
+
+func (ts *SessionsTestSuite) TestListAndRevokeSessions() {
+	phone := ts.login()
+	laptop := ts.login()
+
+	w := ts.request(http.MethodGet, "http://localhost/user/sessions", laptop.Token, nil)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	sessions := []*SessionResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&sessions))
+	require.Len(ts.T(), sessions, 2)
+	for _, session := range sessions {
+		assert.Equal(ts.T(), session.ID.String() == ts.sessionClaim(laptop.Token), session.Current)
+	}
+
+	w = ts.request(http.MethodDelete, "http://localhost/user/sessions/"+ts.sessionClaim(phone.Token), laptop.Token, nil)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	// only the revoked device is signed out
+	w = ts.refresh(phone.RefreshToken)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	w = ts.refresh(laptop.RefreshToken)
+	assert.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+}
+
+func (ts *SessionsTestSuite) TestLogout() {
+	phone := ts.login()
+	laptop := ts.login()
+
+	// only the session of the token is signed out
+	w := ts.request(http.MethodPost, "http://localhost/logout", laptop.Token, nil)
+	require.Equal(ts.T(), http.StatusNoContent, w.Code, w.Body.String())
+	w = ts.refresh(laptop.RefreshToken)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	w = ts.refresh(phone.RefreshToken)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	refreshed := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(refreshed))
+
+	tablet := ts.login()
+	w = ts.request(http.MethodPost, "http://localhost/logout?scope=global", refreshed.Token, nil)
+	require.Equal(ts.T(), http.StatusNoContent, w.Code, w.Body.String())
+	w = ts.refresh(tablet.RefreshToken)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	w = ts.request(http.MethodPost, "http://localhost/logout?scope=others", tablet.Token, nil)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *SessionsTestSuite) TestRevokeSessionOfOtherUser() {
+	token := ts.login()
+
+	other, err := models.NewUser(ts.instanceID, "other@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(other))
+	refreshToken, err := models.GrantAuthenticatedUser(ts.API.db, other, models.GrantParams{})
+	require.NoError(ts.T(), err)
+
+	w := ts.request(http.MethodDelete, "http://localhost/user/sessions/"+refreshToken.SessionID.String(), token.Token, nil)
+	assert.Equal(ts.T(), http.StatusNotFound, w.Code)
+
+	w = ts.request(http.MethodDelete, "http://localhost/user/sessions/not-a-uuid", token.Token, nil)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *SessionsTestSuite) TestAdminSessions() {
+	first := ts.login()
+	second := ts.login()
+	path := fmt.Sprintf("http://localhost/admin/users/%s/sessions", ts.user.ID)
+
+	w := ts.request(http.MethodGet, path, ts.adminToken, nil)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	data := struct {
+		Sessions []*SessionResponse `json:"sessions"`
+	}{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	assert.Len(ts.T(), data.Sessions, 2)
+
+	w = ts.request(http.MethodDelete, path+"/"+ts.sessionClaim(first.Token), ts.adminToken, nil)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(ts.T(), http.StatusBadRequest, ts.refresh(first.RefreshToken).Code)
+
+	w = ts.request(http.MethodDelete, path, ts.adminToken, nil)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(ts.T(), http.StatusBadRequest, ts.refresh(second.RefreshToken).Code)
+
+	sessions, err := models.FindSessionsByUser(ts.API.db, ts.user)
+	require.NoError(ts.T(), err)
+	assert.Empty(ts.T(), sessions)
+}
@@ -1,20 +1,53 @@
 package api
 
-import "net/http"
+import (
+	"encoding/json"
+	"net/http"
 
+	"github.com/netlify/gotrue/api/provider"
+)
+
+// ProviderSettings tells which providers are enabled. Sign in methods and
+// registered providers are keyed by name, generic OpenID Connect providers are
+// listed by name under oidc.
 type ProviderSettings struct {
-	Apple     bool `json:"apple"`
-	Azure     bool `json:"azure"`
-	Bitbucket bool `json:"bitbucket"`
-	Discord   bool `json:"discord"`
-	GitHub    bool `json:"github"`
-	GitLab    bool `json:"gitlab"`
-	Google    bool `json:"google"`
-	Facebook  bool `json:"facebook"`
-	Twitch    bool `json:"twitch"`
-	Twitter   bool `json:"twitter"`
-	Email     bool `json:"email"`
-	SAML      bool `json:"saml"`
+	Enabled map[string]bool
+	OIDC    map[string]bool
+}
+
+func (p ProviderSettings) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(p.Enabled)+1)
+	for name, enabled := range p.Enabled {
+		fields[name] = enabled
+	}
+	if len(p.OIDC) > 0 {
+		fields["oidc"] = p.OIDC
+	}
+	return json.Marshal(fields)
+}
+
+func (p *ProviderSettings) UnmarshalJSON(data []byte) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	p.Enabled = make(map[string]bool, len(fields))
+	p.OIDC = nil
+	for name, value := range fields {
+		if name == "oidc" {
+			if err := json.Unmarshal(value, &p.OIDC); err != nil {
+				return err
+			}
+			continue
+		}
+		var enabled bool
+		if err := json.Unmarshal(value, &enabled); err != nil {
+			return err
+		}
+		p.Enabled[name] = enabled
+	}
+	return nil
 }
 
 type ProviderLabels struct {
@@ -26,30 +59,42 @@ type Settings struct {
 	ExternalLabels    ProviderLabels   `json:"external_labels"`
 	DisableSignup     bool             `json:"disable_signup"`
 	Autoconfirm       bool             `json:"autoconfirm"`
+	MFAEnabled        bool             `json:"mfa_enabled"`
+	WebAuthnEnabled   bool             `json:"webauthn_enabled"`
 }
 
 func (a *API) Settings(w http.ResponseWriter, r *http.Request) error {
 	config := a.getConfig(r.Context())
 
-	return sendJSON(w, http.StatusOK, &Settings{
-		ExternalProviders: ProviderSettings{
-			Apple:     config.External.Apple.Enabled,
-			Azure:     config.External.Azure.Enabled,
-			Bitbucket: config.External.Bitbucket.Enabled,
-			Discord:   config.External.Discord.Enabled,
-			GitHub:    config.External.Github.Enabled,
-			GitLab:    config.External.Gitlab.Enabled,
-			Google:    config.External.Google.Enabled,
-			Facebook:  config.External.Facebook.Enabled,
-			Twitch:    config.External.Twitch.Enabled,
-			Twitter:   config.External.Twitter.Enabled,
-			Email:     !config.External.Email.Disabled,
-			SAML:      config.External.Saml.Enabled,
+	providers := ProviderSettings{
+		Enabled: map[string]bool{
+			"email":     !config.External.Email.Disabled,
+			"phone":     config.External.Phone.Enabled,
+			"ldap":      config.External.LDAP.Enabled,
+			"anonymous": config.External.Anonymous.Enabled,
 		},
+	}
+	for _, reg := range provider.Registrations() {
+		providers.Enabled[reg.Name] = reg.IsEnabled(&config.External)
+	}
+	for name, ext := range config.External.OIDC {
+		if provider.ValidateOIDCName(name) != nil {
+			continue
+		}
+		if providers.OIDC == nil {
+			providers.OIDC = make(map[string]bool, len(config.External.OIDC))
+		}
+		providers.OIDC[name] = ext.Enabled
+	}
+
+	return sendJSON(w, http.StatusOK, &Settings{
+		ExternalProviders: providers,
 		ExternalLabels: ProviderLabels{
 			SAML: config.External.Saml.Name,
 		},
-		DisableSignup: config.DisableSignup,
-		Autoconfirm:   config.Mailer.Autoconfirm,
+		DisableSignup:   config.DisableSignup,
+		Autoconfirm:     config.Mailer.Autoconfirm,
+		MFAEnabled:      config.MFA.Enabled,
+		WebAuthnEnabled: config.WebAuthn.Enabled,
 	})
 }
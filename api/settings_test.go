@@ -7,9 +7,41 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/netlify/gotrue/api/provider"
+	"github.com/netlify/gotrue/conf"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 )
 
+type customTestConfig struct {
+	Enabled bool   `json:"enabled"`
+	URL     string `json:"url"`
+}
+
+type customTestProvider struct {
+	config *customTestConfig
+}
+
+func (p customTestProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.URL + "?state=" + state
+}
+
+func init() {
+	provider.Register(provider.Registration{
+		Name: "customtest",
+		Config: func(ext *conf.ProviderConfiguration) (interface{}, error) {
+			config := &customTestConfig{}
+			return config, provider.DecodeCustomConfig(ext, "customtest", config)
+		},
+		New: func(config interface{}, params provider.Params) (provider.Provider, error) {
+			return customTestProvider{config: config.(*customTestConfig)}, nil
+		},
+		Enabled: func(config interface{}) bool {
+			return config.(*customTestConfig).Enabled
+		},
+	})
+}
+
 func TestSettings_DefaultProviders(t *testing.T) {
 	api, _, _, err := setupAPIForTestForInstance()
 	require.NoError(t, err)
@@ -24,14 +56,15 @@ func TestSettings_DefaultProviders(t *testing.T) {
 	resp := Settings{}
 	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
 
-	p := resp.ExternalProviders
-	require.True(t, p.Email)
-	require.True(t, p.Google)
-	require.True(t, p.GitHub)
-	require.True(t, p.GitLab)
-	require.True(t, p.Bitbucket)
-	require.True(t, p.SAML)
-	require.False(t, p.Facebook)
+	p := resp.ExternalProviders.Enabled
+	require.True(t, p["email"])
+	require.True(t, p["google"])
+	require.True(t, p["github"])
+	require.True(t, p["gitlab"])
+	require.True(t, p["bitbucket"])
+	require.True(t, p["saml"])
+	require.False(t, p["facebook"])
+	require.False(t, p["phone"])
 }
 
 func TestSettings_EmailDisabled(t *testing.T) {
@@ -54,8 +87,8 @@ func TestSettings_EmailDisabled(t *testing.T) {
 	resp := Settings{}
 	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
 
-	p := resp.ExternalProviders
-	require.False(t, p.Email)
+	p := resp.ExternalProviders.Enabled
+	require.False(t, p["email"])
 }
 
 func TestSettings_ExternalName(t *testing.T) {
@@ -81,3 +114,68 @@ func TestSettings_ExternalName(t *testing.T) {
 	n := resp.ExternalLabels
 	require.Equal(t, n.SAML, "TestSamlName")
 }
+
+func TestSettings_RegisteredProvider(t *testing.T) {
+	api, config, instanceID, err := setupAPIForTestForInstance()
+	require.NoError(t, err)
+
+	config.External.Custom = conf.CustomProviders{
+		"customtest": json.RawMessage(`{"enabled":true,"url":"https://custom.example.com/authorize"}`),
+	}
+	ctx, err := WithInstanceConfig(context.Background(), config, instanceID)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/settings", nil)
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	require.Equal(t, w.Code, http.StatusOK)
+	resp := Settings{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.True(t, resp.ExternalProviders.Enabled["customtest"])
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/authorize?provider=customtest", nil)
+	req = req.WithContext(ctx)
+	w = httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusFound, w.Code)
+	require.Contains(t, w.Header().Get("Location"), "https://custom.example.com/authorize?state=")
+}
+
+func TestSettings_OIDCProviders(t *testing.T) {
+	api, config, instanceID, err := setupAPIForTestForInstance()
+	require.NoError(t, err)
+
+	enabled := conf.OIDCProviderConfiguration{
+		OAuthProviderConfiguration: conf.OAuthProviderConfiguration{Enabled: true},
+	}
+	config.External.OIDC = conf.OIDCProviders{
+		"okta":   enabled,
+		"email":  enabled,
+		"oidc":   enabled,
+		"github": enabled,
+	}
+	config.External.Email.Disabled = true
+	ctx, err := WithInstanceConfig(context.Background(), config, instanceID)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/settings", nil)
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	require.Equal(t, w.Code, http.StatusOK)
+	resp := Settings{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+	// names of sign in methods and built-in providers can't be used
+	require.Equal(t, map[string]bool{"okta": true}, resp.ExternalProviders.OIDC)
+	require.False(t, resp.ExternalProviders.Enabled["email"])
+
+	for _, name := range []string{"email", "oidc"} {
+		req = httptest.NewRequest(http.MethodGet, "http://localhost/authorize?provider="+name, nil)
+		req = req.WithContext(ctx)
+		w = httptest.NewRecorder()
+		api.handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	}
+}
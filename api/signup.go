@@ -16,6 +16,7 @@ import (
 // SignupParams are the parameters the Signup endpoint accepts
 type SignupParams struct {
 	Email    string                 `json:"email"`
+	Phone    string                 `json:"phone"`
 	Password string                 `json:"password"`
 	Data     map[string]interface{} `json:"data"`
 	Provider string                 `json:"-"`
@@ -39,6 +40,9 @@ func (a *API) Signup(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Could not read Signup params: %v", err)
 	}
 
+	if params.Email != "" && params.Phone != "" {
+		return unprocessableEntityError("Only an email address or phone number should be provided on signup")
+	}
 	if params.Password == "" {
 		return unprocessableEntityError("Signup requires a valid password")
 	}
@@ -46,13 +50,29 @@ func (a *API) Signup(w http.ResponseWriter, r *http.Request) error {
 		return unprocessableEntityError(fmt.Sprintf("Password should be at least %d characters", config.PasswordMinLength))
 	}
 
-	if err := a.validateEmail(ctx, params.Email); err != nil {
-		return err
-	}
-
 	instanceID := getInstanceID(ctx)
 	params.Aud = a.requestAud(ctx, r)
-	user, err := models.FindUserByEmailAndAudience(a.db, instanceID, params.Email, params.Aud)
+
+	var user *models.User
+	if params.Phone != "" {
+		if !config.External.Phone.Enabled {
+			return badRequestError("Unsupported phone provider")
+		}
+		if params.Phone, err = validatePhone(params.Phone); err != nil {
+			return err
+		}
+		params.Provider = "phone"
+		user, err = models.FindUserByPhoneAndAudience(a.db, instanceID, params.Phone, params.Aud)
+	} else {
+		if config.External.Email.Disabled {
+			return badRequestError("Unsupported email provider")
+		}
+		if err := a.validateEmail(ctx, params.Email); err != nil {
+			return err
+		}
+		params.Provider = "email"
+		user, err = models.FindUserByEmailAndAudience(a.db, instanceID, params.Email, params.Aud)
+	}
 	if err != nil && !models.IsNotFoundError(err) {
 		return internalServerError("Database error finding user").WithInternalError(err)
 	}
@@ -60,7 +80,10 @@ func (a *API) Signup(w http.ResponseWriter, r *http.Request) error {
 	err = a.db.Transaction(func(tx *storage.Connection) error {
 		var terr error
 		if user != nil {
-			if user.IsConfirmed() {
+			if params.Provider == "phone" && user.IsPhoneConfirmed() {
+				return badRequestError("A user with this phone number has already been registered")
+			}
+			if params.Provider == "email" && user.IsConfirmed() {
 				return badRequestError("A user with this email address has already been registered")
 			}
 
@@ -68,13 +91,40 @@ func (a *API) Signup(w http.ResponseWriter, r *http.Request) error {
 				return internalServerError("Database error updating user").WithInternalError(err)
 			}
 		} else {
-			params.Provider = "email"
 			user, terr = a.signupNewUser(ctx, tx, params)
 			if terr != nil {
 				return terr
 			}
 		}
 
+		if params.Provider == "phone" {
+			if config.SMS.Autoconfirm {
+				if terr = models.NewAuditLogEntry(tx, instanceID, user, models.UserSignedUpAction, nil); terr != nil {
+					return terr
+				}
+				if terr = triggerEventHooks(ctx, tx, SignupEvent, user, instanceID, config); terr != nil {
+					return terr
+				}
+				if terr = user.ConfirmPhone(tx); terr != nil {
+					return internalServerError("Database error updating user").WithInternalError(terr)
+				}
+				return nil
+			}
+			smsSender, terr := a.SMSSender(ctx)
+			if terr != nil {
+				return internalServerError("Error configuring SMS provider").WithInternalError(terr)
+			}
+			if terr = sendPhoneConfirmation(tx, user, smsSender, config); terr != nil {
+				if errors.Is(terr, MaxFrequencyLimitError) {
+					now := time.Now()
+					left := user.ConfirmationSentAt.Add(config.SMS.MaxFrequency).Sub(now) / time.Second
+					return tooManyRequestsError(fmt.Sprintf("For security purposes, you can only request this after %d seconds.", left))
+				}
+				return internalServerError("Error sending confirmation sms").WithInternalError(terr)
+			}
+			return nil
+		}
+
 		if config.Mailer.Autoconfirm {
 			if terr = models.NewAuditLogEntry(tx, instanceID, user, models.UserSignedUpAction, nil); terr != nil {
 				return terr
@@ -107,7 +157,7 @@ func (a *API) Signup(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	if user.IsConfirmed() {
+	if user.IsConfirmed() || user.IsPhoneConfirmed() {
 		var token *AccessTokenResponse
 		err = a.db.Transaction(func(tx *storage.Connection) error {
 			var terr error
@@ -118,7 +168,7 @@ func (a *API) Signup(w http.ResponseWriter, r *http.Request) error {
 				return terr
 			}
 
-			token, terr = a.issueRefreshToken(ctx, tx, user)
+			token, terr = a.issueRefreshToken(ctx, tx, user, newGrantParams(r))
 			if terr != nil {
 				return terr
 			}
@@ -148,10 +198,12 @@ func (a *API) signupNewUser(ctx context.Context, conn *storage.Connection, param
 	if err != nil {
 		return nil, internalServerError("Database error creating user").WithInternalError(err)
 	}
+	user.Phone = params.Phone
 	if user.AppMetaData == nil {
 		user.AppMetaData = make(map[string]interface{})
 	}
 	user.AppMetaData["provider"] = params.Provider
+	user.AppMetaData["providers"] = []string{params.Provider}
 
 	if params.Password == "" {
 		user.EncryptedPassword = ""
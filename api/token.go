@@ -3,7 +3,9 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -17,23 +19,33 @@ import (
 type GoTrueClaims struct {
 	jwt.StandardClaims
 	Email        string                 `json:"email"`
+	Phone        string                 `json:"phone"`
 	AppMetaData  map[string]interface{} `json:"app_metadata"`
 	UserMetaData map[string]interface{} `json:"user_metadata"`
 	Role         string                 `json:"role"`
+	AuthTime     int64                  `json:"auth_time,omitempty"`
+	Nonce        string                 `json:"nonce,omitempty"`
+	SessionID    string                 `json:"session_id,omitempty"`
+	IsAnonymous  bool                   `json:"is_anonymous"`
+	// ClientID and Scope are set on tokens issued to OAuth clients
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
 }
 
 // AccessTokenResponse represents an OAuth2 success response
 type AccessTokenResponse struct {
-	Token        string       `json:"access_token"`
-	TokenType    string       `json:"token_type"` // Bearer
-	ExpiresIn    int          `json:"expires_in"`
-	RefreshToken string       `json:"refresh_token"`
-	User         *models.User `json:"user"`
+	Token         string       `json:"access_token"`
+	TokenType     string       `json:"token_type"` // Bearer
+	ExpiresIn     int          `json:"expires_in"`
+	RefreshToken  string       `json:"refresh_token"`
+	ProviderToken string       `json:"provider_token,omitempty"`
+	User          *models.User `json:"user"`
 }
 
 // PasswordGrantParams are the parameters the ResourceOwnerPasswordGrant method accepts
 type PasswordGrantParams struct {
 	Email    string `json:"email"`
+	Phone    string `json:"phone"`
 	Password string `json:"password"`
 }
 
@@ -55,6 +67,14 @@ func (a *API) Token(w http.ResponseWriter, r *http.Request) error {
 		return a.ResourceOwnerPasswordGrant(ctx, w, r)
 	case "refresh_token":
 		return a.RefreshTokenGrant(ctx, w, r)
+	case "mfa_totp":
+		return a.MFATOTPGrant(ctx, w, r)
+	case "mfa_webauthn":
+		return a.MFAWebAuthnGrant(ctx, w, r)
+	case "authorization_code":
+		return a.AuthorizationCodeGrant(ctx, w, r)
+	case "pkce":
+		return a.PKCEGrant(ctx, w, r)
 	default:
 		return oauthError("unsupported_grant_type", "")
 	}
@@ -75,20 +95,73 @@ func (a *API) ResourceOwnerPasswordGrant(ctx context.Context, w http.ResponseWri
 	instanceID := getInstanceID(ctx)
 	config := a.getConfig(ctx)
 
-	user, err := models.FindUserByEmailAndAudience(a.db, instanceID, params.Email, aud)
-	if err != nil {
-		if models.IsNotFoundError(err) {
-			return oauthError("invalid_grant", "Invalid email or password")
+	var user *models.User
+	var err error
+	if params.Phone != "" {
+		if !config.External.Phone.Enabled {
+			return badRequestError("Unsupported phone provider")
+		}
+		if params.Phone, err = validatePhone(params.Phone); err != nil {
+			return err
+		}
+		user, err = models.FindUserByPhoneAndAudience(a.db, instanceID, params.Phone, aud)
+		if err != nil {
+			if models.IsNotFoundError(err) {
+				return oauthError("invalid_grant", "Invalid phone or password")
+			}
+			return internalServerError("Database error finding user").WithInternalError(err)
 		}
-		return internalServerError("Database error finding user").WithInternalError(err)
-	}
 
-	if !user.IsConfirmed() {
-		return oauthError("invalid_grant", "Email not confirmed")
+		if !user.IsPhoneConfirmed() {
+			return oauthError("invalid_grant", "Phone not confirmed")
+		}
+
+		if !user.Authenticate(params.Password) {
+			return oauthError("invalid_grant", "Invalid phone or password")
+		}
+	} else {
+		if config.External.Email.Disabled {
+			return badRequestError("Unsupported email provider")
+		}
+
+		// users in the directory sign in with their directory password
+		if config.External.LDAP.Enabled {
+			if user, err = a.ldapAuthenticate(ctx, params.Email, params.Password, aud); err != nil {
+				return err
+			}
+		}
+
+		if user == nil {
+			user, err = models.FindUserByEmailAndAudience(a.db, instanceID, params.Email, aud)
+			if err != nil {
+				if models.IsNotFoundError(err) {
+					return oauthError("invalid_grant", "Invalid email or password")
+				}
+				return internalServerError("Database error finding user").WithInternalError(err)
+			}
+
+			if !user.IsConfirmed() {
+				return oauthError("invalid_grant", "Email not confirmed")
+			}
+
+			if !user.Authenticate(params.Password) {
+				return oauthError("invalid_grant", "Invalid email or password")
+			}
+		}
 	}
 
-	if !user.Authenticate(params.Password) {
-		return oauthError("invalid_grant", "Invalid email or password")
+	factor, err := models.FindVerifiedTOTPFactorByUser(a.db, user)
+	if err != nil && !models.IsNotFoundError(err) {
+		return internalServerError("Database error finding factor").WithInternalError(err)
+	}
+	var credentials []*models.WebAuthnCredential
+	if config.MFA.Enabled && config.WebAuthn.Enabled {
+		if credentials, err = models.FindWebAuthnCredentialsByUser(a.db, user); err != nil {
+			return internalServerError("Database error finding webauthn credentials").WithInternalError(err)
+		}
+	}
+	if factor != nil || len(credentials) > 0 {
+		return a.sendMFAChallenge(ctx, w, user, factor != nil, credentials)
 	}
 
 	var token *AccessTokenResponse
@@ -101,7 +174,7 @@ func (a *API) ResourceOwnerPasswordGrant(ctx context.Context, w http.ResponseWri
 			return terr
 		}
 
-		token, terr = a.issueRefreshToken(ctx, tx, user)
+		token, terr = a.issueRefreshToken(ctx, tx, user, newGrantParams(r))
 		if terr != nil {
 			return terr
 		}
@@ -147,26 +220,43 @@ func (a *API) RefreshTokenGrant(ctx context.Context, w http.ResponseWriter, r *h
 		return internalServerError(err.Error())
 	}
 
-	if token.Revoked {
-		a.clearCookieToken(ctx, w)
-		return oauthError("invalid_grant", "Invalid Refresh Token").WithInternalMessage("Possible abuse attempt: %v", r)
-	}
-
 	var tokenString string
 	var newToken *models.RefreshToken
+	var session *models.Session
 
-	err = a.db.Transaction(func(tx *storage.Connection) error {
+	if token.Revoked {
+		if newToken, err = a.reusedRefreshToken(ctx, w, r, user, token); err != nil {
+			return err
+		}
+	}
+
+	issue := func(tx *storage.Connection) error {
 		var terr error
-		if terr = models.NewAuditLogEntry(tx, instanceID, user, models.TokenRefreshedAction, nil); terr != nil {
-			return terr
+		if newToken == nil {
+			if terr = models.NewAuditLogEntry(tx, instanceID, user, models.TokenRefreshedAction, nil); terr != nil {
+				return terr
+			}
+
+			newToken, terr = models.GrantRefreshTokenSwap(tx, user, token, sessionTimeouts(config))
+			if terr != nil {
+				switch terr.(type) {
+				case models.SessionExpiredError, models.RefreshTokenRevokedError:
+					return terr
+				}
+				return internalServerError(terr.Error())
+			}
 		}
 
-		newToken, terr = models.GrantRefreshTokenSwap(tx, user, token)
-		if terr != nil {
-			return internalServerError(terr.Error())
+		session, terr = models.FindSessionByRefreshToken(tx, newToken)
+		if terr != nil && !models.IsNotFoundError(terr) {
+			return internalServerError("Database error finding session").WithInternalError(terr)
 		}
 
-		tokenString, terr = generateAccessToken(user, time.Second*time.Duration(config.JWT.Exp), config.JWT.Secret)
+		keys, terr := a.loadKeySet(ctx, tx)
+		if terr != nil {
+			return internalServerError("Error loading JWT signing key").WithInternalError(terr)
+		}
+		tokenString, terr = generateAccessToken(user, session, time.Second*time.Duration(config.JWT.Exp), keys.signing, a.jwtIssuer(config), "")
 		if terr != nil {
 			return internalServerError("error generating jwt token").WithInternalError(terr)
 		}
@@ -177,38 +267,172 @@ func (a *API) RefreshTokenGrant(ctx context.Context, w http.ResponseWriter, r *h
 			}
 		}
 		return nil
-	})
+	}
+	err = a.db.Transaction(issue)
+	if _, ok := err.(models.RefreshTokenRevokedError); ok {
+		// a concurrent request swapped the token first
+		if _, token, err = models.FindUserWithRefreshToken(a.db, params.RefreshToken); err != nil {
+			return internalServerError("Database error finding refresh token").WithInternalError(err)
+		}
+		if newToken, err = a.reusedRefreshToken(ctx, w, r, user, token); err != nil {
+			return err
+		}
+		err = a.db.Transaction(issue)
+	}
 	if err != nil {
+		if expired, ok := err.(models.SessionExpiredError); ok {
+			return a.expireRefreshTokenSession(ctx, w, user, token, expired.Reason)
+		}
 		return err
 	}
 	metering.RecordLogin("token", user.ID, instanceID)
-	return sendJSON(w, http.StatusOK, &AccessTokenResponse{
+	response := &AccessTokenResponse{
 		Token:        tokenString,
 		TokenType:    "bearer",
 		ExpiresIn:    config.JWT.Exp,
 		RefreshToken: newToken.Token,
-		User:         user,
+	}
+	// OAuth clients read the user through the userinfo endpoint
+	if session == nil || session.OAuthClientID == "" {
+		response.User = user
+	}
+	return sendJSON(w, http.StatusOK, response)
+}
+
+// sessionTimeouts reads the session lifetime limits from the configuration
+func sessionTimeouts(config *conf.Configuration) models.SessionTimeouts {
+	return models.SessionTimeouts{
+		MaxLifetime:       time.Second * time.Duration(config.Sessions.MaxLifetime),
+		InactivityTimeout: time.Second * time.Duration(config.Sessions.InactivityTimeout),
+	}
+}
+
+// reusedRefreshToken handles a refresh token that has already been swapped.
+// Clients refreshing concurrently may present the token that was just
+// rotated, they get the token that replaced it. Otherwise the token was
+// stolen, so the tokens swapped from it are revoked as well.
+func (a *API) reusedRefreshToken(ctx context.Context, w http.ResponseWriter, r *http.Request, user *models.User, token *models.RefreshToken) (*models.RefreshToken, error) {
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	reuseInterval := time.Second * time.Duration(config.Security.RefreshTokenReuseInterval)
+	if time.Since(token.UpdatedAt) < reuseInterval {
+		child, err := models.FindRefreshTokenByParent(a.db, token)
+		if err != nil && !models.IsNotFoundError(err) {
+			return nil, internalServerError("Database error finding refresh token").WithInternalError(err)
+		}
+		if child != nil && !child.Revoked {
+			// the session timeouts apply to the replacement as well
+			if _, err := models.CheckRefreshTokenSession(a.db, token, sessionTimeouts(config)); err != nil {
+				if expired, ok := err.(models.SessionExpiredError); ok {
+					return nil, a.expireRefreshTokenSession(ctx, w, user, token, expired.Reason)
+				}
+				return nil, internalServerError("Database error finding session").WithInternalError(err)
+			}
+			return child, nil
+		}
+	}
+
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		if terr := models.NewAuditLogEntry(tx, instanceID, user, models.TokenReuseDetectedAction, nil); terr != nil {
+			return terr
+		}
+		return models.RevokeTokenFamily(tx, token)
 	})
+	if err != nil {
+		return nil, internalServerError("Database error revoking refresh tokens").WithInternalError(err)
+	}
+
+	a.clearCookieToken(ctx, w)
+	return nil, oauthError("invalid_grant", "Invalid Refresh Token").WithInternalMessage("Possible abuse attempt: %v", r)
 }
 
-func generateAccessToken(user *models.User, expiresIn time.Duration, secret string) (string, error) {
+// expireRefreshTokenSession signs out the session of a refresh token that
+// exceeded one of the session timeouts
+func (a *API) expireRefreshTokenSession(ctx context.Context, w http.ResponseWriter, user *models.User, token *models.RefreshToken, reason string) error {
+	payload := map[string]interface{}{
+		"reason": reason,
+	}
+	if token.SessionID != nil {
+		payload["session_id"] = token.SessionID.String()
+	}
+
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		if terr := models.NewAuditLogEntry(tx, getInstanceID(ctx), user, models.SessionExpiredAction, payload); terr != nil {
+			return terr
+		}
+		return models.RevokeRefreshTokenSession(tx, token)
+	})
+	if err != nil {
+		return internalServerError("Database error revoking session").WithInternalError(err)
+	}
+
+	a.clearCookieToken(ctx, w)
+	return oauthError("invalid_grant", "Session expired")
+}
+
+func generateAccessToken(user *models.User, session *models.Session, expiresIn time.Duration, key *jwtKey, issuer, nonce string) (string, error) {
+	now := time.Now()
 	claims := &GoTrueClaims{
 		StandardClaims: jwt.StandardClaims{
 			Subject:   user.ID.String(),
 			Audience:  user.Aud,
-			ExpiresAt: time.Now().Add(expiresIn).Unix(),
+			Issuer:    issuer,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(expiresIn).Unix(),
 		},
 		Email:        user.Email,
+		Phone:        user.Phone,
 		AppMetaData:  user.AppMetaData,
 		UserMetaData: user.UserMetaData,
+		IsAnonymous:  user.IsAnonymous,
 		Role:         user.Role,
+		Nonce:        nonce,
+	}
+	// the session started when the user authenticated
+	if session != nil {
+		claims.SessionID = session.ID.String()
+		claims.AuthTime = session.CreatedAt.Unix()
+		if session.OAuthClientID != "" {
+			limitClaimsToClient(claims, session)
+		}
+	}
+
+	return key.sign(claims)
+}
+
+// limitClaimsToClient restricts a token issued to an OAuth client to the
+// granted scope. It carries no role, so it can't act as the user.
+func limitClaimsToClient(claims *GoTrueClaims, session *models.Session) {
+	scopes := strings.Fields(session.Scope)
+	claims.Audience = session.OAuthClientID
+	claims.ClientID = session.OAuthClientID
+	claims.Scope = session.Scope
+	claims.Role = ""
+	claims.AppMetaData = nil
+	claims.UserMetaData = nil
+	if !isStringInSlice("email", scopes) {
+		claims.Email = ""
+	}
+	if !isStringInSlice("phone", scopes) {
+		claims.Phone = ""
 	}
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+// newGrantParams collects the details of the request that are stored with
+// a new session
+func newGrantParams(r *http.Request) models.GrantParams {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return models.GrantParams{
+		UserAgent: r.UserAgent(),
+		IP:        ip,
+	}
 }
 
-func (a *API) issueRefreshToken(ctx context.Context, conn *storage.Connection, user *models.User) (*AccessTokenResponse, error) {
+func (a *API) issueRefreshToken(ctx context.Context, conn *storage.Connection, user *models.User, grantParams models.GrantParams) (*AccessTokenResponse, error) {
 	config := a.getConfig(ctx)
 
 	now := time.Now()
@@ -219,12 +443,20 @@ func (a *API) issueRefreshToken(ctx context.Context, conn *storage.Connection, u
 
 	err := conn.Transaction(func(tx *storage.Connection) error {
 		var terr error
-		refreshToken, terr = models.GrantAuthenticatedUser(tx, user)
+		refreshToken, terr = models.GrantAuthenticatedUser(tx, user, grantParams)
 		if terr != nil {
 			return internalServerError("Database error granting user").WithInternalError(terr)
 		}
+		session, terr := models.FindSessionByRefreshToken(tx, refreshToken)
+		if terr != nil {
+			return internalServerError("Database error finding session").WithInternalError(terr)
+		}
 
-		tokenString, terr = generateAccessToken(user, time.Second*time.Duration(config.JWT.Exp), config.JWT.Secret)
+		keys, terr := a.loadKeySet(ctx, tx)
+		if terr != nil {
+			return internalServerError("Error loading JWT signing key").WithInternalError(terr)
+		}
+		tokenString, terr = generateAccessToken(user, session, time.Second*time.Duration(config.JWT.Exp), keys.signing, a.jwtIssuer(config), getNonce(ctx))
 		if terr != nil {
 			return internalServerError("error generating jwt token").WithInternalError(terr)
 		}
@@ -2,11 +2,15 @@ package api
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gobuffalo/pop/v5"
 	"github.com/gofrs/uuid"
 	"github.com/netlify/gotrue/conf"
 	"github.com/netlify/gotrue/models"
@@ -41,6 +45,165 @@ func TestToken(t *testing.T) {
 
 func (ts *TokenTestSuite) SetupTest() {
 	models.TruncateAll(ts.API.db)
+	ts.Config.Security.RefreshTokenReuseInterval = 0
+	ts.Config.Sessions.MaxLifetime = 0
+	ts.Config.Sessions.InactivityTimeout = 0
+
+	u, err := models.NewUser(ts.instanceID, "test@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error creating test user model")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error saving new test user")
+	require.NoError(ts.T(), u.Confirm(ts.API.db))
+}
+
+func (ts *TokenTestSuite) grant(grantType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type="+grantType, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *TokenTestSuite) refresh(refreshToken string) (*httptest.ResponseRecorder, *AccessTokenResponse) {
+	w := ts.grant("refresh_token", `{"refresh_token":"`+refreshToken+`"}`)
+	token := &AccessTokenResponse{}
+	if w.Code == http.StatusOK {
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+	}
+	return w, token
+}
+
+func (ts *TokenTestSuite) login() *AccessTokenResponse {
+	w := ts.grant("password", `{"email":"test@example.com","password":"password"}`)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	token := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+	return token
+}
+
+func (ts *TokenTestSuite) TestRefreshTokenReuseRevokesFamily() {
+	first := ts.login()
+
+	w, second := ts.refresh(first.RefreshToken)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	w, third := ts.refresh(second.RefreshToken)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	// presenting a rotated token revokes the whole family
+	w, _ = ts.refresh(first.RefreshToken)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(ts.T(), w.Body.String(), "invalid_grant")
+
+	w, _ = ts.refresh(third.RefreshToken)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	// other logins of the user are not affected
+	other := ts.login()
+	w, _ = ts.refresh(other.RefreshToken)
+	assert.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	entries, err := models.FindAuditLogEntries(ts.API.db, ts.instanceID, nil, "", nil)
+	require.NoError(ts.T(), err)
+	found := false
+	for _, entry := range entries {
+		if entry.Payload["action"] == string(models.TokenReuseDetectedAction) {
+			found = true
+		}
+	}
+	assert.True(ts.T(), found, "expected a token_reuse_detected audit log entry")
+}
+
+func (ts *TokenTestSuite) TestRefreshTokenReuseInterval() {
+	ts.Config.Security.RefreshTokenReuseInterval = 60
+	first := ts.login()
+
+	w, second := ts.refresh(first.RefreshToken)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	// a concurrent refresh with the same token gets the replacement token
+	w, concurrent := ts.refresh(first.RefreshToken)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(ts.T(), second.RefreshToken, concurrent.RefreshToken)
+	assert.NotEmpty(ts.T(), concurrent.Token)
+
+	w, _ = ts.refresh(second.RefreshToken)
+	assert.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+}
+
+func (ts *TokenTestSuite) sessionOf(refreshToken string) *models.Session {
+	_, token, err := models.FindUserWithRefreshToken(ts.API.db, refreshToken)
+	require.NoError(ts.T(), err)
+	require.NotNil(ts.T(), token.SessionID)
+
+	session, err := models.FindSessionByID(ts.API.db, ts.instanceID, *token.SessionID)
+	require.NoError(ts.T(), err)
+	return session
+}
+
+func (ts *TokenTestSuite) assertSessionExpired(refreshToken, reason string) {
+	w, _ := ts.refresh(refreshToken)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(ts.T(), w.Body.String(), "Session expired")
+
+	_, _, err := models.FindUserWithRefreshToken(ts.API.db, refreshToken)
+	assert.True(ts.T(), models.IsNotFoundError(err), "expected the session to be signed out")
+
+	entries, err := models.FindAuditLogEntries(ts.API.db, ts.instanceID, nil, "", nil)
+	require.NoError(ts.T(), err)
+	found := false
+	for _, entry := range entries {
+		if entry.Payload["action"] == string(models.SessionExpiredAction) {
+			traits, ok := entry.Payload["traits"].(map[string]interface{})
+			require.True(ts.T(), ok)
+			assert.Equal(ts.T(), reason, traits["reason"])
+			found = true
+		}
+	}
+	assert.True(ts.T(), found, "expected a session_expired audit log entry")
+}
+
+func (ts *TokenTestSuite) TestSessionMaxLifetime() {
+	ts.Config.Sessions.MaxLifetime = 3600
+	token := ts.login()
+
+	w, refreshed := ts.refresh(token.RefreshToken)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	session := ts.sessionOf(refreshed.RefreshToken)
+	require.NoError(ts.T(), ts.API.db.RawQuery("UPDATE "+(&pop.Model{Value: models.Session{}}).TableName()+" SET created_at = ? WHERE id = ?", time.Now().Add(-2*time.Hour), session.ID).Exec())
+
+	ts.assertSessionExpired(refreshed.RefreshToken, models.SessionMaxLifetimeReason)
+}
+
+func (ts *TokenTestSuite) TestSessionInactivityTimeout() {
+	ts.Config.Sessions.InactivityTimeout = 60
+	token := ts.login()
+
+	w, refreshed := ts.refresh(token.RefreshToken)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	session := ts.sessionOf(refreshed.RefreshToken)
+	require.NotNil(ts.T(), session.RefreshedAt)
+	lastActive := time.Now().Add(-2 * time.Minute)
+	session.RefreshedAt = &lastActive
+	require.NoError(ts.T(), ts.API.db.UpdateOnly(session, "refreshed_at"))
+
+	ts.assertSessionExpired(refreshed.RefreshToken, models.SessionInactivityTimeoutReason)
+}
+
+func (ts *TokenTestSuite) TestSessionMaxLifetimeWithinReuseInterval() {
+	ts.Config.Security.RefreshTokenReuseInterval = 60
+	ts.Config.Sessions.MaxLifetime = 3600
+	token := ts.login()
+
+	w, _ := ts.refresh(token.RefreshToken)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	session := ts.sessionOf(token.RefreshToken)
+	require.NoError(ts.T(), ts.API.db.RawQuery("UPDATE "+(&pop.Model{Value: models.Session{}}).TableName()+" SET created_at = ? WHERE id = ?", time.Now().Add(-2*time.Hour), session.ID).Exec())
+
+	// the rotated token doesn't get the replacement of an expired session
+	ts.assertSessionExpired(token.RefreshToken, models.SessionMaxLifetimeReason)
 }
 
 func (ts *TokenTestSuite) TestRateLimitToken() {
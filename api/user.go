@@ -116,6 +116,16 @@ func (a *API) UserUpdate(w http.ResponseWriter, r *http.Request) error {
 			if terr = user.ConfirmEmailChange(tx); terr != nil {
 				return internalServerError("Error updating user").WithInternalError(terr)
 			}
+
+			// the guest proved they own the email
+			if user.IsAnonymous {
+				if terr = user.Confirm(tx); terr != nil {
+					return internalServerError("Error updating user").WithInternalError(terr)
+				}
+				if terr = a.upgradeAnonymousUser(ctx, tx, user, "email"); terr != nil {
+					return terr
+				}
+			}
 		} else if params.Email != "" && params.Email != user.Email {
 			if terr = a.validateEmail(ctx, params.Email); terr != nil {
 				return terr
@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/netlify/gotrue/crypto"
 	"github.com/netlify/gotrue/models"
 	"github.com/netlify/gotrue/storage"
 	"github.com/sethvargo/go-password/password"
@@ -30,6 +31,8 @@ const (
 type VerifyParams struct {
 	Type       string `json:"type"`
 	Token      string `json:"token"`
+	Email      string `json:"email"`
+	Phone      string `json:"phone"`
 	Password   string `json:"password"`
 	RedirectTo string `json:"redirect_to"`
 }
@@ -63,9 +66,10 @@ func (a *API) Verify(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	var (
-		user  *models.User
-		err   error
-		token *AccessTokenResponse
+		user     *models.User
+		err      error
+		token    *AccessTokenResponse
+		authCode string
 	)
 
 	err = a.db.Transaction(func(tx *storage.Connection) error {
@@ -76,7 +80,13 @@ func (a *API) Verify(w http.ResponseWriter, r *http.Request) error {
 		case inviteVerification:
 			user, terr = a.signupVerify(ctx, tx, params)
 		case recoveryVerification, magicLinkVerification:
-			user, terr = a.recoverVerify(ctx, tx, params)
+			if params.Email != "" {
+				user, terr = a.emailOtpVerify(ctx, tx, params, a.requestAud(ctx, r))
+			} else {
+				user, terr = a.recoverVerify(ctx, tx, params)
+			}
+		case smsVerification:
+			user, terr = a.smsVerify(ctx, tx, params, a.requestAud(ctx, r))
 		default:
 			return unprocessableEntityError("Verify requires a verification type")
 		}
@@ -93,7 +103,22 @@ func (a *API) Verify(w http.ResponseWriter, r *http.Request) error {
 			return terr
 		}
 
-		token, terr = a.issueRefreshToken(ctx, tx, user)
+		// magic links requested with a code challenge issue an auth code
+		// for the PKCE grant instead of tokens
+		if params.Type == magicLinkVerification {
+			flowState, terr := models.FindLatestFlowStateByUser(tx, user, magicLinkVerification)
+			if terr != nil && !models.IsNotFoundError(terr) {
+				return internalServerError("Database error finding flow state").WithInternalError(terr)
+			}
+			if flowState != nil {
+				if authCode, terr = flowState.IssueAuthCode(tx); terr != nil {
+					return internalServerError("Database error issuing auth code").WithInternalError(terr)
+				}
+				return nil
+			}
+		}
+
+		token, terr = a.issueRefreshToken(ctx, tx, user, newGrantParams(r))
 		if terr != nil {
 			return terr
 		}
@@ -113,7 +138,11 @@ func (a *API) Verify(w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
 	case "GET":
 		rurl := params.RedirectTo
-		if token != nil {
+		if authCode != "" {
+			if rurl, err = addQueryParams(rurl, map[string]string{"code": authCode}); err != nil {
+				return internalServerError("Error building redirect URL").WithInternalError(err)
+			}
+		} else if token != nil {
 			q := url.Values{}
 			q.Set("access_token", token.Token)
 			q.Set("token_type", token.TokenType)
@@ -124,6 +153,9 @@ func (a *API) Verify(w http.ResponseWriter, r *http.Request) error {
 		}
 		http.Redirect(w, r, rurl, http.StatusSeeOther)
 	case "POST":
+		if authCode != "" {
+			return sendJSON(w, http.StatusOK, map[string]string{"code": authCode})
+		}
 		return sendJSON(w, http.StatusOK, token)
 	}
 
@@ -183,8 +215,6 @@ func (a *API) signupVerify(ctx context.Context, conn *storage.Connection, params
 }
 
 func (a *API) recoverVerify(ctx context.Context, conn *storage.Connection, params *VerifyParams) (*models.User, error) {
-	instanceID := getInstanceID(ctx)
-	config := a.getConfig(ctx)
 	user, err := models.FindUserByRecoveryToken(conn, params.Token)
 	if err != nil {
 		if models.IsNotFoundError(err) {
@@ -198,7 +228,50 @@ func (a *API) recoverVerify(ctx context.Context, conn *storage.Connection, param
 		return nil, expiredTokenError("Recovery token expired").WithInternalError(redirectWithQueryError)
 	}
 
-	err = conn.Transaction(func(tx *storage.Connection) error {
+	return a.recoverUser(ctx, conn, user)
+}
+
+// emailOtpVerify verifies the one-time code of a magic link email, which
+// users enter with their email instead of following the link
+func (a *API) emailOtpVerify(ctx context.Context, conn *storage.Connection, params *VerifyParams, aud string) (*models.User, error) {
+	instanceID := getInstanceID(ctx)
+	config := a.getConfig(ctx)
+
+	user, err := models.FindUserByEmailAndAudience(conn, instanceID, params.Email, aud)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil, expiredTokenError("Token has expired or is invalid")
+		}
+		return nil, internalServerError("Database error finding user").WithInternalError(err)
+	}
+
+	// codes are short, so each one can only be guessed a few times. The
+	// attempt is counted outside of the transaction of the request, which is
+	// rolled back.
+	ok, err := user.CountEmailOTPAttempt(a.db, config.Mailer.OtpMaxAttempts)
+	if err != nil {
+		return nil, internalServerError("Database error updating user").WithInternalError(err)
+	}
+	if !ok {
+		return nil, expiredTokenError("Token has expired or is invalid")
+	}
+
+	tokenHash := crypto.HashOTP(user.Email, params.Token)
+	otpExp := time.Duration(config.Mailer.OtpExp) * time.Second
+	if !isValidOtp(user.EmailOTPHash, tokenHash, user.EmailOTPSentAt, otpExp) {
+		return nil, expiredTokenError("Token has expired or is invalid")
+	}
+
+	return a.recoverUser(ctx, conn, user)
+}
+
+// recoverUser signs in the user with a recovery token or code, confirming
+// users that weren't yet
+func (a *API) recoverUser(ctx context.Context, conn *storage.Connection, user *models.User) (*models.User, error) {
+	instanceID := getInstanceID(ctx)
+	config := a.getConfig(ctx)
+
+	err := conn.Transaction(func(tx *storage.Connection) error {
 		var terr error
 		if terr = user.Recover(tx); terr != nil {
 			return terr
@@ -12,6 +12,7 @@ import (
 
 	"github.com/gofrs/uuid"
 	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/crypto"
 	"github.com/netlify/gotrue/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -304,3 +305,90 @@ func (ts *VerifyTestSuite) TestVerifySignupWithRedirectUrlContainedPath() {
 		})
 	}
 }
+
+// setEmailOtp sets the one-time code of the user as sent at sentAt
+func (ts *VerifyTestSuite) setEmailOtp(otp string, sentAt time.Time) *models.User {
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	u.EmailOTPHash = crypto.HashOTP(u.Email, otp)
+	u.EmailOTPSentAt = &sentAt
+	u.EmailOTPAttempts = 0
+	require.NoError(ts.T(), ts.API.db.Update(u))
+	return u
+}
+
+func (ts *VerifyTestSuite) verifyEmailOtp(email, otp string) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"type":  "magiclink",
+		"email": email,
+		"token": otp,
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/verify", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *VerifyTestSuite) TestVerify_EmailOtp() {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"email": "test@example.com",
+	}))
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/magiclink", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	// the magic link email sets a hashed code
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), u.EmailOTPHash, 64)
+	require.NotNil(ts.T(), u.EmailOTPSentAt)
+
+	ts.setEmailOtp("123456", time.Now())
+
+	w = ts.verifyEmailOtp("TEST@example.com", "123456")
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	token := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+	assert.NotEmpty(ts.T(), token.Token)
+
+	u, err = models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	assert.True(ts.T(), u.IsConfirmed())
+	assert.Empty(ts.T(), u.EmailOTPHash)
+	assert.Empty(ts.T(), u.RecoveryToken)
+
+	// codes can only be used once
+	w = ts.verifyEmailOtp("test@example.com", "123456")
+	assert.Equal(ts.T(), http.StatusGone, w.Code)
+}
+
+func (ts *VerifyTestSuite) TestVerify_EmailOtpExpired() {
+	ts.setEmailOtp("123456", time.Now().Add(-time.Duration(ts.Config.Mailer.OtpExp+1)*time.Second))
+
+	w := ts.verifyEmailOtp("test@example.com", "123456")
+	assert.Equal(ts.T(), http.StatusGone, w.Code)
+}
+
+func (ts *VerifyTestSuite) TestVerify_EmailOtpMaxAttempts() {
+	ts.setEmailOtp("123456", time.Now())
+
+	for i := 0; i < ts.Config.Mailer.OtpMaxAttempts; i++ {
+		w := ts.verifyEmailOtp("test@example.com", "654321")
+		assert.Equal(ts.T(), http.StatusGone, w.Code)
+	}
+
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), ts.Config.Mailer.OtpMaxAttempts, u.EmailOTPAttempts)
+
+	// the right code is rejected after too many attempts
+	w := ts.verifyEmailOtp("test@example.com", "123456")
+	assert.Equal(ts.T(), http.StatusGone, w.Code)
+}
@@ -0,0 +1,579 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/metering"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+)
+
+const webAuthnFactorType = "webauthn"
+
+// WebAuthnRelyingPartyEntity describes the site to the authenticator
+type WebAuthnRelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// WebAuthnUserEntity describes the user to the authenticator. The id is the
+// base64url encoded user id, which authenticators return as the user handle.
+type WebAuthnUserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// WebAuthnCredentialParameter is a type of credential the site accepts
+type WebAuthnCredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// WebAuthnCredentialDescriptor identifies a registered credential by its
+// base64url encoded id
+type WebAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// WebAuthnAuthenticatorSelection are the requirements on the authenticator
+// a credential is created with
+type WebAuthnAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// WebAuthnCreationOptions are the options of navigator.credentials.create,
+// with the binary values base64url encoded
+type WebAuthnCreationOptions struct {
+	Challenge              string                          `json:"challenge"`
+	RP                     WebAuthnRelyingPartyEntity      `json:"rp"`
+	User                   WebAuthnUserEntity              `json:"user"`
+	PubKeyCredParams       []WebAuthnCredentialParameter   `json:"pubKeyCredParams"`
+	Timeout                int                             `json:"timeout"`
+	ExcludeCredentials     []*WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection WebAuthnAuthenticatorSelection  `json:"authenticatorSelection"`
+	Attestation            string                          `json:"attestation"`
+}
+
+// WebAuthnRequestOptions are the options of navigator.credentials.get, with
+// the binary values base64url encoded
+type WebAuthnRequestOptions struct {
+	Challenge        string                          `json:"challenge"`
+	Timeout          int                             `json:"timeout"`
+	RPID             string                          `json:"rpId"`
+	AllowCredentials []*WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                          `json:"userVerification"`
+}
+
+// WebAuthnRegisterResponse starts the registration of a credential
+type WebAuthnRegisterResponse struct {
+	SessionID uuid.UUID                `json:"session_id"`
+	PublicKey *WebAuthnCreationOptions `json:"publicKey"`
+}
+
+// WebAuthnLoginResponse starts a login with a credential
+type WebAuthnLoginResponse struct {
+	SessionID uuid.UUID               `json:"session_id"`
+	PublicKey *WebAuthnRequestOptions `json:"publicKey"`
+}
+
+// WebAuthnCredentialParams is the PublicKeyCredential returned by the
+// authenticator, with the binary values base64url encoded
+type WebAuthnCredentialParams struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// WebAuthnRegisterFinishParams are the parameters the WebAuthnRegisterFinish
+// method accepts
+type WebAuthnRegisterFinishParams struct {
+	SessionID  uuid.UUID                `json:"session_id"`
+	Name       string                   `json:"name"`
+	Credential WebAuthnCredentialParams `json:"credential"`
+}
+
+// WebAuthnLoginFinishParams are the parameters the WebAuthnLoginFinish
+// method accepts
+type WebAuthnLoginFinishParams struct {
+	SessionID  uuid.UUID                `json:"session_id"`
+	Credential WebAuthnCredentialParams `json:"credential"`
+}
+
+// MFAWebAuthnGrantParams are the parameters the MFAWebAuthnGrant method
+// accepts
+type MFAWebAuthnGrantParams struct {
+	MFAToken   string                   `json:"mfa_token"`
+	SessionID  uuid.UUID                `json:"session_id"`
+	Credential WebAuthnCredentialParams `json:"credential"`
+}
+
+// decodeWebAuthnValue decodes a base64url value, with or without padding
+func decodeWebAuthnValue(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+func webAuthnRelyingParty(config *conf.Configuration) *crypto.WebAuthnRelyingParty {
+	return &crypto.WebAuthnRelyingParty{
+		ID:                      config.WebAuthn.RPID,
+		Origins:                 config.WebAuthn.Origins,
+		RequireUserVerification: config.WebAuthn.UserVerification == "required",
+	}
+}
+
+func webAuthnCredentialDescriptors(credentials []*models.WebAuthnCredential) []*WebAuthnCredentialDescriptor {
+	descriptors := make([]*WebAuthnCredentialDescriptor, 0, len(credentials))
+	for _, credential := range credentials {
+		descriptors = append(descriptors, &WebAuthnCredentialDescriptor{
+			Type: "public-key",
+			ID:   credential.CredentialID,
+		})
+	}
+	return descriptors
+}
+
+// newWebAuthnLogin creates a session to log in with a credential. Sessions
+// for a user only accept the credentials of the user.
+func (a *API) newWebAuthnLogin(ctx context.Context, conn *storage.Connection, user *models.User, credentials []*models.WebAuthnCredential) (*WebAuthnLoginResponse, error) {
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	session, err := models.NewWebAuthnSession(conn, instanceID, user, crypto.WebAuthnGet, time.Second*time.Duration(config.WebAuthn.ChallengeExpiry))
+	if err != nil {
+		return nil, internalServerError("Database error creating webauthn session").WithInternalError(err)
+	}
+
+	userVerification := config.WebAuthn.UserVerification
+	if session.UserID == nil {
+		userVerification = "required"
+	}
+
+	return &WebAuthnLoginResponse{
+		SessionID: session.ID,
+		PublicKey: &WebAuthnRequestOptions{
+			Challenge:        session.Challenge,
+			Timeout:          config.WebAuthn.ChallengeExpiry * 1000,
+			RPID:             config.WebAuthn.RPID,
+			AllowCredentials: webAuthnCredentialDescriptors(credentials),
+			UserVerification: userVerification,
+		},
+	}, nil
+}
+
+// consumeWebAuthnSession finds the session of a ceremony, which can only be
+// used once
+func (a *API) consumeWebAuthnSession(ctx context.Context, id uuid.UUID, ceremony string) (*models.WebAuthnSession, error) {
+	session, err := models.ConsumeWebAuthnSession(a.db, getInstanceID(ctx), id, ceremony)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil, notFoundError("WebAuthn session not found")
+		}
+		return nil, internalServerError("Database error finding webauthn session").WithInternalError(err)
+	}
+	if session.IsExpired() {
+		return nil, expiredTokenError("WebAuthn challenge has expired")
+	}
+	return session, nil
+}
+
+// verifyWebAuthnAssertion verifies the response of the authenticator to the
+// challenge of the session and records the use of the credential
+func (a *API) verifyWebAuthnAssertion(ctx context.Context, session *models.WebAuthnSession, params *WebAuthnCredentialParams) (*models.WebAuthnCredential, error) {
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	rawID, err := decodeWebAuthnValue(params.RawID)
+	if err != nil || len(rawID) == 0 {
+		return nil, oauthError("invalid_request", "Invalid credential id")
+	}
+	clientDataJSON, err := decodeWebAuthnValue(params.Response.ClientDataJSON)
+	if err != nil {
+		return nil, oauthError("invalid_request", "Invalid clientDataJSON")
+	}
+	authenticatorData, err := decodeWebAuthnValue(params.Response.AuthenticatorData)
+	if err != nil {
+		return nil, oauthError("invalid_request", "Invalid authenticatorData")
+	}
+	signature, err := decodeWebAuthnValue(params.Response.Signature)
+	if err != nil {
+		return nil, oauthError("invalid_request", "Invalid signature")
+	}
+
+	credential, err := models.FindWebAuthnCredentialByCredentialID(a.db, instanceID, base64.RawURLEncoding.EncodeToString(rawID))
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil, oauthError("invalid_grant", "Unknown credential")
+		}
+		return nil, internalServerError("Database error finding webauthn credential").WithInternalError(err)
+	}
+	if session.UserID != nil && *session.UserID != credential.UserID {
+		return nil, oauthError("invalid_grant", "Unknown credential")
+	}
+	if params.Response.UserHandle != "" {
+		userHandle, err := decodeWebAuthnValue(params.Response.UserHandle)
+		if err != nil || string(userHandle) != string(credential.UserID.Bytes()) {
+			return nil, oauthError("invalid_grant", "Credential belongs to another user")
+		}
+	}
+
+	// logins without a password are only multi-factor if the authenticator
+	// verified the user with a PIN or biometrics
+	rp := webAuthnRelyingParty(config)
+	if session.UserID == nil {
+		rp.RequireUserVerification = true
+	}
+	data, err := rp.VerifyAssertion(session.Challenge, credential.PublicKey, clientDataJSON, authenticatorData, signature)
+	if err != nil {
+		return nil, oauthError("invalid_grant", "Invalid WebAuthn assertion").WithInternalError(err)
+	}
+
+	if err := credential.UpdateSignCount(a.db, data.SignCount); err != nil {
+		if _, ok := err.(models.WebAuthnCredentialClonedError); ok {
+			return nil, oauthError("invalid_grant", "Invalid WebAuthn assertion").WithInternalError(err)
+		}
+		return nil, internalServerError("Database error updating webauthn credential").WithInternalError(err)
+	}
+	return credential, nil
+}
+
+// signInWithWebAuthn issues tokens to the user of a verified credential
+func (a *API) signInWithWebAuthn(ctx context.Context, w http.ResponseWriter, r *http.Request, user *models.User, auditData map[string]interface{}) error {
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+	cookie := r.Header.Get(useCookieHeader)
+
+	var token *AccessTokenResponse
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if terr = models.NewAuditLogEntry(tx, instanceID, user, models.LoginAction, auditData); terr != nil {
+			return terr
+		}
+		if terr = triggerEventHooks(ctx, tx, LoginEvent, user, instanceID, config); terr != nil {
+			return terr
+		}
+
+		token, terr = a.issueRefreshToken(ctx, tx, user, newGrantParams(r))
+		if terr != nil {
+			return terr
+		}
+
+		if cookie != "" && config.Cookie.Duration > 0 {
+			if terr = a.setCookieToken(config, token.Token, cookie == useSessionCookie, w); terr != nil {
+				return internalServerError("Failed to set JWT cookie. %s", terr)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	token.User = user
+	return sendJSON(w, http.StatusOK, token)
+}
+
+// WebAuthnRegisterBegin starts the registration of a credential for the
+// authenticated user
+func (a *API) WebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	user, err := getUserFromClaims(ctx, a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+	if user.ID == models.SystemUserUUID {
+		return badRequestError("Credentials can not be registered for the system user")
+	}
+
+	credentials, err := models.FindWebAuthnCredentialsByUser(a.db, user)
+	if err != nil {
+		return internalServerError("Database error finding webauthn credentials").WithInternalError(err)
+	}
+
+	session, err := models.NewWebAuthnSession(a.db, instanceID, user, crypto.WebAuthnCreate, time.Second*time.Duration(config.WebAuthn.ChallengeExpiry))
+	if err != nil {
+		return internalServerError("Database error creating webauthn session").WithInternalError(err)
+	}
+
+	name := user.Email
+	if name == "" {
+		name = user.Phone
+	}
+	params := make([]WebAuthnCredentialParameter, 0, len(crypto.WebAuthnAlgorithms))
+	for _, alg := range crypto.WebAuthnAlgorithms {
+		params = append(params, WebAuthnCredentialParameter{Type: "public-key", Alg: alg})
+	}
+
+	return sendJSON(w, http.StatusOK, &WebAuthnRegisterResponse{
+		SessionID: session.ID,
+		PublicKey: &WebAuthnCreationOptions{
+			Challenge: session.Challenge,
+			RP: WebAuthnRelyingPartyEntity{
+				ID:   config.WebAuthn.RPID,
+				Name: config.WebAuthn.RPDisplayName,
+			},
+			User: WebAuthnUserEntity{
+				ID:          base64.RawURLEncoding.EncodeToString(user.ID.Bytes()),
+				Name:        name,
+				DisplayName: name,
+			},
+			PubKeyCredParams:   params,
+			Timeout:            config.WebAuthn.ChallengeExpiry * 1000,
+			ExcludeCredentials: webAuthnCredentialDescriptors(credentials),
+			AuthenticatorSelection: WebAuthnAuthenticatorSelection{
+				ResidentKey:      "preferred",
+				UserVerification: config.WebAuthn.UserVerification,
+			},
+			Attestation: "none",
+		},
+	})
+}
+
+// WebAuthnRegisterFinish stores the credential the authenticator created
+// for the authenticated user
+func (a *API) WebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	params := &WebAuthnRegisterFinishParams{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	if err := jsonDecoder.Decode(params); err != nil {
+		return badRequestError("Could not read webauthn registration params: %v", err)
+	}
+
+	clientDataJSON, err := decodeWebAuthnValue(params.Credential.Response.ClientDataJSON)
+	if err != nil {
+		return badRequestError("Invalid clientDataJSON")
+	}
+	attestationObject, err := decodeWebAuthnValue(params.Credential.Response.AttestationObject)
+	if err != nil {
+		return badRequestError("Invalid attestationObject")
+	}
+
+	user, err := getUserFromClaims(ctx, a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+
+	session, err := a.consumeWebAuthnSession(ctx, params.SessionID, crypto.WebAuthnCreate)
+	if err != nil {
+		return err
+	}
+	if session.UserID == nil || *session.UserID != user.ID {
+		return notFoundError("WebAuthn session not found")
+	}
+
+	data, err := webAuthnRelyingParty(config).VerifyRegistration(session.Challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		return unprocessableEntityError("Invalid WebAuthn registration: %v", err)
+	}
+
+	var credential *models.WebAuthnCredential
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		credential, terr = models.NewWebAuthnCredential(user, data, params.Name)
+		if terr != nil {
+			return internalServerError("Error creating webauthn credential").WithInternalError(terr)
+		}
+
+		existing, terr := models.FindWebAuthnCredentialByCredentialID(tx, instanceID, credential.CredentialID)
+		if terr != nil && !models.IsNotFoundError(terr) {
+			return internalServerError("Database error finding webauthn credential").WithInternalError(terr)
+		}
+		if existing != nil {
+			return unprocessableEntityError("Credential is already registered")
+		}
+
+		if terr = tx.Create(credential); terr != nil {
+			return internalServerError("Database error saving webauthn credential").WithInternalError(terr)
+		}
+		return models.NewAuditLogEntry(tx, instanceID, user, models.WebAuthnRegisteredAction, map[string]interface{}{
+			"credential_id": credential.ID,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, credential)
+}
+
+// UserWebAuthnCredentials lists the credentials of the authenticated user
+func (a *API) UserWebAuthnCredentials(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	user, err := getUserFromClaims(ctx, a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+
+	credentials, err := models.FindWebAuthnCredentialsByUser(a.db, user)
+	if err != nil {
+		return internalServerError("Database error finding webauthn credentials").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, credentials)
+}
+
+// UserWebAuthnCredentialDelete removes a credential of the authenticated
+// user
+func (a *API) UserWebAuthnCredentialDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+
+	user, err := getUserFromClaims(ctx, a.db)
+	if err != nil {
+		return unauthorizedError("Invalid user").WithInternalError(err)
+	}
+
+	credentialID, err := uuid.FromString(chi.URLParam(r, "credential_id"))
+	if err != nil {
+		return badRequestError("credential_id must be an UUID")
+	}
+
+	logEntrySetField(r, "credential_id", credentialID)
+
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		credential, terr := models.FindWebAuthnCredentialByUserAndID(tx, user, credentialID)
+		if terr != nil {
+			if models.IsNotFoundError(terr) {
+				return notFoundError("Credential not found")
+			}
+			return internalServerError("Database error finding webauthn credential").WithInternalError(terr)
+		}
+
+		if terr := models.NewAuditLogEntry(tx, instanceID, user, models.WebAuthnDeletedAction, map[string]interface{}{
+			"credential_id": credential.ID,
+		}); terr != nil {
+			return terr
+		}
+		if terr := tx.Destroy(credential); terr != nil {
+			return internalServerError("Database error deleting webauthn credential").WithInternalError(terr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// WebAuthnLoginBegin starts a login with a discoverable credential, where
+// the authenticator lets the user pick one of their credentials for the site
+func (a *API) WebAuthnLoginBegin(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	login, err := a.newWebAuthnLogin(ctx, a.db, nil, nil)
+	if err != nil {
+		return err
+	}
+	return sendJSON(w, http.StatusOK, login)
+}
+
+// WebAuthnLoginFinish signs in the user of the credential the authenticator
+// answered the challenge with
+func (a *API) WebAuthnLoginFinish(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+
+	params := &WebAuthnLoginFinishParams{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	if err := jsonDecoder.Decode(params); err != nil {
+		return badRequestError("Could not read webauthn login params: %v", err)
+	}
+
+	session, err := a.consumeWebAuthnSession(ctx, params.SessionID, crypto.WebAuthnGet)
+	if err != nil {
+		return err
+	}
+
+	credential, err := a.verifyWebAuthnAssertion(ctx, session, &params.Credential)
+	if err != nil {
+		return err
+	}
+
+	user, err := models.FindUserByInstanceIDAndID(a.db, instanceID, credential.UserID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return oauthError("invalid_grant", "Unknown credential")
+		}
+		return internalServerError("Database error finding user").WithInternalError(err)
+	}
+
+	if err := a.signInWithWebAuthn(ctx, w, r, user, map[string]interface{}{
+		"provider":      webAuthnFactorType,
+		"credential_id": credential.ID,
+	}); err != nil {
+		return err
+	}
+	metering.RecordLogin(webAuthnFactorType, user.ID, instanceID)
+	return nil
+}
+
+// MFAWebAuthnGrant implements the second step of a password grant with a
+// registered credential
+func (a *API) MFAWebAuthnGrant(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	if !config.WebAuthn.Enabled {
+		return oauthError("unsupported_grant_type", "WebAuthn is disabled")
+	}
+
+	params := &MFAWebAuthnGrantParams{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	if err := jsonDecoder.Decode(params); err != nil {
+		return badRequestError("Could not read mfa grant params: %v", err)
+	}
+	if params.MFAToken == "" || params.SessionID == uuid.Nil {
+		return oauthError("invalid_request", "mfa_token, session_id and credential required")
+	}
+
+	user, err := a.mfaChallengeUser(ctx, params.MFAToken)
+	if err != nil {
+		return err
+	}
+
+	session, err := a.consumeWebAuthnSession(ctx, params.SessionID, crypto.WebAuthnGet)
+	if err != nil {
+		return err
+	}
+	if session.UserID == nil || *session.UserID != user.ID {
+		return oauthError("invalid_grant", "Invalid WebAuthn session")
+	}
+
+	credential, err := a.verifyWebAuthnAssertion(ctx, session, &params.Credential)
+	if err != nil {
+		return err
+	}
+
+	if err := a.signInWithWebAuthn(ctx, w, r, user, map[string]interface{}{
+		"factor":        webAuthnFactorType,
+		"credential_id": credential.ID,
+	}); err != nil {
+		return err
+	}
+	metering.RecordLogin("mfa", user.ID, instanceID)
+	return nil
+}
@@ -0,0 +1,421 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+const webAuthnTestOrigin = "https://example.netlify.com"
+
+// softwareAuthenticator creates and uses an ES256 credential like a
+// platform authenticator would
+type softwareAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+	// unverified authenticators only check that the user is present
+	unverified bool
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	credentialID := make([]byte, 16)
+	_, err = rand.Read(credentialID)
+	require.NoError(t, err)
+	return &softwareAuthenticator{key: key, credentialID: credentialID}
+}
+
+func (a *softwareAuthenticator) authData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+
+	// user present and verified
+	flags := byte(0x05)
+	if a.unverified {
+		flags = 0x01
+	}
+	if attested {
+		flags |= 0x40
+	}
+	a.signCount++
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	if !attested {
+		return data
+	}
+
+	x := a.key.X.Bytes()
+	y := a.key.Y.Bytes()
+	x = append(make([]byte, 32-len(x)), x...)
+	y = append(make([]byte, 32-len(y)), y...)
+
+	data = append(data, make([]byte, 16)...)
+	data = append(data, byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+	data = append(data, a.credentialID...)
+	// the COSE key {1: 2, 3: -7, -1: 1, -2: x, -3: y}
+	data = append(data, 0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20)
+	data = append(data, x...)
+	data = append(data, 0x22, 0x58, 0x20)
+	return append(data, y...)
+}
+
+func (a *softwareAuthenticator) clientData(ceremony, challenge, origin string) []byte {
+	b, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    origin,
+	})
+	return b
+}
+
+func (a *softwareAuthenticator) create(options *WebAuthnCreationOptions, origin string) map[string]interface{} {
+	a.userHandle, _ = base64.RawURLEncoding.DecodeString(options.User.ID)
+	authData := a.authData(options.RP.ID, true)
+
+	// {"fmt": "none", "attStmt": {}, "authData": authData}
+	attestation := []byte{0xa3, 0x63, 'f', 'm', 't', 0x64, 'n', 'o', 'n', 'e', 0x67, 'a', 't', 't', 'S', 't', 'm', 't', 0xa0, 0x68, 'a', 'u', 't', 'h', 'D', 'a', 't', 'a', 0x59, byte(len(authData) >> 8), byte(len(authData))}
+	attestation = append(attestation, authData...)
+
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	return map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData(crypto.WebAuthnCreate, options.Challenge, origin)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	}
+}
+
+func (a *softwareAuthenticator) get(t *testing.T, options *WebAuthnRequestOptions, origin string) map[string]interface{} {
+	authData := a.authData(options.RPID, false)
+	clientData := a.clientData(crypto.WebAuthnGet, options.Challenge, origin)
+
+	clientDataHash := sha256.Sum256(clientData)
+	hash := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, hash[:])
+	require.NoError(t, err)
+	signature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	require.NoError(t, err)
+
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	return map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	}
+}
+
+type WebAuthnTestSuite struct {
+	suite.Suite
+	API    *API
+	Config *conf.Configuration
+
+	instanceID uuid.UUID
+}
+
+func TestWebAuthn(t *testing.T) {
+	api, config, instanceID, err := setupAPIForTestForInstance()
+	require.NoError(t, err)
+
+	ts := &WebAuthnTestSuite{
+		API:        api,
+		Config:     config,
+		instanceID: instanceID,
+	}
+	defer api.db.Close()
+
+	suite.Run(t, ts)
+}
+
+func (ts *WebAuthnTestSuite) SetupTest() {
+	models.TruncateAll(ts.API.db)
+	ts.Config.MFA.Enabled = false
+	ts.Config.WebAuthn.Enabled = true
+	ts.Config.WebAuthn.RPID = "example.netlify.com"
+	ts.Config.WebAuthn.Origins = []string{webAuthnTestOrigin}
+
+	u, err := models.NewUser(ts.instanceID, "test@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error creating test user model")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error saving new test user")
+	require.NoError(ts.T(), u.Confirm(ts.API.db))
+}
+
+func (ts *WebAuthnTestSuite) request(method, path string, body map[string]interface{}, authenticated bool) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+
+	req := httptest.NewRequest(method, path, &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	if authenticated {
+		u, err := models.FindUserByEmailAndAudience(ts.API.db, ts.instanceID, "test@example.com", ts.Config.JWT.Aud)
+		require.NoError(ts.T(), err)
+
+		key, err := configSigningKey(&ts.Config.JWT)
+		require.NoError(ts.T(), err)
+		token, err := generateAccessToken(u, nil, time.Second*time.Duration(ts.Config.JWT.Exp), key, "", "")
+		require.NoError(ts.T(), err)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+// register registers a new credential of a software authenticator for the
+// test user
+func (ts *WebAuthnTestSuite) register() *softwareAuthenticator {
+	w := ts.request(http.MethodPost, "http://localhost/user/webauthn/register/begin", map[string]interface{}{}, true)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	begin := WebAuthnRegisterResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&begin))
+	assert.Equal(ts.T(), "example.netlify.com", begin.PublicKey.RP.ID)
+	assert.Equal(ts.T(), "none", begin.PublicKey.Attestation)
+
+	authenticator := newSoftwareAuthenticator(ts.T())
+	w = ts.request(http.MethodPost, "http://localhost/user/webauthn/register/finish", map[string]interface{}{
+		"session_id": begin.SessionID,
+		"name":       "Test phone",
+		"credential": authenticator.create(begin.PublicKey, webAuthnTestOrigin),
+	}, true)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	return authenticator
+}
+
+func (ts *WebAuthnTestSuite) loginBegin() *WebAuthnLoginResponse {
+	w := ts.request(http.MethodPost, "http://localhost/webauthn/login/begin", map[string]interface{}{}, false)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	begin := &WebAuthnLoginResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(begin))
+	assert.Empty(ts.T(), begin.PublicKey.AllowCredentials)
+	return begin
+}
+
+func (ts *WebAuthnTestSuite) loginFinish(sessionID uuid.UUID, credential map[string]interface{}) *httptest.ResponseRecorder {
+	return ts.request(http.MethodPost, "http://localhost/webauthn/login/finish", map[string]interface{}{
+		"session_id": sessionID,
+		"credential": credential,
+	}, false)
+}
+
+func (ts *WebAuthnTestSuite) TestRegisterAndLogin() {
+	authenticator := ts.register()
+
+	w := ts.request(http.MethodGet, "http://localhost/user/webauthn/credentials", nil, true)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	credentials := []*models.WebAuthnCredential{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&credentials))
+	require.Len(ts.T(), credentials, 1)
+	assert.Equal(ts.T(), "Test phone", credentials[0].Name)
+	assert.Equal(ts.T(), base64.RawURLEncoding.EncodeToString(authenticator.credentialID), credentials[0].CredentialID)
+
+	begin := ts.loginBegin()
+	w = ts.loginFinish(begin.SessionID, authenticator.get(ts.T(), begin.PublicKey, webAuthnTestOrigin))
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+	assert.NotEmpty(ts.T(), token.Token)
+	assert.NotEmpty(ts.T(), token.RefreshToken)
+	assert.Equal(ts.T(), "test@example.com", token.User.Email)
+
+	credential, err := models.FindWebAuthnCredentialByCredentialID(ts.API.db, ts.instanceID, credentials[0].CredentialID)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), int64(2), credential.SignCount)
+	assert.NotNil(ts.T(), credential.LastUsedAt)
+}
+
+func (ts *WebAuthnTestSuite) TestRegisterExistingCredential() {
+	authenticator := ts.register()
+
+	w := ts.request(http.MethodPost, "http://localhost/user/webauthn/register/begin", map[string]interface{}{}, true)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	begin := WebAuthnRegisterResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&begin))
+	require.Len(ts.T(), begin.PublicKey.ExcludeCredentials, 1)
+
+	w = ts.request(http.MethodPost, "http://localhost/user/webauthn/register/finish", map[string]interface{}{
+		"session_id": begin.SessionID,
+		"credential": authenticator.create(begin.PublicKey, webAuthnTestOrigin),
+	}, true)
+	assert.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+}
+
+func (ts *WebAuthnTestSuite) TestRegisterOtherOrigin() {
+	w := ts.request(http.MethodPost, "http://localhost/user/webauthn/register/begin", map[string]interface{}{}, true)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	begin := WebAuthnRegisterResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&begin))
+
+	authenticator := newSoftwareAuthenticator(ts.T())
+	w = ts.request(http.MethodPost, "http://localhost/user/webauthn/register/finish", map[string]interface{}{
+		"session_id": begin.SessionID,
+		"credential": authenticator.create(begin.PublicKey, "https://evil.example.com"),
+	}, true)
+	assert.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+}
+
+func (ts *WebAuthnTestSuite) TestLoginSessionIsSingleUse() {
+	authenticator := ts.register()
+
+	begin := ts.loginBegin()
+	w := ts.loginFinish(begin.SessionID, authenticator.get(ts.T(), begin.PublicKey, webAuthnTestOrigin))
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	w = ts.loginFinish(begin.SessionID, authenticator.get(ts.T(), begin.PublicKey, webAuthnTestOrigin))
+	assert.Equal(ts.T(), http.StatusNotFound, w.Code)
+}
+
+func (ts *WebAuthnTestSuite) TestLoginInvalidAssertion() {
+	authenticator := ts.register()
+
+	// another challenge
+	begin := ts.loginBegin()
+	other := ts.loginBegin()
+	w := ts.loginFinish(begin.SessionID, authenticator.get(ts.T(), other.PublicKey, webAuthnTestOrigin))
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	// another origin
+	begin = ts.loginBegin()
+	w = ts.loginFinish(begin.SessionID, authenticator.get(ts.T(), begin.PublicKey, "https://evil.example.com"))
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	// an unknown credential
+	begin = ts.loginBegin()
+	w = ts.loginFinish(begin.SessionID, newSoftwareAuthenticator(ts.T()).get(ts.T(), begin.PublicKey, webAuthnTestOrigin))
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	// a signature counter that didn't increase
+	authenticator.signCount = 0
+	begin = ts.loginBegin()
+	w = ts.loginFinish(begin.SessionID, authenticator.get(ts.T(), begin.PublicKey, webAuthnTestOrigin))
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *WebAuthnTestSuite) TestSignCountIsComparedByTheDatabase() {
+	authenticator := ts.register()
+
+	first, err := models.FindWebAuthnCredentialByCredentialID(ts.API.db, ts.instanceID, base64.RawURLEncoding.EncodeToString(authenticator.credentialID))
+	require.NoError(ts.T(), err)
+	second, err := models.FindWebAuthnCredentialByCredentialID(ts.API.db, ts.instanceID, first.CredentialID)
+	require.NoError(ts.T(), err)
+
+	// two assertions with the same counter verified against the same row
+	require.NoError(ts.T(), first.UpdateSignCount(ts.API.db, 2))
+	err = second.UpdateSignCount(ts.API.db, 2)
+	assert.IsType(ts.T(), models.WebAuthnCredentialClonedError{}, err)
+}
+
+func (ts *WebAuthnTestSuite) TestLoginRequiresUserVerification() {
+	authenticator := ts.register()
+
+	begin := ts.loginBegin()
+	assert.Equal(ts.T(), "required", begin.PublicKey.UserVerification)
+
+	// the credential alone isn't enough to sign in without a password
+	authenticator.unverified = true
+	w := ts.loginFinish(begin.SessionID, authenticator.get(ts.T(), begin.PublicKey, webAuthnTestOrigin))
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *WebAuthnTestSuite) TestDeleteCredential() {
+	authenticator := ts.register()
+
+	w := ts.request(http.MethodGet, "http://localhost/user/webauthn/credentials", nil, true)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	credentials := []*models.WebAuthnCredential{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&credentials))
+	require.Len(ts.T(), credentials, 1)
+
+	w = ts.request(http.MethodDelete, "http://localhost/user/webauthn/credentials/"+credentials[0].ID.String(), nil, true)
+	require.Equal(ts.T(), http.StatusNoContent, w.Code)
+
+	begin := ts.loginBegin()
+	w = ts.loginFinish(begin.SessionID, authenticator.get(ts.T(), begin.PublicKey, webAuthnTestOrigin))
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *WebAuthnTestSuite) TestSecondFactor() {
+	ts.Config.MFA.Enabled = true
+	authenticator := ts.register()
+
+	w := ts.request(http.MethodPost, "http://localhost/token?grant_type=password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	}, false)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	challenge := MFAChallengeResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challenge))
+	require.True(ts.T(), challenge.MFARequired)
+	assert.Equal(ts.T(), webAuthnFactorType, challenge.FactorType)
+	assert.Equal(ts.T(), []string{webAuthnFactorType}, challenge.FactorTypes)
+	require.NotNil(ts.T(), challenge.WebAuthn)
+	require.Len(ts.T(), challenge.WebAuthn.PublicKey.AllowCredentials, 1)
+
+	credential := authenticator.get(ts.T(), challenge.WebAuthn.PublicKey, webAuthnTestOrigin)
+
+	// the session of the challenge is only accepted with the mfa token
+	w = ts.request(http.MethodPost, "http://localhost/token?grant_type=mfa_webauthn", map[string]interface{}{
+		"mfa_token":  "invalid",
+		"session_id": challenge.WebAuthn.SessionID,
+		"credential": credential,
+	}, false)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	w = ts.request(http.MethodPost, "http://localhost/token?grant_type=mfa_webauthn", map[string]interface{}{
+		"mfa_token":  challenge.MFAToken,
+		"session_id": challenge.WebAuthn.SessionID,
+		"credential": credential,
+	}, false)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	token := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+	assert.NotEmpty(ts.T(), token.Token)
+	assert.NotEmpty(ts.T(), token.RefreshToken)
+}
+
+func (ts *WebAuthnTestSuite) TestDisabled() {
+	ts.Config.WebAuthn.Enabled = false
+
+	w := ts.request(http.MethodPost, "http://localhost/user/webauthn/register/begin", map[string]interface{}{}, true)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	w = ts.request(http.MethodPost, "http://localhost/webauthn/login/begin", map[string]interface{}{}, false)
+	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/api"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var keyAlgorithm, keysInstanceID string
+var keyOverlap time.Duration
+
+func keysCmd() *cobra.Command {
+	var keysCmd = &cobra.Command{
+		Use: "keys",
+	}
+
+	keysCmd.AddCommand(&keysListCmd, &keysRotateCmd, &keysRetireCmd)
+	keysCmd.PersistentFlags().StringVarP(&keysInstanceID, "instance_id", "i", uuid.Nil.String(), "Set the instance ID to interact with")
+
+	keysRotateCmd.Flags().StringVar(&keyAlgorithm, "algorithm", "", "Algorithm of the new signing key (HS256, RS256 or ES256). Defaults to JWT_ALGORITHM")
+	keysRotateCmd.Flags().DurationVar(&keyOverlap, "overlap", 0, "How long tokens signed with the previous key stay valid. Defaults to JWT_EXP")
+
+	return keysCmd
+}
+
+var keysListCmd = cobra.Command{
+	Use: "list",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfigAndArgs(cmd, keysList, args)
+	},
+}
+
+var keysRotateCmd = cobra.Command{
+	Use: "rotate",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfigAndArgs(cmd, keysRotate, args)
+	},
+}
+
+var keysRetireCmd = cobra.Command{
+	Use: "retire",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			logrus.Fatal("Not enough arguments to retire command. Expected the kid of the key")
+			return
+		}
+
+		execWithConfigAndArgs(cmd, keysRetire, args)
+	},
+}
+
+func keysList(globalConfig *conf.GlobalConfiguration, config *conf.Configuration, args []string) {
+	iid := uuid.Must(uuid.FromString(keysInstanceID))
+
+	db, err := storage.Dial(globalConfig)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	keys, err := models.FindSigningKeys(db, iid)
+	if err != nil {
+		logrus.Fatalf("Error finding signing keys: %+v", err)
+	}
+
+	for _, key := range keys {
+		entry := logrus.WithField("algorithm", key.Algorithm).WithField("status", key.Status)
+		if key.ExpiresAt != nil {
+			entry = entry.WithField("expires_at", key.ExpiresAt)
+		}
+		entry.Infof("Key: %s", key.KeyID)
+	}
+}
+
+func keysRotate(globalConfig *conf.GlobalConfiguration, config *conf.Configuration, args []string) {
+	iid := uuid.Must(uuid.FromString(keysInstanceID))
+
+	db, err := storage.Dial(globalConfig)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	if iid != uuid.Nil {
+		instance, err := models.GetInstance(db, iid)
+		if err != nil {
+			logrus.Fatalf("Error finding instance (%s): %+v", iid, err)
+		}
+		if config, err = instance.Config(); err != nil {
+			logrus.Fatalf("Error loading instance config (%s): %+v", iid, err)
+		}
+	}
+
+	alg := keyAlgorithm
+	if alg == "" {
+		alg = config.JWT.Algorithm
+	}
+	overlap := keyOverlap
+	if overlap == 0 {
+		overlap = time.Second * time.Duration(config.JWT.Exp)
+	}
+
+	var key *models.SigningKey
+	err = db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		key, terr = api.RotateSigningKey(tx, iid, &config.JWT, alg, "", overlap)
+		return terr
+	})
+	if err != nil {
+		logrus.Fatalf("Error rotating signing key: %+v", err)
+	}
+
+	logrus.Infof("Rotated in signing key: %s", key.KeyID)
+}
+
+func keysRetire(globalConfig *conf.GlobalConfiguration, config *conf.Configuration, args []string) {
+	iid := uuid.Must(uuid.FromString(keysInstanceID))
+
+	db, err := storage.Dial(globalConfig)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	key, err := models.FindSigningKeyByKeyID(db, iid, args[0])
+	if err != nil {
+		logrus.Fatalf("Error finding signing key (%s): %+v", args[0], err)
+	}
+	if key.IsSigning() {
+		logrus.Fatalf("Error retiring signing key (%s): rotate in a new key first", args[0])
+	}
+
+	if err = key.Retire(db); err != nil {
+		logrus.Fatalf("Error retiring signing key (%s): %+v", args[0], err)
+	}
+
+	logrus.Infof("Retired key: %s", args[0])
+}
@@ -4,11 +4,14 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/url"
 	"os"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/netlify/gotrue/crypto"
 )
 
 // OAuthProviderConfiguration holds all config related to external account providers.
@@ -20,10 +23,48 @@ type OAuthProviderConfiguration struct {
 	Enabled     bool   `json:"enabled"`
 }
 
+// OIDCProviderConfiguration holds the config of a generic OpenID Connect
+// provider. Its endpoints are discovered from the issuer.
+type OIDCProviderConfiguration struct {
+	OAuthProviderConfiguration
+	Issuer string `json:"issuer"`
+	// Scopes are requested in addition to openid, email and profile.
+	Scopes string `json:"scopes"`
+}
+
+// OIDCProviders are the generic OpenID Connect providers by name. In the
+// environment they are set as a JSON object.
+type OIDCProviders map[string]OIDCProviderConfiguration
+
+// Decode reads the providers from a JSON object.
+func (p *OIDCProviders) Decode(value string) error {
+	return json.Unmarshal([]byte(value), p)
+}
+
+// CustomProviders are the configs of providers compiled in without a field
+// in ProviderConfiguration, by name. In the environment they are set as a
+// JSON object.
+type CustomProviders map[string]json.RawMessage
+
+// Decode reads the configs from a JSON object.
+func (p *CustomProviders) Decode(value string) error {
+	return json.Unmarshal([]byte(value), p)
+}
+
 type EmailProviderConfiguration struct {
 	Disabled bool `json:"disabled"`
 }
 
+type PhoneProviderConfiguration struct {
+	Enabled bool `json:"enabled"`
+}
+
+// AnonymousProviderConfiguration allows guests to sign in without an email,
+// phone or provider account.
+type AnonymousProviderConfiguration struct {
+	Enabled bool `json:"enabled"`
+}
+
 type SamlProviderConfiguration struct {
 	Enabled     bool   `json:"enabled"`
 	MetadataURL string `json:"metadata_url" envconfig:"METADATA_URL"`
@@ -31,6 +72,107 @@ type SamlProviderConfiguration struct {
 	Name        string `json:"name"`
 	SigningCert string `json:"signing_cert" envconfig:"SIGNING_CERT"`
 	SigningKey  string `json:"signing_key" envconfig:"SIGNING_KEY"`
+	// AttributeMapping applies to the identity provider of the instance and
+	// to SAML connections without their own mapping.
+	AttributeMapping SamlAttributeMapping `json:"attribute_mapping" split_words:"true"`
+}
+
+// SamlAttributeMapping maps the attributes of SAML assertions to the user.
+// In the environment it is set as a JSON object.
+type SamlAttributeMapping struct {
+	// Email is the attribute that replaces the NameID as the email.
+	Email string `json:"email,omitempty"`
+	// UserMetadata and AppMetadata map metadata keys to attribute names.
+	UserMetadata map[string]string `json:"user_metadata,omitempty"`
+	AppMetadata  map[string]string `json:"app_metadata,omitempty"`
+	// Role is the attribute the role of the user is read from. It can't
+	// assign admin roles.
+	Role string `json:"role,omitempty"`
+	// Groups is the attribute listing the groups of the user. The first of
+	// the GroupRoles the user is a member of sets the role, unless the Role
+	// attribute did.
+	Groups     string     `json:"groups,omitempty"`
+	GroupRoles GroupRoles `json:"group_roles,omitempty"`
+	// DefaultRole is set when neither Role nor GroupRoles assign one.
+	// Without it the role of the user is left unchanged.
+	DefaultRole string `json:"default_role,omitempty"`
+}
+
+// GroupRole assigns Role to the members of Group.
+type GroupRole struct {
+	Group string `json:"group"`
+	Role  string `json:"role"`
+}
+
+// GroupRoles are the roles of groups in order of precedence. In the
+// environment they are set as a JSON array.
+type GroupRoles []GroupRole
+
+// Decode reads the roles from a JSON array.
+func (g *GroupRoles) Decode(value string) error {
+	return json.Unmarshal([]byte(value), g)
+}
+
+// LDAPProviderConfiguration holds the configuration of the directory the
+// password grant authenticates users against.
+type LDAPProviderConfiguration struct {
+	Enabled bool `json:"enabled"`
+	// URL is the ldap:// or ldaps:// URL of the directory.
+	URL                string `json:"url"`
+	StartTLS           bool   `json:"start_tls" split_words:"true"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" split_words:"true"`
+	// RootCA is the PEM encoded certificate the directory's certificate is
+	// verified with instead of the system roots.
+	RootCA string `json:"root_ca" split_words:"true"`
+	// BindDN and BindPassword are the account users are searched with. The
+	// search is anonymous without them.
+	BindDN       string `json:"bind_dn" split_words:"true"`
+	BindPassword string `json:"bind_password" split_words:"true"`
+	BaseDN       string `json:"base_dn" split_words:"true"`
+	// SearchFilter finds the user, with {email} replaced by the escaped
+	// email.
+	SearchFilter string `json:"search_filter" split_words:"true"`
+	// IDAttribute identifies users across renames and moves of their
+	// entry, like entryUUID or the objectGUID of Active Directory.
+	IDAttribute    string `json:"id_attribute" split_words:"true"`
+	EmailAttribute string `json:"email_attribute" split_words:"true"`
+	NameAttribute  string `json:"name_attribute" split_words:"true"`
+	GroupAttribute string `json:"group_attribute" split_words:"true"`
+	// The first of the GroupRoles the user is a member of sets the role,
+	// or else DefaultRole if set. Groups match the DN or the CN of a group.
+	GroupRoles  GroupRoles `json:"group_roles" split_words:"true"`
+	DefaultRole string     `json:"default_role" split_words:"true"`
+	// Timeout of requests to the directory, in seconds.
+	Timeout int `json:"timeout"`
+}
+
+// Decode reads the mapping from a JSON object.
+func (m *SamlAttributeMapping) Decode(value string) error {
+	return json.Unmarshal([]byte(value), m)
+}
+
+// IsEmpty checks if the mapping has no rules.
+func (m *SamlAttributeMapping) IsEmpty() bool {
+	return m.Email == "" && len(m.UserMetadata) == 0 && len(m.AppMetadata) == 0 &&
+		m.Role == "" && m.Groups == "" && len(m.GroupRoles) == 0 && m.DefaultRole == ""
+}
+
+// Validate checks the rules of the mapping.
+func (m *SamlAttributeMapping) Validate() error {
+	for key := range m.AppMetadata {
+		if key == "provider" || key == "providers" {
+			return fmt.Errorf("app_metadata.%s is set by GoTrue and can't be mapped", key)
+		}
+	}
+	if len(m.GroupRoles) > 0 && m.Groups == "" {
+		return errors.New("group_roles require the groups attribute")
+	}
+	for _, rule := range m.GroupRoles {
+		if rule.Group == "" || rule.Role == "" {
+			return errors.New("group_roles need a group and a role")
+		}
+	}
+	return nil
 }
 
 // DBConfiguration holds all the database related configuration.
@@ -49,6 +191,66 @@ type JWTConfiguration struct {
 	AdminGroupName   string   `json:"admin_group_name" split_words:"true"`
 	AdminRoles       []string `json:"admin_roles" split_words:"true"`
 	DefaultGroupName string   `json:"default_group_name" split_words:"true"`
+	Algorithm        string   `json:"algorithm"`
+	PrivateKey       string   `json:"private_key" split_words:"true"`
+	KeyID            string   `json:"key_id" split_words:"true"`
+	Issuer           string   `json:"issuer"`
+	// KeyEncryptionKey encrypts the signing keys stored by key rotation. It
+	// defaults to a key derived from the secret.
+	KeyEncryptionKey string `json:"key_encryption_key" split_words:"true"`
+}
+
+// MFAConfiguration holds all the multi-factor authentication related configuration.
+type MFAConfiguration struct {
+	Enabled         bool   `json:"enabled"`
+	Issuer          string `json:"issuer"`
+	EncryptionKey   string `json:"encryption_key" split_words:"true"`
+	ChallengeExpiry int    `json:"challenge_expiry" split_words:"true"`
+	// A factor is locked after MaxAttempts wrong codes, until no code was
+	// tried for LockoutDuration seconds.
+	MaxAttempts     int `json:"max_attempts" split_words:"true"`
+	LockoutDuration int `json:"lockout_duration" split_words:"true"`
+}
+
+// WebAuthnConfiguration holds the configuration of passkeys and security keys.
+type WebAuthnConfiguration struct {
+	Enabled bool `json:"enabled"`
+	// RPID is the domain credentials are scoped to. It defaults to the host
+	// of the site URL.
+	RPID          string `json:"rp_id" envconfig:"RP_ID"`
+	RPDisplayName string `json:"rp_display_name" envconfig:"RP_DISPLAY_NAME"`
+	// Origins are the origins of the pages credentials are used on. They
+	// default to the origin of the site URL.
+	Origins []string `json:"origins"`
+	// UserVerification is required, preferred or discouraged.
+	UserVerification string `json:"user_verification" split_words:"true"`
+	ChallengeExpiry  int    `json:"challenge_expiry" split_words:"true"`
+}
+
+// OAuthServerConfiguration holds the configuration of GoTrue acting as an OAuth2
+// authorization server for registered client applications.
+type OAuthServerConfiguration struct {
+	Enabled bool `json:"enabled"`
+	// ConsentURL is the page of the site that asks users to approve a client.
+	ConsentURL              string `json:"consent_url" split_words:"true"`
+	AuthorizationCodeExpiry int    `json:"authorization_code_expiry" split_words:"true"`
+}
+
+// SecurityConfiguration holds the refresh token rotation settings.
+type SecurityConfiguration struct {
+	// RefreshTokenReuseInterval is how many seconds a rotated refresh token
+	// can still be used, for clients that refresh concurrently. A negative
+	// interval disables reuse.
+	RefreshTokenReuseInterval int `json:"refresh_token_reuse_interval" split_words:"true"`
+}
+
+// SessionsConfiguration holds the lifetime limits of sessions, in seconds.
+// A limit of 0 disables it.
+type SessionsConfiguration struct {
+	// MaxLifetime is how long a session can be refreshed after sign in.
+	MaxLifetime int `json:"max_lifetime" split_words:"true"`
+	// InactivityTimeout is how long a session can go without being refreshed.
+	InactivityTimeout int `json:"inactivity_timeout" split_words:"true"`
 }
 
 // GlobalConfiguration holds all the configuration that applies to all instances.
@@ -80,19 +282,26 @@ type EmailContentConfiguration struct {
 }
 
 type ProviderConfiguration struct {
-	Apple       OAuthProviderConfiguration `json:"apple"`
-	Azure       OAuthProviderConfiguration `json:"azure"`
-	Bitbucket   OAuthProviderConfiguration `json:"bitbucket"`
-	Discord     OAuthProviderConfiguration `json:"discord"`
-	Github      OAuthProviderConfiguration `json:"github"`
-	Gitlab      OAuthProviderConfiguration `json:"gitlab"`
-	Google      OAuthProviderConfiguration `json:"google"`
-	Facebook    OAuthProviderConfiguration `json:"facebook"`
-	Twitter     OAuthProviderConfiguration `json:"twitter"`
-	Twitch      OAuthProviderConfiguration `json:"twitch"`
-	Email       EmailProviderConfiguration `json:"email"`
-	Saml        SamlProviderConfiguration  `json:"saml"`
-	RedirectURL string                     `json:"redirect_url"`
+	Apple       OAuthProviderConfiguration     `json:"apple"`
+	Azure       OAuthProviderConfiguration     `json:"azure"`
+	Bitbucket   OAuthProviderConfiguration     `json:"bitbucket"`
+	Discord     OAuthProviderConfiguration     `json:"discord"`
+	Github      OAuthProviderConfiguration     `json:"github"`
+	Gitlab      OAuthProviderConfiguration     `json:"gitlab"`
+	Google      OAuthProviderConfiguration     `json:"google"`
+	Facebook    OAuthProviderConfiguration     `json:"facebook"`
+	Twitter     OAuthProviderConfiguration     `json:"twitter"`
+	Twitch      OAuthProviderConfiguration     `json:"twitch"`
+	Email       EmailProviderConfiguration     `json:"email"`
+	Phone       PhoneProviderConfiguration     `json:"phone"`
+	Anonymous   AnonymousProviderConfiguration `json:"anonymous"`
+	Saml        SamlProviderConfiguration      `json:"saml"`
+	LDAP        LDAPProviderConfiguration      `json:"ldap"`
+	OIDC        OIDCProviders                  `json:"oidc"`
+	Custom      CustomProviders                `json:"custom"`
+	RedirectURL string                         `json:"redirect_url"`
+	// TokenEncryptionKey encrypts the provider tokens stored for identities.
+	TokenEncryptionKey string `json:"token_encryption_key" split_words:"true"`
 }
 
 type SMTPConfiguration struct {
@@ -110,19 +319,50 @@ type MailerConfiguration struct {
 	Subjects    EmailContentConfiguration `json:"subjects"`
 	Templates   EmailContentConfiguration `json:"templates"`
 	URLPaths    EmailContentConfiguration `json:"url_paths"`
+
+	// The one-time codes of magic link emails expire after OtpExp seconds
+	// or OtpMaxAttempts failed attempts.
+	OtpExp         uint `json:"otp_exp" split_words:"true"`
+	OtpLength      int  `json:"otp_length" split_words:"true"`
+	OtpMaxAttempts int  `json:"otp_max_attempts" split_words:"true"`
+}
+
+// SMSWebhookConfiguration holds the configuration for delivering SMS through a webhook.
+type SMSWebhookConfiguration struct {
+	URL        string `json:"url"`
+	Secret     string `json:"secret"`
+	TimeoutSec int    `json:"timeout_sec" split_words:"true"`
+}
+
+// SMSConfiguration holds all the SMS related configuration.
+type SMSConfiguration struct {
+	Provider       string                  `json:"provider"`
+	Autoconfirm    bool                    `json:"autoconfirm"`
+	MaxFrequency   time.Duration           `json:"max_frequency" split_words:"true"`
+	OtpExp         uint                    `json:"otp_exp" split_words:"true"`
+	OtpLength      int                     `json:"otp_length" split_words:"true"`
+	OtpMaxAttempts int                     `json:"otp_max_attempts" split_words:"true"`
+	Template       string                  `json:"template"`
+	Webhook        SMSWebhookConfiguration `json:"webhook"`
 }
 
 // Configuration holds all the per-instance configuration.
 type Configuration struct {
-	SiteURL           string                `json:"site_url" split_words:"true" required:"true"`
-	URIAllowList      []string              `json:"uri_allow_list" split_words:"true"`
-	PasswordMinLength int                   `json:"password_min_length" default:"6"`
-	JWT               JWTConfiguration      `json:"jwt"`
-	SMTP              SMTPConfiguration     `json:"smtp"`
-	Mailer            MailerConfiguration   `json:"mailer"`
-	External          ProviderConfiguration `json:"external"`
-	DisableSignup     bool                  `json:"disable_signup" split_words:"true"`
-	Webhook           WebhookConfig         `json:"webhook" split_words:"true"`
+	SiteURL           string                   `json:"site_url" split_words:"true" required:"true"`
+	URIAllowList      []string                 `json:"uri_allow_list" split_words:"true"`
+	PasswordMinLength int                      `json:"password_min_length" default:"6"`
+	JWT               JWTConfiguration         `json:"jwt"`
+	SMTP              SMTPConfiguration        `json:"smtp"`
+	Mailer            MailerConfiguration      `json:"mailer"`
+	SMS               SMSConfiguration         `json:"sms"`
+	External          ProviderConfiguration    `json:"external"`
+	DisableSignup     bool                     `json:"disable_signup" split_words:"true"`
+	Webhook           WebhookConfig            `json:"webhook" split_words:"true"`
+	MFA               MFAConfiguration         `json:"mfa"`
+	WebAuthn          WebAuthnConfiguration    `json:"webauthn"`
+	OAuthServer       OAuthServerConfiguration `json:"oauth_server" split_words:"true"`
+	Security          SecurityConfiguration    `json:"security"`
+	Sessions          SessionsConfiguration    `json:"sessions"`
 	Cookie            struct {
 		Key      string `json:"key"`
 		Duration int    `json:"duration"`
@@ -211,6 +451,14 @@ func (config *Configuration) ApplyDefaults() {
 		config.JWT.Exp = 3600
 	}
 
+	if config.JWT.Algorithm == "" {
+		config.JWT.Algorithm = "HS256"
+	}
+
+	if config.JWT.KeyEncryptionKey == "" && config.JWT.Secret != "" {
+		config.JWT.KeyEncryptionKey = crypto.DeriveKey(config.JWT.Secret, "gotrue signing keys")
+	}
+
 	if config.Mailer.URLPaths.Invite == "" {
 		config.Mailer.URLPaths.Invite = "/"
 	}
@@ -228,6 +476,38 @@ func (config *Configuration) ApplyDefaults() {
 		config.SMTP.MaxFrequency = 1 * time.Minute
 	}
 
+	if config.SMS.MaxFrequency == 0 {
+		config.SMS.MaxFrequency = 1 * time.Minute
+	}
+
+	if config.Mailer.OtpExp == 0 {
+		config.Mailer.OtpExp = 300
+	}
+
+	if config.Mailer.OtpLength == 0 {
+		config.Mailer.OtpLength = 6
+	}
+
+	if config.Mailer.OtpMaxAttempts == 0 {
+		config.Mailer.OtpMaxAttempts = 5
+	}
+
+	if config.SMS.OtpExp == 0 {
+		config.SMS.OtpExp = 300
+	}
+
+	if config.SMS.OtpLength == 0 {
+		config.SMS.OtpLength = 6
+	}
+
+	if config.SMS.OtpMaxAttempts == 0 {
+		config.SMS.OtpMaxAttempts = 5
+	}
+
+	if config.SMS.Template == "" {
+		config.SMS.Template = "Your code is {{ .Code }}"
+	}
+
 	if config.Cookie.Key == "" {
 		config.Cookie.Key = "nf_jwt"
 	}
@@ -239,6 +519,89 @@ func (config *Configuration) ApplyDefaults() {
 	if config.URIAllowList == nil {
 		config.URIAllowList = []string{}
 	}
+
+	if config.MFA.Issuer == "" {
+		config.MFA.Issuer = "GoTrue"
+	}
+
+	if config.MFA.EncryptionKey == "" && config.JWT.Secret != "" {
+		config.MFA.EncryptionKey = crypto.DeriveKey(config.JWT.Secret, "gotrue mfa")
+	}
+
+	if config.WebAuthn.RPID == "" || len(config.WebAuthn.Origins) == 0 {
+		if u, err := url.Parse(config.SiteURL); err == nil {
+			if config.WebAuthn.RPID == "" {
+				config.WebAuthn.RPID = u.Hostname()
+			}
+			if len(config.WebAuthn.Origins) == 0 {
+				config.WebAuthn.Origins = []string{u.Scheme + "://" + u.Host}
+			}
+		}
+	}
+
+	if config.WebAuthn.RPDisplayName == "" {
+		config.WebAuthn.RPDisplayName = config.MFA.Issuer
+	}
+
+	if config.WebAuthn.UserVerification == "" {
+		config.WebAuthn.UserVerification = "preferred"
+	}
+
+	if config.WebAuthn.ChallengeExpiry == 0 {
+		config.WebAuthn.ChallengeExpiry = 300
+	}
+
+	if config.External.TokenEncryptionKey == "" && config.JWT.Secret != "" {
+		config.External.TokenEncryptionKey = crypto.DeriveKey(config.JWT.Secret, "gotrue provider tokens")
+	}
+
+	if config.External.LDAP.SearchFilter == "" {
+		config.External.LDAP.SearchFilter = "(mail={email})"
+	}
+
+	if config.External.LDAP.IDAttribute == "" {
+		config.External.LDAP.IDAttribute = "entryUUID"
+	}
+
+	if config.External.LDAP.EmailAttribute == "" {
+		config.External.LDAP.EmailAttribute = "mail"
+	}
+
+	if config.External.LDAP.NameAttribute == "" {
+		config.External.LDAP.NameAttribute = "cn"
+	}
+
+	if config.External.LDAP.GroupAttribute == "" {
+		config.External.LDAP.GroupAttribute = "memberOf"
+	}
+
+	if config.External.LDAP.Timeout == 0 {
+		config.External.LDAP.Timeout = 10
+	}
+
+	if config.MFA.ChallengeExpiry == 0 {
+		config.MFA.ChallengeExpiry = 300
+	}
+
+	if config.MFA.MaxAttempts == 0 {
+		config.MFA.MaxAttempts = 5
+	}
+
+	if config.MFA.LockoutDuration == 0 {
+		config.MFA.LockoutDuration = 300
+	}
+
+	if config.OAuthServer.ConsentURL == "" {
+		config.OAuthServer.ConsentURL = config.SiteURL
+	}
+
+	if config.OAuthServer.AuthorizationCodeExpiry == 0 {
+		config.OAuthServer.AuthorizationCodeExpiry = 300
+	}
+
+	if config.Security.RefreshTokenReuseInterval == 0 {
+		config.Security.RefreshTokenReuseInterval = 10
+	}
 }
 
 func (config *Configuration) Value() (driver.Value, error) {
@@ -281,3 +644,13 @@ func (o *OAuthProviderConfiguration) Validate() error {
 	}
 	return nil
 }
+
+func (o *OIDCProviderConfiguration) Validate() error {
+	if err := o.OAuthProviderConfiguration.Validate(); err != nil {
+		return err
+	}
+	if o.Issuer == "" {
+		return errors.New("Missing OpenID Connect issuer")
+	}
+	return nil
+}
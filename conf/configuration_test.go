@@ -44,3 +44,43 @@ func TestTracing(t *testing.T) {
 	assert.Equal(t, "127.0.0.1", gc.Tracing.Host)
 	assert.Equal(t, map[string]string{"tag1": "value1", "tag2": "value2"}, gc.Tracing.Tags)
 }
+
+func TestMFAEncryptionKey(t *testing.T) {
+	config := &Configuration{}
+	config.JWT.Secret = "secret"
+	config.ApplyDefaults()
+	assert.NotEmpty(t, config.MFA.EncryptionKey)
+	assert.NotEqual(t, config.JWT.Secret, config.MFA.EncryptionKey)
+
+	config = &Configuration{}
+	config.JWT.Secret = "secret"
+	config.MFA.EncryptionKey = "mfa key"
+	config.ApplyDefaults()
+	assert.Equal(t, "mfa key", config.MFA.EncryptionKey)
+}
+
+func TestApplyDefaults(t *testing.T) {
+	config := &Configuration{}
+	config.ApplyDefaults()
+	assert.Equal(t, 10, config.Security.RefreshTokenReuseInterval)
+
+	config = &Configuration{}
+	config.Security.RefreshTokenReuseInterval = -1
+	config.ApplyDefaults()
+	assert.Equal(t, -1, config.Security.RefreshTokenReuseInterval)
+}
+
+func TestDerivedEncryptionKeys(t *testing.T) {
+	config := &Configuration{}
+	config.JWT.Secret = "secret"
+	config.ApplyDefaults()
+	assert.NotEmpty(t, config.External.TokenEncryptionKey)
+	assert.NotEqual(t, config.JWT.Secret, config.External.TokenEncryptionKey)
+	assert.NotEqual(t, config.JWT.KeyEncryptionKey, config.External.TokenEncryptionKey)
+
+	config = &Configuration{}
+	config.JWT.Secret = "secret"
+	config.External.TokenEncryptionKey = "token key"
+	config.ApplyDefaults()
+	assert.Equal(t, "token key", config.External.TokenEncryptionKey)
+}
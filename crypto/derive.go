@@ -0,0 +1,20 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// DeriveKey derives a key for a single purpose from secret with HKDF. Keys
+// derived with different labels are independent, so one secret can back
+// several keys.
+func DeriveKey(secret, label string) string {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(label)), key); err != nil {
+		panic(err.Error()) // hkdf can always expand to 32 bytes
+	}
+	return base64.RawStdEncoding.EncodeToString(key)
+}
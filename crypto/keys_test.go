@@ -0,0 +1,33 @@
+package crypto
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateSigningKey(t *testing.T) {
+	secret, err := GenerateSigningKey("HS256")
+	require.NoError(t, err)
+	assert.Len(t, secret, 43)
+
+	rsaKey, err := GenerateSigningKey("RS256")
+	require.NoError(t, err)
+	block, _ := pem.Decode([]byte(rsaKey))
+	require.NotNil(t, block)
+	_, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	assert.NoError(t, err)
+
+	ecKey, err := GenerateSigningKey("ES256")
+	require.NoError(t, err)
+	block, _ = pem.Decode([]byte(ecKey))
+	require.NotNil(t, block)
+	_, err = x509.ParseECPrivateKey(block.Bytes)
+	assert.NoError(t, err)
+
+	_, err = GenerateSigningKey("none")
+	assert.Error(t, err)
+}
@@ -0,0 +1,30 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"strings"
+)
+
+// GenerateOTP creates a random numeric one-time password of the given length
+func GenerateOTP(digits int) (string, error) {
+	max := big.NewInt(10)
+	var b strings.Builder
+	for i := 0; i < digits; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(byte('0' + n.Int64()))
+	}
+	return b.String(), nil
+}
+
+// HashOTP hashes a one-time password together with the address it was sent to,
+// so the stored value is bound to that address and can't be read back as a code.
+func HashOTP(address, otp string) string {
+	sum := sha256.Sum256([]byte(address + ":" + otp))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,22 @@
+package crypto
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateOTP(t *testing.T) {
+	otp, err := GenerateOTP(6)
+	require.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^[0-9]{6}$`), otp)
+}
+
+func TestHashOTP(t *testing.T) {
+	assert.Equal(t, HashOTP("12345678", "123456"), HashOTP("12345678", "123456"))
+	assert.NotEqual(t, HashOTP("12345678", "123456"), HashOTP("87654321", "123456"))
+	assert.NotEqual(t, HashOTP("12345678", "123456"), HashOTP("12345678", "654321"))
+	assert.NotContains(t, HashOTP("12345678", "123456"), "123456")
+}
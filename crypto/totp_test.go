@@ -0,0 +1,72 @@
+package crypto
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors from RFC 6238, truncated to six digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	cases := []struct {
+		Time     int64
+		Expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, c := range cases {
+		code, err := TOTPCode(secret, TOTPCounter(time.Unix(c.Time, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, c.Expected, code)
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := GenerateTOTPSecret()
+	now := time.Now()
+
+	code, err := TOTPCode(secret, TOTPCounter(now.Add(-TOTPPeriod*time.Second)))
+	require.NoError(t, err)
+
+	counter, ok := ValidateTOTP(secret, code, now, 1)
+	assert.True(t, ok)
+	assert.Equal(t, TOTPCounter(now)-1, counter)
+
+	_, ok = ValidateTOTP(secret, code, now, 0)
+	assert.False(t, ok)
+
+	_, ok = ValidateTOTP(secret, "12345", now, 1)
+	assert.False(t, ok)
+}
+
+func TestTOTPSecretFromURL(t *testing.T) {
+	secret := GenerateTOTPSecret()
+	u := TOTPURL("GoTrue", "user@example.com", secret)
+
+	parsed, err := TOTPSecretFromURL(u)
+	require.NoError(t, err)
+	assert.Equal(t, secret, parsed)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	data := []byte("otpauth://totp/GoTrue:user@example.com?secret=ABC")
+	sealed, err := Encrypt("secret", data)
+	require.NoError(t, err)
+	assert.NotEqual(t, data, sealed)
+
+	opened, err := Decrypt("secret", sealed)
+	require.NoError(t, err)
+	assert.Equal(t, data, opened)
+
+	_, err = Decrypt("other secret", sealed)
+	assert.Error(t, err)
+}
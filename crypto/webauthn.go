@@ -0,0 +1,293 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// The types of the client data of WebAuthn ceremonies
+const (
+	WebAuthnCreate = "webauthn.create"
+	WebAuthnGet    = "webauthn.get"
+)
+
+// The COSE algorithms (RFC 8152) of the supported credential public keys
+const (
+	COSEAlgES256 = -7
+	COSEAlgEdDSA = -8
+	COSEAlgRS256 = -257
+)
+
+// WebAuthnAlgorithms are the supported COSE algorithms in order of preference
+var WebAuthnAlgorithms = []int{COSEAlgES256, COSEAlgEdDSA, COSEAlgRS256}
+
+// flags of the authenticator data
+const (
+	webAuthnUserPresent  = 0x01
+	webAuthnUserVerified = 0x04
+	webAuthnAttestedData = 0x40
+)
+
+// WebAuthnRelyingParty verifies the responses of authenticators for a site.
+type WebAuthnRelyingParty struct {
+	// ID is the domain credentials are scoped to
+	ID string
+	// Origins are the origins of the pages credentials can be used on
+	Origins []string
+	// RequireUserVerification rejects authenticators that didn't verify
+	// the user, such as by PIN or biometrics
+	RequireUserVerification bool
+}
+
+// WebAuthnAuthenticatorData is the authenticator data of a WebAuthn
+// ceremony. The credential is only set for registrations.
+type WebAuthnAuthenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+
+	AAGUID       []byte
+	CredentialID []byte
+	// PublicKey is the COSE encoded public key of the credential
+	PublicKey []byte
+}
+
+// UserVerified checks if the authenticator verified the user
+func (d *WebAuthnAuthenticatorData) UserVerified() bool {
+	return d.Flags&webAuthnUserVerified != 0
+}
+
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// GenerateWebAuthnChallenge creates a random base64url encoded challenge
+func GenerateWebAuthnChallenge() string {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err.Error()) // rand should never fail
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// VerifyRegistration verifies the response of navigator.credentials.create
+// to the challenge and returns the authenticator data with the new
+// credential. Attestation statements are not verified, since credentials are
+// requested without attestation.
+func (rp *WebAuthnRelyingParty) VerifyRegistration(challenge string, clientDataJSON, attestationObject []byte) (*WebAuthnAuthenticatorData, error) {
+	if err := rp.verifyClientData(clientDataJSON, WebAuthnCreate, challenge); err != nil {
+		return nil, err
+	}
+
+	item, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: invalid attestation object: %v", err)
+	}
+	attestation, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("webauthn: invalid attestation object")
+	}
+	authData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("webauthn: attestation object has no authenticator data")
+	}
+
+	data, err := rp.verifyAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if data.CredentialID == nil {
+		return nil, errors.New("webauthn: no credential was created")
+	}
+	if _, _, err := parseCOSEKey(data.PublicKey); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// VerifyAssertion verifies the response of navigator.credentials.get to the
+// challenge, signed with the credential of publicKey.
+func (rp *WebAuthnRelyingParty) VerifyAssertion(challenge string, publicKey, clientDataJSON, authenticatorData, signature []byte) (*WebAuthnAuthenticatorData, error) {
+	if err := rp.verifyClientData(clientDataJSON, WebAuthnGet, challenge); err != nil {
+		return nil, err
+	}
+	data, err := rp.verifyAuthenticatorData(authenticatorData)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, key, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := make([]byte, 0, len(authenticatorData)+len(clientDataHash))
+	signed = append(signed, authenticatorData...)
+	signed = append(signed, clientDataHash[:]...)
+	if !verifyCOSESignature(alg, key, signed, signature) {
+		return nil, errors.New("webauthn: invalid signature")
+	}
+	return data, nil
+}
+
+func (rp *WebAuthnRelyingParty) verifyClientData(clientDataJSON []byte, ceremony, challenge string) error {
+	clientData := webAuthnClientData{}
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return fmt.Errorf("webauthn: invalid client data: %v", err)
+	}
+	if clientData.Type != ceremony {
+		return fmt.Errorf("webauthn: client data is of type %q instead of %q", clientData.Type, ceremony)
+	}
+	if challenge == "" || subtle.ConstantTimeCompare([]byte(clientData.Challenge), []byte(challenge)) != 1 {
+		return errors.New("webauthn: challenge does not match")
+	}
+	for _, origin := range rp.Origins {
+		if clientData.Origin == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("webauthn: origin %q is not allowed", clientData.Origin)
+}
+
+func (rp *WebAuthnRelyingParty) verifyAuthenticatorData(authData []byte) (*WebAuthnAuthenticatorData, error) {
+	data, err := parseWebAuthnAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(data.RPIDHash, rpIDHash[:]) != 1 {
+		return nil, errors.New("webauthn: credential is scoped to another relying party")
+	}
+	if data.Flags&webAuthnUserPresent == 0 {
+		return nil, errors.New("webauthn: user was not present")
+	}
+	if rp.RequireUserVerification && !data.UserVerified() {
+		return nil, errors.New("webauthn: user was not verified")
+	}
+	return data, nil
+}
+
+func parseWebAuthnAuthenticatorData(authData []byte) (*WebAuthnAuthenticatorData, error) {
+	if len(authData) < 37 {
+		return nil, errors.New("webauthn: authenticator data is too short")
+	}
+	data := &WebAuthnAuthenticatorData{
+		RPIDHash:  authData[:32],
+		Flags:     authData[32],
+		SignCount: binary.BigEndian.Uint32(authData[33:37]),
+	}
+	if data.Flags&webAuthnAttestedData == 0 {
+		return data, nil
+	}
+
+	rest := authData[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("webauthn: attested credential data is too short")
+	}
+	data.AAGUID = rest[:16]
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if n == 0 || len(rest) < n {
+		return nil, errors.New("webauthn: invalid credential id")
+	}
+	data.CredentialID = rest[:n]
+	rest = rest[n:]
+
+	// extensions may follow the public key
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: invalid credential public key: %v", err)
+	}
+	data.PublicKey = rest[:len(rest)-len(after)]
+	return data, nil
+}
+
+// parseCOSEKey decodes a COSE encoded public key of one of the
+// WebAuthnAlgorithms
+func parseCOSEKey(coseKey []byte) (int64, crypto.PublicKey, error) {
+	item, _, err := decodeCBOR(coseKey)
+	if err != nil {
+		return 0, nil, fmt.Errorf("webauthn: invalid public key: %v", err)
+	}
+	params, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return 0, nil, errors.New("webauthn: invalid public key")
+	}
+	kty, _ := params[int64(1)].(int64)
+	alg, _ := params[int64(3)].(int64)
+	crv, _ := params[int64(-1)].(int64)
+
+	switch {
+	case alg == COSEAlgES256 && kty == 2 && crv == 1:
+		x, _ := params[int64(-2)].([]byte)
+		y, _ := params[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return 0, nil, errors.New("webauthn: invalid EC2 public key")
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return 0, nil, errors.New("webauthn: invalid EC2 public key")
+		}
+		return alg, key, nil
+	case alg == COSEAlgEdDSA && kty == 1 && crv == 6:
+		x, _ := params[int64(-2)].([]byte)
+		if len(x) != ed25519.PublicKeySize {
+			return 0, nil, errors.New("webauthn: invalid OKP public key")
+		}
+		return alg, ed25519.PublicKey(x), nil
+	case alg == COSEAlgRS256 && kty == 3:
+		n, _ := params[int64(-1)].([]byte)
+		e, _ := params[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, errors.New("webauthn: invalid RSA public key")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+	}
+	return 0, nil, fmt.Errorf("webauthn: unsupported public key algorithm %d", alg)
+}
+
+func verifyCOSESignature(alg int64, key crypto.PublicKey, signed, signature []byte) bool {
+	switch alg {
+	case COSEAlgES256:
+		var sig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(signature, &sig)
+		if err != nil || len(rest) != 0 || sig.R == nil || sig.S == nil {
+			return false
+		}
+		hash := sha256.Sum256(signed)
+		return ecdsa.Verify(key.(*ecdsa.PublicKey), hash[:], sig.R, sig.S)
+	case COSEAlgEdDSA:
+		return ed25519.Verify(key.(ed25519.PublicKey), signed, signature)
+	case COSEAlgRS256:
+		hash := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hash[:], signature) == nil
+	}
+	return false
+}
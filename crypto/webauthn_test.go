@@ -0,0 +1,181 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	// examples from appendix A of RFC 8949
+	cases := []struct {
+		Hex      string
+		Expected interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3903e7", int64(-1000)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"6449455446", "IETF"},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+	}
+
+	for _, c := range cases {
+		data, err := hex.DecodeString(c.Hex)
+		require.NoError(t, err)
+		item, rest, err := decodeCBOR(data)
+		require.NoError(t, err, c.Hex)
+		assert.Equal(t, c.Expected, item, c.Hex)
+		assert.Empty(t, rest, c.Hex)
+	}
+
+	for _, invalid := range []string{"", "18", "1b", "4401", "83", "9f01ff", "f97c00", "a1a1010101", "a201020102"} {
+		data, err := hex.DecodeString(invalid)
+		require.NoError(t, err)
+		_, _, err = decodeCBOR(data)
+		assert.Error(t, err, invalid)
+	}
+}
+
+// testAuthenticator is a software authenticator with an ES256 credential
+type testAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return &testAuthenticator{key: key, credentialID: []byte("test-credential")}
+}
+
+func (a *testAuthenticator) coseKey() []byte {
+	x := a.key.X.Bytes()
+	y := a.key.Y.Bytes()
+	x = append(make([]byte, 32-len(x)), x...)
+	y = append(make([]byte, 32-len(y)), y...)
+
+	key := []byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20}
+	key = append(key, x...)
+	key = append(key, 0x22, 0x58, 0x20)
+	return append(key, y...)
+}
+
+func (a *testAuthenticator) authData(rpID string, flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	a.signCount++
+	if attested {
+		flags |= webAuthnAttestedData
+	}
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = append(data, byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *testAuthenticator) create(rpID, origin, challenge string) ([]byte, []byte) {
+	clientData, _ := json.Marshal(webAuthnClientData{Type: WebAuthnCreate, Challenge: challenge, Origin: origin})
+	authData := a.authData(rpID, webAuthnUserPresent|webAuthnUserVerified, true)
+
+	// {"fmt": "none", "attStmt": {}, "authData": authData}
+	obj := []byte{0xa3, 0x63, 'f', 'm', 't', 0x64, 'n', 'o', 'n', 'e', 0x67, 'a', 't', 't', 'S', 't', 'm', 't', 0xa0, 0x68, 'a', 'u', 't', 'h', 'D', 'a', 't', 'a', 0x59, byte(len(authData) >> 8), byte(len(authData))}
+	return clientData, append(obj, authData...)
+}
+
+func (a *testAuthenticator) get(t *testing.T, rpID, origin, challenge string) ([]byte, []byte, []byte) {
+	clientData, _ := json.Marshal(webAuthnClientData{Type: WebAuthnGet, Challenge: challenge, Origin: origin})
+	authData := a.authData(rpID, webAuthnUserPresent, false)
+
+	clientDataHash := sha256.Sum256(clientData)
+	hash := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, hash[:])
+	require.NoError(t, err)
+	signature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	require.NoError(t, err)
+	return clientData, authData, signature
+}
+
+func TestWebAuthnRegistrationAndAssertion(t *testing.T) {
+	rp := &WebAuthnRelyingParty{ID: "example.com", Origins: []string{"https://example.com"}}
+	authenticator := newTestAuthenticator(t)
+
+	challenge := GenerateWebAuthnChallenge()
+	clientData, attestation := authenticator.create("example.com", "https://example.com", challenge)
+	data, err := rp.VerifyRegistration(challenge, clientData, attestation)
+	require.NoError(t, err)
+	assert.Equal(t, authenticator.credentialID, data.CredentialID)
+	assert.Equal(t, authenticator.coseKey(), data.PublicKey)
+	assert.True(t, data.UserVerified())
+
+	challenge = GenerateWebAuthnChallenge()
+	clientData, authData, signature := authenticator.get(t, "example.com", "https://example.com", challenge)
+	data, err = rp.VerifyAssertion(challenge, authenticator.coseKey(), clientData, authData, signature)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), data.SignCount)
+	assert.False(t, data.UserVerified())
+
+	// another challenge
+	_, err = rp.VerifyAssertion(GenerateWebAuthnChallenge(), authenticator.coseKey(), clientData, authData, signature)
+	assert.Error(t, err)
+
+	// tampered authenticator data
+	tampered := append([]byte{}, authData...)
+	tampered[36]++
+	_, err = rp.VerifyAssertion(challenge, authenticator.coseKey(), clientData, tampered, signature)
+	assert.Error(t, err)
+
+	// another credential
+	other := newTestAuthenticator(t)
+	_, err = rp.VerifyAssertion(challenge, other.coseKey(), clientData, authData, signature)
+	assert.Error(t, err)
+
+	// user verification is required
+	rp.RequireUserVerification = true
+	_, err = rp.VerifyAssertion(challenge, authenticator.coseKey(), clientData, authData, signature)
+	assert.Error(t, err)
+}
+
+func TestWebAuthnRegistrationScope(t *testing.T) {
+	rp := &WebAuthnRelyingParty{ID: "example.com", Origins: []string{"https://example.com"}}
+	authenticator := newTestAuthenticator(t)
+	challenge := GenerateWebAuthnChallenge()
+
+	clientData, attestation := authenticator.create("example.com", "https://evil.example", challenge)
+	_, err := rp.VerifyRegistration(challenge, clientData, attestation)
+	assert.Error(t, err)
+
+	clientData, attestation = authenticator.create("evil.example", "https://example.com", challenge)
+	_, err = rp.VerifyRegistration(challenge, clientData, attestation)
+	assert.Error(t, err)
+
+	// an assertion is not a registration
+	clientData, authData, _ := authenticator.get(t, "example.com", "https://example.com", challenge)
+	_, err = rp.VerifyRegistration(challenge, clientData, authData)
+	assert.Error(t, err)
+}
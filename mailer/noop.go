@@ -21,7 +21,7 @@ func (m noopMailer) RecoveryMail(user *models.User, referrerURL string) error {
 	return nil
 }
 
-func (m noopMailer) MagicLinkMail(user *models.User, referrerURL string) error {
+func (m noopMailer) MagicLinkMail(user *models.User, otp, referrerURL string) error {
 	return nil
 }
 
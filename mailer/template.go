@@ -34,7 +34,8 @@ const defaultRecoveryMail = `<h2>Reset password</h2>
 const defaultMagicLinkMail = `<h2>Magic Link</h2>
 
 <p>Follow this link to login:</p>
-<p><a href="{{ .ConfirmationURL }}">Log In</a></p>`
+<p><a href="{{ .ConfirmationURL }}">Log In</a></p>
+<p>Alternatively, enter the code: {{ .Token }}</p>`
 
 const defaultEmailChangeMail = `<h2>Confirm email address change</h2>
 
@@ -166,8 +167,9 @@ func (m *TemplateMailer) RecoveryMail(user *models.User, referrerURL string) err
 	)
 }
 
-// MagicLinkMail sends a login link mail
-func (m *TemplateMailer) MagicLinkMail(user *models.User, referrerURL string) error {
+// MagicLinkMail sends a login link mail with the one-time code that can be
+// entered instead of following the link
+func (m *TemplateMailer) MagicLinkMail(user *models.User, otp, referrerURL string) error {
 	globalConfig, err := conf.LoadGlobal(configFile)
 
 	redirectParam := ""
@@ -183,7 +185,7 @@ func (m *TemplateMailer) MagicLinkMail(user *models.User, referrerURL string) er
 		"SiteURL":         m.Config.SiteURL,
 		"ConfirmationURL": url,
 		"Email":           user.Email,
-		"Token":           user.RecoveryToken,
+		"Token":           otp,
 		"Data":            user.UserMetaData,
 	}
 
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS `{{ index .Options "Namespace" }}totp_auth` (
+  `instance_id` varchar(255) DEFAULT NULL,
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `user_id` varchar(255) NOT NULL,
+  `encrypted_url` blob DEFAULT NULL,
+  `otp_last_requested_at` timestamp NULL DEFAULT NULL,
+  `verified_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NULL DEFAULT NULL,
+  `updated_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `totp_auth_user_id_idx` (`user_id`),
+  KEY `totp_auth_instance_id_idx` (`instance_id`),
+  KEY `totp_auth_instance_id_user_id_idx` (`instance_id`,`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,4 @@
+ALTER TABLE `{{ index .Options "Namespace" }}users`
+DROP KEY `users_instance_id_phone_idx`,
+DROP `phone_confirmed_at`,
+DROP `phone`;
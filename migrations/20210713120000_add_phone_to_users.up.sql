@@ -0,0 +1,4 @@
+ALTER TABLE `{{ index .Options "Namespace" }}users`
+ADD `phone` varchar(15) NULL DEFAULT NULL AFTER `invited_at`,
+ADD `phone_confirmed_at` timestamp NULL DEFAULT NULL AFTER `phone`,
+ADD KEY `users_instance_id_phone_idx` (`instance_id`,`phone`);
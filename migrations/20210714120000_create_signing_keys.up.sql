@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS `{{ index .Options "Namespace" }}signing_keys` (
+  `instance_id` varchar(255) DEFAULT NULL,
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `kid` varchar(255) NOT NULL DEFAULT '',
+  `algorithm` varchar(10) NOT NULL,
+  `material` text NOT NULL,
+  `status` varchar(20) NOT NULL,
+  `expires_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NULL DEFAULT NULL,
+  `updated_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `signing_keys_instance_id_kid_idx` (`instance_id`,`kid`),
+  KEY `signing_keys_instance_id_idx` (`instance_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `{{ index .Options "Namespace" }}oauth_authorization_codes`;
+DROP TABLE IF EXISTS `{{ index .Options "Namespace" }}oauth_clients`;
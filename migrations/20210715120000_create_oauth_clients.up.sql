@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS `{{ index .Options "Namespace" }}oauth_clients` (
+  `instance_id` varchar(255) DEFAULT NULL,
+  `id` varchar(255) NOT NULL,
+  `client_id` varchar(255) NOT NULL,
+  `encrypted_client_secret` varchar(255) NOT NULL,
+  `name` varchar(255) NOT NULL DEFAULT '',
+  `redirect_uris` text NOT NULL,
+  `created_at` timestamp NULL DEFAULT NULL,
+  `updated_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `oauth_clients_instance_id_client_id_idx` (`instance_id`,`client_id`),
+  KEY `oauth_clients_instance_id_idx` (`instance_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `{{ index .Options "Namespace" }}oauth_authorization_codes` (
+  `instance_id` varchar(255) DEFAULT NULL,
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `client_id` varchar(255) NOT NULL,
+  `user_id` varchar(255) NOT NULL,
+  `code_hash` varchar(64) NOT NULL,
+  `redirect_uri` text NOT NULL,
+  `scope` varchar(255) NOT NULL DEFAULT '',
+  `nonce` varchar(255) NOT NULL DEFAULT '',
+  `expires_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NULL DEFAULT NULL,
+  `updated_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `oauth_authorization_codes_code_hash_idx` (`code_hash`),
+  KEY `oauth_authorization_codes_instance_id_idx` (`instance_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS `{{ index .Options "Namespace" }}flow_state` (
+  `instance_id` varchar(255) DEFAULT NULL,
+  `id` varchar(255) NOT NULL,
+  `user_id` varchar(255) NOT NULL,
+  `code_challenge` varchar(128) NOT NULL,
+  `code_challenge_method` varchar(10) NOT NULL,
+  `authentication_method` varchar(50) NOT NULL,
+  `provider_token` text DEFAULT NULL,
+  `nonce` varchar(255) NOT NULL DEFAULT '',
+  `auth_code_hash` varchar(64) NOT NULL DEFAULT '',
+  `auth_code_issued_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NULL DEFAULT NULL,
+  `updated_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `flow_state_instance_id_auth_code_hash_idx` (`instance_id`,`auth_code_hash`),
+  KEY `flow_state_instance_id_user_id_idx` (`instance_id`,`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
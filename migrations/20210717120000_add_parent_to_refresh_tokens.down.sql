@@ -0,0 +1,5 @@
+ALTER TABLE `{{ index .Options "Namespace" }}refresh_tokens`
+DROP KEY `refresh_tokens_instance_id_family_id_idx`,
+DROP KEY `refresh_tokens_parent_idx`,
+DROP `family_id`,
+DROP `parent`;
@@ -0,0 +1,5 @@
+ALTER TABLE `{{ index .Options "Namespace" }}refresh_tokens`
+ADD `parent` varchar(255) NOT NULL DEFAULT '' AFTER `user_id`,
+ADD `family_id` bigint(20) NOT NULL DEFAULT 0 AFTER `parent`,
+ADD KEY `refresh_tokens_parent_idx` (`parent`),
+ADD KEY `refresh_tokens_instance_id_family_id_idx` (`instance_id`,`family_id`);
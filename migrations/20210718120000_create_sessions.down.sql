@@ -0,0 +1,5 @@
+ALTER TABLE `{{ index .Options "Namespace" }}refresh_tokens`
+DROP KEY `refresh_tokens_instance_id_session_id_idx`,
+DROP `session_id`;
+
+DROP TABLE IF EXISTS `{{ index .Options "Namespace" }}sessions`;
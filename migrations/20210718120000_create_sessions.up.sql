@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS `{{ index .Options "Namespace" }}sessions` (
+  `instance_id` varchar(255) DEFAULT NULL,
+  `id` varchar(255) NOT NULL,
+  `user_id` varchar(255) NOT NULL,
+  `user_agent` text DEFAULT NULL,
+  `ip` varchar(255) NOT NULL DEFAULT '',
+  `refreshed_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NULL DEFAULT NULL,
+  `updated_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `sessions_instance_id_user_id_idx` (`instance_id`,`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+ALTER TABLE `{{ index .Options "Namespace" }}refresh_tokens`
+ADD `session_id` varchar(255) DEFAULT NULL AFTER `user_id`,
+ADD KEY `refresh_tokens_instance_id_session_id_idx` (`instance_id`,`session_id`);
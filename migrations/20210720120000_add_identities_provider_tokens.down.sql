@@ -0,0 +1,4 @@
+ALTER TABLE `{{ index .Options "Namespace" }}identities`
+DROP `provider_token_expires_at`,
+DROP `encrypted_provider_refresh_token`,
+DROP `encrypted_provider_token`;
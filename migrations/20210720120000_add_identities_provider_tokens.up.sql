@@ -0,0 +1,4 @@
+ALTER TABLE `{{ index .Options "Namespace" }}identities`
+ADD `encrypted_provider_token` blob DEFAULT NULL AFTER `identity_data`,
+ADD `encrypted_provider_refresh_token` blob DEFAULT NULL AFTER `encrypted_provider_token`,
+ADD `provider_token_expires_at` timestamp NULL DEFAULT NULL AFTER `encrypted_provider_refresh_token`;
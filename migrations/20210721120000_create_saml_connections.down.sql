@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `{{ index .Options "Namespace" }}saml_connections`;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS `{{ index .Options "Namespace" }}saml_connections` (
+  `instance_id` varchar(255) DEFAULT NULL,
+  `id` varchar(255) NOT NULL,
+  `name` varchar(255) NOT NULL DEFAULT '',
+  `metadata_url` text DEFAULT NULL,
+  `metadata_xml` mediumtext DEFAULT NULL,
+  `attribute_mapping` JSON NULL DEFAULT NULL,
+  `domains` text NOT NULL,
+  `created_at` timestamp NULL DEFAULT NULL,
+  `updated_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `saml_connections_instance_id_idx` (`instance_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
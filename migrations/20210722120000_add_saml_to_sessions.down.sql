@@ -0,0 +1,5 @@
+ALTER TABLE `{{ index .Options "Namespace" }}sessions`
+DROP KEY `sessions_instance_id_saml_name_id_idx`,
+DROP `saml_session_index`,
+DROP `saml_name_id`,
+DROP `saml_connection_id`;
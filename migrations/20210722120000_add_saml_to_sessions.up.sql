@@ -0,0 +1,5 @@
+ALTER TABLE `{{ index .Options "Namespace" }}sessions`
+ADD `saml_connection_id` varchar(255) DEFAULT NULL AFTER `refreshed_at`,
+ADD `saml_name_id` varchar(255) NOT NULL DEFAULT '' AFTER `saml_connection_id`,
+ADD `saml_session_index` varchar(255) NOT NULL DEFAULT '' AFTER `saml_name_id`,
+ADD KEY `sessions_instance_id_saml_name_id_idx` (`instance_id`,`saml_name_id`);
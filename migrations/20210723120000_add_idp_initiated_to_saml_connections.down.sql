@@ -0,0 +1,3 @@
+ALTER TABLE `{{ index .Options "Namespace" }}saml_connections`
+DROP `default_redirect_url`,
+DROP `idp_initiated`;
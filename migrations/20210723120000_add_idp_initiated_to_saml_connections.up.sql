@@ -0,0 +1,3 @@
+ALTER TABLE `{{ index .Options "Namespace" }}saml_connections`
+ADD `idp_initiated` tinyint(1) NOT NULL DEFAULT 0 AFTER `domains`,
+ADD `default_redirect_url` varchar(2048) NOT NULL DEFAULT '' AFTER `idp_initiated`;
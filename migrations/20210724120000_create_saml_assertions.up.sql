@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS `{{ index .Options "Namespace" }}saml_assertions` (
+  `instance_id` varchar(255) DEFAULT NULL,
+  `id` varchar(255) NOT NULL,
+  `connection_id` varchar(255) NOT NULL,
+  `assertion_id` varchar(255) NOT NULL,
+  `expires_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `saml_assertions_instance_id_connection_id_assertion_id_idx` (`instance_id`,`connection_id`,`assertion_id`),
+  KEY `saml_assertions_expires_at_idx` (`expires_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
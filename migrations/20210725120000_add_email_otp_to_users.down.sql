@@ -0,0 +1,4 @@
+ALTER TABLE `{{ index .Options "Namespace" }}users`
+DROP `email_otp_attempts`,
+DROP `email_otp_sent_at`,
+DROP `email_otp_hash`;
@@ -0,0 +1,4 @@
+ALTER TABLE `{{ index .Options "Namespace" }}users`
+ADD `email_otp_hash` varchar(255) NOT NULL DEFAULT '' AFTER `recovery_sent_at`,
+ADD `email_otp_sent_at` timestamp NULL DEFAULT NULL AFTER `email_otp_hash`,
+ADD `email_otp_attempts` int NOT NULL DEFAULT 0 AFTER `email_otp_sent_at`;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS `{{ index .Options "Namespace" }}webauthn_credentials` (
+  `instance_id` varchar(255) DEFAULT NULL,
+  `id` varchar(255) NOT NULL,
+  `user_id` varchar(255) NOT NULL,
+  `credential_id` varchar(1400) NOT NULL,
+  `public_key` blob NOT NULL,
+  `sign_count` bigint(20) NOT NULL DEFAULT 0,
+  `aaguid` varchar(255) NOT NULL DEFAULT '',
+  `name` varchar(255) NOT NULL DEFAULT '',
+  `last_used_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NULL DEFAULT NULL,
+  `updated_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `webauthn_credentials_instance_id_credential_id_idx` (`instance_id`,`credential_id`(255)),
+  KEY `webauthn_credentials_instance_id_user_id_idx` (`instance_id`,`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS `{{ index .Options "Namespace" }}webauthn_sessions` (
+  `instance_id` varchar(255) DEFAULT NULL,
+  `id` varchar(255) NOT NULL,
+  `user_id` varchar(255) DEFAULT NULL,
+  `challenge` varchar(255) NOT NULL,
+  `type` varchar(255) NOT NULL,
+  `expires_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `webauthn_sessions_expires_at_idx` (`expires_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
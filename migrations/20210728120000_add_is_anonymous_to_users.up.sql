@@ -0,0 +1,2 @@
+ALTER TABLE `{{ index .Options "Namespace" }}users`
+ADD `is_anonymous` tinyint(1) NOT NULL DEFAULT 0 AFTER `is_super_admin`;
@@ -0,0 +1,3 @@
+ALTER TABLE `{{ index .Options "Namespace" }}totp_auth`
+DROP `last_attempt_at`,
+DROP `failed_attempts`;
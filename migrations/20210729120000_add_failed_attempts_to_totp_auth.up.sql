@@ -0,0 +1,3 @@
+ALTER TABLE `{{ index .Options "Namespace" }}totp_auth`
+ADD `failed_attempts` int NOT NULL DEFAULT 0 AFTER `otp_last_requested_at`,
+ADD `last_attempt_at` timestamp NULL DEFAULT NULL AFTER `failed_attempts`;
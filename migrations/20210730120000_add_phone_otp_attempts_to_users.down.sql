@@ -0,0 +1,2 @@
+ALTER TABLE `{{ index .Options "Namespace" }}users`
+DROP `phone_otp_attempts`;
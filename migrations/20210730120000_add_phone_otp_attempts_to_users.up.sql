@@ -0,0 +1,2 @@
+ALTER TABLE `{{ index .Options "Namespace" }}users`
+ADD `phone_otp_attempts` int NOT NULL DEFAULT 0 AFTER `phone_confirmed_at`;
@@ -0,0 +1,4 @@
+ALTER TABLE `{{ index .Options "Namespace" }}users`
+DROP KEY `users_instance_id_phone_key`,
+DROP `phone_key`,
+MODIFY `phone` varchar(15) NULL DEFAULT NULL;
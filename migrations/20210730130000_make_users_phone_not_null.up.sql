@@ -0,0 +1,8 @@
+UPDATE `{{ index .Options "Namespace" }}users` SET `phone` = '' WHERE `phone` IS NULL;
+
+-- Empty phones are NULL in `phone_key`, so only non-empty phones have to be
+-- unique per instance
+ALTER TABLE `{{ index .Options "Namespace" }}users`
+MODIFY `phone` varchar(15) NOT NULL DEFAULT '',
+ADD `phone_key` varchar(15) AS (NULLIF(`phone`, '')) VIRTUAL AFTER `phone`,
+ADD UNIQUE KEY `users_instance_id_phone_key` (`instance_id`,`phone_key`);
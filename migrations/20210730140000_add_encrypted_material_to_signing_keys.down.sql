@@ -0,0 +1,2 @@
+ALTER TABLE `{{ index .Options "Namespace" }}signing_keys`
+DROP `encrypted_material`;
@@ -0,0 +1,2 @@
+ALTER TABLE `{{ index .Options "Namespace" }}signing_keys`
+ADD `encrypted_material` blob NULL AFTER `material`;
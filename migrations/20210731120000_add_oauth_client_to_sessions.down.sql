@@ -0,0 +1,4 @@
+ALTER TABLE `{{ index .Options "Namespace" }}sessions`
+DROP KEY `sessions_instance_id_oauth_client_id_idx`,
+DROP `scope`,
+DROP `oauth_client_id`;
@@ -0,0 +1,4 @@
+ALTER TABLE `{{ index .Options "Namespace" }}sessions`
+ADD `oauth_client_id` varchar(255) NOT NULL DEFAULT '' AFTER `saml_session_index`,
+ADD `scope` varchar(255) NOT NULL DEFAULT '' AFTER `oauth_client_id`,
+ADD KEY `sessions_instance_id_oauth_client_id_idx` (`instance_id`,`oauth_client_id`);
@@ -0,0 +1,3 @@
+ALTER TABLE `{{ index .Options "Namespace" }}flow_state`
+DROP `encrypted_provider_token`,
+ADD `provider_token` text DEFAULT NULL AFTER `authentication_method`;
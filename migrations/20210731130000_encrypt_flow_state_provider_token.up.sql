@@ -0,0 +1,5 @@
+-- Flow states only live until the code is exchanged, so unencrypted provider
+-- tokens are dropped instead of being encrypted
+ALTER TABLE `{{ index .Options "Namespace" }}flow_state`
+DROP `provider_token`,
+ADD `encrypted_provider_token` blob DEFAULT NULL AFTER `authentication_method`;
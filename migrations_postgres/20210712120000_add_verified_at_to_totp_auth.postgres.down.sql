@@ -0,0 +1,4 @@
+-- Remove verified_at column from auth.totp_auth
+
+ALTER TABLE auth.totp_auth
+DROP COLUMN verified_at;
@@ -0,0 +1,4 @@
+-- Add verified_at column to auth.totp_auth
+
+ALTER TABLE auth.totp_auth
+ADD COLUMN verified_at timestamptz NULL;
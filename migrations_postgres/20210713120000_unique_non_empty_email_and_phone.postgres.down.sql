@@ -0,0 +1,8 @@
+-- Only enforce uniqueness of non-empty emails and phones, so users
+-- can sign up with either one of them
+
+DROP INDEX IF EXISTS auth.users_email_key;
+DROP INDEX IF EXISTS auth.users_phone_key;
+ALTER TABLE auth.users
+ADD CONSTRAINT users_email_key UNIQUE (email),
+ADD CONSTRAINT users_phone_key UNIQUE (phone);
@@ -0,0 +1,8 @@
+-- Only enforce uniqueness of non-empty emails and phones, so users
+-- can sign up with either one of them
+
+ALTER TABLE auth.users
+DROP CONSTRAINT IF EXISTS users_email_key,
+DROP CONSTRAINT IF EXISTS users_phone_key;
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON auth.users (email) WHERE email <> '';
+CREATE UNIQUE INDEX IF NOT EXISTS users_phone_key ON auth.users (phone) WHERE phone <> '';
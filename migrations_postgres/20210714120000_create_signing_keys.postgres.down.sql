@@ -0,0 +1 @@
+DROP TABLE IF EXISTS auth.signing_keys CASCADE;
@@ -0,0 +1,17 @@
+-- auth.signing_keys definition
+
+CREATE TABLE IF NOT EXISTS auth.signing_keys(
+    instance_id uuid NULL,
+    id bigserial NOT NULL,
+    kid varchar(255) NOT NULL DEFAULT '',
+    algorithm varchar(10) NOT NULL,
+    material text NOT NULL,
+    status varchar(20) NOT NULL,
+    expires_at timestamptz NULL,
+    created_at timestamptz NULL,
+    updated_at timestamptz NULL,
+    CONSTRAINT signing_keys_pkey PRIMARY KEY (id),
+    CONSTRAINT signing_keys_instance_id_kid_key UNIQUE (instance_id, kid)
+);
+CREATE INDEX signing_keys_instance_id_idx ON auth.signing_keys USING btree (instance_id);
+comment on table auth.signing_keys is 'Auth: Store of keys used to sign and verify JWTs.';
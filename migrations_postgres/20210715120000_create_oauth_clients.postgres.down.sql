@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS auth.oauth_authorization_codes CASCADE;
+DROP TABLE IF EXISTS auth.oauth_clients CASCADE;
@@ -0,0 +1,36 @@
+-- auth.oauth_clients definition
+
+CREATE TABLE IF NOT EXISTS auth.oauth_clients(
+    instance_id uuid NULL,
+    id uuid NOT NULL,
+    client_id varchar(255) NOT NULL,
+    encrypted_client_secret varchar(255) NOT NULL,
+    name varchar(255) NOT NULL DEFAULT '',
+    redirect_uris text NOT NULL,
+    created_at timestamptz NULL,
+    updated_at timestamptz NULL,
+    CONSTRAINT oauth_clients_pkey PRIMARY KEY (id),
+    CONSTRAINT oauth_clients_instance_id_client_id_key UNIQUE (instance_id, client_id)
+);
+CREATE INDEX oauth_clients_instance_id_idx ON auth.oauth_clients USING btree (instance_id);
+comment on table auth.oauth_clients is 'Auth: Applications that sign users in with GoTrue as their OAuth2 authorization server.';
+
+-- auth.oauth_authorization_codes definition
+
+CREATE TABLE IF NOT EXISTS auth.oauth_authorization_codes(
+    instance_id uuid NULL,
+    id bigserial NOT NULL,
+    client_id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    code_hash varchar(64) NOT NULL,
+    redirect_uri text NOT NULL,
+    scope varchar(255) NOT NULL DEFAULT '',
+    nonce varchar(255) NOT NULL DEFAULT '',
+    expires_at timestamptz NULL,
+    created_at timestamptz NULL,
+    updated_at timestamptz NULL,
+    CONSTRAINT oauth_authorization_codes_pkey PRIMARY KEY (id),
+    CONSTRAINT oauth_authorization_codes_code_hash_key UNIQUE (code_hash)
+);
+CREATE INDEX oauth_authorization_codes_instance_id_idx ON auth.oauth_authorization_codes USING btree (instance_id);
+comment on table auth.oauth_authorization_codes is 'Auth: Authorization codes issued to OAuth clients.';
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS auth.flow_state CASCADE;
@@ -0,0 +1,20 @@
+-- auth.flow_state definition
+
+CREATE TABLE IF NOT EXISTS auth.flow_state(
+    instance_id uuid NULL,
+    id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    code_challenge varchar(128) NOT NULL,
+    code_challenge_method varchar(10) NOT NULL,
+    authentication_method varchar(50) NOT NULL,
+    provider_token text NULL,
+    nonce varchar(255) NOT NULL DEFAULT '',
+    auth_code_hash varchar(64) NOT NULL DEFAULT '',
+    auth_code_issued_at timestamptz NULL,
+    created_at timestamptz NULL,
+    updated_at timestamptz NULL,
+    CONSTRAINT flow_state_pkey PRIMARY KEY (id)
+);
+CREATE INDEX flow_state_instance_id_auth_code_hash_idx ON auth.flow_state USING btree (instance_id, auth_code_hash);
+CREATE INDEX flow_state_instance_id_user_id_idx ON auth.flow_state USING btree (instance_id, user_id);
+comment on table auth.flow_state is 'Auth: Stores PKCE logins until the auth code is exchanged for tokens.';
@@ -0,0 +1,5 @@
+-- Remove parent, family_id columns from auth.refresh_tokens
+
+ALTER TABLE auth.refresh_tokens
+DROP COLUMN family_id,
+DROP COLUMN parent;
@@ -0,0 +1,7 @@
+-- Add parent, family_id columns to auth.refresh_tokens
+
+ALTER TABLE auth.refresh_tokens
+ADD COLUMN parent varchar(255) NOT NULL DEFAULT '',
+ADD COLUMN family_id int8 NOT NULL DEFAULT 0;
+CREATE INDEX refresh_tokens_parent_idx ON auth.refresh_tokens USING btree (parent);
+CREATE INDEX refresh_tokens_instance_id_family_id_idx ON auth.refresh_tokens USING btree (instance_id, family_id);
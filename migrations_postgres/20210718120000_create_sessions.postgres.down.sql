@@ -0,0 +1,4 @@
+ALTER TABLE auth.refresh_tokens
+DROP COLUMN session_id;
+
+DROP TABLE IF EXISTS auth.sessions CASCADE;
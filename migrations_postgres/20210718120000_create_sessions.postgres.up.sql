@@ -0,0 +1,19 @@
+-- auth.sessions definition
+
+CREATE TABLE IF NOT EXISTS auth.sessions(
+    instance_id uuid NULL,
+    id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    user_agent text NULL,
+    ip varchar(255) NOT NULL DEFAULT '',
+    refreshed_at timestamptz NULL,
+    created_at timestamptz NULL,
+    updated_at timestamptz NULL,
+    CONSTRAINT sessions_pkey PRIMARY KEY (id)
+);
+CREATE INDEX sessions_instance_id_user_id_idx ON auth.sessions USING btree (instance_id, user_id);
+comment on table auth.sessions is 'Auth: Stores the signed in devices of a user.';
+
+ALTER TABLE auth.refresh_tokens
+ADD COLUMN session_id uuid NULL;
+CREATE INDEX refresh_tokens_instance_id_session_id_idx ON auth.refresh_tokens USING btree (instance_id, session_id);
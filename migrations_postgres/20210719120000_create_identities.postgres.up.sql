@@ -0,0 +1,17 @@
+-- auth.identities definition
+
+CREATE TABLE IF NOT EXISTS auth.identities(
+    instance_id uuid NULL,
+    id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    provider varchar(255) NOT NULL,
+    provider_id varchar(255) NOT NULL,
+    identity_data jsonb NULL,
+    last_sign_in_at timestamptz NULL,
+    created_at timestamptz NULL,
+    updated_at timestamptz NULL,
+    CONSTRAINT identities_pkey PRIMARY KEY (id),
+    CONSTRAINT identities_instance_id_provider_provider_id_key UNIQUE (instance_id, provider, provider_id)
+);
+CREATE INDEX identities_instance_id_user_id_idx ON auth.identities USING btree (instance_id, user_id);
+comment on table auth.identities is 'Auth: Stores the external provider accounts linked to a user.';
@@ -0,0 +1,4 @@
+ALTER TABLE auth.identities
+DROP COLUMN provider_token_expires_at,
+DROP COLUMN encrypted_provider_refresh_token,
+DROP COLUMN encrypted_provider_token;
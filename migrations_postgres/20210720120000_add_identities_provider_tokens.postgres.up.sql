@@ -0,0 +1,4 @@
+ALTER TABLE auth.identities
+ADD COLUMN encrypted_provider_token bytea NULL,
+ADD COLUMN encrypted_provider_refresh_token bytea NULL,
+ADD COLUMN provider_token_expires_at timestamptz NULL;
@@ -0,0 +1,16 @@
+-- auth.saml_connections definition
+
+CREATE TABLE IF NOT EXISTS auth.saml_connections(
+    instance_id uuid NULL,
+    id uuid NOT NULL,
+    name varchar(255) NOT NULL DEFAULT '',
+    metadata_url text NULL,
+    metadata_xml text NULL,
+    attribute_mapping jsonb NULL,
+    domains text NOT NULL,
+    created_at timestamptz NULL,
+    updated_at timestamptz NULL,
+    CONSTRAINT saml_connections_pkey PRIMARY KEY (id)
+);
+CREATE INDEX saml_connections_instance_id_idx ON auth.saml_connections USING btree (instance_id);
+comment on table auth.saml_connections is 'Auth: Stores the SAML identity providers of organizations.';
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS auth.sessions_instance_id_saml_name_id_idx;
+ALTER TABLE auth.sessions
+DROP COLUMN saml_session_index,
+DROP COLUMN saml_name_id,
+DROP COLUMN saml_connection_id;
@@ -0,0 +1,5 @@
+ALTER TABLE auth.sessions
+ADD COLUMN saml_connection_id uuid NULL,
+ADD COLUMN saml_name_id varchar(255) NOT NULL DEFAULT '',
+ADD COLUMN saml_session_index varchar(255) NOT NULL DEFAULT '';
+CREATE INDEX sessions_instance_id_saml_name_id_idx ON auth.sessions USING btree (instance_id, saml_name_id);
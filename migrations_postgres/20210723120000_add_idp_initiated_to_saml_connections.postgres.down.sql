@@ -0,0 +1,3 @@
+ALTER TABLE auth.saml_connections
+DROP COLUMN default_redirect_url,
+DROP COLUMN idp_initiated;
@@ -0,0 +1,3 @@
+ALTER TABLE auth.saml_connections
+ADD COLUMN idp_initiated boolean NOT NULL DEFAULT false,
+ADD COLUMN default_redirect_url varchar(2048) NOT NULL DEFAULT '';
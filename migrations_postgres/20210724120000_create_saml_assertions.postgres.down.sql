@@ -0,0 +1 @@
+DROP TABLE IF EXISTS auth.saml_assertions CASCADE;
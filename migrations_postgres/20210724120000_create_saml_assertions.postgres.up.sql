@@ -0,0 +1,14 @@
+-- auth.saml_assertions definition
+
+CREATE TABLE IF NOT EXISTS auth.saml_assertions(
+    instance_id uuid NULL,
+    id uuid NOT NULL,
+    connection_id uuid NOT NULL,
+    assertion_id varchar(255) NOT NULL,
+    expires_at timestamptz NULL,
+    created_at timestamptz NULL,
+    CONSTRAINT saml_assertions_pkey PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX saml_assertions_instance_id_connection_id_assertion_id_idx ON auth.saml_assertions USING btree (instance_id, connection_id, assertion_id);
+CREATE INDEX saml_assertions_expires_at_idx ON auth.saml_assertions USING btree (expires_at);
+comment on table auth.saml_assertions is 'Auth: Stores the ids of unsolicited SAML assertions until they expire, so they can''t be replayed.';
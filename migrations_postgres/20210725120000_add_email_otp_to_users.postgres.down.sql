@@ -0,0 +1,4 @@
+ALTER TABLE auth.users
+DROP COLUMN email_otp_attempts,
+DROP COLUMN email_otp_sent_at,
+DROP COLUMN email_otp_hash;
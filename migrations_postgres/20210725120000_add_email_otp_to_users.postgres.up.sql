@@ -0,0 +1,4 @@
+ALTER TABLE auth.users
+ADD COLUMN email_otp_hash varchar(255) NOT NULL DEFAULT '',
+ADD COLUMN email_otp_sent_at timestamptz NULL,
+ADD COLUMN email_otp_attempts integer NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS auth.webauthn_credentials CASCADE;
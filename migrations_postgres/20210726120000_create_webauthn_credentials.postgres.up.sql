@@ -0,0 +1,19 @@
+-- auth.webauthn_credentials definition
+
+CREATE TABLE IF NOT EXISTS auth.webauthn_credentials(
+    instance_id uuid NULL,
+    id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    credential_id text NOT NULL,
+    public_key bytea NOT NULL,
+    sign_count bigint NOT NULL DEFAULT 0,
+    aaguid varchar(255) NOT NULL DEFAULT '',
+    name varchar(255) NOT NULL DEFAULT '',
+    last_used_at timestamptz NULL,
+    created_at timestamptz NULL,
+    updated_at timestamptz NULL,
+    CONSTRAINT webauthn_credentials_pkey PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX webauthn_credentials_instance_id_credential_id_idx ON auth.webauthn_credentials USING btree (instance_id, credential_id);
+CREATE INDEX webauthn_credentials_instance_id_user_id_idx ON auth.webauthn_credentials USING btree (instance_id, user_id);
+comment on table auth.webauthn_credentials is 'Auth: Stores the public keys of the passkeys and security keys users registered.';
@@ -0,0 +1,14 @@
+-- auth.webauthn_sessions definition
+
+CREATE TABLE IF NOT EXISTS auth.webauthn_sessions(
+    instance_id uuid NULL,
+    id uuid NOT NULL,
+    user_id uuid NULL,
+    challenge varchar(255) NOT NULL,
+    type varchar(255) NOT NULL,
+    expires_at timestamptz NULL,
+    created_at timestamptz NULL,
+    CONSTRAINT webauthn_sessions_pkey PRIMARY KEY (id)
+);
+CREATE INDEX webauthn_sessions_expires_at_idx ON auth.webauthn_sessions USING btree (expires_at);
+comment on table auth.webauthn_sessions is 'Auth: Stores the challenges of WebAuthn registrations and logins in progress until they are answered.';
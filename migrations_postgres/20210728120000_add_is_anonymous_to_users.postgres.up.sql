@@ -0,0 +1,2 @@
+ALTER TABLE auth.users
+ADD COLUMN is_anonymous boolean NOT NULL DEFAULT false;
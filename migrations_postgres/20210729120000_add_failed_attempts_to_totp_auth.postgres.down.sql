@@ -0,0 +1,3 @@
+ALTER TABLE auth.totp_auth
+DROP COLUMN last_attempt_at,
+DROP COLUMN failed_attempts;
@@ -0,0 +1,3 @@
+ALTER TABLE auth.totp_auth
+ADD COLUMN failed_attempts integer NOT NULL DEFAULT 0,
+ADD COLUMN last_attempt_at timestamptz NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE auth.users
+DROP COLUMN phone_otp_attempts;
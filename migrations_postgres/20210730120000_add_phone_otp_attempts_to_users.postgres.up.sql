@@ -0,0 +1,2 @@
+ALTER TABLE auth.users
+ADD COLUMN phone_otp_attempts integer NOT NULL DEFAULT 0;
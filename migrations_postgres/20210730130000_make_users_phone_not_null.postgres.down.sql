@@ -0,0 +1,3 @@
+ALTER TABLE auth.users
+ALTER COLUMN phone DROP NOT NULL,
+ALTER COLUMN phone DROP DEFAULT;
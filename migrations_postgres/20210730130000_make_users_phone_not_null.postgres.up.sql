@@ -0,0 +1,6 @@
+-- Phones are scanned into strings, so users without a phone store an empty one
+
+UPDATE auth.users SET phone = '' WHERE phone IS NULL;
+ALTER TABLE auth.users
+ALTER COLUMN phone SET DEFAULT '',
+ALTER COLUMN phone SET NOT NULL;
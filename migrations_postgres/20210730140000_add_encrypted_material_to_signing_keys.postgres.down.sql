@@ -0,0 +1,3 @@
+ALTER TABLE auth.signing_keys
+DROP COLUMN encrypted_material,
+ALTER COLUMN material DROP DEFAULT;
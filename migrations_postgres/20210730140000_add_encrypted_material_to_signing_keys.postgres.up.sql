@@ -0,0 +1,6 @@
+-- Keys stored before keys were encrypted keep their material until they
+-- are loaded and encrypted
+
+ALTER TABLE auth.signing_keys
+ADD COLUMN encrypted_material bytea NULL,
+ALTER COLUMN material SET DEFAULT '';
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS auth.sessions_instance_id_oauth_client_id_idx;
+ALTER TABLE auth.sessions
+DROP COLUMN scope,
+DROP COLUMN oauth_client_id;
@@ -0,0 +1,4 @@
+ALTER TABLE auth.sessions
+ADD COLUMN oauth_client_id varchar(255) NOT NULL DEFAULT '',
+ADD COLUMN scope varchar(255) NOT NULL DEFAULT '';
+CREATE INDEX sessions_instance_id_oauth_client_id_idx ON auth.sessions USING btree (instance_id, oauth_client_id);
@@ -0,0 +1,3 @@
+ALTER TABLE auth.flow_state
+DROP COLUMN encrypted_provider_token,
+ADD COLUMN provider_token text NULL;
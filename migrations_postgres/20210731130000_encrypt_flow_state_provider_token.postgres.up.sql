@@ -0,0 +1,6 @@
+-- Flow states only live until the code is exchanged, so unencrypted provider
+-- tokens are dropped instead of being encrypted
+
+ALTER TABLE auth.flow_state
+DROP COLUMN provider_token,
+ADD COLUMN encrypted_provider_token bytea NULL;
@@ -25,6 +25,25 @@ const (
 	UserRecoveryRequestedAction AuditAction = "user_recovery_requested"
 	TokenRevokedAction          AuditAction = "token_revoked"
 	TokenRefreshedAction        AuditAction = "token_refreshed"
+	TokenReuseDetectedAction    AuditAction = "token_reuse_detected"
+	FactorEnrolledAction        AuditAction = "factor_enrolled"
+	FactorVerifiedAction        AuditAction = "factor_verified"
+	FactorUnenrolledAction      AuditAction = "factor_unenrolled"
+	SigningKeyRotatedAction     AuditAction = "signing_key_rotated"
+	SigningKeyRetiredAction     AuditAction = "signing_key_retired"
+	OAuthClientCreatedAction    AuditAction = "oauth_client_created"
+	OAuthClientUpdatedAction    AuditAction = "oauth_client_updated"
+	OAuthClientDeletedAction    AuditAction = "oauth_client_deleted"
+	OAuthClientAuthorizedAction AuditAction = "oauth_client_authorized"
+	SessionRevokedAction        AuditAction = "session_revoked"
+	SessionExpiredAction        AuditAction = "session_expired"
+	IdentityLinkedAction        AuditAction = "identity_linked"
+	IdentityUnlinkedAction      AuditAction = "identity_unlinked"
+	SAMLConnectionCreatedAction AuditAction = "saml_connection_created"
+	SAMLConnectionUpdatedAction AuditAction = "saml_connection_updated"
+	SAMLConnectionDeletedAction AuditAction = "saml_connection_deleted"
+	WebAuthnRegisteredAction    AuditAction = "webauthn_registered"
+	WebAuthnDeletedAction       AuditAction = "webauthn_deleted"
 
 	account auditLogType = "account"
 	team    auditLogType = "team"
@@ -41,8 +60,27 @@ var actionLogTypeMap = map[AuditAction]auditLogType{
 	UserDeletedAction:           team,
 	TokenRevokedAction:          token,
 	TokenRefreshedAction:        token,
+	TokenReuseDetectedAction:    token,
+	SessionExpiredAction:        token,
+	SigningKeyRotatedAction:     token,
+	SigningKeyRetiredAction:     token,
+	OAuthClientCreatedAction:    team,
+	OAuthClientUpdatedAction:    team,
+	OAuthClientDeletedAction:    team,
+	SAMLConnectionCreatedAction: team,
+	SAMLConnectionUpdatedAction: team,
+	SAMLConnectionDeletedAction: team,
+	OAuthClientAuthorizedAction: account,
+	SessionRevokedAction:        account,
 	UserModifiedAction:          user,
 	UserRecoveryRequestedAction: user,
+	FactorEnrolledAction:        user,
+	FactorVerifiedAction:        user,
+	FactorUnenrolledAction:      user,
+	IdentityLinkedAction:        user,
+	IdentityUnlinkedAction:      user,
+	WebAuthnRegisteredAction:    user,
+	WebAuthnDeletedAction:       user,
 }
 
 // AuditLogEntry is the database model for audit log entries.
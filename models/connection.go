@@ -41,6 +41,39 @@ func TruncateAll(conn *storage.Connection) error {
 		if err := tx.RawQuery("TRUNCATE " + (&pop.Model{Value: AuditLogEntry{}}).TableName()).Exec(); err != nil {
 			return err
 		}
+		if err := tx.RawQuery("TRUNCATE " + (&pop.Model{Value: TOTPFactor{}}).TableName()).Exec(); err != nil {
+			return err
+		}
+		if err := tx.RawQuery("TRUNCATE " + (&pop.Model{Value: SigningKey{}}).TableName()).Exec(); err != nil {
+			return err
+		}
+		if err := tx.RawQuery("TRUNCATE " + (&pop.Model{Value: OAuthClient{}}).TableName()).Exec(); err != nil {
+			return err
+		}
+		if err := tx.RawQuery("TRUNCATE " + (&pop.Model{Value: OAuthAuthorizationCode{}}).TableName()).Exec(); err != nil {
+			return err
+		}
+		if err := tx.RawQuery("TRUNCATE " + (&pop.Model{Value: FlowState{}}).TableName()).Exec(); err != nil {
+			return err
+		}
+		if err := tx.RawQuery("TRUNCATE " + (&pop.Model{Value: Session{}}).TableName()).Exec(); err != nil {
+			return err
+		}
+		if err := tx.RawQuery("TRUNCATE " + (&pop.Model{Value: Identity{}}).TableName()).Exec(); err != nil {
+			return err
+		}
+		if err := tx.RawQuery("TRUNCATE " + (&pop.Model{Value: SAMLConnection{}}).TableName()).Exec(); err != nil {
+			return err
+		}
+		if err := tx.RawQuery("TRUNCATE " + (&pop.Model{Value: SAMLAssertion{}}).TableName()).Exec(); err != nil {
+			return err
+		}
+		if err := tx.RawQuery("TRUNCATE " + (&pop.Model{Value: WebAuthnCredential{}}).TableName()).Exec(); err != nil {
+			return err
+		}
+		if err := tx.RawQuery("TRUNCATE " + (&pop.Model{Value: WebAuthnSession{}}).TableName()).Exec(); err != nil {
+			return err
+		}
 		return tx.RawQuery("TRUNCATE " + (&pop.Model{Value: Instance{}}).TableName()).Exec()
 	})
 }
@@ -14,9 +14,20 @@ func TestTableNameNamespacing(t *testing.T) {
 		value    interface{}
 	}{
 		{expected: "test_audit_log_entries", value: []*models.AuditLogEntry{}},
+		{expected: "test_flow_state", value: []*models.FlowState{}},
+		{expected: "test_identities", value: []*models.Identity{}},
 		{expected: "test_instances", value: []*models.Instance{}},
+		{expected: "test_oauth_authorization_codes", value: []*models.OAuthAuthorizationCode{}},
+		{expected: "test_oauth_clients", value: []*models.OAuthClient{}},
 		{expected: "test_refresh_tokens", value: []*models.RefreshToken{}},
+		{expected: "test_saml_assertions", value: []*models.SAMLAssertion{}},
+		{expected: "test_saml_connections", value: []*models.SAMLConnection{}},
+		{expected: "test_sessions", value: []*models.Session{}},
+		{expected: "test_signing_keys", value: []*models.SigningKey{}},
+		{expected: "test_totp_auth", value: []*models.TOTPFactor{}},
 		{expected: "test_users", value: []*models.User{}},
+		{expected: "test_webauthn_credentials", value: []*models.WebAuthnCredential{}},
+		{expected: "test_webauthn_sessions", value: []*models.WebAuthnSession{}},
 	}
 
 	for _, tc := range cases {
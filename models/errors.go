@@ -11,6 +11,26 @@ func IsNotFoundError(err error) bool {
 		return true
 	case InstanceNotFoundError:
 		return true
+	case TOTPFactorNotFoundError:
+		return true
+	case SigningKeyNotFoundError:
+		return true
+	case OAuthClientNotFoundError:
+		return true
+	case AuthorizationCodeNotFoundError:
+		return true
+	case FlowStateNotFoundError:
+		return true
+	case SessionNotFoundError:
+		return true
+	case IdentityNotFoundError:
+		return true
+	case SAMLConnectionNotFoundError:
+		return true
+	case WebAuthnCredentialNotFoundError:
+		return true
+	case WebAuthnSessionNotFoundError:
+		return true
 	}
 	return false
 }
@@ -36,9 +56,123 @@ func (e RefreshTokenNotFoundError) Error() string {
 	return "Refresh Token not found"
 }
 
+// RefreshTokenRevokedError represents when a refresh token was revoked by
+// a concurrent request.
+type RefreshTokenRevokedError struct{}
+
+func (e RefreshTokenRevokedError) Error() string {
+	return "Refresh Token already revoked"
+}
+
 // InstanceNotFoundError represents when an instance is not found.
 type InstanceNotFoundError struct{}
 
 func (e InstanceNotFoundError) Error() string {
 	return "Instance not found"
 }
+
+// TOTPFactorNotFoundError represents when a TOTP factor is not found.
+type TOTPFactorNotFoundError struct{}
+
+func (e TOTPFactorNotFoundError) Error() string {
+	return "TOTP factor not found"
+}
+
+// TOTPFactorLockedError represents when a TOTP factor is locked after too
+// many failed attempts.
+type TOTPFactorLockedError struct{}
+
+func (e TOTPFactorLockedError) Error() string {
+	return "Too many failed attempts"
+}
+
+// SigningKeyNotFoundError represents when a signing key is not found.
+type SigningKeyNotFoundError struct{}
+
+func (e SigningKeyNotFoundError) Error() string {
+	return "Signing key not found"
+}
+
+// OAuthClientNotFoundError represents when an OAuth client is not found.
+type OAuthClientNotFoundError struct{}
+
+func (e OAuthClientNotFoundError) Error() string {
+	return "OAuth client not found"
+}
+
+// AuthorizationCodeNotFoundError represents when an authorization code is not found.
+type AuthorizationCodeNotFoundError struct{}
+
+func (e AuthorizationCodeNotFoundError) Error() string {
+	return "Authorization code not found"
+}
+
+// FlowStateNotFoundError represents when a PKCE flow state is not found.
+type FlowStateNotFoundError struct{}
+
+func (e FlowStateNotFoundError) Error() string {
+	return "Flow state not found"
+}
+
+// SessionNotFoundError represents when a session is not found.
+type SessionNotFoundError struct{}
+
+func (e SessionNotFoundError) Error() string {
+	return "Session not found"
+}
+
+// IdentityNotFoundError represents when an identity is not found.
+type IdentityNotFoundError struct{}
+
+func (e IdentityNotFoundError) Error() string {
+	return "Identity not found"
+}
+
+// SAMLConnectionNotFoundError represents when a SAML connection is not found.
+type SAMLConnectionNotFoundError struct{}
+
+func (e SAMLConnectionNotFoundError) Error() string {
+	return "SAML connection not found"
+}
+
+// SAMLAssertionReplayedError represents when an unsolicited SAML assertion
+// is used again.
+type SAMLAssertionReplayedError struct{}
+
+func (e SAMLAssertionReplayedError) Error() string {
+	return "SAML assertion was already used"
+}
+
+// WebAuthnCredentialNotFoundError represents when a WebAuthn credential is
+// not found.
+type WebAuthnCredentialNotFoundError struct{}
+
+func (e WebAuthnCredentialNotFoundError) Error() string {
+	return "WebAuthn credential not found"
+}
+
+// WebAuthnCredentialClonedError represents when the signature counter of a
+// WebAuthn credential didn't increase.
+type WebAuthnCredentialClonedError struct{}
+
+func (e WebAuthnCredentialClonedError) Error() string {
+	return "WebAuthn credential may have been cloned"
+}
+
+// WebAuthnSessionNotFoundError represents when a WebAuthn session is not
+// found.
+type WebAuthnSessionNotFoundError struct{}
+
+func (e WebAuthnSessionNotFoundError) Error() string {
+	return "WebAuthn session not found"
+}
+
+// SessionExpiredError represents when the session of a refresh token
+// exceeded one of its timeouts.
+type SessionExpiredError struct {
+	Reason string
+}
+
+func (e SessionExpiredError) Error() string {
+	return "Session expired: " + e.Reason
+}
@@ -0,0 +1,212 @@
+package models
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop/v5"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/storage"
+	"github.com/netlify/gotrue/storage/namespace"
+	"github.com/pkg/errors"
+)
+
+const (
+	CodeChallengeMethodS256  = "s256"
+	CodeChallengeMethodPlain = "plain"
+)
+
+// code challenges and verifiers are 43 to 128 unreserved characters (RFC 7636)
+var codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// FlowState is the database model for a PKCE login in progress. It holds
+// the code challenge of the client and, once the user is authenticated, the
+// hash of the auth code that is exchanged for tokens.
+type FlowState struct {
+	InstanceID uuid.UUID `json:"-" db:"instance_id"`
+	ID         uuid.UUID `json:"id" db:"id"`
+
+	UserID uuid.UUID `json:"-" db:"user_id"`
+
+	CodeChallenge        string `json:"-" db:"code_challenge"`
+	CodeChallengeMethod  string `json:"-" db:"code_challenge_method"`
+	AuthenticationMethod string `json:"-" db:"authentication_method"`
+	Nonce                string `json:"-" db:"nonce"`
+
+	EncryptedProviderToken []byte `json:"-" db:"encrypted_provider_token"`
+
+	AuthCodeHash     string     `json:"-" db:"auth_code_hash"`
+	AuthCodeIssuedAt *time.Time `json:"-" db:"auth_code_issued_at"`
+
+	CreatedAt time.Time `json:"-" db:"created_at"`
+	UpdatedAt time.Time `json:"-" db:"updated_at"`
+}
+
+func (FlowState) TableName() string {
+	tableName := "flow_state"
+
+	if namespace.GetNamespace() != "" {
+		return namespace.GetNamespace() + "_" + tableName
+	}
+
+	return tableName
+}
+
+// ParseCodeChallengeMethod normalizes the code_challenge_method parameter,
+// which defaults to plain.
+func ParseCodeChallengeMethod(method string) (string, error) {
+	switch strings.ToLower(method) {
+	case CodeChallengeMethodS256:
+		return CodeChallengeMethodS256, nil
+	case CodeChallengeMethodPlain, "":
+		return CodeChallengeMethodPlain, nil
+	}
+	return "", fmt.Errorf("unsupported code challenge method: %s", method)
+}
+
+// ValidateCodeChallenge checks the format of a code challenge or verifier.
+func ValidateCodeChallenge(challenge string) error {
+	if !codeChallengePattern.MatchString(challenge) {
+		return errors.New("code challenge must be 43 to 128 characters of A-Z, a-z, 0-9, '-', '.', '_' or '~'")
+	}
+	return nil
+}
+
+// NewFlowState initializes a PKCE login of the user.
+func NewFlowState(user *User, codeChallenge, codeChallengeMethod, authenticationMethod string) (*FlowState, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating unique id")
+	}
+
+	return &FlowState{
+		InstanceID:           user.InstanceID,
+		ID:                   id,
+		UserID:               user.ID,
+		CodeChallenge:        codeChallenge,
+		CodeChallengeMethod:  codeChallengeMethod,
+		AuthenticationMethod: authenticationMethod,
+	}, nil
+}
+
+// SetProviderToken encrypts the token the external provider issued, it is
+// returned with the tokens of the PKCE grant.
+func (f *FlowState) SetProviderToken(encryptionKey, token string) error {
+	if token == "" {
+		f.EncryptedProviderToken = nil
+		return nil
+	}
+	encrypted, err := crypto.Encrypt(encryptionKey, []byte(token))
+	if err != nil {
+		return errors.Wrap(err, "error encrypting provider token")
+	}
+	f.EncryptedProviderToken = encrypted
+	return nil
+}
+
+// ProviderToken decrypts the token the external provider issued. It is
+// empty if none is stored.
+func (f *FlowState) ProviderToken(encryptionKey string) (string, error) {
+	if len(f.EncryptedProviderToken) == 0 {
+		return "", nil
+	}
+	decrypted, err := crypto.Decrypt(encryptionKey, f.EncryptedProviderToken)
+	if err != nil {
+		return "", errors.Wrap(err, "error decrypting provider token")
+	}
+	return string(decrypted), nil
+}
+
+// GenerateAuthCode sets a new auth code on the flow state, returning the
+// plain code.
+func (f *FlowState) GenerateAuthCode() string {
+	code := crypto.SecureToken()
+	now := time.Now()
+	f.AuthCodeHash = hashAuthorizationCode(code)
+	f.AuthCodeIssuedAt = &now
+	return code
+}
+
+// IssueAuthCode generates and stores an auth code for a stored flow state.
+func (f *FlowState) IssueAuthCode(tx *storage.Connection) (string, error) {
+	code := f.GenerateAuthCode()
+	return code, tx.UpdateOnly(f, "auth_code_hash", "auth_code_issued_at")
+}
+
+// IsAuthCodeExpired checks if the auth code was issued longer ago than expiry.
+func (f *FlowState) IsAuthCodeExpired(expiry time.Duration) bool {
+	return f.AuthCodeIssuedAt == nil || time.Now().After(f.AuthCodeIssuedAt.Add(expiry))
+}
+
+// VerifyCodeVerifier checks the code verifier against the code challenge.
+func (f *FlowState) VerifyCodeVerifier(verifier string) bool {
+	if ValidateCodeChallenge(verifier) != nil {
+		return false
+	}
+
+	challenge := verifier
+	if f.CodeChallengeMethod == CodeChallengeMethodS256 {
+		sum := sha256.Sum256([]byte(verifier))
+		challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(f.CodeChallenge)) == 1
+}
+
+// Consume deletes the flow state so its auth code can't be exchanged twice.
+// Of concurrent exchanges only one deletes the flow state, the others fail
+// with a FlowStateNotFoundError.
+func (f *FlowState) Consume(tx *storage.Connection) error {
+	count, err := tx.RawQuery("DELETE FROM "+f.TableName()+" WHERE id = ?", f.ID).ExecWithCount()
+	if err != nil {
+		return errors.Wrap(err, "error deleting flow state")
+	}
+	if count != 1 {
+		return FlowStateNotFoundError{}
+	}
+	return nil
+}
+
+// DeleteExpiredFlowStates removes the flow states whose auth code expired
+// and the ones that didn't get an auth code within maxAge.
+func DeleteExpiredFlowStates(tx *storage.Connection, authCodeExpiry, maxAge time.Duration) error {
+	now := time.Now()
+	if err := tx.RawQuery("DELETE FROM "+(&FlowState{}).TableName()+" WHERE auth_code_issued_at < ? OR created_at < ?", now.Add(-authCodeExpiry), now.Add(-maxAge)).Exec(); err != nil {
+		return errors.Wrap(err, "error deleting expired flow states")
+	}
+	return nil
+}
+
+// FindFlowStateByAuthCode finds a flow state by its plain auth code.
+func FindFlowStateByAuthCode(tx *storage.Connection, instanceID uuid.UUID, code string) (*FlowState, error) {
+	return findFlowState(tx.Q().Where("instance_id = ? and auth_code_hash = ?", instanceID, hashAuthorizationCode(code)))
+}
+
+// FindLatestFlowStateByUser finds the most recent flow state of the user
+// for an authentication method.
+func FindLatestFlowStateByUser(tx *storage.Connection, user *User, authenticationMethod string) (*FlowState, error) {
+	return findFlowState(tx.Q().Where("instance_id = ? and user_id = ? and authentication_method = ?", user.InstanceID, user.ID, authenticationMethod).Order("created_at desc"))
+}
+
+// DeleteFlowStatesByUser removes the flow states of the user for an
+// authentication method.
+func DeleteFlowStatesByUser(tx *storage.Connection, user *User, authenticationMethod string) error {
+	return tx.RawQuery("DELETE FROM "+(&pop.Model{Value: FlowState{}}).TableName()+" WHERE instance_id = ? AND user_id = ? AND authentication_method = ?", user.InstanceID, user.ID, authenticationMethod).Exec()
+}
+
+func findFlowState(q *pop.Query) (*FlowState, error) {
+	flowState := &FlowState{}
+	if err := q.First(flowState); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, FlowStateNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding flow state")
+	}
+	return flowState, nil
+}
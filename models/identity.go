@@ -0,0 +1,182 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/storage"
+	"github.com/netlify/gotrue/storage/namespace"
+	"github.com/pkg/errors"
+)
+
+// Identity is the database model for an external provider account linked to
+// a user. It is keyed by the provider and the stable id the provider uses
+// for the account, so changes to the account's email don't affect it.
+type Identity struct {
+	InstanceID uuid.UUID `json:"-" db:"instance_id"`
+	ID         uuid.UUID `json:"id" db:"id"`
+
+	UserID     uuid.UUID `json:"user_id" db:"user_id"`
+	Provider   string    `json:"provider" db:"provider"`
+	ProviderID string    `json:"provider_id" db:"provider_id"`
+
+	IdentityData JSONMap    `json:"identity_data,omitempty" db:"identity_data"`
+	LastSignInAt *time.Time `json:"last_sign_in_at,omitempty" db:"last_sign_in_at"`
+
+	// The tokens the provider issued on the last sign in, to call its API
+	// on behalf of the user.
+	EncryptedProviderToken        []byte     `json:"-" db:"encrypted_provider_token"`
+	EncryptedProviderRefreshToken []byte     `json:"-" db:"encrypted_provider_refresh_token"`
+	ProviderTokenExpiresAt        *time.Time `json:"-" db:"provider_token_expires_at"`
+
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+func (Identity) TableName() string {
+	tableName := "identities"
+
+	if namespace.GetNamespace() != "" {
+		return namespace.GetNamespace() + "_" + tableName
+	}
+
+	return tableName
+}
+
+// NewIdentity initializes an identity of the user at the provider.
+func NewIdentity(user *User, provider, providerID string, identityData map[string]interface{}) (*Identity, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating unique id")
+	}
+
+	now := time.Now()
+	return &Identity{
+		InstanceID:   user.InstanceID,
+		ID:           id,
+		UserID:       user.ID,
+		Provider:     provider,
+		ProviderID:   providerID,
+		IdentityData: identityData,
+		LastSignInAt: &now,
+	}, nil
+}
+
+// UpdateSignIn stores the latest data the provider returned for the identity.
+func (i *Identity) UpdateSignIn(tx *storage.Connection, identityData map[string]interface{}) error {
+	now := time.Now()
+	i.IdentityData = identityData
+	i.LastSignInAt = &now
+	return tx.UpdateOnly(i, "identity_data", "last_sign_in_at", "updated_at")
+}
+
+// UpdateProviderToken encrypts and stores the tokens the provider issued for
+// the identity. The refresh token is kept if the provider didn't issue a new
+// one.
+func (i *Identity) UpdateProviderToken(tx *storage.Connection, encryptionKey, token, refreshToken string, expiresAt *time.Time) error {
+	encrypted, err := crypto.Encrypt(encryptionKey, []byte(token))
+	if err != nil {
+		return errors.Wrap(err, "error encrypting provider token")
+	}
+	i.EncryptedProviderToken = encrypted
+
+	if refreshToken != "" {
+		encrypted, err := crypto.Encrypt(encryptionKey, []byte(refreshToken))
+		if err != nil {
+			return errors.Wrap(err, "error encrypting provider refresh token")
+		}
+		i.EncryptedProviderRefreshToken = encrypted
+	}
+
+	i.ProviderTokenExpiresAt = expiresAt
+	return tx.UpdateOnly(i, "encrypted_provider_token", "encrypted_provider_refresh_token", "provider_token_expires_at", "updated_at")
+}
+
+// ProviderToken decrypts the tokens the provider issued for the identity.
+// Both are empty if none are stored.
+func (i *Identity) ProviderToken(encryptionKey string) (token, refreshToken string, err error) {
+	if len(i.EncryptedProviderToken) > 0 {
+		decrypted, err := crypto.Decrypt(encryptionKey, i.EncryptedProviderToken)
+		if err != nil {
+			return "", "", errors.Wrap(err, "error decrypting provider token")
+		}
+		token = string(decrypted)
+	}
+	if len(i.EncryptedProviderRefreshToken) > 0 {
+		decrypted, err := crypto.Decrypt(encryptionKey, i.EncryptedProviderRefreshToken)
+		if err != nil {
+			return "", "", errors.Wrap(err, "error decrypting provider refresh token")
+		}
+		refreshToken = string(decrypted)
+	}
+	return token, refreshToken, nil
+}
+
+// FindIdentityByProviderID finds the identity of a provider account.
+func FindIdentityByProviderID(tx *storage.Connection, instanceID uuid.UUID, provider, providerID string) (*Identity, error) {
+	identity := &Identity{}
+	if err := tx.Q().Where("instance_id = ? and provider = ? and provider_id = ?", instanceID, provider, providerID).First(identity); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, IdentityNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding identity")
+	}
+	return identity, nil
+}
+
+// FindIdentitiesByUser finds the identities linked to the user, oldest first.
+func FindIdentitiesByUser(tx *storage.Connection, user *User) ([]*Identity, error) {
+	identities := []*Identity{}
+	if err := tx.Q().Where("instance_id = ? and user_id = ?", user.InstanceID, user.ID).Order("created_at asc").All(&identities); err != nil {
+		return nil, errors.Wrap(err, "error finding identities")
+	}
+	return identities, nil
+}
+
+// FindIdentityByUserAndID finds an identity linked to the user by its id.
+func FindIdentityByUserAndID(tx *storage.Connection, user *User, id uuid.UUID) (*Identity, error) {
+	identity := &Identity{}
+	if err := tx.Q().Where("instance_id = ? and user_id = ? and id = ?", user.InstanceID, user.ID, id).First(identity); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, IdentityNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding identity")
+	}
+	return identity, nil
+}
+
+// UpdateProviders lists the ways the user can sign in with in
+// app_metadata.providers: email and phone if the user has a password,
+// followed by the providers of all identities linked to the user.
+func (u *User) UpdateProviders(tx *storage.Connection) error {
+	identities, err := FindIdentitiesByUser(tx, u)
+	if err != nil {
+		return err
+	}
+
+	providers := []interface{}{}
+	seen := map[string]bool{}
+	add := func(provider string) {
+		if !seen[provider] {
+			seen[provider] = true
+			providers = append(providers, provider)
+		}
+	}
+	if u.HasPassword() {
+		if u.Email != "" {
+			add("email")
+		}
+		if u.Phone != "" {
+			add("phone")
+		}
+	}
+	for _, identity := range identities {
+		add(identity.Provider)
+	}
+
+	return u.UpdateAppMetaData(tx, map[string]interface{}{
+		"providers": providers,
+	})
+}
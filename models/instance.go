@@ -80,8 +80,19 @@ func GetInstanceByUUID(tx *storage.Connection, uuid uuid.UUID) (*Instance, error
 func DeleteInstance(conn *storage.Connection, instance *Instance) error {
 	return conn.Transaction(func(tx *storage.Connection) error {
 		delModels := map[string]*pop.Model{
-			"user":          &pop.Model{Value: &User{}},
-			"refresh token": &pop.Model{Value: &RefreshToken{}},
+			"user":                     &pop.Model{Value: &User{}},
+			"refresh token":            &pop.Model{Value: &RefreshToken{}},
+			"totp factor":              &pop.Model{Value: &TOTPFactor{}},
+			"signing key":              &pop.Model{Value: &SigningKey{}},
+			"oauth client":             &pop.Model{Value: &OAuthClient{}},
+			"oauth authorization code": &pop.Model{Value: &OAuthAuthorizationCode{}},
+			"flow state":               &pop.Model{Value: &FlowState{}},
+			"session":                  &pop.Model{Value: &Session{}},
+			"identity":                 &pop.Model{Value: &Identity{}},
+			"saml connection":          &pop.Model{Value: &SAMLConnection{}},
+			"saml assertion":           &pop.Model{Value: &SAMLAssertion{}},
+			"webauthn credential":      &pop.Model{Value: &WebAuthnCredential{}},
+			"webauthn session":         &pop.Model{Value: &WebAuthnSession{}},
 		}
 
 		for name, dm := range delModels {
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/storage"
+	"github.com/netlify/gotrue/storage/namespace"
+	"github.com/pkg/errors"
+)
+
+// OAuthAuthorizationCode is the database model for authorization codes
+// issued to OAuth clients. Only a hash of the code is stored.
+type OAuthAuthorizationCode struct {
+	InstanceID uuid.UUID `json:"-" db:"instance_id"`
+	ID         int64     `json:"id" db:"id"`
+
+	ClientID uuid.UUID `json:"-" db:"client_id"`
+	UserID   uuid.UUID `json:"-" db:"user_id"`
+
+	CodeHash    string `json:"-" db:"code_hash"`
+	RedirectURI string `json:"-" db:"redirect_uri"`
+	Scope       string `json:"-" db:"scope"`
+	Nonce       string `json:"-" db:"nonce"`
+
+	ExpiresAt time.Time `json:"-" db:"expires_at"`
+	CreatedAt time.Time `json:"-" db:"created_at"`
+	UpdatedAt time.Time `json:"-" db:"updated_at"`
+}
+
+func (OAuthAuthorizationCode) TableName() string {
+	tableName := "oauth_authorization_codes"
+
+	if namespace.GetNamespace() != "" {
+		return namespace.GetNamespace() + "_" + tableName
+	}
+
+	return tableName
+}
+
+// CreateOAuthAuthorizationCode stores a new authorization code for the user
+// and client, returning the plain code.
+func CreateOAuthAuthorizationCode(tx *storage.Connection, client *OAuthClient, user *User, redirectURI, scope, nonce string, expiresIn time.Duration) (string, error) {
+	code := crypto.SecureToken()
+	authCode := &OAuthAuthorizationCode{
+		InstanceID:  client.InstanceID,
+		ClientID:    client.ID,
+		UserID:      user.ID,
+		CodeHash:    hashAuthorizationCode(code),
+		RedirectURI: redirectURI,
+		Scope:       scope,
+		Nonce:       nonce,
+		ExpiresAt:   time.Now().Add(expiresIn),
+	}
+	if err := tx.Create(authCode); err != nil {
+		return "", errors.Wrap(err, "error creating authorization code")
+	}
+	return code, nil
+}
+
+// IsExpired checks if the code can no longer be exchanged.
+func (c *OAuthAuthorizationCode) IsExpired() bool {
+	return time.Now().After(c.ExpiresAt)
+}
+
+// Consume deletes the code so it can't be exchanged twice. Of concurrent
+// exchanges only one deletes the code, the others fail with an
+// AuthorizationCodeNotFoundError.
+func (c *OAuthAuthorizationCode) Consume(tx *storage.Connection) error {
+	count, err := tx.RawQuery("DELETE FROM "+c.TableName()+" WHERE id = ?", c.ID).ExecWithCount()
+	if err != nil {
+		return errors.Wrap(err, "error deleting authorization code")
+	}
+	if count != 1 {
+		return AuthorizationCodeNotFoundError{}
+	}
+	return nil
+}
+
+// FindOAuthAuthorizationCode finds an authorization code by its plain value.
+func FindOAuthAuthorizationCode(tx *storage.Connection, instanceID uuid.UUID, code string) (*OAuthAuthorizationCode, error) {
+	authCode := &OAuthAuthorizationCode{}
+	if err := tx.Q().Where("instance_id = ? and code_hash = ?", instanceID, hashAuthorizationCode(code)).First(authCode); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, AuthorizationCodeNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding authorization code")
+	}
+	return authCode, nil
+}
+
+func hashAuthorizationCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,149 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gobuffalo/pop/v5"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/storage"
+	"github.com/netlify/gotrue/storage/namespace"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// OAuthClient is the database model for applications that sign users in
+// with GoTrue as their OAuth2 authorization server.
+type OAuthClient struct {
+	InstanceID uuid.UUID `json:"-" db:"instance_id"`
+	ID         uuid.UUID `json:"id" db:"id"`
+
+	ClientID              string     `json:"client_id" db:"client_id"`
+	EncryptedClientSecret string     `json:"-" db:"encrypted_client_secret"`
+	Name                  string     `json:"name" db:"name"`
+	RedirectURIs          StringList `json:"redirect_uris" db:"redirect_uris"`
+
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+func (OAuthClient) TableName() string {
+	tableName := "oauth_clients"
+
+	if namespace.GetNamespace() != "" {
+		return namespace.GetNamespace() + "_" + tableName
+	}
+
+	return tableName
+}
+
+// NewOAuthClient initializes a new client. The generated secret is returned
+// once, only its hash is stored.
+func NewOAuthClient(instanceID uuid.UUID, name string, redirectURIs []string) (*OAuthClient, string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Error generating unique id")
+	}
+
+	client := &OAuthClient{
+		InstanceID:   instanceID,
+		ID:           id,
+		ClientID:     crypto.SecureToken(),
+		Name:         name,
+		RedirectURIs: redirectURIs,
+	}
+	secret, err := client.generateSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	return client, secret, nil
+}
+
+func (c *OAuthClient) generateSecret() (string, error) {
+	secret := crypto.SecureToken() + crypto.SecureToken()
+	encrypted, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.Wrap(err, "error hashing client secret")
+	}
+	c.EncryptedClientSecret = string(encrypted)
+	return secret, nil
+}
+
+// RegenerateSecret replaces the client secret, returning the new one.
+func (c *OAuthClient) RegenerateSecret(tx *storage.Connection) (string, error) {
+	secret, err := c.generateSecret()
+	if err != nil {
+		return "", err
+	}
+	return secret, tx.UpdateOnly(c, "encrypted_client_secret")
+}
+
+// UpdateInfo updates the name and redirect URIs of the client.
+func (c *OAuthClient) UpdateInfo(tx *storage.Connection, name string, redirectURIs []string) error {
+	c.Name = name
+	c.RedirectURIs = redirectURIs
+	return tx.UpdateOnly(c, "name", "redirect_uris")
+}
+
+// Delete removes the client together with its pending authorization codes
+// and the sessions users authorized it for.
+func (c *OAuthClient) Delete(tx *storage.Connection) error {
+	codes := &pop.Model{Value: &OAuthAuthorizationCode{}}
+	if err := tx.RawQuery("DELETE FROM "+codes.TableName()+" WHERE client_id = ?", c.ID).Exec(); err != nil {
+		return errors.Wrap(err, "error deleting authorization codes")
+	}
+
+	sessions := &pop.Model{Value: &Session{}}
+	if err := tx.RawQuery("DELETE FROM "+(&pop.Model{Value: &RefreshToken{}}).TableName()+" WHERE instance_id = ? AND session_id IN (SELECT id FROM "+sessions.TableName()+" WHERE instance_id = ? AND oauth_client_id = ?)", c.InstanceID, c.InstanceID, c.ClientID).Exec(); err != nil {
+		return errors.Wrap(err, "error deleting refresh tokens")
+	}
+	if err := tx.RawQuery("DELETE FROM "+sessions.TableName()+" WHERE instance_id = ? AND oauth_client_id = ?", c.InstanceID, c.ClientID).Exec(); err != nil {
+		return errors.Wrap(err, "error deleting sessions")
+	}
+	return tx.Destroy(c)
+}
+
+// Authenticate checks a client secret.
+func (c *OAuthClient) Authenticate(secret string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(c.EncryptedClientSecret), []byte(secret)) == nil
+}
+
+// HasRedirectURI checks if uri is registered for the client. URIs have to
+// match exactly.
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// FindOAuthClients finds all clients of an instance.
+func FindOAuthClients(tx *storage.Connection, instanceID uuid.UUID) ([]*OAuthClient, error) {
+	clients := []*OAuthClient{}
+	err := tx.Q().Order("created_at desc").Where("instance_id = ?", instanceID).All(&clients)
+	return clients, err
+}
+
+// FindOAuthClientByClientID finds a client by its public client_id.
+func FindOAuthClientByClientID(tx *storage.Connection, instanceID uuid.UUID, clientID string) (*OAuthClient, error) {
+	return findOAuthClient(tx, "instance_id = ? and client_id = ?", instanceID, clientID)
+}
+
+// FindOAuthClientByID finds a client by its id.
+func FindOAuthClientByID(tx *storage.Connection, instanceID, id uuid.UUID) (*OAuthClient, error) {
+	return findOAuthClient(tx, "instance_id = ? and id = ?", instanceID, id)
+}
+
+func findOAuthClient(tx *storage.Connection, query string, args ...interface{}) (*OAuthClient, error) {
+	client := &OAuthClient{}
+	if err := tx.Q().Where(query, args...).First(client); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, OAuthClientNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding oauth client")
+	}
+	return client, nil
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"database/sql"
 	"time"
 
 	"github.com/gobuffalo/pop/v5"
@@ -20,6 +21,15 @@ type RefreshToken struct {
 
 	UserID uuid.UUID `db:"user_id"`
 
+	// SessionID is the session the token belongs to. Tokens created before
+	// sessions were tracked don't have one.
+	SessionID *uuid.UUID `db:"session_id"`
+
+	// Parent is the token this one replaced. All tokens swapped from the
+	// same login share the ID of the first one as FamilyID.
+	Parent   string `db:"parent"`
+	FamilyID int64  `db:"family_id"`
+
 	Revoked   bool      `db:"revoked"`
 	CreatedAt time.Time `db:"created_at"`
 	UpdatedAt time.Time `db:"updated_at"`
@@ -35,46 +45,184 @@ func (RefreshToken) TableName() string {
 	return tableName
 }
 
-// GrantAuthenticatedUser creates a refresh token for the provided user.
-func GrantAuthenticatedUser(tx *storage.Connection, user *User) (*RefreshToken, error) {
-	return createRefreshToken(tx, user)
+// GrantParams holds the details of the request that signed in the user.
+type GrantParams struct {
+	UserAgent string
+	IP        string
+
+	// The session at the SAML identity provider the user signed in through
+	SAMLConnectionID *uuid.UUID
+	SAMLNameID       string
+	SAMLSessionIndex string
+
+	// The OAuth client the user authorized, whose tokens are limited to
+	// the granted scope
+	OAuthClientID string
+	Scope         string
+}
+
+// GrantAuthenticatedUser starts a new session for the provided user and
+// creates its first refresh token.
+func GrantAuthenticatedUser(tx *storage.Connection, user *User, params GrantParams) (*RefreshToken, error) {
+	session, err := NewSession(user, params)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Create(session); err != nil {
+		return nil, errors.Wrap(err, "error creating session")
+	}
+	return createRefreshToken(tx, user, nil, &session.ID)
 }
 
 // GrantRefreshTokenSwap swaps a refresh token for a new one, revoking the provided token.
-func GrantRefreshTokenSwap(tx *storage.Connection, user *User, token *RefreshToken) (*RefreshToken, error) {
+// It fails with a SessionExpiredError if the session of the token exceeded
+// one of the timeouts, and with a RefreshTokenRevokedError if the token was
+// revoked concurrently.
+func GrantRefreshTokenSwap(tx *storage.Connection, user *User, token *RefreshToken, timeouts SessionTimeouts) (*RefreshToken, error) {
 	var newToken *RefreshToken
 	err := tx.Transaction(func(rtx *storage.Connection) error {
-		var terr error
-		if terr = NewAuditLogEntry(tx, user.InstanceID, user, TokenRevokedAction, nil); terr != nil {
-			return errors.Wrap(terr, "error creating audit log entry")
+		session, terr := CheckRefreshTokenSession(rtx, token, timeouts)
+		if terr != nil {
+			return terr
 		}
 
+		now := time.Now()
+		count, terr := rtx.RawQuery("UPDATE "+(&pop.Model{Value: RefreshToken{}}).TableName()+" SET revoked = ?, updated_at = ? WHERE id = ? AND revoked = ?", true, now, token.ID, false).ExecWithCount()
+		if terr != nil {
+			return errors.Wrap(terr, "error revoking refresh token")
+		}
+		if count == 0 {
+			return RefreshTokenRevokedError{}
+		}
 		token.Revoked = true
-		if terr = tx.UpdateOnly(token, "revoked"); terr != nil {
-			return terr
+		token.UpdatedAt = now
+
+		if terr = NewAuditLogEntry(rtx, user.InstanceID, user, TokenRevokedAction, nil); terr != nil {
+			return errors.Wrap(terr, "error creating audit log entry")
 		}
-		newToken, terr = createRefreshToken(rtx, user)
+
+		if session != nil {
+			if terr = session.UpdateRefreshedAt(rtx); terr != nil {
+				return errors.Wrap(terr, "error updating session")
+			}
+		}
+
+		newToken, terr = createRefreshToken(rtx, user, token, token.SessionID)
 		return terr
 	})
 	return newToken, err
 }
 
-// Logout deletes all refresh tokens for a user.
+// CheckRefreshTokenSession finds the session of the token, which is nil for
+// tokens without one. It fails with a SessionExpiredError if the session
+// exceeded one of the timeouts.
+func CheckRefreshTokenSession(tx *storage.Connection, token *RefreshToken, timeouts SessionTimeouts) (*Session, error) {
+	var session *Session
+	if token.SessionID != nil {
+		var err error
+		session, err = FindSessionByID(tx, token.InstanceID, *token.SessionID)
+		if err != nil && !IsNotFoundError(err) {
+			return nil, err
+		}
+	}
+
+	// tokens without a session were last active when they were swapped, the
+	// login started with the first token of their family
+	createdAt, lastActiveAt := token.CreatedAt, token.CreatedAt
+	if session != nil {
+		createdAt, lastActiveAt = session.CreatedAt, session.LastActiveAt()
+	} else if token.familyID() != token.ID {
+		root := &RefreshToken{}
+		if err := tx.Q().Where("instance_id = ? and id = ?", token.InstanceID, token.familyID()).First(root); err != nil {
+			if errors.Cause(err) != sql.ErrNoRows {
+				return nil, errors.Wrap(err, "error finding refresh token")
+			}
+		} else {
+			createdAt = root.CreatedAt
+		}
+	}
+	if reason := timeouts.ExpiryReason(createdAt, lastActiveAt); reason != "" {
+		return nil, SessionExpiredError{Reason: reason}
+	}
+	return session, nil
+}
+
+// RevokeRefreshTokenSession signs out the session of the provided token. For
+// tokens without a session, the tokens swapped from the same login are
+// revoked.
+func RevokeRefreshTokenSession(tx *storage.Connection, token *RefreshToken) error {
+	if token.SessionID == nil {
+		return RevokeTokenFamily(tx, token)
+	}
+
+	session, err := FindSessionByID(tx, token.InstanceID, *token.SessionID)
+	if err != nil {
+		if IsNotFoundError(err) {
+			return RevokeTokenFamily(tx, token)
+		}
+		return err
+	}
+	return session.Logout(tx)
+}
+
+// RevokeTokenFamily revokes all tokens swapped from the same login as the
+// provided token.
+func RevokeTokenFamily(tx *storage.Connection, token *RefreshToken) error {
+	return tx.RawQuery("UPDATE "+(&pop.Model{Value: RefreshToken{}}).TableName()+" SET revoked = ?, updated_at = ? WHERE instance_id = ? AND (family_id = ? OR id = ?) AND revoked = ?", true, time.Now(), token.InstanceID, token.familyID(), token.familyID(), false).Exec()
+}
+
+// FindRefreshTokenByParent finds the token that replaced the provided token.
+func FindRefreshTokenByParent(tx *storage.Connection, token *RefreshToken) (*RefreshToken, error) {
+	child := &RefreshToken{}
+	if err := tx.Q().Where("instance_id = ? and parent = ?", token.InstanceID, token.Token).First(child); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, RefreshTokenNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding refresh token")
+	}
+	return child, nil
+}
+
+// tokens created before families were tracked are their own family
+func (r *RefreshToken) familyID() int64 {
+	if r.FamilyID == 0 {
+		return r.ID
+	}
+	return r.FamilyID
+}
+
+// Logout deletes all sessions and refresh tokens for a user.
 func Logout(tx *storage.Connection, instanceID uuid.UUID, id uuid.UUID) error {
-	return tx.RawQuery("DELETE FROM "+(&pop.Model{Value: RefreshToken{}}).TableName()+" WHERE instance_id = ? AND user_id = ?", instanceID, id).Exec()
+	if err := tx.RawQuery("DELETE FROM "+(&pop.Model{Value: RefreshToken{}}).TableName()+" WHERE instance_id = ? AND user_id = ?", instanceID, id).Exec(); err != nil {
+		return err
+	}
+	return tx.RawQuery("DELETE FROM "+(&pop.Model{Value: Session{}}).TableName()+" WHERE instance_id = ? AND user_id = ?", instanceID, id).Exec()
 }
 
-func createRefreshToken(tx *storage.Connection, user *User) (*RefreshToken, error) {
+func createRefreshToken(tx *storage.Connection, user *User, parent *RefreshToken, sessionID *uuid.UUID) (*RefreshToken, error) {
 	token := &RefreshToken{
 		InstanceID: user.InstanceID,
 		UserID:     user.ID,
+		SessionID:  sessionID,
 		Token:      crypto.SecureToken(),
 	}
+	if parent != nil {
+		token.Parent = parent.Token
+		token.FamilyID = parent.familyID()
+	}
 
 	if err := tx.Create(token); err != nil {
 		return nil, errors.Wrap(err, "error creating refresh token")
 	}
 
+	// the first token of a login starts a new family
+	if token.FamilyID == 0 {
+		token.FamilyID = token.ID
+		if err := tx.UpdateOnly(token, "family_id"); err != nil {
+			return nil, errors.Wrap(err, "error updating refresh token family")
+		}
+	}
+
 	if err := user.UpdateLastSignInAt(tx); err != nil {
 		return nil, errors.Wrap(err, "error update user`s last_sign_in field")
 	}
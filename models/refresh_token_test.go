@@ -2,7 +2,9 @@ package models
 
 import (
 	"testing"
+	"time"
 
+	"github.com/gobuffalo/pop/v5"
 	"github.com/netlify/gotrue/conf"
 	"github.com/netlify/gotrue/storage"
 	"github.com/netlify/gotrue/storage/test"
@@ -37,7 +39,7 @@ func TestRefreshToken(t *testing.T) {
 
 func (ts *RefreshTokenTestSuite) TestGrantAuthenticatedUser() {
 	u := ts.createUser()
-	r, err := GrantAuthenticatedUser(ts.db, u)
+	r, err := GrantAuthenticatedUser(ts.db, u, GrantParams{})
 	require.NoError(ts.T(), err)
 
 	require.NotEmpty(ts.T(), r.Token)
@@ -46,10 +48,10 @@ func (ts *RefreshTokenTestSuite) TestGrantAuthenticatedUser() {
 
 func (ts *RefreshTokenTestSuite) TestGrantRefreshTokenSwap() {
 	u := ts.createUser()
-	r, err := GrantAuthenticatedUser(ts.db, u)
+	r, err := GrantAuthenticatedUser(ts.db, u, GrantParams{})
 	require.NoError(ts.T(), err)
 
-	s, err := GrantRefreshTokenSwap(ts.db, u, r)
+	s, err := GrantRefreshTokenSwap(ts.db, u, r, SessionTimeouts{})
 	require.NoError(ts.T(), err)
 
 	_, nr, err := FindUserWithRefreshToken(ts.db, r.Token)
@@ -62,9 +64,23 @@ func (ts *RefreshTokenTestSuite) TestGrantRefreshTokenSwap() {
 	require.Equal(ts.T(), u.ID, s.UserID)
 }
 
+func (ts *RefreshTokenTestSuite) TestGrantRefreshTokenSwapConcurrently() {
+	u := ts.createUser()
+	r, err := GrantAuthenticatedUser(ts.db, u, GrantParams{})
+	require.NoError(ts.T(), err)
+
+	// a second request loaded the token before the first one revoked it
+	stale := *r
+	_, err = GrantRefreshTokenSwap(ts.db, u, r, SessionTimeouts{})
+	require.NoError(ts.T(), err)
+
+	_, err = GrantRefreshTokenSwap(ts.db, u, &stale, SessionTimeouts{})
+	require.Equal(ts.T(), RefreshTokenRevokedError{}, err)
+}
+
 func (ts *RefreshTokenTestSuite) TestLogout() {
 	u := ts.createUser()
-	r, err := GrantAuthenticatedUser(ts.db, u)
+	r, err := GrantAuthenticatedUser(ts.db, u, GrantParams{})
 	require.NoError(ts.T(), err)
 
 	require.NoError(ts.T(), Logout(ts.db, uuid.Nil, u.ID))
@@ -74,6 +90,85 @@ func (ts *RefreshTokenTestSuite) TestLogout() {
 	require.True(ts.T(), IsNotFoundError(err), "expected NotFoundError")
 }
 
+func (ts *RefreshTokenTestSuite) TestRefreshTokenFamily() {
+	u := ts.createUser()
+	r, err := GrantAuthenticatedUser(ts.db, u, GrantParams{})
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), r.ID, r.FamilyID)
+	require.Empty(ts.T(), r.Parent)
+
+	s, err := GrantRefreshTokenSwap(ts.db, u, r, SessionTimeouts{})
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), r.Token, s.Parent)
+	require.Equal(ts.T(), r.FamilyID, s.FamilyID)
+	require.NotNil(ts.T(), s.SessionID)
+	require.Equal(ts.T(), *r.SessionID, *s.SessionID)
+
+	child, err := FindRefreshTokenByParent(ts.db, r)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), s.ID, child.ID)
+
+	_, err = FindRefreshTokenByParent(ts.db, s)
+	require.True(ts.T(), IsNotFoundError(err), "expected NotFoundError")
+}
+
+func (ts *RefreshTokenTestSuite) TestRevokeTokenFamily() {
+	u := ts.createUser()
+	r, err := GrantAuthenticatedUser(ts.db, u, GrantParams{})
+	require.NoError(ts.T(), err)
+	s, err := GrantRefreshTokenSwap(ts.db, u, r, SessionTimeouts{})
+	require.NoError(ts.T(), err)
+	other, err := GrantAuthenticatedUser(ts.db, u, GrantParams{})
+	require.NoError(ts.T(), err)
+
+	require.NoError(ts.T(), RevokeTokenFamily(ts.db, r))
+
+	_, ns, err := FindUserWithRefreshToken(ts.db, s.Token)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), ns.Revoked, "expected descendant token to be revoked")
+
+	_, no, err := FindUserWithRefreshToken(ts.db, other.Token)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), no.Revoked, "expected unrelated token to be left alone")
+}
+
+func (ts *RefreshTokenTestSuite) TestGrantRefreshTokenSwapSessionExpired() {
+	u := ts.createUser()
+	r, err := GrantAuthenticatedUser(ts.db, u, GrantParams{})
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.db.RawQuery("UPDATE "+(&pop.Model{Value: Session{}}).TableName()+" SET created_at = ? WHERE id = ?", time.Now().Add(-time.Hour), r.SessionID).Exec())
+
+	_, err = GrantRefreshTokenSwap(ts.db, u, r, SessionTimeouts{MaxLifetime: time.Minute})
+	require.Equal(ts.T(), SessionExpiredError{Reason: SessionMaxLifetimeReason}, err)
+
+	_, err = GrantRefreshTokenSwap(ts.db, u, r, SessionTimeouts{InactivityTimeout: time.Minute})
+	require.Equal(ts.T(), SessionExpiredError{Reason: SessionInactivityTimeoutReason}, err)
+
+	_, nr, err := FindUserWithRefreshToken(ts.db, r.Token)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), nr.Revoked, "expected token of an expired session to be left alone")
+
+	require.NoError(ts.T(), RevokeRefreshTokenSession(ts.db, r))
+	_, _, err = FindUserWithRefreshToken(ts.db, r.Token)
+	require.True(ts.T(), IsNotFoundError(err), "expected NotFoundError")
+}
+
+func (ts *RefreshTokenTestSuite) TestGrantRefreshTokenSwapWithoutSessionExpired() {
+	u := ts.createUser()
+	r, err := createRefreshToken(ts.db, u, nil, nil)
+	require.NoError(ts.T(), err)
+	s, err := GrantRefreshTokenSwap(ts.db, u, r, SessionTimeouts{})
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.db.RawQuery("UPDATE "+(&pop.Model{Value: RefreshToken{}}).TableName()+" SET created_at = ? WHERE id = ?", time.Now().Add(-time.Hour), r.ID).Exec())
+
+	// the lifetime starts with the first token of the login, not the last swap
+	_, err = GrantRefreshTokenSwap(ts.db, u, s, SessionTimeouts{MaxLifetime: time.Minute})
+	require.Equal(ts.T(), SessionExpiredError{Reason: SessionMaxLifetimeReason}, err)
+
+	_, err = GrantRefreshTokenSwap(ts.db, u, s, SessionTimeouts{InactivityTimeout: time.Minute})
+	require.NoError(ts.T(), err)
+}
+
 func (ts *RefreshTokenTestSuite) createUser() *User {
 	return ts.createUserWithEmail("david@netlify.com")
 }
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/storage"
+	"github.com/netlify/gotrue/storage/namespace"
+	"github.com/pkg/errors"
+)
+
+// SAMLAssertion is the database model for an unsolicited assertion a user
+// signed in with. It is kept until the assertion expires, so it can't be
+// replayed.
+type SAMLAssertion struct {
+	InstanceID uuid.UUID `json:"-" db:"instance_id"`
+	ID         uuid.UUID `json:"id" db:"id"`
+
+	ConnectionID uuid.UUID `json:"connection_id" db:"connection_id"`
+	AssertionID  string    `json:"assertion_id" db:"assertion_id"`
+
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+func (SAMLAssertion) TableName() string {
+	tableName := "saml_assertions"
+
+	if namespace.GetNamespace() != "" {
+		return namespace.GetNamespace() + "_" + tableName
+	}
+
+	return tableName
+}
+
+// UseSAMLAssertion records that the assertion of the connection signed in a
+// user. It fails with SAMLAssertionReplayedError if it already did.
+func UseSAMLAssertion(tx *storage.Connection, instanceID, connectionID uuid.UUID, assertionID string, expiresAt time.Time) error {
+	// expired assertions are rejected before they get here
+	if err := tx.RawQuery("DELETE FROM "+(&SAMLAssertion{}).TableName()+" WHERE expires_at < ?", time.Now()).Exec(); err != nil {
+		return errors.Wrap(err, "error deleting expired saml assertions")
+	}
+
+	err := tx.Q().Where("instance_id = ? and connection_id = ? and assertion_id = ?", instanceID, connectionID, assertionID).First(&SAMLAssertion{})
+	if err == nil {
+		return SAMLAssertionReplayedError{}
+	}
+	if errors.Cause(err) != sql.ErrNoRows {
+		return errors.Wrap(err, "error finding saml assertion")
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return errors.Wrap(err, "Error generating unique id")
+	}
+	assertion := &SAMLAssertion{
+		InstanceID:   instanceID,
+		ID:           id,
+		ConnectionID: connectionID,
+		AssertionID:  assertionID,
+		ExpiresAt:    expiresAt,
+	}
+	if err := tx.Create(assertion); err != nil {
+		return errors.Wrap(err, "error creating saml assertion")
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/storage"
+	"github.com/netlify/gotrue/storage/namespace"
+	"github.com/pkg/errors"
+)
+
+// SAMLConnection is the database model for the SAML identity provider of an
+// organization. Users sign in through the connection that lists the domain
+// of their email.
+type SAMLConnection struct {
+	InstanceID uuid.UUID `json:"-" db:"instance_id"`
+	ID         uuid.UUID `json:"id" db:"id"`
+
+	Name string `json:"name" db:"name"`
+
+	// The metadata of the identity provider is fetched from MetadataURL,
+	// unless MetadataXML is set.
+	MetadataURL string `json:"metadata_url,omitempty" db:"metadata_url"`
+	MetadataXML string `json:"metadata_xml,omitempty" db:"metadata_xml"`
+
+	// AttributeMapping holds the rules of a conf.SamlAttributeMapping.
+	AttributeMapping JSONMap    `json:"attribute_mapping" db:"attribute_mapping"`
+	Domains          StringList `json:"domains" db:"domains"`
+
+	// IdPInitiated allows users to sign in with assertions the identity
+	// provider sends without a request of GoTrue, such as from the tiles of
+	// its dashboard. They are sent to DefaultRedirectURL, unless the
+	// RelayState is another redirect URL.
+	IdPInitiated       bool   `json:"idp_initiated" db:"idp_initiated"`
+	DefaultRedirectURL string `json:"default_redirect_url,omitempty" db:"default_redirect_url"`
+
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+func (SAMLConnection) TableName() string {
+	tableName := "saml_connections"
+
+	if namespace.GetNamespace() != "" {
+		return namespace.GetNamespace() + "_" + tableName
+	}
+
+	return tableName
+}
+
+// NewSAMLConnection initializes a new connection.
+func NewSAMLConnection(instanceID uuid.UUID, name string) (*SAMLConnection, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating unique id")
+	}
+
+	return &SAMLConnection{
+		InstanceID:       instanceID,
+		ID:               id,
+		Name:             name,
+		AttributeMapping: JSONMap{},
+		Domains:          StringList{},
+	}, nil
+}
+
+// UpdateInfo updates the identity provider, the domains and the sign in
+// settings of the connection.
+func (c *SAMLConnection) UpdateInfo(tx *storage.Connection) error {
+	return tx.UpdateOnly(c, "name", "metadata_url", "metadata_xml", "attribute_mapping", "domains", "idp_initiated", "default_redirect_url")
+}
+
+// HasDomain checks if users with emails of the domain sign in through the
+// connection.
+func (c *SAMLConnection) HasDomain(domain string) bool {
+	for _, d := range c.Domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsEmail checks if the email belongs to one of the domains of the
+// connection.
+func (c *SAMLConnection) AllowsEmail(email string) bool {
+	at := strings.LastIndex(email, "@")
+	return at >= 0 && c.HasDomain(email[at+1:])
+}
+
+// Mapping returns the attribute mapping rules of the connection. Other keys
+// with an attribute name as value map fields of user_metadata.
+func (c *SAMLConnection) Mapping() (*conf.SamlAttributeMapping, error) {
+	mapping := &conf.SamlAttributeMapping{}
+	data, err := json.Marshal(c.AttributeMapping)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, mapping); err != nil {
+		return nil, errors.Wrap(err, "invalid attribute mapping")
+	}
+
+	for key, value := range c.AttributeMapping {
+		name, ok := value.(string)
+		if !ok || samlMappingRules[key] {
+			continue
+		}
+		if mapping.UserMetadata == nil {
+			mapping.UserMetadata = map[string]string{}
+		}
+		if _, ok := mapping.UserMetadata[key]; !ok {
+			mapping.UserMetadata[key] = name
+		}
+	}
+	return mapping, mapping.Validate()
+}
+
+// samlMappingRules are the keys of conf.SamlAttributeMapping
+var samlMappingRules = map[string]bool{
+	"email":         true,
+	"user_metadata": true,
+	"app_metadata":  true,
+	"role":          true,
+	"groups":        true,
+	"group_roles":   true,
+	"default_role":  true,
+}
+
+// FindSAMLConnections finds all connections of an instance.
+func FindSAMLConnections(tx *storage.Connection, instanceID uuid.UUID) ([]*SAMLConnection, error) {
+	connections := []*SAMLConnection{}
+	if err := tx.Q().Where("instance_id = ?", instanceID).Order("created_at asc").All(&connections); err != nil {
+		return nil, errors.Wrap(err, "error finding saml connections")
+	}
+	return connections, nil
+}
+
+// FindSAMLConnectionByID finds a connection by its id.
+func FindSAMLConnectionByID(tx *storage.Connection, instanceID, id uuid.UUID) (*SAMLConnection, error) {
+	connection := &SAMLConnection{}
+	if err := tx.Q().Where("instance_id = ? and id = ?", instanceID, id).First(connection); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, SAMLConnectionNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding saml connection")
+	}
+	return connection, nil
+}
+
+// FindSAMLConnectionByDomain finds the connection users with emails of the
+// domain sign in through.
+func FindSAMLConnectionByDomain(tx *storage.Connection, instanceID uuid.UUID, domain string) (*SAMLConnection, error) {
+	connections, err := FindSAMLConnections(tx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	for _, connection := range connections {
+		if connection.HasDomain(domain) {
+			return connection, nil
+		}
+	}
+	return nil, SAMLConnectionNotFoundError{}
+}
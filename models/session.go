@@ -0,0 +1,186 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gobuffalo/pop/v5"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/storage"
+	"github.com/netlify/gotrue/storage/namespace"
+	"github.com/pkg/errors"
+)
+
+// Reasons a session can expire for.
+const (
+	SessionMaxLifetimeReason       = "max_lifetime"
+	SessionInactivityTimeoutReason = "inactivity_timeout"
+)
+
+// SessionTimeouts are the lifetime limits of sessions. A zero limit is not
+// enforced.
+type SessionTimeouts struct {
+	MaxLifetime       time.Duration
+	InactivityTimeout time.Duration
+}
+
+// ExpiryReason returns why a session started at createdAt and last active at
+// lastActiveAt is expired, or an empty string if it isn't.
+func (t SessionTimeouts) ExpiryReason(createdAt, lastActiveAt time.Time) string {
+	now := time.Now()
+	if t.MaxLifetime > 0 && now.After(createdAt.Add(t.MaxLifetime)) {
+		return SessionMaxLifetimeReason
+	}
+	if t.InactivityTimeout > 0 && now.After(lastActiveAt.Add(t.InactivityTimeout)) {
+		return SessionInactivityTimeoutReason
+	}
+	return ""
+}
+
+// Session is the database model for a signed in device. It is created on
+// sign in and shared by all refresh tokens swapped from that sign in.
+type Session struct {
+	InstanceID uuid.UUID `json:"-" db:"instance_id"`
+	ID         uuid.UUID `json:"id" db:"id"`
+
+	UserID uuid.UUID `json:"user_id" db:"user_id"`
+
+	UserAgent   string     `json:"user_agent" db:"user_agent"`
+	IP          string     `json:"ip" db:"ip"`
+	RefreshedAt *time.Time `json:"refreshed_at,omitempty" db:"refreshed_at"`
+
+	// The session at the SAML identity provider the user signed in through,
+	// which is ended by single logout. SAMLConnectionID is nil for the
+	// instance's own identity provider.
+	SAMLConnectionID *uuid.UUID `json:"-" db:"saml_connection_id"`
+	SAMLNameID       string     `json:"-" db:"saml_name_id"`
+	SAMLSessionIndex string     `json:"-" db:"saml_session_index"`
+
+	// The OAuth client the session was authorized for. The access tokens of
+	// the session are issued to the client and limited to the scope.
+	OAuthClientID string `json:"oauth_client_id,omitempty" db:"oauth_client_id"`
+	Scope         string `json:"scope,omitempty" db:"scope"`
+
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+func (Session) TableName() string {
+	tableName := "sessions"
+
+	if namespace.GetNamespace() != "" {
+		return namespace.GetNamespace() + "_" + tableName
+	}
+
+	return tableName
+}
+
+// NewSession initializes a session of the user.
+func NewSession(user *User, params GrantParams) (*Session, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating unique id")
+	}
+
+	return &Session{
+		InstanceID:       user.InstanceID,
+		ID:               id,
+		UserID:           user.ID,
+		UserAgent:        params.UserAgent,
+		IP:               params.IP,
+		SAMLConnectionID: params.SAMLConnectionID,
+		SAMLNameID:       params.SAMLNameID,
+		SAMLSessionIndex: params.SAMLSessionIndex,
+		OAuthClientID:    params.OAuthClientID,
+		Scope:            params.Scope,
+	}, nil
+}
+
+// LastActiveAt is when a refresh token of the session was last issued.
+func (s *Session) LastActiveAt() time.Time {
+	if s.RefreshedAt != nil {
+		return *s.RefreshedAt
+	}
+	return s.CreatedAt
+}
+
+// UpdateRefreshedAt records that a refresh token of the session was swapped.
+func (s *Session) UpdateRefreshedAt(tx *storage.Connection) error {
+	now := time.Now()
+	s.RefreshedAt = &now
+	return tx.UpdateOnly(s, "refreshed_at", "updated_at")
+}
+
+// Logout deletes the session and all of its refresh tokens.
+func (s *Session) Logout(tx *storage.Connection) error {
+	if err := tx.RawQuery("DELETE FROM "+(&pop.Model{Value: RefreshToken{}}).TableName()+" WHERE instance_id = ? AND session_id = ?", s.InstanceID, s.ID).Exec(); err != nil {
+		return errors.Wrap(err, "error deleting refresh tokens")
+	}
+	return tx.Destroy(s)
+}
+
+// FindSessionByID finds a session by its id.
+func FindSessionByID(tx *storage.Connection, instanceID, id uuid.UUID) (*Session, error) {
+	session := &Session{}
+	if err := tx.Q().Where("instance_id = ? and id = ?", instanceID, id).First(session); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, SessionNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding session")
+	}
+	return session, nil
+}
+
+// FindSessionByRefreshToken finds the session a refresh token was issued
+// for. Tokens issued before sessions were introduced don't have one.
+func FindSessionByRefreshToken(tx *storage.Connection, token *RefreshToken) (*Session, error) {
+	if token.SessionID == nil {
+		return nil, SessionNotFoundError{}
+	}
+	return FindSessionByID(tx, token.InstanceID, *token.SessionID)
+}
+
+// FindSessionByUserAndID finds a session of the user by its id.
+func FindSessionByUserAndID(tx *storage.Connection, user *User, id uuid.UUID) (*Session, error) {
+	session, err := FindSessionByID(tx, user.InstanceID, id)
+	if err != nil {
+		return nil, err
+	}
+	if session.UserID != user.ID {
+		return nil, SessionNotFoundError{}
+	}
+	return session, nil
+}
+
+// FindSessionsByUser finds the sessions of the user, newest first.
+func FindSessionsByUser(tx *storage.Connection, user *User) ([]*Session, error) {
+	sessions := []*Session{}
+	if err := tx.Q().Where("instance_id = ? and user_id = ?", user.InstanceID, user.ID).Order("created_at desc").All(&sessions); err != nil {
+		return nil, errors.Wrap(err, "error finding sessions")
+	}
+	return sessions, nil
+}
+
+// FindSessionsBySAMLNameID finds the sessions of the SAML identity provider
+// for the NameID. Only the sessions with one of the session indexes are
+// returned, if any are given.
+func FindSessionsBySAMLNameID(tx *storage.Connection, instanceID uuid.UUID, connectionID *uuid.UUID, nameID string, sessionIndexes []string) ([]*Session, error) {
+	sessions := []*Session{}
+	q := tx.Q().Where("instance_id = ? and saml_name_id = ?", instanceID, nameID)
+	if connectionID != nil {
+		q = q.Where("saml_connection_id = ?", *connectionID)
+	} else {
+		q = q.Where("saml_connection_id is null")
+	}
+	if len(sessionIndexes) > 0 {
+		indexes := make([]interface{}, 0, len(sessionIndexes))
+		for _, index := range sessionIndexes {
+			indexes = append(indexes, index)
+		}
+		q = q.Where("saml_session_index in (?)", indexes...)
+	}
+	if err := q.All(&sessions); err != nil {
+		return nil, errors.Wrap(err, "error finding sessions")
+	}
+	return sessions, nil
+}
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/storage"
+	"github.com/netlify/gotrue/storage/namespace"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SigningKeyStatusSigning marks the key new access tokens are signed with.
+	SigningKeyStatusSigning = "signing"
+	// SigningKeyStatusVerification marks a key tokens are still verified with.
+	SigningKeyStatusVerification = "verification"
+	// SigningKeyStatusRetired marks a key that is no longer accepted.
+	SigningKeyStatusRetired = "retired"
+)
+
+// SigningKey is the database model for the keys JWTs are signed and verified with.
+type SigningKey struct {
+	InstanceID uuid.UUID `json:"-" db:"instance_id"`
+	ID         int64     `json:"-" db:"id"`
+
+	KeyID     string `json:"kid" db:"kid"`
+	Algorithm string `json:"algorithm" db:"algorithm"`
+	// EncryptedMaterial is the encrypted HMAC secret or PEM encoded private
+	// key.
+	EncryptedMaterial []byte `json:"-" db:"encrypted_material"`
+	// LegacyMaterial is the unencrypted material of keys stored before keys
+	// were encrypted. It is encrypted the first time the key is loaded.
+	LegacyMaterial string `json:"-" db:"material"`
+	Status         string `json:"status" db:"status"`
+
+	// ExpiresAt is the end of the overlap window of a key that has been
+	// rotated out. Tokens are no longer verified with the key afterwards.
+	ExpiresAt *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+func (SigningKey) TableName() string {
+	tableName := "signing_keys"
+
+	if namespace.GetNamespace() != "" {
+		return namespace.GetNamespace() + "_" + tableName
+	}
+
+	return tableName
+}
+
+// NewSigningKey initializes a new signing key, encrypting its material.
+func NewSigningKey(instanceID uuid.UUID, kid, algorithm, material, encryptionKey string) (*SigningKey, error) {
+	encrypted, err := crypto.Encrypt(encryptionKey, []byte(material))
+	if err != nil {
+		return nil, errors.Wrap(err, "error encrypting signing key")
+	}
+	return &SigningKey{
+		InstanceID:        instanceID,
+		KeyID:             kid,
+		Algorithm:         algorithm,
+		EncryptedMaterial: encrypted,
+		Status:            SigningKeyStatusVerification,
+	}, nil
+}
+
+// Material decrypts the HMAC secret or PEM encoded private key.
+func (k *SigningKey) Material(encryptionKey string) (string, error) {
+	if len(k.EncryptedMaterial) == 0 {
+		return k.LegacyMaterial, nil
+	}
+	decrypted, err := crypto.Decrypt(encryptionKey, k.EncryptedMaterial)
+	if err != nil {
+		return "", errors.Wrap(err, "error decrypting signing key")
+	}
+	return string(decrypted), nil
+}
+
+// EncryptLegacyMaterial encrypts the material of a key stored before keys
+// were encrypted.
+func (k *SigningKey) EncryptLegacyMaterial(tx *storage.Connection, encryptionKey string) error {
+	if len(k.EncryptedMaterial) != 0 {
+		return nil
+	}
+	encrypted, err := crypto.Encrypt(encryptionKey, []byte(k.LegacyMaterial))
+	if err != nil {
+		return errors.Wrap(err, "error encrypting signing key")
+	}
+	k.EncryptedMaterial = encrypted
+	k.LegacyMaterial = ""
+	return tx.UpdateOnly(k, "encrypted_material", "material")
+}
+
+// IsSigning checks if new tokens are signed with the key.
+func (k *SigningKey) IsSigning() bool {
+	return k.Status == SigningKeyStatusSigning
+}
+
+// Retire stops tokens from being verified with the key.
+func (k *SigningKey) Retire(tx *storage.Connection) error {
+	k.Status = SigningKeyStatusRetired
+	return tx.UpdateOnly(k, "status")
+}
+
+// RotateSigningKey makes next the signing key. The current signing key keeps
+// verifying tokens until the overlap has passed. If no keys are stored yet,
+// current is the configured key and is stored so it can be rotated out.
+func RotateSigningKey(tx *storage.Connection, instanceID uuid.UUID, current, next *SigningKey, overlap time.Duration) error {
+	return tx.Transaction(func(rtx *storage.Connection) error {
+		keys, terr := FindSigningKeys(rtx, instanceID)
+		if terr != nil {
+			return terr
+		}
+
+		expiresAt := time.Now().Add(overlap)
+		if len(keys) == 0 && current != nil {
+			current.Status = SigningKeyStatusVerification
+			current.ExpiresAt = &expiresAt
+			if terr = rtx.Create(current); terr != nil {
+				return errors.Wrap(terr, "error saving current signing key")
+			}
+		}
+		for _, k := range keys {
+			if !k.IsSigning() {
+				continue
+			}
+			k.Status = SigningKeyStatusVerification
+			k.ExpiresAt = &expiresAt
+			if terr = rtx.UpdateOnly(k, "status", "expires_at"); terr != nil {
+				return errors.Wrap(terr, "error updating current signing key")
+			}
+		}
+
+		next.Status = SigningKeyStatusSigning
+		next.ExpiresAt = nil
+		if terr = rtx.Create(next); terr != nil {
+			return errors.Wrap(terr, "error saving signing key")
+		}
+		return nil
+	})
+}
+
+// FindSigningKeys finds all signing keys of an instance, including retired ones.
+func FindSigningKeys(tx *storage.Connection, instanceID uuid.UUID) ([]*SigningKey, error) {
+	keys := []*SigningKey{}
+	err := tx.Q().Order("id desc").Where("instance_id = ?", instanceID).All(&keys)
+	return keys, err
+}
+
+// FindActiveSigningKeys finds the signing keys tokens can be verified with.
+func FindActiveSigningKeys(tx *storage.Connection, instanceID uuid.UUID) ([]*SigningKey, error) {
+	keys := []*SigningKey{}
+	q := tx.Q().Order("id desc").Where("instance_id = ? and status <> ?", instanceID, SigningKeyStatusRetired)
+	err := q.Where("(expires_at is null or expires_at > ?)", time.Now()).All(&keys)
+	return keys, err
+}
+
+// FindSigningKeyByKeyID finds a signing key by its kid.
+func FindSigningKeyByKeyID(tx *storage.Connection, instanceID uuid.UUID, kid string) (*SigningKey, error) {
+	key := &SigningKey{}
+	if err := tx.Q().Where("instance_id = ? and kid = ?", instanceID, kid).First(key); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, SigningKeyNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding signing key")
+	}
+	return key, nil
+}
@@ -0,0 +1,188 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/storage"
+	"github.com/netlify/gotrue/storage/namespace"
+	"github.com/pkg/errors"
+)
+
+// TOTPFactor is the database model for a user's TOTP second factor.
+type TOTPFactor struct {
+	InstanceID uuid.UUID `json:"-" db:"instance_id"`
+	ID         int64     `json:"id" db:"id"`
+
+	UserID uuid.UUID `json:"-" db:"user_id"`
+
+	EncryptedURL []byte `json:"-" db:"encrypted_url"`
+
+	// OTPLastRequestedAt is the start of the last time step a code was
+	// accepted for, used to reject replayed codes.
+	OTPLastRequestedAt *time.Time `json:"-" db:"otp_last_requested_at"`
+	VerifiedAt         *time.Time `json:"verified_at,omitempty" db:"verified_at"`
+
+	// FailedAttempts counts the codes tried since the last accepted one.
+	// They are forgotten once no code was tried for the lockout duration.
+	FailedAttempts int        `json:"-" db:"failed_attempts"`
+	LastAttemptAt  *time.Time `json:"-" db:"last_attempt_at"`
+
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+func (TOTPFactor) TableName() string {
+	tableName := "totp_auth"
+
+	if namespace.GetNamespace() != "" {
+		return namespace.GetNamespace() + "_" + tableName
+	}
+
+	return tableName
+}
+
+// NewTOTPFactor initializes a new, unverified factor from an otpauth:// URL.
+func NewTOTPFactor(user *User, otpURL, encryptionKey string) (*TOTPFactor, error) {
+	factor := &TOTPFactor{
+		InstanceID: user.InstanceID,
+		UserID:     user.ID,
+	}
+	if err := factor.setURL(otpURL, encryptionKey); err != nil {
+		return nil, err
+	}
+	return factor, nil
+}
+
+func (f *TOTPFactor) setURL(otpURL, encryptionKey string) error {
+	encrypted, err := crypto.Encrypt(encryptionKey, []byte(otpURL))
+	if err != nil {
+		return errors.Wrap(err, "error encrypting totp url")
+	}
+	f.EncryptedURL = encrypted
+	return nil
+}
+
+// URL decrypts the otpauth:// URL of the factor.
+func (f *TOTPFactor) URL(encryptionKey string) (string, error) {
+	decrypted, err := crypto.Decrypt(encryptionKey, f.EncryptedURL)
+	if err != nil {
+		return "", errors.Wrap(err, "error decrypting totp url")
+	}
+	return string(decrypted), nil
+}
+
+func (f *TOTPFactor) reencrypt(tx *storage.Connection, otpURL, encryptionKey string) error {
+	if err := f.setURL(otpURL, encryptionKey); err != nil {
+		return err
+	}
+	return tx.UpdateOnly(f, "encrypted_url")
+}
+
+// IsVerified checks if the user has completed enrollment of the factor.
+func (f *TOTPFactor) IsVerified() bool {
+	return f.VerifiedAt != nil
+}
+
+// CountAttempt records an attempt before a code is checked, so concurrent
+// requests can't try more than maxAttempts codes. It must be called outside
+// of the transaction checking the code, so failed attempts aren't rolled back.
+func (f *TOTPFactor) CountAttempt(tx *storage.Connection, maxAttempts int, lockout time.Duration) error {
+	now := time.Now()
+	if err := tx.RawQuery("UPDATE "+f.TableName()+" SET failed_attempts = 0 WHERE id = ? AND last_attempt_at < ?", f.ID, now.Add(-lockout)).Exec(); err != nil {
+		return errors.Wrap(err, "error resetting totp factor attempts")
+	}
+
+	count, err := tx.RawQuery("UPDATE "+f.TableName()+" SET failed_attempts = failed_attempts + 1, last_attempt_at = ? WHERE id = ? AND failed_attempts < ?", now, f.ID, maxAttempts).ExecWithCount()
+	if err != nil {
+		return errors.Wrap(err, "error counting totp factor attempt")
+	}
+	if count == 0 {
+		return TOTPFactorLockedError{}
+	}
+	return nil
+}
+
+// Authenticate checks a code against the factor, allowing one time step of
+// clock drift. A code is only accepted once, and accepting it resets the
+// failed attempts. Secrets that can only be decrypted with legacyKey are
+// encrypted again with encryptionKey.
+func (f *TOTPFactor) Authenticate(tx *storage.Connection, encryptionKey, legacyKey, code string) (bool, error) {
+	otpURL, err := f.URL(encryptionKey)
+	if err != nil && legacyKey != "" {
+		if otpURL, err = f.URL(legacyKey); err == nil {
+			err = f.reencrypt(tx, otpURL, encryptionKey)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	secret, err := crypto.TOTPSecretFromURL(otpURL)
+	if err != nil {
+		return false, err
+	}
+
+	counter, ok := crypto.ValidateTOTP(secret, code, time.Now(), 1)
+	if !ok {
+		return false, nil
+	}
+
+	// the step is only recorded if it is newer than the last accepted one,
+	// so concurrent requests can't both accept the same code
+	step := time.Unix(int64(counter*crypto.TOTPPeriod), 0)
+	count, err := tx.RawQuery("UPDATE "+f.TableName()+" SET otp_last_requested_at = ?, failed_attempts = 0 WHERE id = ? AND (otp_last_requested_at IS NULL OR otp_last_requested_at < ?)", step, f.ID, step).ExecWithCount()
+	if err != nil {
+		return false, errors.Wrap(err, "error updating totp factor")
+	}
+	if count == 0 {
+		return false, nil
+	}
+
+	f.OTPLastRequestedAt = &step
+	f.FailedAttempts = 0
+	return true, nil
+}
+
+// Reset replaces the secret of an unverified factor.
+func (f *TOTPFactor) Reset(tx *storage.Connection, otpURL, encryptionKey string) error {
+	if err := f.setURL(otpURL, encryptionKey); err != nil {
+		return err
+	}
+	f.OTPLastRequestedAt = nil
+	f.VerifiedAt = nil
+	return tx.UpdateOnly(f, "encrypted_url", "otp_last_requested_at", "verified_at")
+}
+
+// Verify marks the factor as enrolled.
+func (f *TOTPFactor) Verify(tx *storage.Connection) error {
+	now := time.Now()
+	f.VerifiedAt = &now
+	return tx.UpdateOnly(f, "verified_at")
+}
+
+// FindTOTPFactorByUser finds the TOTP factor of the provided user.
+func FindTOTPFactorByUser(tx *storage.Connection, user *User) (*TOTPFactor, error) {
+	factor := &TOTPFactor{}
+	if err := tx.Q().Where("instance_id = ? and user_id = ?", user.InstanceID, user.ID).First(factor); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, TOTPFactorNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding totp factor")
+	}
+	return factor, nil
+}
+
+// FindVerifiedTOTPFactorByUser finds the TOTP factor of the provided user
+// if enrollment has been completed.
+func FindVerifiedTOTPFactorByUser(tx *storage.Connection, user *User) (*TOTPFactor, error) {
+	factor, err := FindTOTPFactorByUser(tx, user)
+	if err != nil {
+		return nil, err
+	}
+	if !factor.IsVerified() {
+		return nil, TOTPFactorNotFoundError{}
+	}
+	return factor, nil
+}
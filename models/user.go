@@ -28,6 +28,9 @@ type User struct {
 	EncryptedPassword string     `json:"-" db:"encrypted_password"`
 	ConfirmedAt       *time.Time `json:"confirmed_at,omitempty" db:"confirmed_at"`
 	InvitedAt         *time.Time `json:"invited_at,omitempty" db:"invited_at"`
+	Phone             string     `json:"phone" db:"phone"`
+	PhoneConfirmedAt  *time.Time `json:"phone_confirmed_at,omitempty" db:"phone_confirmed_at"`
+	PhoneOTPAttempts  int        `json:"-" db:"phone_otp_attempts"`
 
 	ConfirmationToken  string     `json:"-" db:"confirmation_token"`
 	ConfirmationSentAt *time.Time `json:"confirmation_sent_at,omitempty" db:"confirmation_sent_at"`
@@ -35,6 +38,10 @@ type User struct {
 	RecoveryToken  string     `json:"-" db:"recovery_token"`
 	RecoverySentAt *time.Time `json:"recovery_sent_at,omitempty" db:"recovery_sent_at"`
 
+	EmailOTPHash     string     `json:"-" db:"email_otp_hash"`
+	EmailOTPSentAt   *time.Time `json:"-" db:"email_otp_sent_at"`
+	EmailOTPAttempts int        `json:"-" db:"email_otp_attempts"`
+
 	EmailChangeToken  string     `json:"-" db:"email_change_token"`
 	EmailChange       string     `json:"new_email,omitempty" db:"email_change"`
 	EmailChangeSentAt *time.Time `json:"email_change_sent_at,omitempty" db:"email_change_sent_at"`
@@ -46,6 +53,10 @@ type User struct {
 
 	IsSuperAdmin bool `json:"-" db:"is_super_admin"`
 
+	// IsAnonymous is set for guests that signed in without an email, phone
+	// or provider account until they add one
+	IsAnonymous bool `json:"is_anonymous" db:"is_anonymous"`
+
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
 }
@@ -72,6 +83,23 @@ func NewUser(instanceID uuid.UUID, email, password, aud string, userData map[str
 	return user, nil
 }
 
+// NewAnonymousUser initializes a new guest user without an email or password.
+func NewAnonymousUser(instanceID uuid.UUID, aud string, userData map[string]interface{}) (*User, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating unique id")
+	}
+
+	user := &User{
+		InstanceID:   instanceID,
+		ID:           id,
+		Aud:          aud,
+		UserMetaData: userData,
+		IsAnonymous:  true,
+	}
+	return user, nil
+}
+
 func NewSystemUser(instanceID uuid.UUID, aud string) *User {
 	return &User{
 		InstanceID:   instanceID,
@@ -111,6 +139,9 @@ func (u *User) BeforeSave(tx *pop.Connection) error {
 	if u.ConfirmedAt != nil && u.ConfirmedAt.IsZero() {
 		u.ConfirmedAt = nil
 	}
+	if u.PhoneConfirmedAt != nil && u.PhoneConfirmedAt.IsZero() {
+		u.PhoneConfirmedAt = nil
+	}
 	if u.InvitedAt != nil && u.InvitedAt.IsZero() {
 		u.InvitedAt = nil
 	}
@@ -120,6 +151,9 @@ func (u *User) BeforeSave(tx *pop.Connection) error {
 	if u.RecoverySentAt != nil && u.RecoverySentAt.IsZero() {
 		u.RecoverySentAt = nil
 	}
+	if u.EmailOTPSentAt != nil && u.EmailOTPSentAt.IsZero() {
+		u.EmailOTPSentAt = nil
+	}
 	if u.EmailChangeSentAt != nil && u.EmailChangeSentAt.IsZero() {
 		u.EmailChangeSentAt = nil
 	}
@@ -135,6 +169,12 @@ func (u *User) IsConfirmed() bool {
 	return u.ConfirmedAt != nil
 }
 
+// IsPhoneConfirmed checks if a user's phone has already been
+// registered and confirmed.
+func (u *User) IsPhoneConfirmed() bool {
+	return u.PhoneConfirmedAt != nil
+}
+
 // SetRole sets the users Role to roleName
 func (u *User) SetRole(tx *storage.Connection, roleName string) error {
 	u.Role = strings.TrimSpace(roleName)
@@ -209,6 +249,12 @@ func (u *User) Authenticate(password string) bool {
 	return err == nil
 }
 
+// HasPassword returns true if the user can sign in with a password. Users
+// that signed up without one have the hash of an empty password.
+func (u *User) HasPassword() bool {
+	return u.EncryptedPassword != "" && !u.Authenticate("")
+}
+
 // Confirm resets the confimation token and the confirm timestamp
 func (u *User) Confirm(tx *storage.Connection) error {
 	u.ConfirmationToken = ""
@@ -217,6 +263,14 @@ func (u *User) Confirm(tx *storage.Connection) error {
 	return tx.UpdateOnly(u, "confirmation_token", "confirmed_at")
 }
 
+// ConfirmPhone resets the confimation token and the phone confirm timestamp
+func (u *User) ConfirmPhone(tx *storage.Connection) error {
+	u.ConfirmationToken = ""
+	now := time.Now()
+	u.PhoneConfirmedAt = &now
+	return tx.UpdateOnly(u, "confirmation_token", "phone_confirmed_at")
+}
+
 // UpdateLastSignInAt update field last_sign_in_at for user according to specified field
 func (u *User) UpdateLastSignInAt(tx *storage.Connection) error {
 	return tx.UpdateOnly(u, "last_sign_in_at")
@@ -230,10 +284,42 @@ func (u *User) ConfirmEmailChange(tx *storage.Connection) error {
 	return tx.UpdateOnly(u, "email", "email_change", "email_change_token")
 }
 
-// Recover resets the recovery token
+// ClearAnonymous marks a guest user as a regular user once they added a way
+// to sign in. The id of the user stays the same.
+func (u *User) ClearAnonymous(tx *storage.Connection) error {
+	u.IsAnonymous = false
+	return tx.UpdateOnly(u, "is_anonymous")
+}
+
+// Recover resets the recovery token and the one-time code sent with it
 func (u *User) Recover(tx *storage.Connection) error {
 	u.RecoveryToken = ""
-	return tx.UpdateOnly(u, "recovery_token")
+	u.EmailOTPHash = ""
+	return tx.UpdateOnly(u, "recovery_token", "email_otp_hash")
+}
+
+// CountEmailOTPAttempt counts an attempt to verify the one-time code of the
+// user before it is compared, returning false once maxAttempts codes have
+// been tried. The counter is incremented in the database, so concurrent
+// attempts can't exceed the limit.
+func (u *User) CountEmailOTPAttempt(tx *storage.Connection, maxAttempts int) (bool, error) {
+	count, err := tx.RawQuery("UPDATE "+u.TableName()+" SET email_otp_attempts = email_otp_attempts + 1 WHERE instance_id = ? AND id = ? AND email_otp_attempts < ?", u.InstanceID, u.ID, maxAttempts).ExecWithCount()
+	if err != nil {
+		return false, errors.Wrap(err, "error counting email otp attempt")
+	}
+	return count == 1, nil
+}
+
+// CountPhoneOTPAttempt counts an attempt to verify an SMS code of the user
+// before it is compared, returning false once maxAttempts codes have been
+// tried. The counter is incremented in the database, so concurrent attempts
+// can't exceed the limit.
+func (u *User) CountPhoneOTPAttempt(tx *storage.Connection, maxAttempts int) (bool, error) {
+	count, err := tx.RawQuery("UPDATE "+u.TableName()+" SET phone_otp_attempts = phone_otp_attempts + 1 WHERE instance_id = ? AND id = ? AND phone_otp_attempts < ?", u.InstanceID, u.ID, maxAttempts).ExecWithCount()
+	if err != nil {
+		return false, errors.Wrap(err, "error counting phone otp attempt")
+	}
+	return count == 1, nil
 }
 
 // CountOtherUsers counts how many other users exist besides the one provided
@@ -268,6 +354,11 @@ func FindUserByEmailAndAudience(tx *storage.Connection, instanceID uuid.UUID, em
 	return findUser(tx, "instance_id = ? and LOWER(email) = ? and aud = ?", instanceID, strings.ToLower(email), aud)
 }
 
+// FindUserByPhoneAndAudience finds a user with the matching phone and audience.
+func FindUserByPhoneAndAudience(tx *storage.Connection, instanceID uuid.UUID, phone, aud string) (*User, error) {
+	return findUser(tx, "instance_id = ? and phone = ? and aud = ?", instanceID, phone, aud)
+}
+
 // FindUserByID finds a user matching the provided ID.
 func FindUserByID(tx *storage.Connection, id uuid.UUID) (*User, error) {
 	return findUser(tx, "id = ?", id)
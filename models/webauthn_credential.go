@@ -0,0 +1,127 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/storage"
+	"github.com/netlify/gotrue/storage/namespace"
+	"github.com/pkg/errors"
+)
+
+// WebAuthnCredential is the database model for a passkey or security key a
+// user registered.
+type WebAuthnCredential struct {
+	InstanceID uuid.UUID `json:"-" db:"instance_id"`
+	ID         uuid.UUID `json:"id" db:"id"`
+
+	UserID uuid.UUID `json:"-" db:"user_id"`
+
+	// CredentialID is the base64url encoded id the authenticator assigned
+	CredentialID string `json:"credential_id" db:"credential_id"`
+	// PublicKey is the COSE encoded public key of the credential
+	PublicKey []byte `json:"-" db:"public_key"`
+	SignCount int64  `json:"-" db:"sign_count"`
+	AAGUID    string `json:"aaguid" db:"aaguid"`
+	Name      string `json:"name" db:"name"`
+
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+func (WebAuthnCredential) TableName() string {
+	tableName := "webauthn_credentials"
+
+	if namespace.GetNamespace() != "" {
+		return namespace.GetNamespace() + "_" + tableName
+	}
+
+	return tableName
+}
+
+// NewWebAuthnCredential initializes a credential of the user from the
+// authenticator data of its registration.
+func NewWebAuthnCredential(user *User, data *crypto.WebAuthnAuthenticatorData, name string) (*WebAuthnCredential, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating unique id")
+	}
+
+	aaguid, err := uuid.FromBytes(data.AAGUID)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid aaguid")
+	}
+
+	return &WebAuthnCredential{
+		InstanceID:   user.InstanceID,
+		ID:           id,
+		UserID:       user.ID,
+		CredentialID: base64.RawURLEncoding.EncodeToString(data.CredentialID),
+		PublicKey:    data.PublicKey,
+		SignCount:    int64(data.SignCount),
+		AAGUID:       aaguid.String(),
+		Name:         name,
+	}, nil
+}
+
+// UpdateSignCount records a use of the credential. Authenticators that keep
+// a signature counter increase it with every use, so a counter that didn't
+// increase indicates a cloned authenticator. The counter is compared by the
+// update itself so that concurrent assertions with the same counter can't
+// both succeed.
+func (c *WebAuthnCredential) UpdateSignCount(tx *storage.Connection, signCount uint32) error {
+	now := time.Now()
+	count, err := tx.RawQuery("UPDATE "+c.TableName()+" SET sign_count = ?, last_used_at = ?, updated_at = ? WHERE id = ? AND (sign_count < ? OR (sign_count = 0 AND ? = 0))", signCount, now, now, c.ID, signCount, signCount).ExecWithCount()
+	if err != nil {
+		return errors.Wrap(err, "error updating webauthn credential")
+	}
+	if count == 0 {
+		return WebAuthnCredentialClonedError{}
+	}
+
+	c.SignCount = int64(signCount)
+	c.LastUsedAt = &now
+	c.UpdatedAt = now
+	return nil
+}
+
+// FindWebAuthnCredentialsByUser finds the credentials of the user.
+func FindWebAuthnCredentialsByUser(tx *storage.Connection, user *User) ([]*WebAuthnCredential, error) {
+	credentials := []*WebAuthnCredential{}
+	if err := tx.Q().Where("instance_id = ? and user_id = ?", user.InstanceID, user.ID).Order("created_at asc").All(&credentials); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return credentials, nil
+		}
+		return nil, errors.Wrap(err, "error finding webauthn credentials")
+	}
+	return credentials, nil
+}
+
+// FindWebAuthnCredentialByCredentialID finds a credential by the base64url
+// encoded id the authenticator assigned.
+func FindWebAuthnCredentialByCredentialID(tx *storage.Connection, instanceID uuid.UUID, credentialID string) (*WebAuthnCredential, error) {
+	credential := &WebAuthnCredential{}
+	if err := tx.Q().Where("instance_id = ? and credential_id = ?", instanceID, credentialID).First(credential); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, WebAuthnCredentialNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding webauthn credential")
+	}
+	return credential, nil
+}
+
+// FindWebAuthnCredentialByUserAndID finds a credential of the user by its id.
+func FindWebAuthnCredentialByUserAndID(tx *storage.Connection, user *User, id uuid.UUID) (*WebAuthnCredential, error) {
+	credential := &WebAuthnCredential{}
+	if err := tx.Q().Where("instance_id = ? and user_id = ? and id = ?", user.InstanceID, user.ID, id).First(credential); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, WebAuthnCredentialNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding webauthn credential")
+	}
+	return credential, nil
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/crypto"
+	"github.com/netlify/gotrue/storage"
+	"github.com/netlify/gotrue/storage/namespace"
+	"github.com/pkg/errors"
+)
+
+// WebAuthnSession is the database model for the challenge of a WebAuthn
+// registration or login in progress. It is deleted when it's used, so a
+// challenge is only answered once.
+type WebAuthnSession struct {
+	InstanceID uuid.UUID `json:"-" db:"instance_id"`
+	ID         uuid.UUID `json:"id" db:"id"`
+
+	// UserID is unset for logins with a discoverable credential, where the
+	// user is only known from the response of the authenticator
+	UserID *uuid.UUID `json:"-" db:"user_id"`
+
+	Challenge string `json:"-" db:"challenge"`
+	// Type is the type of the client data the challenge is answered with
+	Type string `json:"-" db:"type"`
+
+	ExpiresAt time.Time `json:"-" db:"expires_at"`
+	CreatedAt time.Time `json:"-" db:"created_at"`
+}
+
+func (WebAuthnSession) TableName() string {
+	tableName := "webauthn_sessions"
+
+	if namespace.GetNamespace() != "" {
+		return namespace.GetNamespace() + "_" + tableName
+	}
+
+	return tableName
+}
+
+// NewWebAuthnSession creates a session with a new challenge of the
+// ceremony type for the user, who may be nil.
+func NewWebAuthnSession(tx *storage.Connection, instanceID uuid.UUID, user *User, ceremony string, expiry time.Duration) (*WebAuthnSession, error) {
+	// the challenges of abandoned ceremonies are never used
+	if err := tx.RawQuery("DELETE FROM "+(&WebAuthnSession{}).TableName()+" WHERE expires_at < ?", time.Now()).Exec(); err != nil {
+		return nil, errors.Wrap(err, "error deleting expired webauthn sessions")
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating unique id")
+	}
+	session := &WebAuthnSession{
+		InstanceID: instanceID,
+		ID:         id,
+		Challenge:  crypto.GenerateWebAuthnChallenge(),
+		Type:       ceremony,
+		ExpiresAt:  time.Now().Add(expiry),
+	}
+	if user != nil {
+		session.UserID = &user.ID
+	}
+	if err := tx.Create(session); err != nil {
+		return nil, errors.Wrap(err, "error creating webauthn session")
+	}
+	return session, nil
+}
+
+// IsExpired checks if the challenge of the session can no longer be answered.
+func (s *WebAuthnSession) IsExpired() bool {
+	return time.Now().After(s.ExpiresAt)
+}
+
+// ConsumeWebAuthnSession finds and deletes the session of the ceremony type.
+// The session is returned even if it expired. Only one of concurrent
+// requests deletes the session, the others get a not found error.
+func ConsumeWebAuthnSession(tx *storage.Connection, instanceID, id uuid.UUID, ceremony string) (*WebAuthnSession, error) {
+	session := &WebAuthnSession{}
+	if err := tx.Q().Where("instance_id = ? and id = ? and type = ?", instanceID, id, ceremony).First(session); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, WebAuthnSessionNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding webauthn session")
+	}
+	count, err := tx.RawQuery("DELETE FROM "+session.TableName()+" WHERE id = ?", session.ID).ExecWithCount()
+	if err != nil {
+		return nil, errors.Wrap(err, "error deleting webauthn session")
+	}
+	if count != 1 {
+		return nil, WebAuthnSessionNotFoundError{}
+	}
+	return session, nil
+}
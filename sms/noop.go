@@ -0,0 +1,16 @@
+package sms
+
+import "github.com/sirupsen/logrus"
+
+// noopSender doesn't deliver any messages, it only logs them so that
+// phone signups can be exercised without an SMS provider.
+type noopSender struct {
+}
+
+func (s *noopSender) Send(phone, message string) error {
+	logrus.WithFields(logrus.Fields{
+		"component": "sms",
+		"phone":     phone,
+	}).Debug(message)
+	return nil
+}
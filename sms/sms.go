@@ -0,0 +1,40 @@
+package sms
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	"github.com/netlify/gotrue/conf"
+)
+
+// SMSSender defines the interface an SMS provider must implement.
+type SMSSender interface {
+	Send(phone, message string) error
+}
+
+// NewSMSSender returns a new gotrue SMS sender
+func NewSMSSender(instanceConfig *conf.Configuration) (SMSSender, error) {
+	switch instanceConfig.SMS.Provider {
+	case "", "log":
+		return &noopSender{}, nil
+	case "webhook":
+		return NewWebhookSender(instanceConfig.SMS.Webhook)
+	default:
+		return nil, fmt.Errorf("Unsupported SMS provider: %s", instanceConfig.SMS.Provider)
+	}
+}
+
+// OtpMessage renders the SMS template with the one-time password
+func OtpMessage(tmpl, otp string) (string, error) {
+	t, err := template.New("sms").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	var message bytes.Buffer
+	if err := t.Execute(&message, map[string]string{"Code": otp}); err != nil {
+		return "", err
+	}
+	return message.String(), nil
+}
@@ -0,0 +1,81 @@
+package sms
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/gotrue/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOtpMessage(t *testing.T) {
+	message, err := OtpMessage("Your code is {{ .Code }}", "123456")
+	require.NoError(t, err)
+	assert.Equal(t, "Your code is 123456", message)
+}
+
+func TestNewSMSSender(t *testing.T) {
+	config := &conf.Configuration{}
+
+	sender, err := NewSMSSender(config)
+	require.NoError(t, err)
+	assert.IsType(t, &noopSender{}, sender)
+
+	config.SMS.Provider = "webhook"
+	_, err = NewSMSSender(config)
+	assert.Error(t, err)
+
+	config.SMS.Webhook.URL = "http://localhost/sms"
+	sender, err = NewSMSSender(config)
+	require.NoError(t, err)
+	assert.IsType(t, &WebhookSender{}, sender)
+
+	config.SMS.Provider = "carrier-pigeon"
+	_, err = NewSMSSender(config)
+	assert.Error(t, err)
+}
+
+func TestWebhookSender(t *testing.T) {
+	var payload WebhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(body, &payload))
+
+		claims := &webhookClaims{}
+		p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
+		_, err = p.ParseWithClaims(r.Header.Get(headerWebhookSignature), claims, func(token *jwt.Token) (interface{}, error) {
+			return []byte("webhooksecret"), nil
+		})
+		require.NoError(t, err)
+		sha := sha256.Sum256(body)
+		assert.Equal(t, hex.EncodeToString(sha[:]), claims.SHA256)
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sender, err := NewWebhookSender(conf.SMSWebhookConfiguration{URL: server.URL, Secret: "webhooksecret"})
+	require.NoError(t, err)
+	require.NoError(t, sender.Send("12345678", "Your code is 123456"))
+	assert.Equal(t, "12345678", payload.Phone)
+	assert.Equal(t, "Your code is 123456", payload.Message)
+}
+
+func TestWebhookSenderFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	sender, err := NewWebhookSender(conf.SMSWebhookConfiguration{URL: server.URL})
+	require.NoError(t, err)
+	assert.Error(t, sender.Send("12345678", "Your code is 123456"))
+}
@@ -0,0 +1,107 @@
+package sms
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/gotrue/conf"
+)
+
+const (
+	headerWebhookSignature = "x-webhook-signature"
+	defaultWebhookTimeout  = 10 * time.Second
+	gotrueIssuer           = "gotrue"
+)
+
+type webhookClaims struct {
+	jwt.StandardClaims
+	SHA256 string `json:"sha256"`
+}
+
+// WebhookPayload is the body posted to the SMS webhook
+type WebhookPayload struct {
+	Phone   string `json:"phone"`
+	Message string `json:"message"`
+}
+
+// WebhookSender delivers messages by posting them to a webhook, leaving the
+// actual delivery to whatever service sits behind it.
+type WebhookSender struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+// NewWebhookSender returns a new SMS sender posting to the configured webhook
+func NewWebhookSender(config conf.SMSWebhookConfiguration) (*WebhookSender, error) {
+	if config.URL == "" {
+		return nil, errors.New("Missing SMS webhook URL")
+	}
+
+	timeout := defaultWebhookTimeout
+	if config.TimeoutSec > 0 {
+		timeout = time.Duration(config.TimeoutSec) * time.Second
+	}
+
+	return &WebhookSender{
+		URL:    config.URL,
+		Secret: config.Secret,
+		Client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Send posts the message to the webhook
+func (s *WebhookSender) Send(phone, message string) error {
+	data, err := json.Marshal(&WebhookPayload{Phone: phone, Message: message})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if s.Secret != "" {
+		signature, err := s.signature(data)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(headerWebhookSignature, signature)
+	}
+
+	rsp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	switch rsp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusAccepted:
+		return nil
+	default:
+		return fmt.Errorf("SMS webhook responded with status %d", rsp.StatusCode)
+	}
+}
+
+func (s *WebhookSender) signature(data []byte) (string, error) {
+	sha := sha256.Sum256(data)
+	claims := webhookClaims{
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt: time.Now().Unix(),
+			Issuer:   gotrueIssuer,
+		},
+		SHA256: hex.EncodeToString(sha[:]),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(s.Secret))
+}